@@ -0,0 +1,359 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Access schedules and daily quotas for users and groups.
+
+package icap
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Schedule is a period of each week, such as working hours.
+type Schedule struct {
+	// Days are the days on which the period starts. If empty, it starts
+	// every day.
+	Days []time.Weekday
+
+	// Start and End are the times of day, as durations since midnight,
+	// at which the period starts and ends. If End is not after Start, the
+	// period runs past midnight into the next day; if both are zero, it
+	// lasts the whole day.
+	Start, End time.Duration
+}
+
+// Contains reports whether t, in its own location, falls within s.
+func (s Schedule) Contains(t time.Time) bool {
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if s.Start < s.End {
+		return s.onDay(t.Weekday()) && s.Start <= clock && clock < s.End
+	}
+	return s.onDay(t.Weekday()) && clock >= s.Start || s.onDay((t.Weekday()+6)%7) && clock < s.End
+}
+
+// onDay reports whether s starts on day.
+func (s Schedule) onDay(day time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns s in a form suitable for a block page, such as
+// "Mon, Tue 09:00-17:00".
+func (s Schedule) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	times := clock(s.Start) + "-" + clock(s.End)
+	if s.Start == s.End {
+		times = "all day"
+	}
+	if len(s.Days) == 0 {
+		return "every day " + times
+	}
+	days := make([]string, len(s.Days))
+	for i, d := range s.Days {
+		days[i] = d.String()[:3]
+	}
+	return strings.Join(days, ", ") + " " + times
+}
+
+// An AccessRule sets when a set of users may use the web, and how much.
+type AccessRule struct {
+	// Users and Groups are the names of the users the rule applies to,
+	// and of their groups, compared without regard to case (see
+	// Request.AuthenticatedUser). If both are empty, the rule applies
+	// to everyone.
+	Users  []string
+	Groups []string
+
+	// Hours are the times at which access is allowed. If empty, it is
+	// allowed at any time.
+	Hours []Schedule
+
+	// DailyBytes limits the bytes of encapsulated bodies each user may
+	// transfer in a day. If zero, there is no limit.
+	DailyBytes int64
+
+	// DailyTime limits the time each user may spend on the web in a day,
+	// counted in whole minutes: any minute in which the user makes a
+	// request counts in full. If zero, there is no limit.
+	DailyTime time.Duration
+}
+
+// matches reports whether r applies to user, a member of groups.
+func (r *AccessRule) matches(user string, groups []string) bool {
+	if len(r.Users) == 0 && len(r.Groups) == 0 {
+		return true
+	}
+	for _, u := range r.Users {
+		if user != "" && strings.EqualFold(u, user) {
+			return true
+		}
+	}
+	for _, g := range r.Groups {
+		for _, ug := range groups {
+			if strings.EqualFold(g, ug) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A QuotaUsage is what a user has used of a quota.
+type QuotaUsage struct {
+	Bytes int64
+	Time  time.Duration
+}
+
+// A QuotaStore keeps the usage of quotas. Implementations shared among
+// several servers (in a database, for example) enforce the quotas across
+// a whole cluster, however the clients spread users' requests.
+type QuotaStore interface {
+	// Add adds u to the usage recorded under key, keeps it until
+	// expires, and returns the new total. Adding a zero QuotaUsage
+	// returns the usage so far.
+	Add(key string, u QuotaUsage, expires time.Time) (QuotaUsage, error)
+}
+
+// A MemoryQuotaStore is a QuotaStore that keeps the usage in memory.
+// The zero value is ready to use.
+type MemoryQuotaStore struct {
+	mu        sync.Mutex
+	usage     map[string]quotaEntry
+	lastSweep int              // the number of entries after the last sweep
+	now       func() time.Time // for testing; time.Now if nil
+}
+
+type quotaEntry struct {
+	usage   QuotaUsage
+	expires time.Time
+}
+
+// Add adds u to the usage recorded under key, keeps it until expires,
+// and returns the new total.
+func (s *MemoryQuotaStore) Add(key string, u QuotaUsage, expires time.Time) (QuotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+	if s.usage == nil {
+		s.usage = make(map[string]quotaEntry)
+	}
+	if len(s.usage) >= 2*s.lastSweep+1000 {
+		for k, e := range s.usage {
+			if !now.Before(e.expires) {
+				delete(s.usage, k)
+			}
+		}
+		s.lastSweep = len(s.usage)
+	}
+	e := s.usage[key]
+	if !now.Before(e.expires) {
+		e = quotaEntry{}
+	}
+	e.usage.Bytes += u.Bytes
+	e.usage.Time += u.Time
+	if expires.After(e.expires) {
+		e.expires = expires
+	}
+	s.usage[key] = e
+	return e.usage, nil
+}
+
+// An AccessPolicy is a Stage that enforces access schedules and daily
+// quotas. The first of Rules that applies to the user of a request
+// decides: outside the rule's Hours, or once the user has used up one
+// of its quotas for the day, the request is blocked with a page that
+// explains why. Requests that no rule applies to are let through.
+//
+// The user is the one the ICAP client authenticated (see
+// Request.AuthenticatedUser), or if there is none, the address of the
+// HTTP client (see Request.ClientIP); requests from neither have only
+// their schedules checked. Usage is counted per user and per day, in
+// Location, whichever rule applies. The bytes of a body are counted
+// from its Content-Length if it is known, and otherwise as it is read;
+// a body of unknown length that the server never reads, as when it
+// answers 204 No Modifications, isn't counted. An AccessPolicy must not
+// be copied after first use.
+type AccessPolicy struct {
+	Rules []AccessRule
+
+	// Store keeps the usage of quotas. If nil, the usage is kept in
+	// memory, for this AccessPolicy only.
+	Store QuotaStore
+
+	// Location is the time zone of the schedules and of the days that
+	// quotas reset at. If nil, time.Local is used.
+	Location *time.Location
+
+	// Status is the HTTP status code of the block page; 403 if zero.
+	Status int
+
+	once  sync.Once
+	store QuotaStore
+	now   func() time.Time // for testing; time.Now if nil
+}
+
+// Process checks req against the rule that applies to its user.
+func (p *AccessPolicy) Process(req *Request) (StageResult, error) {
+	if req.Method != "REQMOD" && req.Method != "RESPMOD" {
+		return StageResult{Action: ActionContinue}, nil
+	}
+	user := req.AuthenticatedUser()
+	groups := req.AuthenticatedGroups()
+	var rule *AccessRule
+	for i := range p.Rules {
+		if p.Rules[i].matches(user, groups) {
+			rule = &p.Rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return StageResult{Action: ActionContinue}, nil
+	}
+
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	loc := p.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	now = now.In(loc)
+
+	if len(rule.Hours) > 0 && !inSchedules(rule.Hours, now) {
+		hours := make([]string, len(rule.Hours))
+		for i, s := range rule.Hours {
+			hours[i] = s.String()
+		}
+		return p.block(req, "Access to the web is not allowed at this time. It is allowed "+strings.Join(hours, "; ")+".")
+	}
+
+	if rule.DailyBytes <= 0 && rule.DailyTime <= 0 {
+		return StageResult{Action: ActionContinue}, nil
+	}
+	if user == "" {
+		if ip, ok := req.ClientIP(); ok {
+			user = ip.String()
+		} else {
+			return StageResult{Action: ActionContinue}, nil
+		}
+	}
+	store := p.quotaStore()
+	key := "quota:" + strings.ToLower(user) + ":" + now.Format("2006-01-02")
+	y, m, d := now.Date()
+	resets := time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+
+	var charge QuotaUsage
+	if rule.DailyTime > 0 {
+		minute := now.Truncate(time.Minute)
+		first, err := store.Add(key+"@"+minute.Format("15:04"), QuotaUsage{Bytes: 1}, minute.Add(time.Minute))
+		if err != nil {
+			return StageResult{}, err
+		}
+		if first.Bytes == 1 {
+			charge.Time = time.Minute
+		}
+	}
+	usage, err := store.Add(key, charge, resets)
+	if err != nil {
+		return StageResult{}, err
+	}
+	if rule.DailyTime > 0 && usage.Time > rule.DailyTime {
+		return p.block(req, fmt.Sprintf("You have used your daily %v of web time. It will be available again at midnight.", rule.DailyTime))
+	}
+	if rule.DailyBytes > 0 && usage.Bytes >= rule.DailyBytes {
+		return p.block(req, fmt.Sprintf("You have used %s of your daily %s of web traffic. It will be available again at midnight.", formatSize(usage.Bytes), formatSize(rule.DailyBytes)))
+	}
+
+	if rule.DailyBytes > 0 && req.hasBody {
+		chargeBytes := func(n int64) error {
+			_, err := store.Add(key, QuotaUsage{Bytes: n}, resets)
+			return err
+		}
+		if n := req.declaredSize(); n >= 0 {
+			if err := chargeBytes(n); err != nil {
+				return StageResult{}, err
+			}
+		} else if body := req.bodyPtr(); body != nil && bodyPresent(*body) {
+			*body = &quotaBody{ReadCloser: *body, charge: chargeBytes}
+		}
+	}
+	return StageResult{Action: ActionContinue}, nil
+}
+
+// block returns the result that blocks req with reason.
+func (p *AccessPolicy) block(req *Request, reason string) (StageResult, error) {
+	req.Audit().AddScanResult("access-policy", reason)
+	return StageResult{Action: ActionBlock, Status: p.Status, Reason: reason}, nil
+}
+
+func (p *AccessPolicy) quotaStore() QuotaStore {
+	if p.Store != nil {
+		return p.Store
+	}
+	p.once.Do(func() { p.store = new(MemoryQuotaStore) })
+	return p.store
+}
+
+// inSchedules reports whether t falls within any of schedules.
+func inSchedules(schedules []Schedule, t time.Time) bool {
+	for _, s := range schedules {
+		if s.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatSize formats a number of bytes for people to read.
+func formatSize(n int64) string {
+	const unit = 1 << 10
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+	v, i := float64(n), -1
+	for v >= unit && i < 3 {
+		v /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %cB", v, "KMGT"[i])
+}
+
+// A quotaBody counts the bytes read from a body of unknown length, and
+// charges them to a quota when it ends.
+type quotaBody struct {
+	io.ReadCloser
+	n       int64
+	charged bool
+	charge  func(n int64) error
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if err == io.EOF && !b.charged {
+		b.charged = true
+		if cerr := b.charge(b.n); cerr != nil {
+			log.Printf("icap: error charging %d bytes to a quota: %v", b.n, cerr)
+		}
+	}
+	return n, err
+}
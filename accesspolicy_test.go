@@ -0,0 +1,102 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleContains(t *testing.T) {
+	// 2024-01-01 was a Monday.
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, time.UTC)
+	}
+	work := Schedule{Days: []time.Weekday{time.Monday, time.Tuesday}, Start: 9 * time.Hour, End: 17 * time.Hour}
+	night := Schedule{Days: []time.Weekday{time.Monday}, Start: 22 * time.Hour, End: 6 * time.Hour}
+	for _, tc := range []struct {
+		s    Schedule
+		t    time.Time
+		want bool
+	}{
+		{work, at(1, 9, 0), true},
+		{work, at(2, 16, 59), true},
+		{work, at(1, 17, 0), false},
+		{work, at(3, 12, 0), false},
+		{night, at(1, 23, 0), true},
+		{night, at(2, 5, 59), true},
+		{night, at(2, 23, 0), false},
+		{night, at(1, 5, 0), false},
+		{Schedule{}, at(7, 3, 0), true},
+	} {
+		if got := tc.s.Contains(tc.t); got != tc.want {
+			t.Errorf("%v contains %v = %v, want %v", tc.s, tc.t, got, tc.want)
+		}
+	}
+	if got, want := work.String(), "Mon, Tue 09:00-17:00"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestAccessPolicy(t *testing.T) {
+	request := func(user, groups string, size int) string {
+		httpHdr := "GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+		respHdr := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(size) + "\r\n\r\n"
+		body := strings.Repeat("x", size)
+		return "RESPMOD icap://icap.example.net/policy ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"X-Authenticated-User: " + user + "\r\n" +
+			"X-Authenticated-Groups: " + groups + "\r\n" +
+			"Encapsulated: req-hdr=0, res-hdr=" + strconv.Itoa(len(httpHdr)) + ", res-body=" + strconv.Itoa(len(httpHdr)+len(respHdr)) + "\r\n" +
+			"\r\n" + httpHdr + respHdr +
+			strconv.FormatInt(int64(size), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+	}
+
+	// 2024-01-01 was a Monday.
+	now := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	policy := &AccessPolicy{
+		Rules: []AccessRule{
+			{Users: []string{"night"}, Hours: []Schedule{{Start: 22 * time.Hour, End: 6 * time.Hour}}},
+			{Groups: []string{"Students"}, DailyTime: 2 * time.Minute},
+			{DailyBytes: 1000},
+		},
+		Store:    &MemoryQuotaStore{now: clock},
+		Location: time.UTC,
+		now:      clock,
+	}
+	srv := &Server{Handler: &Pipeline{Stages: []Stage{policy}}}
+	check := func(user, groups string, size int, want string) {
+		t.Helper()
+		resp := roundTrip(t, srv, request(user, groups, size))
+		if !strings.Contains(resp, want) {
+			t.Errorf("%s at %v: want %q in response:\n%s", user, now.Format("15:04"), want, resp)
+		}
+	}
+
+	check("night", "", 10, "It is allowed every day 22:00-06:00.")
+	now = now.Add(13 * time.Hour)
+	check("night", "", 10, "ICAP/1.0 204 ")
+
+	check("alice", "", 600, "ICAP/1.0 204 ")
+	check("ALICE", "", 600, "ICAP/1.0 204 ")
+	check("alice", "", 10, "You have used 1.2 KB of your daily 1000 bytes of web traffic.")
+	check("bob", "", 10, "ICAP/1.0 204 ")
+
+	check("carol", "WinNT://staff,WinNT://students", 10, "ICAP/1.0 204 ")
+	check("carol", "students", 10, "ICAP/1.0 204 ")
+	now = now.Add(time.Minute)
+	check("carol", "students", 10000, "ICAP/1.0 204 ")
+	now = now.Add(time.Minute)
+	check("carol", "students", 10, "You have used your daily 2m0s of web time.")
+
+	// The quotas reset at midnight.
+	now = time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	check("alice", "", 10, "ICAP/1.0 204 ")
+	check("carol", "students", 10, "ICAP/1.0 204 ")
+}
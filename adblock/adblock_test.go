@@ -0,0 +1,141 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package adblock
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/intra-sh/icap"
+	"github.com/intra-sh/icap/feeds"
+)
+
+const list = `[Adblock Plus 2.0]
+! Title: test list
+||ads.example.com^
+||tracker.net^$third-party
+/banner/*/img^
+|http://example.org/popunder.js|
+@@||ads.example.com/allowed/
+-ad-frame.$domain=news.example|~sports.news.example
+/\/pixel\.gif\?id=[0-9]+/
+||cdn.example.com/annoy.js$script,important
+@@||cdn.example.com^
+example.com##.sidebar-ad
+||popups.example.com^$popup
+`
+
+func TestMatcher(t *testing.T) {
+	m, err := Parse(strings.NewReader(list))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Len() != 9 {
+		t.Errorf("Len = %d, want 9", m.Len())
+	}
+	for _, tc := range []struct {
+		url, doc string
+		want     bool
+	}{
+		{"http://ads.example.com/x.js", "", true},
+		{"https://img.ads.example.com:8443/x.js", "", true},
+		{"http://badads.example.com/x.js", "", false},
+		{"http://ads.example.com.evil/x.js", "", false},
+		{"http://ads.example.com/allowed/x.js", "", false},
+		{"http://tracker.net/t.js", "www.shop.example", true},
+		{"http://tracker.net/t.js", "www.tracker.net", false},
+		{"http://site.example/banner/big/img?size=2", "", true},
+		{"http://site.example/banner/big/imgs.png", "", false},
+		{"http://example.org/popunder.js", "", true},
+		{"http://example.org/popunder.js?x", "", false},
+		{"http://x.example/top-ad-frame.html", "www.news.example", true},
+		{"http://x.example/top-ad-frame.html", "sports.news.example", false},
+		{"http://x.example/top-ad-frame.html", "", false},
+		{"http://x.example/pixel.gif?id=42", "", true},
+		{"http://x.example/pixel.gif?id=abc", "", false},
+		{"http://cdn.example.com/annoy.js", "", true},
+		{"http://cdn.example.com/lib.js", "", false},
+		{"http://popups.example.com/", "", false},
+		{"http://www.example.com/", "", false},
+	} {
+		u, _ := url.Parse(tc.url)
+		if got := m.Match(u, tc.doc); got != tc.want {
+			t.Errorf("Match(%s, %q) = %v, want %v", tc.url, tc.doc, got, tc.want)
+		}
+	}
+}
+
+func TestBlocker(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "easylist.txt")
+	if err := os.WriteFile(name, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &feeds.Feed[*Matcher]{Source: name, Parse: Parse}
+	if err := f.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv := &icap.Server{Handler: &Blocker{Lists: []*feeds.Feed[*Matcher]{f}, Stub: true}}
+	go srv.Serve(l)
+
+	roundTrip := func(target string) string {
+		httpHdr := "GET " + target + " HTTP/1.1\r\nHost: " + strings.Split(target, "/")[2] + "\r\n\r\n"
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		io.WriteString(c, "REQMOD icap://icap.example.net/adblock ICAP/1.0\r\n"+
+			"Host: icap.example.net\r\n"+
+			"Allow: 204\r\n"+
+			"Encapsulated: req-hdr=0, null-body="+strconv.Itoa(len(httpHdr))+"\r\n\r\n"+httpHdr)
+		c.(*net.TCPConn).CloseWrite()
+		resp, _ := io.ReadAll(c)
+		return string(resp)
+	}
+
+	resp := roundTrip("http://ads.example.com/banner.js")
+	if !strings.Contains(resp, "\r\n\r\nHTTP/1.1 204 No Content\r\n") || !strings.Contains(resp, "null-body") {
+		t.Errorf("blocked request should get an empty stub:\n%s", resp)
+	}
+	resp = roundTrip("http://www.example.com/")
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Errorf("allowed request should get ICAP 204:\n%s", resp)
+	}
+}
+
+func TestMatcherIDN(t *testing.T) {
+	m, err := Parse(strings.NewReader("||werbung.bücher.example^\n/banner/$domain=xn--mnchen-3ya.example\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		url, doc string
+		want     bool
+	}{
+		{"http://werbung.xn--bcher-kva.example/x.js", "", true},
+		{"http://werbung.bücher.example/x.js", "", true},
+		{"http://werbung.bucher.example/x.js", "", false},
+		{"http://cdn.example/banner/1.png", "www.münchen.example", true},
+		{"http://cdn.example/banner/1.png", "www.munchen.example", false},
+	} {
+		u, _ := url.Parse(tc.url)
+		if got := m.Match(u, tc.doc); got != tc.want {
+			t.Errorf("Match(%s, %q) = %v, want %v", tc.url, tc.doc, got, tc.want)
+		}
+	}
+}
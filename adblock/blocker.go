@@ -0,0 +1,73 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A pipeline stage that blocks requests matched by filter lists.
+
+package adblock
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/intra-sh/icap"
+	"github.com/intra-sh/icap/feeds"
+)
+
+// A Blocker is an icap.Stage and an icap.Handler that blocks REQMOD
+// requests for URLs matched by any of its lists. The page making the
+// request is found from the Referer header.
+type Blocker struct {
+	// Lists are the filter lists, such as EasyList loaded with
+	// feeds.Feed[*Matcher]{Source: url, Parse: Parse}. Lists that have
+	// not been loaded yet are skipped.
+	Lists []*feeds.Feed[*Matcher]
+
+	// Stub answers blocked requests with an empty 204 No Content HTTP
+	// response, which browsers show as nothing, instead of a block page.
+	Stub bool
+
+	// Status and Reason make up the block page when Stub is false.
+	// If they are zero, 403 and "Blocked by filter list." are used.
+	Status int
+	Reason string
+}
+
+// ServeICAP blocks req if it matches the lists, and otherwise lets it
+// through unmodified.
+func (b *Blocker) ServeICAP(w icap.ResponseWriter, req *icap.Request) {
+	p := icap.Pipeline{Stages: []icap.Stage{b}}
+	p.ServeICAP(w, req)
+}
+
+// Process checks the encapsulated HTTP request of req against the lists.
+func (b *Blocker) Process(req *icap.Request) (icap.StageResult, error) {
+	hr := req.Request
+	if req.Method != "REQMOD" || hr == nil || hr.URL == nil {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	u := hr.URL
+	if u.Host == "" {
+		v := *u
+		v.Host = hr.Host
+		u = &v
+	}
+	var docHost string
+	if ref, err := url.Parse(hr.Header.Get("Referer")); err == nil {
+		docHost = ref.Hostname()
+	}
+
+	for _, f := range b.Lists {
+		if m, ok := f.Get(); ok && m.Match(u, docHost) {
+			if b.Stub {
+				return icap.StageResult{Action: icap.ActionBlock, Status: http.StatusNoContent}, nil
+			}
+			reason := b.Reason
+			if reason == "" {
+				reason = "Blocked by filter list."
+			}
+			return icap.StageResult{Action: icap.ActionBlock, Status: b.Status, Reason: reason}, nil
+		}
+	}
+	return icap.StageResult{Action: icap.ActionContinue}, nil
+}
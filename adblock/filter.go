@@ -0,0 +1,427 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package adblock blocks advertisements and trackers with filter lists in
+// the Adblock Plus format, such as EasyList and EasyPrivacy.
+//
+// Parse compiles a list into a Matcher, which matches request URLs against
+// its URL filters. Element hiding rules, and filters with options that
+// only make sense inside a browser (such as $popup, $csp or $redirect),
+// are skipped. Resource type options, such as $script or $image, are
+// ignored, since an ICAP service can't tell what a request is for; a
+// filter with them applies to every request it matches. Internationalized
+// domain names match whether a filter or a request writes them in Unicode
+// or in their ASCII ("xn--") form.
+//
+// The Blocker stage blocks matching REQMOD requests, using lists kept up to
+// date by the feeds package.
+package adblock
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/intra-sh/icap"
+)
+
+// A filter is a compiled URL filter.
+type filter struct {
+	pattern      string // with anchors removed; lower case unless matchCase
+	domainAnchor bool   // ||: the pattern starts at the start of a domain name
+	startAnchor  bool   // |: the pattern starts at the start of the URL
+	endAnchor    bool   // |: the pattern ends at the end of the URL
+	re           *regexp.Regexp
+
+	matchCase  bool
+	thirdParty int // 1: third-party requests only; -1: first-party only
+	domains    []string
+	notDomains []string
+	important  bool
+}
+
+// A Matcher is a compiled filter list. It is safe for concurrent use.
+type Matcher struct {
+	blocks     index
+	important  index // blocking filters that exceptions don't override
+	exceptions index
+	n          int
+}
+
+// An index finds the filters that may match a URL by the tokens in them.
+type index struct {
+	byToken map[string][]*filter
+	other   []*filter // filters without a usable token
+}
+
+func (ix *index) add(f *filter) {
+	if tok := filterToken(f); tok != "" {
+		if ix.byToken == nil {
+			ix.byToken = make(map[string][]*filter)
+		}
+		ix.byToken[tok] = append(ix.byToken[tok], f)
+		return
+	}
+	ix.other = append(ix.other, f)
+}
+
+// match returns the first filter in ix that matches the request.
+func (ix *index) match(r *request) *filter {
+	for _, tok := range r.tokens {
+		for _, f := range ix.byToken[tok] {
+			if f.match(r) {
+				return f
+			}
+		}
+	}
+	for _, f := range ix.other {
+		if f.match(r) {
+			return f
+		}
+	}
+	return nil
+}
+
+// Parse compiles a filter list.
+func Parse(r io.Reader) (*Matcher, error) {
+	m := new(Matcher)
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		f, exception := parseFilter(line)
+		if f == nil {
+			continue
+		}
+		switch {
+		case exception:
+			m.exceptions.add(f)
+		case f.important:
+			m.important.add(f)
+		default:
+			m.blocks.add(f)
+		}
+		m.n++
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Len returns the number of filters in m.
+func (m *Matcher) Len() int {
+	return m.n
+}
+
+// unsupportedOptions are the filter options that make a filter apply to
+// something other than the request itself.
+var unsupportedOptions = map[string]bool{
+	"popup": true, "document": true, "elemhide": true, "generichide": true,
+	"genericblock": true, "csp": true, "redirect": true, "redirect-rule": true,
+	"rewrite": true, "removeparam": true, "badfilter": true, "header": true,
+	"permissions": true, "replace": true, "cookie": true,
+}
+
+// parseFilter parses one line of a filter list. It returns nil for
+// comments, element hiding rules, and filters that aren't supported.
+func parseFilter(line string) (f *filter, exception bool) {
+	if line == "" || line[0] == '!' || line[0] == '[' ||
+		strings.Contains(line, "##") || strings.Contains(line, "#@#") ||
+		strings.Contains(line, "#?#") || strings.Contains(line, "#$#") {
+		return nil, false
+	}
+	if strings.HasPrefix(line, "@@") {
+		exception = true
+		line = line[2:]
+	}
+	f = new(filter)
+
+	// Options follow the last $, unless it is part of a regular expression.
+	if i := strings.LastIndexByte(line, '$'); i >= 0 && i > strings.LastIndexByte(line, '/') {
+		opts := line[i+1:]
+		line = line[:i]
+		for _, opt := range strings.Split(opts, ",") {
+			name, value, _ := strings.Cut(strings.ToLower(strings.TrimSpace(opt)), "=")
+			switch {
+			case unsupportedOptions[strings.TrimPrefix(name, "~")]:
+				return nil, false
+			case name == "third-party" || name == "3p":
+				f.thirdParty = 1
+			case name == "~third-party" || name == "first-party" || name == "1p":
+				f.thirdParty = -1
+			case name == "match-case":
+				f.matchCase = true
+			case name == "important":
+				f.important = true
+			case name == "domain":
+				for _, d := range strings.Split(value, "|") {
+					if d, ok := strings.CutPrefix(d, "~"); ok {
+						f.notDomains = append(f.notDomains, icap.CanonicalHost(d))
+					} else if d != "" {
+						f.domains = append(f.domains, icap.CanonicalHost(d))
+					}
+				}
+			}
+		}
+	}
+
+	if len(line) > 2 && line[0] == '/' && line[len(line)-1] == '/' {
+		expr := line[1 : len(line)-1]
+		if !f.matchCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, false
+		}
+		f.re = re
+		return f, exception
+	}
+
+	switch {
+	case strings.HasPrefix(line, "||"):
+		f.domainAnchor = true
+		line = asciiPatternHost(line[2:])
+	case strings.HasPrefix(line, "|"):
+		f.startAnchor = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "|") {
+		f.endAnchor = true
+		line = line[:len(line)-1]
+	}
+	if !f.matchCase {
+		line = strings.ToLower(line)
+	}
+	if (line == "" || line == "*") && len(f.domains) == 0 {
+		// A filter that would match everything is almost certainly a mistake.
+		return nil, false
+	}
+	f.pattern = line
+	return f, exception
+}
+
+// isTokenChar reports whether c may be part of a token.
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '%'
+}
+
+// filterToken returns the longest token of f's pattern that must appear
+// as a whole token of every URL that f matches, or "" if there is none.
+func filterToken(f *filter) string {
+	if f.re != nil || f.matchCase {
+		return ""
+	}
+	p := f.pattern
+	best := ""
+	for i := 0; i < len(p); {
+		if !isTokenChar(p[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(p) && isTokenChar(p[j]) {
+			j++
+		}
+		// The token must not be extended by a wildcard or by the
+		// unanchored ends of the pattern.
+		leftOK := i > 0 && p[i-1] != '*' || i == 0 && (f.domainAnchor || f.startAnchor)
+		rightOK := j < len(p) && p[j] != '*' || j == len(p) && f.endAnchor
+		if leftOK && rightOK && j-i > len(best) {
+			best = p[i:j]
+		}
+		i = j
+	}
+	return best
+}
+
+// A request is a URL being checked, with the information filters need.
+type request struct {
+	url        string // lower case
+	rawURL     string // as given, for match-case filters
+	host       string
+	hostStart  int // the index of host in url
+	docHost    string
+	thirdParty bool
+	tokens     []string
+}
+
+func newRequest(u *url.URL, docHost string) *request {
+	r := &request{host: icap.CanonicalHost(u.Hostname())}
+	v := *u
+	switch {
+	case v.Port() != "":
+		v.Host = net.JoinHostPort(r.host, v.Port())
+	case strings.Contains(r.host, ":"):
+		v.Host = "[" + r.host + "]"
+	default:
+		v.Host = r.host
+	}
+	r.rawURL = v.String()
+	r.url = strings.ToLower(r.rawURL)
+	r.hostStart = strings.Index(r.url, r.host)
+	r.docHost = icap.CanonicalHost(docHost)
+	r.thirdParty = r.docHost != "" && baseDomain(r.host) != baseDomain(r.docHost)
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(r.url); {
+		if !isTokenChar(r.url[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(r.url) && isTokenChar(r.url[j]) {
+			j++
+		}
+		if tok := r.url[i:j]; !seen[tok] {
+			seen[tok] = true
+			r.tokens = append(r.tokens, tok)
+		}
+		i = j
+	}
+	return r
+}
+
+// asciiPatternHost converts the host name at the start of p, the pattern
+// of a || filter, to its ASCII ("xn--") form, the form in which request
+// hosts are compared.
+func asciiPatternHost(p string) string {
+	end := strings.IndexAny(p, "/^*:|?")
+	if end < 0 {
+		end = len(p)
+	}
+	for i := 0; i < end; i++ {
+		if p[i] >= utf8.RuneSelf {
+			return icap.CanonicalHost(p[:end]) + p[end:]
+		}
+	}
+	return p
+}
+
+// baseDomain returns the last two labels of host, an approximation of its
+// registrable domain that is used to decide whether a request is
+// third-party.
+func baseDomain(host string) string {
+	i := strings.LastIndexByte(host, '.')
+	if i < 0 {
+		return host
+	}
+	if j := strings.LastIndexByte(host[:i], '.'); j >= 0 {
+		return host[j+1:]
+	}
+	return host
+}
+
+// inDomain reports whether host is domain or one of its subdomains.
+func inDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func (f *filter) match(r *request) bool {
+	switch {
+	case f.thirdParty > 0 && !r.thirdParty, f.thirdParty < 0 && r.thirdParty:
+		return false
+	}
+	if len(f.domains) > 0 || len(f.notDomains) > 0 {
+		for _, d := range f.notDomains {
+			if inDomain(r.docHost, d) {
+				return false
+			}
+		}
+		if len(f.domains) > 0 {
+			found := false
+			for _, d := range f.domains {
+				if inDomain(r.docHost, d) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	s := r.url
+	if f.matchCase {
+		s = r.rawURL
+	}
+	if f.re != nil {
+		return f.re.MatchString(s)
+	}
+	switch {
+	case f.domainAnchor:
+		if r.hostStart < 0 {
+			return false
+		}
+		for i := r.hostStart; i < r.hostStart+len(r.host); i++ {
+			if (i == r.hostStart || s[i-1] == '.') && globMatch(f.pattern, s[i:], f.endAnchor) {
+				return true
+			}
+		}
+		return false
+	case f.startAnchor:
+		return globMatch(f.pattern, s, f.endAnchor)
+	}
+	return globMatch("*"+f.pattern, s, f.endAnchor)
+}
+
+// isSeparator reports whether c matches the ^ placeholder.
+func isSeparator(c byte) bool {
+	return !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == '%')
+}
+
+// globMatch reports whether pattern matches a prefix of s (or all of s,
+// if end is true). In the pattern, * matches any string and ^ matches a
+// separator character or the end of s.
+func globMatch(pattern, s string, end bool) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:], end) {
+					return true
+				}
+			}
+			return false
+		case '^':
+			if len(s) == 0 {
+				pattern = pattern[1:]
+				continue
+			}
+			if !isSeparator(s[0]) {
+				return false
+			}
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return !end || len(s) == 0
+}
+
+// Match reports whether a request for u, made by a page on docHost,
+// should be blocked. docHost may be empty if the page is unknown; then
+// filters for third-party requests or particular sites don't apply.
+func (m *Matcher) Match(u *url.URL, docHost string) bool {
+	r := newRequest(u, docHost)
+	if m.important.match(r) != nil {
+		return true
+	}
+	return m.blocks.match(r) != nil && m.exceptions.match(r) == nil
+}
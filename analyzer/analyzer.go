@@ -0,0 +1,283 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package analyzer decodes the ICAP transactions in the two directions of
+// a captured connection, such as one reassembled from a pcap file, for
+// troubleshooting. The data can be fed in as it is reassembled; messages
+// are decoded as soon as they are complete.
+package analyzer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/intra-sh/icap"
+)
+
+// A Transaction is an ICAP request and the response to it.
+type Transaction struct {
+	Request *icap.Request
+
+	// RequestBody is the encapsulated body of the request: the preview,
+	// followed by the rest of the body if the server asked for it.
+	RequestBody []byte
+
+	// Continued reports whether the server sent 100 Continue.
+	Continued bool
+
+	// Response is the final response, or nil if the connection ended
+	// without one. ResponseBody is its encapsulated body.
+	Response     *icap.Response
+	ResponseBody []byte
+
+	// The offsets of the request in the client's stream and of the
+	// response in the server's stream.
+	RequestOffset, ResponseOffset int64
+
+	bodyPending bool // the rest of the body after the preview is still to come
+}
+
+// An Analyzer decodes the transactions of one connection. The zero value
+// is ready to use.
+type Analyzer struct {
+	client, server stream
+
+	// pending holds the transactions that aren't complete yet, in
+	// order. waiting is the one whose preview awaits the server's
+	// answer, and continuing the one whose body follows in the client's
+	// stream.
+	pending             []*Transaction
+	waiting, continuing *Transaction
+
+	err error
+}
+
+// A stream is the undecoded data from one side of the connection.
+type stream struct {
+	buf []byte
+	off int64 // the offset of buf in the stream
+}
+
+func (s *stream) consume(n int) {
+	s.buf = s.buf[n:]
+	s.off += int64(n)
+}
+
+// ClientData adds data sent by the client, and returns the transactions
+// that are now complete. After a malformed message, it returns an error,
+// and the analyzer stops.
+func (a *Analyzer) ClientData(p []byte) ([]*Transaction, error) {
+	a.client.buf = append(a.client.buf, p...)
+	return a.decode()
+}
+
+// ServerData adds data sent by the server, like ClientData.
+func (a *Analyzer) ServerData(p []byte) ([]*Transaction, error) {
+	a.server.buf = append(a.server.buf, p...)
+	return a.decode()
+}
+
+// Close ends the streams, and returns the transactions left incomplete.
+// If either stream ends partway through a message, it returns an error
+// that wraps icap.ErrIncomplete.
+func (a *Analyzer) Close() ([]*Transaction, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	txs := a.pending
+	a.pending, a.waiting, a.continuing = nil, nil, nil
+	switch {
+	case len(a.client.buf) > 0:
+		a.err = fmt.Errorf("analyzer: client stream at byte %d: %w", a.client.off, icap.ErrIncomplete)
+	case len(a.server.buf) > 0:
+		a.err = fmt.Errorf("analyzer: server stream at byte %d: %w", a.server.off, icap.ErrIncomplete)
+	}
+	return txs, a.err
+}
+
+// Analyze decodes the transactions of a connection from the whole of the
+// client's and the server's streams.
+func Analyze(client, server io.Reader) ([]*Transaction, error) {
+	var a Analyzer
+	c, err := io.ReadAll(client)
+	if err != nil {
+		return nil, err
+	}
+	s, err := io.ReadAll(server)
+	if err != nil {
+		return nil, err
+	}
+	txs, err := a.ClientData(c)
+	if err != nil {
+		return txs, err
+	}
+	more, err := a.ServerData(s)
+	txs = append(txs, more...)
+	if err != nil {
+		return txs, err
+	}
+	more, err = a.Close()
+	return append(txs, more...), err
+}
+
+// decode decodes as many messages as it can, and returns the transactions
+// that are complete.
+func (a *Analyzer) decode() ([]*Transaction, error) {
+	if a.err != nil {
+		return nil, a.err
+	}
+	for {
+		client, err := a.decodeClient()
+		if err != nil {
+			a.err = fmt.Errorf("analyzer: client stream at byte %d: %w", a.client.off, err)
+			return a.complete(), a.err
+		}
+		server, err := a.decodeServer()
+		if err != nil {
+			a.err = fmt.Errorf("analyzer: server stream at byte %d: %w", a.server.off, err)
+			return a.complete(), a.err
+		}
+		if !client && !server {
+			return a.complete(), nil
+		}
+	}
+}
+
+// complete removes the transactions at the start of pending that are
+// complete, and returns them.
+func (a *Analyzer) complete() []*Transaction {
+	var done []*Transaction
+	for len(a.pending) > 0 {
+		tx := a.pending[0]
+		if tx.Response == nil || tx.bodyPending {
+			break
+		}
+		done = append(done, tx)
+		a.pending = a.pending[1:]
+	}
+	return done
+}
+
+// decodeClient decodes the next message in the client's stream, if it
+// can, and reports whether it did.
+func (a *Analyzer) decodeClient() (bool, error) {
+	if len(a.client.buf) == 0 || a.waiting != nil {
+		// Whether the rest of the body follows depends on the server.
+		return false, nil
+	}
+
+	if tx := a.continuing; tx != nil {
+		body, _, n, err := icap.ParseChunks(a.client.buf)
+		if err != nil {
+			return false, ignoreIncomplete(err)
+		}
+		tx.RequestBody = append(tx.RequestBody, body...)
+		tx.bodyPending = false
+		a.continuing = nil
+		a.client.consume(n)
+		return true, nil
+	}
+
+	req, n, err := icap.ParseRequest(a.client.buf)
+	if err != nil {
+		return false, ignoreIncomplete(err)
+	}
+	tx := &Transaction{Request: req, RequestOffset: a.client.off}
+	tx.RequestBody = readBody(requestBody(req))
+	if req.Header.Get("Preview") != "" && !req.PreviewComplete() &&
+		!strings.Contains(req.Header.Get("Encapsulated"), "null-body") {
+		tx.bodyPending = true
+		a.waiting = tx
+	}
+	a.pending = append(a.pending, tx)
+	a.client.consume(n)
+	return true, nil
+}
+
+// decodeServer decodes the next message in the server's stream, if it
+// can, and reports whether it did.
+func (a *Analyzer) decodeServer() (bool, error) {
+	if len(a.server.buf) == 0 {
+		return false, nil
+	}
+	var tx *Transaction
+	for _, t := range a.pending {
+		if t.Response == nil {
+			tx = t
+			break
+		}
+	}
+	if tx == nil {
+		// The request hasn't been decoded yet.
+		return false, nil
+	}
+
+	resp, n, err := icap.ParseResponse(a.server.buf, tx.Request)
+	if err != nil {
+		return false, ignoreIncomplete(err)
+	}
+	if resp.StatusCode == icap.StatusContinue {
+		tx.Continued = true
+		if a.waiting == tx {
+			a.waiting, a.continuing = nil, tx
+		}
+	} else {
+		tx.Response, tx.ResponseOffset = resp, a.server.off
+		tx.ResponseBody = readBody(responseBody(resp))
+		if a.waiting == tx {
+			// The client won't send the rest of the body.
+			a.waiting = nil
+			tx.bodyPending = false
+		}
+	}
+	a.server.consume(n)
+	return true, nil
+}
+
+func ignoreIncomplete(err error) error {
+	if errors.Is(err, icap.ErrIncomplete) {
+		return nil
+	}
+	return err
+}
+
+// requestBody returns the body of the message that req encapsulates.
+func requestBody(req *icap.Request) *io.ReadCloser {
+	switch {
+	case req.Method == "REQMOD" && req.Request != nil:
+		return &req.Request.Body
+	case req.Method == "RESPMOD" && req.Response != nil:
+		return &req.Response.Body
+	case req.OptBody != nil:
+		return &req.OptBody
+	}
+	return nil
+}
+
+// responseBody returns the body of the message that resp encapsulates.
+func responseBody(resp *icap.Response) *io.ReadCloser {
+	switch {
+	case resp.Response != nil:
+		return &resp.Response.Body
+	case resp.Request != nil:
+		return &resp.Request.Body
+	case resp.OptBody != nil:
+		return &resp.OptBody
+	}
+	return nil
+}
+
+// readBody reads the body that p points to, and replaces it with a reader
+// of the same content, so that it can be read again.
+func readBody(p *io.ReadCloser) []byte {
+	if p == nil || *p == nil {
+		return nil
+	}
+	b, _ := io.ReadAll(*p)
+	*p = io.NopCloser(bytes.NewReader(b))
+	return b
+}
@@ -0,0 +1,144 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package analyzer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/intra-sh/icap"
+)
+
+// capture returns the messages of a connection, in the order they were
+// sent, marked with whether the client sent them.
+func capture() (msgs []string, fromClient []bool) {
+	reqHdr := "GET /file HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	respHdr := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	add := func(client bool, msg string) {
+		msgs = append(msgs, msg)
+		fromClient = append(fromClient, client)
+	}
+
+	add(true, "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Preview: 4\r\n"+
+		fmt.Sprintf("Encapsulated: req-hdr=0, res-hdr=%d, res-body=%d\r\n\r\n", len(reqHdr), len(reqHdr)+len(respHdr))+
+		reqHdr+respHdr+
+		"4\r\nhell\r\n0\r\n\r\n")
+	add(false, "ICAP/1.0 100 Continue\r\n\r\n")
+	add(true, "8\r\no, world\r\n0\r\n\r\n")
+	add(false, "ICAP/1.0 200 OK\r\n"+
+		fmt.Sprintf("Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(respHdr))+
+		respHdr+
+		"5\r\nHELLO\r\n0\r\n\r\n")
+
+	add(true, "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: req-hdr=0, null-body="+fmt.Sprint(len(reqHdr))+"\r\n\r\n"+
+		reqHdr)
+	add(false, "ICAP/1.0 204 No Modifications\r\nEncapsulated: null-body=0\r\n\r\n")
+
+	add(true, "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Preview: 4\r\n"+
+		fmt.Sprintf("Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(respHdr))+
+		respHdr+
+		"4\r\nhell\r\n0\r\n\r\n")
+	add(false, "ICAP/1.0 204 No Modifications\r\nEncapsulated: null-body=0\r\n\r\n")
+	return msgs, fromClient
+}
+
+func checkTransactions(t *testing.T, txs []*Transaction) {
+	t.Helper()
+	if len(txs) != 3 {
+		t.Fatalf("got %d transactions, want 3", len(txs))
+	}
+	want := []struct {
+		method, requestBody string
+		continued           bool
+		status              int
+		responseBody        string
+	}{
+		{"RESPMOD", "hello, world", true, 200, "HELLO"},
+		{"REQMOD", "", false, 204, ""},
+		{"RESPMOD", "hell", false, 204, ""},
+	}
+	for i, w := range want {
+		tx := txs[i]
+		if tx.Request.Method != w.method || string(tx.RequestBody) != w.requestBody || tx.Continued != w.continued ||
+			tx.Response == nil || tx.Response.StatusCode != w.status || string(tx.ResponseBody) != w.responseBody {
+			t.Errorf("transaction %d: %s %q continued=%v, response %+v %q", i, tx.Request.Method, tx.RequestBody, tx.Continued, tx.Response, tx.ResponseBody)
+		}
+	}
+	if txs[1].RequestOffset == 0 || txs[1].ResponseOffset == 0 {
+		t.Errorf("offsets of transaction 1: %d, %d", txs[1].RequestOffset, txs[1].ResponseOffset)
+	}
+}
+
+func TestAnalyzerIncremental(t *testing.T) {
+	msgs, fromClient := capture()
+	var a Analyzer
+	var txs []*Transaction
+	for i, msg := range msgs {
+		// Feed the data a few bytes at a time.
+		for len(msg) > 0 {
+			n := min(3, len(msg))
+			feed := a.ServerData
+			if fromClient[i] {
+				feed = a.ClientData
+			}
+			done, err := feed([]byte(msg[:n]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			txs = append(txs, done...)
+			msg = msg[n:]
+		}
+	}
+	rest, err := a.Close()
+	if err != nil || len(rest) != 0 {
+		t.Errorf("Close() = %v, %v", rest, err)
+	}
+	checkTransactions(t, txs)
+}
+
+func TestAnalyze(t *testing.T) {
+	msgs, fromClient := capture()
+	var client, server strings.Builder
+	for i, msg := range msgs {
+		if fromClient[i] {
+			client.WriteString(msg)
+		} else {
+			server.WriteString(msg)
+		}
+	}
+	txs, err := Analyze(strings.NewReader(client.String()), strings.NewReader(server.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTransactions(t, txs)
+
+	// A connection cut off in the middle of the last response.
+	cut := server.String()[:server.Len()-10]
+	txs, err = Analyze(strings.NewReader(client.String()), strings.NewReader(cut))
+	if !errors.Is(err, icap.ErrIncomplete) {
+		t.Errorf("truncated stream: error %v, want ErrIncomplete", err)
+	}
+	if len(txs) != 3 || txs[2].Response != nil {
+		t.Errorf("truncated stream: got %d transactions", len(txs))
+	}
+}
+
+func TestAnalyzerMalformed(t *testing.T) {
+	var a Analyzer
+	if _, err := a.ClientData([]byte("REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\nEncapsulated: bogus\r\n\r\n")); err == nil {
+		t.Fatal("malformed request accepted")
+	}
+	if _, err := a.ServerData([]byte("ICAP/1.0 204 No Modifications\r\n\r\n")); err == nil {
+		t.Error("analyzer continued after an error")
+	}
+}
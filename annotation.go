@@ -0,0 +1,52 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Annotations passed between chained handlers.
+
+package icap
+
+// SetAnnotation attaches value to the request under key, so that handlers
+// later in a chain can use results computed by earlier ones (an
+// authenticated user, a URL category, a scan result). Annotations last for
+// a single transaction. Keys should be qualified with the name of the
+// package that sets them, such as "auth.user", to avoid collisions.
+func (req *Request) SetAnnotation(key string, value interface{}) {
+	req.annotationMu.Lock()
+	defer req.annotationMu.Unlock()
+	if req.annotations == nil {
+		req.annotations = make(map[string]interface{})
+	}
+	req.annotations[key] = value
+}
+
+// GetAnnotation returns the value stored under key by SetAnnotation.
+func (req *Request) GetAnnotation(key string) (value interface{}, ok bool) {
+	req.annotationMu.Lock()
+	defer req.annotationMu.Unlock()
+	value, ok = req.annotations[key]
+	return value, ok
+}
+
+// Annotations returns a copy of all the annotations on the request.
+func (req *Request) Annotations() map[string]interface{} {
+	req.annotationMu.Lock()
+	defer req.annotationMu.Unlock()
+	m := make(map[string]interface{}, len(req.annotations))
+	for k, v := range req.annotations {
+		m[k] = v
+	}
+	return m
+}
+
+// Annotation returns the annotation stored under key, if there is one
+// and it has type T.
+func Annotation[T any](req *Request, key string) (T, bool) {
+	v, ok := req.GetAnnotation(key)
+	if !ok {
+		var zero T
+		return zero, false
+	}
+	t, ok := v.(T)
+	return t, ok
+}
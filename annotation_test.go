@@ -0,0 +1,60 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnnotations(t *testing.T) {
+	var got map[string]interface{}
+	inner := HandlerFunc(func(w ResponseWriter, req *Request) {
+		if user, ok := Annotation[string](req, "auth.user"); !ok || user != "alice" {
+			t.Errorf(`Annotation[string]("auth.user") = %q, %v; want "alice", true`, user, ok)
+		}
+		req.SetAnnotation("auth.user", "bob")
+		if v, ok := req.GetAnnotation("auth.user"); !ok || v != "bob" {
+			t.Errorf(`overwritten annotation = %v, %v; want "bob", true`, v, ok)
+		}
+
+		if v, ok := req.GetAnnotation("missing"); ok || v != nil {
+			t.Errorf("GetAnnotation(missing) = %v, %v", v, ok)
+		}
+		if n, ok := Annotation[int](req, "missing"); ok || n != 0 {
+			t.Errorf("Annotation[int](missing) = %v, %v", n, ok)
+		}
+		if n, ok := Annotation[int](req, "auth.user"); ok || n != 0 {
+			t.Errorf("Annotation[int] of a string = %v, %v", n, ok)
+		}
+		if c, ok := Annotation[[]string](req, "url.categories"); !ok || len(c) != 2 {
+			t.Errorf("Annotation[[]string](url.categories) = %v, %v", c, ok)
+		}
+
+		got = req.Annotations()
+		got["auth.user"] = "mallory"
+		if user, _ := Annotation[string](req, "auth.user"); user != "bob" {
+			t.Errorf("changing the map from Annotations changed the request: %q", user)
+		}
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	outer := HandlerFunc(func(w ResponseWriter, req *Request) {
+		req.SetAnnotation("auth.user", "alice")
+		req.SetAnnotation("url.categories", []string{"news", "sports"})
+		inner.ServeICAP(w, req)
+	})
+
+	resp := roundTrip(t, &Server{Handler: outer}, "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: req-hdr=0, null-body=18\r\n"+
+		"\r\n"+
+		"GET / HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Errorf("unexpected response:\n%s", resp)
+	}
+	if len(got) != 2 {
+		t.Errorf("Annotations() = %v, want 2 entries", got)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Per-transaction audit records for compliance logging.
+
+package icap
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Verdicts recorded in AuditRecord.Verdict.
+const (
+	VerdictAllow  = "allow"  // the message was passed on unchanged
+	VerdictModify = "modify" // the message was changed
+	VerdictBlock  = "block"  // the message was replaced with a block page
+	VerdictError  = "error"  // the request failed
+)
+
+// An AuditRecord describes a transaction for compliance logging. The
+// server fills in what it knows about the request and the response;
+// Pipeline, Unmodified and the stages in this package record their
+// verdicts, modifications and scan results, and handlers can add their
+// own through Request.Audit. When the response has been sent, the record
+// is passed to Server.Audit, subject to the server's AuditPolicy.
+type AuditRecord struct {
+	Time          time.Time     // when the request started to arrive
+	Duration      time.Duration // until the response was sent
+	ParseDuration time.Duration // see Request.ParseDuration
+
+	Method     string   // ICAP method
+	Service    string   // path of the ICAP URL
+	ClientAddr string   // address of the ICAP client
+	ClientIP   string   // address of the HTTP client, if known
+	User       string   // see Request.AuthenticatedUser
+	Groups     []string // see Request.AuthenticatedGroups
+	URL        string   // URL of the encapsulated HTTP request
+
+	Status  int    // ICAP status code of the response
+	Verdict string // VerdictAllow, VerdictModify, VerdictBlock or VerdictError
+	Reason  string // why the message was blocked, or the error
+
+	Modifications []string     // descriptions of changes to the message
+	ScanResults   []ScanResult // findings of scanners, in order
+
+	HeaderBytes  int64 // see Request.HeaderBytes
+	PreviewBytes int64
+	BodyBytes    int64 // see Request.BodyBytes
+
+	Annotations map[string]interface{} // see Request.SetAnnotation
+
+	mu sync.Mutex
+}
+
+// A ScanResult is the finding of one scanner about a message.
+type ScanResult struct {
+	Scanner string // e.g. "reputation" or "av"
+	Result  string // e.g. "clean" or "Eicar-Test-Signature"
+}
+
+// Audit returns the AuditRecord of req, or nil if the server has no
+// Audit hook. The methods of AuditRecord do nothing on a nil record,
+// so handlers can use them unconditionally.
+func (req *Request) Audit() *AuditRecord {
+	return req.audit
+}
+
+// SetVerdict records the verdict on the transaction, and the reason
+// for it, replacing any verdict recorded before.
+func (r *AuditRecord) SetVerdict(verdict, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Verdict, r.Reason = verdict, reason
+}
+
+// defaultVerdict records the verdict unless one has already been recorded.
+func (r *AuditRecord) defaultVerdict(verdict, reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.Verdict == "" {
+		r.Verdict, r.Reason = verdict, reason
+	}
+}
+
+// AddModification records a change made to the message.
+func (r *AuditRecord) AddModification(desc string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Modifications = append(r.Modifications, desc)
+}
+
+// AddScanResult records the finding of a scanner.
+func (r *AuditRecord) AddScanResult(scanner, result string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.ScanResults = append(r.ScanResults, ScanResult{scanner, result})
+}
+
+// finishAudit completes the audit record of the transaction and passes
+// it to the server's Audit hook (or to the connection's auditSink).
+func (w *respWriter) finishAudit() {
+	req := w.req
+	r := req.audit
+	if r == nil || w.conn.server == nil {
+		return
+	}
+	audit := w.conn.server.Audit
+	if w.conn.auditSink != nil {
+		audit = w.conn.auditSink
+	}
+	if audit == nil {
+		return
+	}
+	req.audit = nil // only once
+
+	r.mu.Lock()
+	r.Time = req.start
+	r.Duration = time.Since(req.start)
+	r.ParseDuration = req.ParseDuration
+	r.Method = req.Method
+	if req.URL != nil {
+		r.Service = req.URL.Path
+	}
+	r.ClientAddr = req.RemoteAddr
+	if ip, ok := req.ClientIP(); ok {
+		r.ClientIP = ip.String()
+	}
+	r.User, _ = UserFromContext(req.Context())
+	r.Groups = req.AuthenticatedGroups()
+	switch {
+	case req.Request != nil && req.Request.URL != nil:
+		r.URL = absoluteURL(req.Request)
+	case req.Response != nil && req.Response.Request != nil && req.Response.Request.URL != nil:
+		r.URL = absoluteURL(req.Response.Request)
+	}
+	r.Status = w.status
+	if r.Verdict == "" {
+		switch {
+		case w.status == StatusNoContent:
+			r.Verdict = VerdictAllow
+		case IsError(w.status):
+			r.Verdict = VerdictError
+		default:
+			r.Verdict = VerdictModify
+		}
+	}
+	r.HeaderBytes = req.HeaderBytes
+	r.PreviewBytes = req.PreviewBytes
+	r.BodyBytes = req.BodyBytes()
+	r.Annotations = req.Annotations()
+	r.mu.Unlock()
+
+	if p := w.conn.server.auditPolicy(r.Service); p != nil {
+		if w.conn.auditSink == nil && !p.keep(r) {
+			return
+		}
+		p.redact(r)
+	}
+	audit(r)
+}
+
+// absoluteURL returns the URL of r, with the host from its Host header
+// if the request line gave only a path.
+func absoluteURL(r *http.Request) string {
+	if r.URL.Host != "" || r.Host == "" {
+		return r.URL.String()
+	}
+	u := *r.URL
+	u.Host = r.Host
+	if u.Scheme == "" {
+		u.Scheme = "http"
+	}
+	return u.String()
+}
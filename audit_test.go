@@ -0,0 +1,120 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestAuditRecord(t *testing.T) {
+	request := func(path string) string {
+		httpHdr := "GET " + path + " HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+		return "REQMOD icap://icap.example.net/filter ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"X-Client-IP: 192.0.2.7\r\n" +
+			"X-Authenticated-User: V2luTlQ6Ly9FWEFNUExFL2FsaWNl\r\n" +
+			"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr
+	}
+
+	records := make(chan *AuditRecord, 3)
+	tag := StageFunc(func(req *Request) (StageResult, error) {
+		if req.Request.URL.Path == "/tagged" {
+			req.Request.Header.Set("X-Tag", "1")
+			req.SetAnnotation("tagged", true)
+			return StageResult{Action: ActionModify}, nil
+		}
+		if req.Request.URL.Path == "/malware" {
+			req.Audit().AddScanResult("av", "Eicar-Test-Signature")
+			return StageResult{Action: ActionBlock, Reason: "Virus found"}, nil
+		}
+		return StageResult{Action: ActionContinue}, nil
+	})
+	srv := &Server{
+		Handler: &Pipeline{Stages: []Stage{tag}},
+		Audit:   func(r *AuditRecord) { records <- r },
+	}
+
+	roundTrip(t, srv, request("/index.html"))
+	r := <-records
+	if r.Verdict != VerdictAllow || r.Status != StatusNoContent || r.Method != "REQMOD" || r.Service != "/filter" {
+		t.Errorf("allowed request: %+v", r)
+	}
+	if r.URL != "http://www.example.com/index.html" || r.ClientIP != "192.0.2.7" || r.User != "EXAMPLE/alice" {
+		t.Errorf("request details: URL %q, client %q, user %q", r.URL, r.ClientIP, r.User)
+	}
+	if r.Time.IsZero() || r.Duration <= 0 || r.HeaderBytes == 0 || r.ClientAddr == "" {
+		t.Errorf("timings and sizes not recorded: %+v", r)
+	}
+
+	roundTrip(t, srv, request("/tagged"))
+	r = <-records
+	if r.Verdict != VerdictModify || r.Status != StatusOK || !reflect.DeepEqual(r.Modifications, []string{"icap.StageFunc"}) {
+		t.Errorf("modified request: %+v", r)
+	}
+	if r.Annotations["tagged"] != true {
+		t.Errorf("annotations = %v", r.Annotations)
+	}
+
+	roundTrip(t, srv, request("/malware"))
+	r = <-records
+	if r.Verdict != VerdictBlock || r.Reason != "Virus found" || !reflect.DeepEqual(r.ScanResults, []ScanResult{{"av", "Eicar-Test-Signature"}}) {
+		t.Errorf("blocked request: %+v", r)
+	}
+
+	// Without an Audit hook there is no record, and its methods do nothing.
+	var req Request
+	req.Audit().SetVerdict(VerdictBlock, "")
+	req.Audit().AddScanResult("av", "clean")
+	if req.Audit() != nil {
+		t.Error("record without an Audit hook")
+	}
+}
+
+func TestAuditPolicy(t *testing.T) {
+	p := &AuditPolicy{HashURLs: true, MaskUsers: true, MaskClientIPs: true, DropAnnotations: true, HashKey: []byte("k")}
+	r := &AuditRecord{
+		URL:         "http://www.example.com/private/page?id=7",
+		User:        "alice",
+		Groups:      []string{"staff"},
+		ClientIP:    "192.0.2.77",
+		Annotations: map[string]interface{}{"a": 1},
+	}
+	p.redact(r)
+	if r.URL != "http://www.example.com/"+p.hash("http://www.example.com/private/page?id=7") || len(p.hash("x")) != 32 {
+		t.Errorf("URL = %q", r.URL)
+	}
+	if r.User != p.hash("alice") || r.Groups != nil || r.ClientIP != "192.0.2.0" || r.Annotations != nil {
+		t.Errorf("redacted record: %+v", r)
+	}
+	r = &AuditRecord{ClientIP: "2001:db8:1:2:3:4:5:6"}
+	p.redact(r)
+	if r.ClientIP != "2001:db8:1::" {
+		t.Errorf("IPv6 client = %q", r.ClientIP)
+	}
+
+	sampled := &AuditPolicy{SampleRate: 0.000001}
+	if sampled.keep(&AuditRecord{Verdict: VerdictAllow}) {
+		t.Error("allowed transaction kept at a tiny sample rate")
+	}
+	if !sampled.keep(&AuditRecord{Verdict: VerdictBlock}) {
+		t.Error("blocked transaction not kept")
+	}
+
+	srv := &Server{
+		AuditPolicy:   p,
+		AuditPolicies: map[string]*AuditPolicy{"/quiet/": {Disabled: true}, "/quiet/loud": sampled},
+	}
+	for path, want := range map[string]*AuditPolicy{"/av": p, "/quiet/x": srv.AuditPolicies["/quiet/"], "/quiet/loud": sampled} {
+		if got := srv.auditPolicy(path); got != want {
+			t.Errorf("policy for %s = %+v", path, got)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Formatting of audit records for SIEMs.
+
+package auditlog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+// A Format is a way of formatting audit records as syslog messages.
+type Format int
+
+const (
+	// RFC5424 puts the fields of the record in a structured-data element.
+	RFC5424 Format = iota
+
+	// CEF is ArcSight's Common Event Format.
+	CEF
+
+	// LEEF is QRadar's Log Event Extended Format, version 1.0.
+	LEEF
+)
+
+// Syslog severities.
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+// severity returns the syslog severity of a record: warning for blocked
+// messages, error for failures and informational for the rest.
+func severity(r *icap.AuditRecord) int {
+	switch r.Verdict {
+	case icap.VerdictBlock:
+		return severityWarning
+	case icap.VerdictError:
+		return severityError
+	}
+	return severityInfo
+}
+
+// A field is a named value of an audit record.
+type field struct {
+	name, value string
+}
+
+// fields returns the non-empty fields of r, named by names, which maps
+// the standard names used in RFC 5424 structured data to those of
+// another format. Fields missing from names are left out.
+func fields(r *icap.AuditRecord, names map[string]string) []field {
+	all := []field{
+		{"method", r.Method},
+		{"service", r.Service},
+		{"clientAddr", r.ClientAddr},
+		{"clientIP", r.ClientIP},
+		{"user", r.User},
+		{"groups", strings.Join(r.Groups, ",")},
+		{"url", r.URL},
+		{"status", strconv.Itoa(r.Status)},
+		{"verdict", r.Verdict},
+		{"reason", r.Reason},
+		{"modifications", strings.Join(r.Modifications, ",")},
+		{"scanResults", scanResults(r.ScanResults)},
+		{"durationMs", strconv.FormatInt(r.Duration.Milliseconds(), 10)},
+		{"headerBytes", strconv.FormatInt(r.HeaderBytes, 10)},
+		{"bodyBytes", strconv.FormatInt(r.PreviewBytes+r.BodyBytes, 10)},
+	}
+	var fs []field
+	for _, f := range all {
+		if f.value == "" {
+			continue
+		}
+		if names != nil {
+			n, ok := names[f.name]
+			if !ok {
+				continue
+			}
+			f.name = n
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+func scanResults(results []icap.ScanResult) string {
+	s := make([]string, len(results))
+	for i, sr := range results {
+		s[i] = sr.Scanner + ":" + sr.Result
+	}
+	return strings.Join(s, ",")
+}
+
+// summary returns a one-line description of r.
+func summary(r *icap.AuditRecord) string {
+	s := r.Method + " " + r.URL + " " + r.Verdict
+	if r.Reason != "" {
+		s += ": " + r.Reason
+	}
+	return s
+}
+
+// header returns the RFC 5424 header of a message about r.
+func (s *Syslog) header(r *icap.AuditRecord) string {
+	facility := s.Facility
+	if facility == 0 {
+		facility = 13 // log audit
+	}
+	t := r.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d audit ",
+		facility*8+severity(r), t.UTC().Format(time.RFC3339Nano),
+		headerField(s.hostname(), 255), headerField(s.appName(), 48), s.pid)
+}
+
+// headerField returns v as an RFC 5424 header field: printable ASCII
+// without spaces, at most max characters, or "-" if empty.
+func headerField(v string, max int) string {
+	v = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return -1
+		}
+		return r
+	}, v)
+	if len(v) > max {
+		v = v[:max]
+	}
+	if v == "" {
+		return "-"
+	}
+	return v
+}
+
+// format returns the syslog message for r.
+func (s *Syslog) format(r *icap.AuditRecord) string {
+	switch s.Format {
+	case CEF:
+		return s.header(r) + "- " + s.cef(r)
+	case LEEF:
+		return s.header(r) + "- " + s.leef(r)
+	}
+	return s.header(r) + s.structuredData(r) + " " + summary(r)
+}
+
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// structuredData formats r as an RFC 5424 SD-ELEMENT.
+func (s *Syslog) structuredData(r *icap.AuditRecord) string {
+	id := s.SDID
+	if id == "" {
+		id = "icap@32473"
+	}
+	var b strings.Builder
+	b.WriteString("[" + id)
+	for _, f := range fields(r, nil) {
+		b.WriteString(" " + f.name + `="` + sdEscaper.Replace(f.value) + `"`)
+	}
+	b.WriteString("]")
+	return b.String()
+}
+
+var cefNames = map[string]string{
+	"clientIP":      "src",
+	"user":          "suser",
+	"url":           "request",
+	"method":        "cs1",
+	"service":       "cs2",
+	"modifications": "cs3",
+	"scanResults":   "cs4",
+	"status":        "cn1",
+	"verdict":       "act",
+	"reason":        "reason",
+	"bodyBytes":     "in",
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// cef formats r as a CEF event.
+func (s *Syslog) cef(r *icap.AuditRecord) string {
+	sev := map[int]string{severityError: "7", severityWarning: "5", severityInfo: "1"}[severity(r)]
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|%s|%s|%s|%s|%s|%s|",
+		cefHeaderEscaper.Replace(s.vendor()), cefHeaderEscaper.Replace(s.product()),
+		cefHeaderEscaper.Replace(s.version()), cefHeaderEscaper.Replace(r.Verdict),
+		cefHeaderEscaper.Replace(summary(r)), sev)
+	fmt.Fprintf(&b, "rt=%d", r.Time.UnixMilli())
+	for _, f := range fields(r, cefNames) {
+		b.WriteString(" " + f.name + "=" + cefExtensionEscaper.Replace(f.value))
+	}
+	if r.Method != "" {
+		b.WriteString(" cs1Label=icapMethod")
+	}
+	if r.Service != "" {
+		b.WriteString(" cs2Label=icapService")
+	}
+	if len(r.Modifications) > 0 {
+		b.WriteString(" cs3Label=modifications")
+	}
+	if len(r.ScanResults) > 0 {
+		b.WriteString(" cs4Label=scanResults")
+	}
+	if r.Status != 0 {
+		b.WriteString(" cn1Label=icapStatus")
+	}
+	return b.String()
+}
+
+var leefNames = map[string]string{
+	"clientIP":      "src",
+	"user":          "usrName",
+	"groups":        "groups",
+	"url":           "url",
+	"method":        "icapMethod",
+	"service":       "icapService",
+	"status":        "icapStatus",
+	"verdict":       "action",
+	"reason":        "reason",
+	"modifications": "modifications",
+	"scanResults":   "scanResults",
+	"durationMs":    "durationMs",
+	"bodyBytes":     "bytesIn",
+}
+
+var leefEscaper = strings.NewReplacer("\t", " ", "\r", " ", "\n", " ", "|", "/")
+
+// leef formats r as a LEEF 1.0 event, with tab-separated attributes.
+func (s *Syslog) leef(r *icap.AuditRecord) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "LEEF:1.0|%s|%s|%s|%s|",
+		leefEscaper.Replace(s.vendor()), leefEscaper.Replace(s.product()),
+		leefEscaper.Replace(s.version()), leefEscaper.Replace(r.Verdict))
+	fmt.Fprintf(&b, "devTime=%d\tdevTimeFormat=epoch\tsev=%d", r.Time.UnixMilli(), 10-severity(r))
+	for _, f := range fields(r, leefNames) {
+		b.WriteString("\t" + f.name + "=" + leefEscaper.Replace(f.value))
+	}
+	return b.String()
+}
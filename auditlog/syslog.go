@@ -0,0 +1,182 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package auditlog sends the audit records of ICAP transactions to
+// security information and event management systems.
+package auditlog
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+// A Syslog sends audit records to a syslog server. Its Log method can be
+// used as icap.Server.Audit.
+//
+// Over UDP, each record is one datagram. Over TCP and TLS, records are
+// framed by octet counting (RFC 6587); the connection is opened when the
+// first record is sent and reopened after an error.
+type Syslog struct {
+	// Network is "udp", "tcp" or "tls". If empty, "udp" is used.
+	Network string
+	Addr    string
+
+	// TLSConfig is the configuration of TLS connections.
+	TLSConfig *tls.Config
+
+	// Timeout limits the time taken to connect and to send each record.
+	// If zero, 5 seconds is used.
+	Timeout time.Duration
+
+	Format Format
+
+	// Facility is the syslog facility. If zero, 13 (log audit) is used.
+	Facility int
+
+	// Hostname and AppName identify the sender in the syslog header.
+	// If empty, the host's name and "icap" are used.
+	Hostname string
+	AppName  string
+
+	// SDID is the ID of the structured-data element in RFC 5424 format.
+	// If empty, "icap@32473" is used.
+	SDID string
+
+	// Vendor, Product and Version identify the device in CEF and LEEF
+	// formats. If empty, "intra-sh", "icap" and "1.0" are used.
+	Vendor  string
+	Product string
+	Version string
+
+	once sync.Once
+	pid  int
+	host string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Log sends r to the syslog server. Errors are logged, and the record
+// is dropped.
+func (s *Syslog) Log(r *icap.AuditRecord) {
+	if err := s.Send(r); err != nil {
+		log.Printf("icap: audit record not sent to %s: %v", s.Addr, err)
+	}
+}
+
+// Send sends r to the syslog server.
+func (s *Syslog) Send(r *icap.AuditRecord) error {
+	s.once.Do(s.init)
+	msg := s.format(r)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.write(msg)
+	if err != nil && s.Network != "" && s.Network != "udp" {
+		// The server may have closed an idle connection; try once more.
+		err = s.write(msg)
+	}
+	return err
+}
+
+// write sends msg, connecting first if necessary.
+func (s *Syslog) write(msg string) error {
+	if s.conn == nil {
+		c, err := s.dial()
+		if err != nil {
+			return err
+		}
+		s.conn = c
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout()))
+	if s.Network != "" && s.Network != "udp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *Syslog) dial() (net.Conn, error) {
+	d := &net.Dialer{Timeout: s.timeout()}
+	switch s.Network {
+	case "", "udp":
+		return d.Dial("udp", s.Addr)
+	case "tcp":
+		return d.Dial("tcp", s.Addr)
+	case "tls":
+		return tls.DialWithDialer(d, "tcp", s.Addr, s.TLSConfig)
+	}
+	return nil, errors.New("auditlog: unknown network " + strconv.Quote(s.Network))
+}
+
+// Close closes the connection to the syslog server.
+func (s *Syslog) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+func (s *Syslog) init() {
+	s.pid = os.Getpid()
+	s.host, _ = os.Hostname()
+}
+
+func (s *Syslog) timeout() time.Duration {
+	if s.Timeout > 0 {
+		return s.Timeout
+	}
+	return 5 * time.Second
+}
+
+func (s *Syslog) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return s.host
+}
+
+func (s *Syslog) appName() string {
+	if s.AppName != "" {
+		return s.AppName
+	}
+	return "icap"
+}
+
+func (s *Syslog) vendor() string {
+	if s.Vendor != "" {
+		return s.Vendor
+	}
+	return "intra-sh"
+}
+
+func (s *Syslog) product() string {
+	if s.Product != "" {
+		return s.Product
+	}
+	return "icap"
+}
+
+func (s *Syslog) version() string {
+	if s.Version != "" {
+		return s.Version
+	}
+	return "1.0"
+}
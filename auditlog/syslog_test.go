@@ -0,0 +1,125 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package auditlog
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+func record() *icap.AuditRecord {
+	return &icap.AuditRecord{
+		Time:        time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Duration:    25 * time.Millisecond,
+		Method:      "RESPMOD",
+		Service:     "/av",
+		ClientIP:    "192.0.2.7",
+		User:        "alice",
+		URL:         "http://www.example.com/setup.exe",
+		Status:      200,
+		Verdict:     icap.VerdictBlock,
+		Reason:      `Virus "Eicar" found`,
+		ScanResults: []icap.ScanResult{{Scanner: "av", Result: "Eicar-Test-Signature"}},
+		BodyBytes:   68,
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	s := &Syslog{Addr: pc.LocalAddr().String(), Hostname: "gw1"}
+	defer s.Close()
+	if err := s.Send(record()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(buf[:n])
+	prefix := "<108>1 2024-05-01T12:00:00Z gw1 icap "
+	if !strings.HasPrefix(msg, prefix) {
+		t.Errorf("message %q doesn't start with %q", msg, prefix)
+	}
+	for _, want := range []string{
+		`[icap@32473 method="RESPMOD" service="/av" clientIP="192.0.2.7" user="alice"`,
+		`verdict="block" reason="Virus \"Eicar\" found" scanResults="av:Eicar-Test-Signature" durationMs="25"`,
+		`] RESPMOD http://www.example.com/setup.exe block: Virus "Eicar" found`,
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message %q doesn't contain %q", msg, want)
+		}
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msgs := make(chan string, 2)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		for {
+			length, err := br.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(length))
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return
+			}
+			msgs <- string(buf)
+		}
+	}()
+
+	s := &Syslog{Network: "tcp", Addr: l.Addr().String(), Format: CEF}
+	defer s.Close()
+	for i := 0; i < 2; i++ {
+		if err := s.Send(record()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		msg := <-msgs
+		want := `- CEF:0|intra-sh|icap|1.0|block|RESPMOD http://www.example.com/setup.exe block: Virus "Eicar" found|5|rt=1714564800000 cs1=RESPMOD cs2=/av src=192.0.2.7 suser=alice`
+		if !strings.Contains(msg, want) || !strings.Contains(msg, " cs4=av:Eicar-Test-Signature") {
+			t.Errorf("message %d = %q", i, msg)
+		}
+	}
+}
+
+func TestLEEF(t *testing.T) {
+	s := &Syslog{Format: LEEF}
+	r := record()
+	r.Reason = "bad\tfile"
+	got := s.leef(r)
+	want := "LEEF:1.0|intra-sh|icap|1.0|block|devTime=1714564800000\tdevTimeFormat=epoch\tsev=6\t" +
+		"icapMethod=RESPMOD\ticapService=/av\tsrc=192.0.2.7\tusrName=alice\turl=http://www.example.com/setup.exe\t" +
+		"icapStatus=200\taction=block\treason=bad file\tscanResults=av:Eicar-Test-Signature\tdurationMs=25\tbytesIn=68"
+	if got != want {
+		t.Errorf("LEEF event:\n%q\nwant\n%q", got, want)
+	}
+}
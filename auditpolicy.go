@@ -0,0 +1,121 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Sampling and redaction of audit records.
+
+package icap
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"net/netip"
+	"net/url"
+)
+
+// An AuditPolicy controls which audit records are passed to Server.Audit
+// and what they may contain, so that privacy requirements can be met
+// without turning auditing off.
+type AuditPolicy struct {
+	// Disabled drops all records.
+	Disabled bool
+
+	// SampleRate is the fraction of the records of allowed and modified
+	// transactions that are kept, between 0 and 1. Records of blocked and
+	// failed transactions are always kept. If zero, all records are kept.
+	SampleRate float64
+
+	// HashURLs replaces the path and query of URLs with a keyed hash of
+	// the whole URL, so that visits to the same page can be correlated
+	// without revealing it. The scheme and host are kept.
+	HashURLs bool
+
+	// MaskUsers replaces user names with a keyed hash, and removes
+	// group memberships.
+	MaskUsers bool
+
+	// MaskClientIPs zeroes the host part of HTTP client addresses: the
+	// last 8 bits of IPv4 addresses and the last 80 bits of IPv6 ones.
+	MaskClientIPs bool
+
+	// DropAnnotations removes the annotations from records.
+	DropAnnotations bool
+
+	// HashKey is the key of the hashes used by HashURLs and MaskUsers.
+	// It should be secret, or the hashes of likely values can be
+	// computed and compared.
+	HashKey []byte
+}
+
+// keep reports whether the record r should be passed on.
+func (p *AuditPolicy) keep(r *AuditRecord) bool {
+	if p.Disabled {
+		return false
+	}
+	if p.SampleRate <= 0 || p.SampleRate >= 1 {
+		return true
+	}
+	if r.Verdict == VerdictBlock || r.Verdict == VerdictError {
+		return true
+	}
+	return rand.Float64() < p.SampleRate
+}
+
+// redact removes the fields of r that the policy doesn't allow.
+func (p *AuditPolicy) redact(r *AuditRecord) {
+	if p.HashURLs && r.URL != "" {
+		h := p.hash(r.URL)
+		if u, err := url.Parse(r.URL); err == nil && u.Host != "" {
+			r.URL = (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/" + h}).String()
+		} else {
+			r.URL = h
+		}
+	}
+	if p.MaskUsers {
+		if r.User != "" {
+			r.User = p.hash(r.User)
+		}
+		r.Groups = nil
+	}
+	if p.MaskClientIPs && r.ClientIP != "" {
+		if addr, err := netip.ParseAddr(r.ClientIP); err == nil {
+			bits := 24
+			if addr.Is6() {
+				bits = 48
+			}
+			prefix, _ := addr.Prefix(bits)
+			r.ClientIP = prefix.Addr().String()
+		} else {
+			r.ClientIP = ""
+		}
+	}
+	if p.DropAnnotations {
+		r.Annotations = nil
+	}
+}
+
+// hash returns a keyed hash of s, as 32 hexadecimal digits.
+func (p *AuditPolicy) hash(s string) string {
+	m := hmac.New(sha256.New, p.HashKey)
+	m.Write([]byte(s))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// auditPolicy returns the audit policy for the ICAP service at path: the
+// one in AuditPolicies whose pattern most closely matches the path, or
+// else AuditPolicy.
+func (srv *Server) auditPolicy(path string) *AuditPolicy {
+	var p *AuditPolicy
+	n := 0
+	for pattern, v := range srv.AuditPolicies {
+		if pathMatch(pattern, path) && (p == nil || len(pattern) > n) {
+			p, n = v, len(pattern)
+		}
+	}
+	if p == nil {
+		p = srv.AuditPolicy
+	}
+	return p
+}
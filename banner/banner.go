@@ -0,0 +1,169 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package banner marks web pages and documents passing through a RESPMOD
+// service with a banner or a watermark comment, as required on some
+// classified networks.
+package banner
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/intra-sh/icap"
+	"github.com/intra-sh/icap/charset"
+)
+
+// An Injector is an icap.Handler and an icap.Stage that adds a banner to
+// HTML responses, just after the opening body tag, and a watermark
+// comment to the end of HTML and PDF responses. The bodies are rewritten
+// as they stream through, in their own character encoding; since their length changes, their
+// Content-Length headers are removed.
+type Injector struct {
+	// HTML is the markup of the banner, such as
+	// <div style="background:red">SECRET</div>.
+	HTML string
+
+	// Comment is the text of the watermark comment.
+	Comment string
+
+	// Types lists the media types to mark. If empty, text/html,
+	// application/xhtml+xml and application/pdf are marked.
+	Types []string
+
+	// MaxScan is the number of bytes of an HTML page searched for the body
+	// tag. Pages without one in that range get only the comment.
+	// If zero, 64 KB is used.
+	MaxScan int
+}
+
+var defaultTypes = []string{"text/html", "application/xhtml+xml", "application/pdf"}
+
+// ServeICAP marks the response in req.
+func (in *Injector) ServeICAP(w icap.ResponseWriter, req *icap.Request) {
+	p := icap.Pipeline{Stages: []icap.Stage{in}}
+	p.ServeICAP(w, req)
+}
+
+// Process marks the response in req, if it is of one of the types.
+func (in *Injector) Process(req *icap.Request) (icap.StageResult, error) {
+	if req.Method != "RESPMOD" || req.Response == nil {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	h := req.Response.Header
+	types := in.Types
+	if len(types) == 0 {
+		types = defaultTypes
+	}
+	if !icap.CanDecompress(h) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	contentType := h.Get("Content-Type")
+	if !icap.MatchMediaType(contentType, types) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	if _, err := req.DecompressBody(); err != nil {
+		return icap.StageResult{}, err
+	}
+
+	t := charset.UTF8(contentType, icap.TransformerFunc(in.markHTML))
+	if mt, _, _ := mime.ParseMediaType(contentType); mt == "application/pdf" {
+		t = icap.TransformerFunc(in.markPDF)
+	}
+	if !req.TransformBody(t) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	return icap.StageResult{Action: icap.ActionModify}, nil
+}
+
+// markHTML inserts the banner after the body tag and appends the comment.
+func (in *Injector) markHTML(dst io.Writer, src io.Reader) error {
+	maxScan := in.MaxScan
+	if maxScan <= 0 {
+		maxScan = 64 << 10
+	}
+
+	if in.HTML != "" {
+		// Read until the end of the body tag.
+		var head []byte
+		buf := make([]byte, 4096)
+		end := -1
+		for len(head) < maxScan {
+			n, err := src.Read(buf)
+			head = append(head, buf[:n]...)
+			if end = bodyTagEnd(head); end >= 0 || err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if end >= 0 {
+			if _, err := dst.Write(head[:end]); err != nil {
+				return err
+			}
+			if _, err := io.WriteString(dst, in.HTML); err != nil {
+				return err
+			}
+			head = head[end:]
+		}
+		if _, err := dst.Write(head); err != nil {
+			return err
+		}
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if in.Comment != "" {
+		c := strings.ReplaceAll(in.Comment, "--", "- -")
+		if _, err := io.WriteString(dst, "\n<!-- "+c+" -->\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bodyTagEnd returns the index just after the opening body tag in html,
+// or -1 if the tag isn't complete.
+func bodyTagEnd(html []byte) int {
+	lower := bytes.ToLower(html)
+	for i := 0; ; {
+		j := bytes.Index(lower[i:], []byte("<body"))
+		if j < 0 {
+			return -1
+		}
+		j += i + len("<body")
+		if j == len(lower) {
+			return -1
+		}
+		switch lower[j] {
+		case '>', ' ', '\t', '\n', '\r', '/':
+			k := bytes.IndexByte(lower[j:], '>')
+			if k < 0 {
+				return -1
+			}
+			return j + k + 1
+		}
+		i = j
+	}
+}
+
+// markPDF appends the comment to a PDF file. A comment after the end of
+// the file doesn't change the offsets that the file's cross-reference
+// table records.
+func (in *Injector) markPDF(dst io.Writer, src io.Reader) error {
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+	if in.Comment != "" {
+		c := strings.NewReplacer("\r", " ", "\n", " ").Replace(in.Comment)
+		if _, err := io.WriteString(dst, "\n% "+c+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package banner
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/intra-sh/icap"
+	"github.com/intra-sh/icap/icaptest"
+)
+
+func respmod(t *testing.T, h icap.Handler, contentType, body string) string {
+	t.Helper()
+	return encodedRespmod(t, h, contentType, "", body)
+}
+
+// encodedRespmod is like respmod, but the body is compressed with the
+// content-coding encoding.
+func encodedRespmod(t *testing.T, h icap.Handler, contentType, encoding, body string) string {
+	t.Helper()
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: " + contentType + "\r\n"
+	if encoding != "" {
+		body = icaptest.Encode(t, encoding, body)
+		httpHdr += "Content-Encoding: " + encoding + "\r\n"
+	}
+	httpHdr += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n"
+	return icaptest.RoundTrip(t, &icap.Server{Handler: h}, "RESPMOD icap://icap.example.net/banner ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: res-hdr=0, res-body="+strconv.Itoa(len(httpHdr))+"\r\n"+
+		"\r\n"+httpHdr+
+		strconv.FormatInt(int64(len(body)), 16)+"\r\n"+body+"\r\n0\r\n\r\n")
+}
+
+func TestInjector(t *testing.T) {
+	in := &Injector{HTML: `<div class="banner">SECRET</div>`, Comment: "classification -- SECRET"}
+
+	resp := respmod(t, in, "text/html; charset=utf-8", "<html><head></head><BODY class=x>\n<p>hello</p></body></html>")
+	if strings.Contains(resp, "Content-Length") {
+		t.Errorf("stale Content-Length kept:\n%s", resp)
+	}
+	want := "<html><head></head><BODY class=x><div class=\"banner\">SECRET</div>\n<p>hello</p></body></html>\n<!-- classification - - SECRET -->\n"
+	if got := icaptest.Unchunk(t, resp); got != want {
+		t.Errorf("HTML body:\n%q\nwant\n%q", got, want)
+	}
+
+	resp = respmod(t, in, "application/pdf", "%PDF-1.4\n...\n%%EOF\n")
+	if got := icaptest.Unchunk(t, resp); got != "%PDF-1.4\n...\n%%EOF\n\n% classification -- SECRET\n" {
+		t.Errorf("PDF body: %q", got)
+	}
+
+	resp = respmod(t, in, "image/png", "png data")
+	if got := icaptest.Unchunk(t, resp); got != "png data" {
+		t.Errorf("image body changed: %q", got)
+	}
+}
+
+func TestBodyTagEnd(t *testing.T) {
+	for html, want := range map[string]int{
+		"<body>":                 6,
+		"<html><body>":           12,
+		"<bodyguard><body>":      17,
+		"<body class='a'>":       16,
+		"<body class='a'":        -1,
+		"<bod":                   -1,
+		"<html><head></head>":    -1,
+		"<BODY\n onload='f()'>x": 20,
+	} {
+		if got := bodyTagEnd([]byte(html)); got != want {
+			t.Errorf("bodyTagEnd(%q) = %d, want %d", html, got, want)
+		}
+	}
+}
+
+func TestInjectorCompressed(t *testing.T) {
+	in := &Injector{HTML: "<div>SECRET</div>"}
+	for _, coding := range []string{"br", "zstd"} {
+		resp := encodedRespmod(t, in, "text/html", coding, "<body><p>hello</p></body>")
+		if strings.Contains(resp, "Content-Encoding") {
+			t.Errorf("%s: Content-Encoding kept after decompression:\n%s", coding, resp)
+		}
+		if got, want := icaptest.Unchunk(t, resp), "<body><div>SECRET</div><p>hello</p></body>"; got != want {
+			t.Errorf("%s: body = %q, want %q", coding, got, want)
+		}
+	}
+}
+
+func TestInjectorLegacyCharset(t *testing.T) {
+	in := &Injector{HTML: "<div>☢ nur für den Dienstgebrauch</div>"}
+	resp := respmod(t, in, "text/html; charset=iso-8859-1", "<body>\xfcber")
+	want := "<body><div>&#9762; nur f\xfcr den Dienstgebrauch</div>\xfcber"
+	if got := icaptest.Unchunk(t, resp); got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
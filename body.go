@@ -0,0 +1,217 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Buffering of encapsulated message bodies.
+
+package icap
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// A BodyMode selects how a ResponseWriter sets the Content-Length of an
+// encapsulated HTTP message whose body the handler writes.
+type BodyMode int
+
+const (
+	// BodyAuto keeps the message's Content-Length header, except that
+	// a changed ContentLength field takes precedence over a stale header.
+	BodyAuto BodyMode = iota
+
+	// BodyStream removes the Content-Length header, so that the ICAP client
+	// forwards the body with chunked encoding.
+	BodyStream
+
+	// BodyBuffered holds the body until the handler returns, and then
+	// sets Content-Length to the number of bytes actually written.
+	BodyBuffered
+)
+
+// SetBodyMode sets the BodyMode for the next WriteHeader call on w,
+// overriding Server.BodyMode. It reports whether w supports body modes.
+func SetBodyMode(w ResponseWriter, mode BodyMode) bool {
+	if bw, ok := w.(interface{ SetBodyMode(BodyMode) }); ok {
+		bw.SetBodyMode(mode)
+		return true
+	}
+	return false
+}
+
+// fixContentLength updates the Content-Length header of an encapsulated
+// message whose body will be written in the given mode.
+// It reports whether the header should be included when writing a request,
+// whose length is otherwise left to the ICAP client.
+func fixContentLength(header http.Header, contentLength int64, mode BodyMode) (keep bool) {
+	switch mode {
+	case BodyStream:
+		header.Del("Content-Length")
+	case BodyBuffered:
+		header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+		return true
+	default:
+		if contentLength >= 0 && header.Get("Content-Length") != "" &&
+			header.Get("Content-Length") != strconv.FormatInt(contentLength, 10) {
+			header.Set("Content-Length", strconv.FormatInt(contentLength, 10))
+		}
+	}
+	return false
+}
+
+// A BufferedBody holds the complete body of an encapsulated message,
+// in memory or in a temporary file, and can be read any number of times.
+type BufferedBody struct {
+	*io.SectionReader
+	file *SpoolFile // the spool file, or nil if the body is in memory
+}
+
+// Rewind moves the read position back to the start of the body.
+func (b *BufferedBody) Rewind() error {
+	_, err := b.Seek(0, io.SeekStart)
+	return err
+}
+
+// InMemory reports whether the body is held in memory rather than in a file.
+func (b *BufferedBody) InMemory() bool {
+	return b.file == nil
+}
+
+func (b *BufferedBody) close() error {
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Close()
+}
+
+// BufferedBody reads the body of the encapsulated message (the HTTP request
+// for REQMOD, the HTTP response for RESPMOD) to the end and returns it as a
+// BufferedBody. Up to memLimit bytes are kept in memory; larger bodies are
+// written to a file in the server's Spool, which is removed when the
+// transaction ends. If the spool is full, the error is ErrSpoolFull.
+//
+// If the client sent a preview, reading past it sends 100 Continue.
+// The message's Body is replaced with a fresh reader over the buffered data,
+// so the original message can still be written back after sniffing it.
+// Later calls return the same BufferedBody.
+func (req *Request) BufferedBody(memLimit int64) (*BufferedBody, error) {
+	if req.bufferedBody != nil {
+		return req.bufferedBody, nil
+	}
+
+	body := req.bodyPtr()
+	if body == nil {
+		var empty io.ReadCloser = emptyReader(0)
+		body = &empty
+	}
+
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, *body, memLimit+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n <= memLimit {
+		if err := req.reserve(n); err != nil {
+			return nil, err
+		}
+	}
+
+	var ra io.ReaderAt = bytes.NewReader(buf.Bytes())
+	bb := new(BufferedBody)
+	if n > memLimit {
+		f, err := req.createSpoolFile()
+		if err != nil {
+			return nil, err
+		}
+		bb.file = f
+		if _, err := f.Write(buf.Bytes()); err != nil {
+			bb.close()
+			return nil, err
+		}
+		m, err := io.Copy(f, *body)
+		if err != nil {
+			bb.close()
+			return nil, err
+		}
+		n += m
+		ra = f
+	}
+
+	bb.SectionReader = io.NewSectionReader(ra, 0, n)
+	*body = io.NopCloser(io.NewSectionReader(ra, 0, n))
+	req.bufferedBody = bb
+	return bb, nil
+}
+
+// TeeBody makes the body of the encapsulated message (the HTTP request for
+// REQMOD, the HTTP response for RESPMOD) write everything read from it to w,
+// so that another component, such as a logger, sees the body as it streams
+// through without buffering it. An error writing to w is returned by the
+// read that caused it. TeeBody does nothing if there is no body.
+func (req *Request) TeeBody(w io.Writer) {
+	body := req.bodyPtr()
+	if body == nil || *body == nil {
+		return
+	}
+	*body = teeReadCloser{io.TeeReader(*body, w), *body}
+}
+
+// A teeReadCloser reads through a TeeReader and closes the original body.
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// bodyPtr returns a pointer to the Body field of the encapsulated message
+// that is being adapted: the HTTP request for REQMOD, the HTTP response for
+// RESPMOD, or the opt-body of an OPTIONS request. It returns nil if there
+// is no such message.
+func (req *Request) bodyPtr() *io.ReadCloser {
+	switch {
+	case req.Method == "REQMOD" && req.Request != nil:
+		return &req.Request.Body
+	case req.Method == "RESPMOD" && req.Response != nil:
+		return &req.Response.Body
+	case req.Method == "OPTIONS" && req.OptBody != nil:
+		return &req.OptBody
+	}
+	return nil
+}
+
+// bodyHeader returns the header of the message returned by bodyPtr.
+func (req *Request) bodyHeader() http.Header {
+	switch {
+	case req.Method == "REQMOD" && req.Request != nil:
+		return req.Request.Header
+	case req.Method == "RESPMOD" && req.Response != nil:
+		return req.Response.Header
+	}
+	return http.Header{}
+}
+
+// createSpoolFile creates a temporary file for the request in the
+// server's Spool.
+func (req *Request) createSpoolFile() (*SpoolFile, error) {
+	if req.server != nil {
+		return req.server.createSpoolFile()
+	}
+	return DefaultSpool.Create()
+}
+
+// cleanup releases resources held for the transaction, such as spool files.
+func (req *Request) cleanup() {
+	if req.bufferedBody != nil {
+		req.bufferedBody.close()
+		req.bufferedBody = nil
+	}
+	if req.encodedBody != nil {
+		req.encodedBody.close()
+		req.encodedBody = nil
+	}
+	req.releaseMemory()
+	if req.cancelCtx != nil {
+		req.cancelCtx(nil)
+	}
+}
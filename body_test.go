@@ -0,0 +1,373 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestBufferedBodyAfterPreview(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Preview: 4\r\n" +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr +
+		"4\r\nsome\r\n0\r\n\r\n" +
+		"b\r\n body text.\r\n0\r\n\r\n"
+
+	var fileName string
+	handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+		if string(req.Preview) != "some" {
+			t.Errorf("Preview is %q", req.Preview)
+		}
+		bb, err := req.BufferedBody(8)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(StatusInternalServerError, nil, false)
+			return
+		}
+		if bb.InMemory() {
+			t.Error("body should have spilled to a file")
+		} else {
+			fileName = bb.file.Name()
+		}
+		first, _ := io.ReadAll(bb)
+		bb.Rewind()
+		second, _ := io.ReadAll(bb)
+		if string(first) != "some body text." || string(second) != string(first) {
+			t.Errorf("body read as %q, then %q", first, second)
+		}
+
+		w.WriteHeader(StatusOK, req.Response, true)
+		io.Copy(w, req.Response.Body)
+	})
+
+	spool := &Spool{Dir: t.TempDir()}
+	resp := roundTrip(t, &Server{Handler: handler, Spool: spool}, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 100 Continue\r\n\r\nICAP/1.0 200 OK\r\n") {
+		t.Errorf("expected 100 Continue before the response:\n%q", resp)
+	}
+	if !strings.HasSuffix(resp, "\r\nf\r\nsome body text.\r\n0\r\n\r\n") {
+		t.Errorf("buffered body not written back:\n%q", resp)
+	}
+	if _, err := os.Stat(fileName); !os.IsNotExist(err) {
+		t.Errorf("spool file %s not removed", fileName)
+	}
+	if files, size := spool.Usage(); files != 0 || size != 0 {
+		t.Errorf("spool usage after transaction: %d files, %d bytes", files, size)
+	}
+}
+
+func TestMemoryLimits(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: res-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr
+
+	handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+		SetBodyMode(w, BodyBuffered)
+		w.WriteHeader(StatusOK, req.Response, true)
+		for i := 0; i < 10; i++ {
+			io.WriteString(w, "0123456789")
+		}
+	})
+	exceeded := make(chan *MemoryLimitError, 2)
+	srv := &Server{
+		Handler:          handler,
+		MaxRequestMemory: 100,
+		Trace: &ServerTrace{
+			MemoryLimit: func(req *Request, err *MemoryLimitError) { exceeded <- err },
+		},
+	}
+	resp := roundTrip(t, srv, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 413 ") {
+		t.Errorf("expected 413 when the buffered body exceeds the budget:\n%s", resp)
+	}
+	if err := <-exceeded; err.Global || err.Limit != 100 {
+		t.Errorf("unexpected error: %+v", err)
+	}
+	if n := srv.MemoryInUse(); n != 0 {
+		t.Errorf("MemoryInUse() = %d after the transaction", n)
+	}
+
+	srv = &Server{Handler: handler, MaxTotalMemory: 10}
+	resp = roundTrip(t, srv, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 500 ") {
+		t.Errorf("expected 500 when the headers exceed the server's budget:\n%s", resp)
+	}
+
+	srv = &Server{Handler: handler, MaxRequestMemory: 1000}
+	resp = roundTrip(t, srv, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 200 ") {
+		t.Errorf("transaction within budget failed:\n%s", resp)
+	}
+}
+
+func TestTeeBody(t *testing.T) {
+	httpReq, _ := http.NewRequest("POST", "http://www.example.com/", strings.NewReader("hello, world"))
+	req := &Request{Method: "REQMOD", Request: httpReq}
+	var copied bytes.Buffer
+	req.TeeBody(&copied)
+	body, err := io.ReadAll(req.Request.Body)
+	if err != nil || string(body) != "hello, world" {
+		t.Errorf("body = %q, %v", body, err)
+	}
+	if copied.String() != "hello, world" {
+		t.Errorf("tee got %q", copied.String())
+	}
+
+	// Without a body, TeeBody does nothing.
+	(&Request{Method: "RESPMOD"}).TeeBody(&copied)
+}
+
+func TestMultiConsumer(t *testing.T) {
+	data := strings.Repeat("0123456789abcdef", 1<<14)
+	var all, prefix []byte
+	errConsumer := errors.New("consumer failed")
+
+	m := &MultiConsumer{BufferSize: 1024}
+	m.Add(func(r io.Reader) (err error) {
+		all, err = io.ReadAll(r)
+		return err
+	})
+	m.Add(func(r io.Reader) error {
+		// Stops early, without holding up the others.
+		prefix = make([]byte, 5)
+		_, err := io.ReadFull(r, prefix)
+		return err
+	})
+	m.Add(func(r io.Reader) error {
+		io.Copy(io.Discard, r)
+		return errConsumer
+	})
+	if err := m.Run(strings.NewReader(data)); err != errConsumer {
+		t.Errorf("Run returned %v, want %v", err, errConsumer)
+	}
+	if string(all) != data {
+		t.Errorf("first consumer read %d bytes, want %d", len(all), len(data))
+	}
+	if string(prefix) != "01234" {
+		t.Errorf("second consumer read %q", prefix)
+	}
+}
+
+func TestBodyHash(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 11\r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr +
+		"5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n"
+
+	srv := &Server{BodyHashes: []crypto.Hash{crypto.SHA256, crypto.MD5}}
+	srv.Handler = HandlerFunc(func(w ResponseWriter, req *Request) {
+		if _, ok := req.BodyHash(crypto.SHA256); ok {
+			t.Error("BodyHash available before the body was read")
+		}
+		writeMessage(w, req)
+
+		sha, ok := req.BodyHash(crypto.SHA256)
+		if want := sha256.Sum256([]byte("hello world")); !ok || !bytes.Equal(sha, want[:]) {
+			t.Errorf("SHA-256 = %x, %v; want %x", sha, ok, want)
+		}
+		sum, ok := req.BodyHash(crypto.MD5)
+		if want := md5.Sum([]byte("hello world")); !ok || !bytes.Equal(sum, want[:]) {
+			t.Errorf("MD5 = %x, %v; want %x", sum, ok, want)
+		}
+		if _, ok := req.BodyHash(crypto.SHA1); ok {
+			t.Error("BodyHash returned a hash that wasn't requested")
+		}
+	})
+	resp := roundTrip(t, srv, request)
+	if !strings.HasSuffix(resp, "5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n") {
+		t.Errorf("body not passed through:\n%q", resp)
+	}
+}
+
+func TestDecodeBody(t *testing.T) {
+	body := `{"user": {"name": "alice", "password": "hunter2"}, "amount": 12.50}`
+	httpHdr := "POST /api/login HTTP/1.1\r\n" +
+		"Host: api.example.com\r\n" +
+		"Content-Type: application/json; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n"
+	request := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr +
+		strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+
+	strip := StageFunc(func(req *Request) (StageResult, error) {
+		d, err := req.DecodeBody(1 << 10)
+		if err != nil {
+			return StageResult{}, err
+		}
+		if name, _ := d.Get("user.name"); name != "alice" {
+			t.Errorf("user.name = %v", name)
+		}
+		if !d.Delete("user.password") || d.Delete("user.missing") {
+			t.Error("Delete reported the wrong fields")
+		}
+		return StageResult{Action: ActionModify}, req.SetDecodedBody(d)
+	})
+	resp := roundTrip(t, &Server{Handler: &Pipeline{Stages: []Stage{strip}}}, request)
+	want := `{"amount":12.50,"user":{"name":"alice"}}`
+	if !strings.Contains(resp, "\r\n"+strconv.FormatInt(int64(len(want)), 16)+"\r\n"+want+"\r\n0\r\n\r\n") {
+		t.Errorf("body not re-encoded:\n%q", resp)
+	}
+
+	httpReq, _ := http.NewRequest("POST", "http://www.example.com/", strings.NewReader("a=1&card=4111&b=2"))
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req := &Request{Method: "REQMOD", Request: httpReq}
+	d, err := req.DecodeBody(1 << 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Delete("card")
+	if err := req.SetDecodedBody(d); err != nil {
+		t.Fatal(err)
+	}
+	newBody, _ := io.ReadAll(httpReq.Body)
+	if string(newBody) != "a=1&b=2" || httpReq.ContentLength != 7 || httpReq.Header.Get("Content-Length") != "7" {
+		t.Errorf("form body = %q, length %d, header %q", newBody, httpReq.ContentLength, httpReq.Header.Get("Content-Length"))
+	}
+
+	httpReq, _ = http.NewRequest("POST", "http://www.example.com/", strings.NewReader("plain"))
+	httpReq.Header.Set("Content-Type", "text/plain")
+	if _, err := (&Request{Method: "REQMOD", Request: httpReq}).DecodeBody(1 << 10); err != ErrUnsupportedBody {
+		t.Errorf("DecodeBody(text/plain) returned %v", err)
+	}
+}
+
+func TestTransformStage(t *testing.T) {
+	upper := TransformerFunc(func(dst io.Writer, src io.Reader) error {
+		b, err := io.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(bytes.ToUpper(b))
+		return err
+	})
+	s := &TransformStage{Transformer: upper, Types: []string{"text/*"}}
+
+	newResp := func(contentType, body string) *Request {
+		resp := &http.Response{
+			Header:        http.Header{"Content-Type": {contentType}, "Content-Length": {strconv.Itoa(len(body))}},
+			ContentLength: int64(len(body)),
+			Body:          io.NopCloser(strings.NewReader(body)),
+		}
+		return &Request{Method: "RESPMOD", Response: resp, hasBody: true}
+	}
+
+	req := newResp("text/plain; charset=utf-8", "hello")
+	if res, err := s.Process(req); err != nil || res.Action != ActionModify {
+		t.Fatalf("Process = %v, %v", res, err)
+	}
+	if req.Response.ContentLength != -1 || req.Response.Header.Get("Content-Length") != "" {
+		t.Error("Content-Length kept after transformation")
+	}
+	if b, _ := io.ReadAll(req.Response.Body); string(b) != "HELLO" {
+		t.Errorf("transformed body = %q", b)
+	}
+
+	req = newResp("image/png", "hello")
+	if res, _ := s.Process(req); res.Action != ActionContinue {
+		t.Errorf("image/png body transformed")
+	}
+
+	for coding, body := range map[string][]byte{"br": brotlied("hello"), "zstd": zstded("hello")} {
+		req = compressedResponse(coding, body)
+		if res, err := s.Process(req); err != nil || res.Action != ActionModify {
+			t.Fatalf("%s: Process = %v, %v", coding, res, err)
+		}
+		if req.Response.Header.Get("Content-Encoding") != "" {
+			t.Errorf("%s: Content-Encoding kept after decompression", coding)
+		}
+		if b, _ := io.ReadAll(req.Response.Body); string(b) != "HELLO" {
+			t.Errorf("%s: transformed body = %q", coding, b)
+		}
+	}
+
+	for ct, want := range map[string]bool{
+		"text/html":            true,
+		"TEXT/HTML; charset=x": true,
+		"application/json":     false,
+		"":                     false,
+	} {
+		if got := MatchMediaType(ct, []string{"text/*"}); got != want {
+			t.Errorf("MatchMediaType(%q) = %v", ct, got)
+		}
+	}
+}
+
+func TestTailTransformer(t *testing.T) {
+	footer := &TailTransformer{
+		Size: 64,
+		Modify: func(tail []byte) []byte {
+			i := bytes.LastIndex(tail, []byte("</body>"))
+			if i < 0 {
+				return tail
+			}
+			return append(append(tail[:i:i], "<p>footer</p>"...), tail[i:]...)
+		},
+	}
+	for _, body := range []string{
+		"<html><body>" + strings.Repeat("x", 10000) + "</body></html>",
+		"<body>short</body>",
+	} {
+		for _, r := range []func(io.Reader) io.Reader{iotest.OneByteReader, iotest.DataErrReader, iotest.HalfReader} {
+			var out bytes.Buffer
+			if err := footer.Transform(&out, r(strings.NewReader(body))); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Replace(body, "</body>", "<p>footer</p></body>", 1)
+			if out.String() != want {
+				t.Errorf("Transform(%.20q...) = %.20q...%q", body, out.String(), out.String()[max(0, out.Len()-40):])
+			}
+		}
+	}
+
+	// The start of the body is passed through before the end arrives.
+	pr, pw := io.Pipe()
+	out := make(chan []byte, 16)
+	done := make(chan error)
+	go func() {
+		done <- footer.Transform(writerFunc(func(p []byte) (int, error) {
+			out <- append([]byte(nil), p...)
+			return len(p), nil
+		}), pr)
+	}()
+	pw.Write([]byte(strings.Repeat("a", 100)))
+	if first := <-out; string(first) != strings.Repeat("a", 36) {
+		t.Errorf("first write = %q, want the bytes before the tail", first)
+	}
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,261 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A circuit breaker for stages that call external services.
+
+package icap
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned by a Breaker without a Fallback while it is open.
+var ErrBreakerOpen = errors.New("icap: circuit breaker open")
+
+// A BreakerState is the state of a Breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed passes every call to the stage.
+	BreakerClosed BreakerState = iota
+
+	// BreakerOpen answers every call with the fallback.
+	BreakerOpen
+
+	// BreakerHalfOpen passes a few probe calls to the stage to find out
+	// whether it has recovered.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// BreakerStats describes the activity of a Breaker.
+type BreakerStats struct {
+	State    BreakerState
+	Calls    uint64 // calls passed to the stage
+	Failures uint64 // calls that failed or were too slow
+	Rejected uint64 // calls answered with the fallback
+	Trips    uint64 // times the breaker has opened
+}
+
+// A Breaker is a Stage that wraps a stage calling an external service,
+// such as a Callout or a virus scanner, and stops calling it while it is
+// failing. When the proportion of calls in a Window that return an error
+// or take longer than SlowCall reaches ErrorRate, the breaker opens and
+// answers with Fallback for OpenTimeout. Then it lets HalfOpenProbes calls
+// through; if they all succeed it closes again, and otherwise it reopens.
+type Breaker struct {
+	Stage Stage
+
+	// ErrorRate is the proportion of failed calls that opens the breaker.
+	// If zero, 0.5 is used.
+	ErrorRate float64
+
+	// MinCalls is the number of calls in a Window needed before the
+	// breaker can open. If zero, 20 is used.
+	MinCalls int
+
+	// SlowCall, if positive, counts calls that take longer as failures.
+	SlowCall time.Duration
+
+	// Window is the period over which the error rate is measured.
+	// If zero, 10 seconds is used.
+	Window time.Duration
+
+	// OpenTimeout is how long the breaker stays open before probing
+	// the stage again. If zero, 30 seconds is used.
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of successful probe calls needed to
+	// close the breaker again. If zero, 1 is used.
+	HalfOpenProbes int
+
+	// Fallback is the result returned while the breaker is open.
+	// If nil, ErrBreakerOpen is returned, which makes a Pipeline fail
+	// open or closed according to its FailOpen setting.
+	Fallback *StageResult
+
+	// OnStateChange, if not nil, is called when the breaker changes state.
+	OnStateChange func(from, to BreakerState)
+
+	mu          sync.Mutex
+	state       BreakerState
+	windowStart time.Time
+	calls       int // calls in the current window
+	failed      int // failed calls in the current window
+	openedAt    time.Time
+	probes      int // probe calls started while half-open
+	probesOK    int // probe calls that succeeded
+	stats       BreakerStats
+	changes     [][2]BreakerState // state changes to report after unlocking
+}
+
+// Process passes req to the stage, unless the breaker is open.
+func (b *Breaker) Process(req *Request) (StageResult, error) {
+	probe, ok := b.allow()
+	if !ok {
+		if b.Fallback != nil {
+			return *b.Fallback, nil
+		}
+		return StageResult{}, ErrBreakerOpen
+	}
+
+	start := time.Now()
+	res, err := b.Stage.Process(req)
+	failed := err != nil || (b.SlowCall > 0 && time.Since(start) > b.SlowCall)
+	b.record(probe, failed)
+	return res, err
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.unlock()
+	b.checkTimeout(time.Now())
+	return b.state
+}
+
+// Stats returns statistics about the breaker.
+func (b *Breaker) Stats() BreakerStats {
+	b.mu.Lock()
+	defer b.unlock()
+	b.checkTimeout(time.Now())
+	s := b.stats
+	s.State = b.state
+	return s
+}
+
+// allow reports whether a call may go to the stage, and whether it is
+// a probe of a half-open breaker.
+func (b *Breaker) allow() (probe, ok bool) {
+	b.mu.Lock()
+	defer b.unlock()
+	b.checkTimeout(time.Now())
+	switch b.state {
+	case BreakerOpen:
+		b.stats.Rejected++
+		return false, false
+	case BreakerHalfOpen:
+		if b.probes >= b.halfOpenProbes() {
+			b.stats.Rejected++
+			return false, false
+		}
+		b.probes++
+		probe = true
+	}
+	b.stats.Calls++
+	return probe, true
+}
+
+// record updates the breaker with the outcome of a call.
+func (b *Breaker) record(probe, failed bool) {
+	b.mu.Lock()
+	defer b.unlock()
+	now := time.Now()
+	if failed {
+		b.stats.Failures++
+	}
+
+	if probe {
+		if b.state != BreakerHalfOpen {
+			return
+		}
+		if failed {
+			b.trip(now)
+			return
+		}
+		b.probesOK++
+		if b.probesOK >= b.halfOpenProbes() {
+			b.setState(BreakerClosed)
+			b.windowStart, b.calls, b.failed = now, 0, 0
+		}
+		return
+	}
+
+	if b.state != BreakerClosed {
+		return
+	}
+	window := b.Window
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	if now.Sub(b.windowStart) > window {
+		b.windowStart, b.calls, b.failed = now, 0, 0
+	}
+	b.calls++
+	if failed {
+		b.failed++
+	}
+
+	minCalls, rate := b.MinCalls, b.ErrorRate
+	if minCalls <= 0 {
+		minCalls = 20
+	}
+	if rate <= 0 {
+		rate = 0.5
+	}
+	if b.calls >= minCalls && float64(b.failed) >= rate*float64(b.calls) {
+		b.trip(now)
+	}
+}
+
+// trip opens the breaker.
+func (b *Breaker) trip(now time.Time) {
+	b.stats.Trips++
+	b.openedAt = now
+	b.setState(BreakerOpen)
+}
+
+// checkTimeout moves an open breaker to half-open once OpenTimeout
+// has passed.
+func (b *Breaker) checkTimeout(now time.Time) {
+	timeout := b.OpenTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	if b.state == BreakerOpen && now.Sub(b.openedAt) >= timeout {
+		b.probes, b.probesOK = 0, 0
+		b.setState(BreakerHalfOpen)
+	}
+}
+
+func (b *Breaker) setState(s BreakerState) {
+	if b.state != s {
+		b.changes = append(b.changes, [2]BreakerState{b.state, s})
+		b.state = s
+	}
+}
+
+// unlock unlocks b.mu and calls OnStateChange for the changes made
+// while it was held.
+func (b *Breaker) unlock() {
+	changes := b.changes
+	b.changes = nil
+	b.mu.Unlock()
+	if b.OnStateChange != nil {
+		for _, c := range changes {
+			b.OnStateChange(c[0], c[1])
+		}
+	}
+}
+
+func (b *Breaker) halfOpenProbes() int {
+	if b.HalfOpenProbes <= 0 {
+		return 1
+	}
+	return b.HalfOpenProbes
+}
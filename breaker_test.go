@@ -0,0 +1,72 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	failing := true
+	var changes []string
+	b := &Breaker{
+		Stage: StageFunc(func(req *Request) (StageResult, error) {
+			if failing {
+				return StageResult{}, errors.New("scanner unavailable")
+			}
+			return StageResult{Action: ActionModify}, nil
+		}),
+		MinCalls:    4,
+		OpenTimeout: 20 * time.Millisecond,
+		Fallback:    &StageResult{Action: ActionBlock, Reason: "scanner unavailable"},
+		OnStateChange: func(from, to BreakerState) {
+			changes = append(changes, from.String()+"->"+to.String())
+		},
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := b.Process(nil); err == nil {
+			t.Fatal("failing stage returned no error")
+		}
+	}
+	if b.State() != BreakerOpen {
+		t.Fatalf("state after 4 failures = %v, want open", b.State())
+	}
+	res, err := b.Process(nil)
+	if err != nil || res.Action != ActionBlock {
+		t.Errorf("open breaker returned %+v, %v; want the fallback", res, err)
+	}
+
+	// A failed probe reopens the breaker.
+	time.Sleep(30 * time.Millisecond)
+	if _, err := b.Process(nil); err == nil {
+		t.Error("probe of failing stage returned no error")
+	}
+	if b.State() != BreakerOpen {
+		t.Errorf("state after failed probe = %v, want open", b.State())
+	}
+
+	// A successful probe closes it.
+	failing = false
+	time.Sleep(30 * time.Millisecond)
+	if res, err := b.Process(nil); err != nil || res.Action != ActionModify {
+		t.Errorf("probe returned %+v, %v", res, err)
+	}
+	if b.State() != BreakerClosed {
+		t.Errorf("state after successful probe = %v, want closed", b.State())
+	}
+
+	stats := b.Stats()
+	if stats.Calls != 6 || stats.Failures != 5 || stats.Rejected != 1 || stats.Trips != 2 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	want := "closed->open open->half-open half-open->open open->half-open half-open->closed"
+	if got := strings.Join(changes, " "); got != want {
+		t.Errorf("state changes: %s\nwant: %s", got, want)
+	}
+}
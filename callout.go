@@ -0,0 +1,186 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Forwarding of encapsulated messages to an HTTP filtering service.
+
+package icap
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// CalloutMessageHeader is the header of a callout request that carries
+// the CalloutMessage, encoded as JSON.
+const CalloutMessageHeader = "X-Icap-Message"
+
+// A CalloutMessage describes an encapsulated message to an HTTP callout
+// service. The body of the message being adapted (the HTTP request for
+// REQMOD, the HTTP response for RESPMOD) is the body of the callout request.
+type CalloutMessage struct {
+	Method         string      `json:"method"` // REQMOD or RESPMOD
+	ClientIP       string      `json:"clientIP,omitempty"`
+	URL            string      `json:"url,omitempty"`
+	RequestMethod  string      `json:"requestMethod,omitempty"`
+	RequestHeader  http.Header `json:"requestHeader,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+}
+
+// A CalloutVerdict is the JSON response of a callout service.
+// A 204 No Content response is the same as {"action": "allow"}.
+type CalloutVerdict struct {
+	// Action is "allow" to pass the message on unchanged, "block" to
+	// replace it with a block page, or "modify" to apply the header
+	// changes below and pass it on.
+	Action string `json:"action"`
+
+	Status int    `json:"status,omitempty"` // status of the block page; 403 if zero
+	Reason string `json:"reason,omitempty"` // body of the block page
+
+	// Header changes to the message being adapted.
+	SetHeaders    map[string]string `json:"setHeaders,omitempty"`
+	RemoveHeaders []string          `json:"removeHeaders,omitempty"`
+}
+
+// A Callout is a Handler that asks an HTTP service what to do with each
+// REQMOD and RESPMOD request: it POSTs the encapsulated message to URL,
+// with the headers as JSON in the X-Icap-Message header and the body as
+// the request body, and acts on the CalloutVerdict it gets back.
+// This lets an existing HTTP filtering API serve ICAP clients.
+//
+// A Callout is also a Stage, so it can be one step of a Pipeline.
+type Callout struct {
+	URL string
+
+	// Client sends the callout requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Timeout limits the time taken by each callout request,
+	// including sending the body. Zero means no limit.
+	Timeout time.Duration
+
+	// FailOpen makes the handler pass the message on unmodified when the
+	// callout fails or times out, instead of sending an ICAP 500 Server Error.
+	FailOpen bool
+
+	// BodyMemory is the number of bytes of each body kept in memory
+	// while it is forwarded; larger bodies are spooled to disk.
+	// If zero, 1 MB is used.
+	BodyMemory int64
+}
+
+// ServeICAP forwards req to the callout service and responds according
+// to its verdict.
+func (c *Callout) ServeICAP(w ResponseWriter, req *Request) {
+	p := Pipeline{Stages: []Stage{c}, FailOpen: c.FailOpen}
+	p.ServeICAP(w, req)
+}
+
+// Process forwards req to the callout service and returns its verdict
+// as a StageResult, after applying any header changes to req.
+func (c *Callout) Process(req *Request) (StageResult, error) {
+	v, err := c.call(req)
+	if err != nil {
+		return StageResult{}, fmt.Errorf("callout to %s: %v", c.URL, err)
+	}
+	if v.Action == "" {
+		v.Action = "allow"
+	}
+	req.Audit().AddScanResult("callout "+c.URL, v.Action)
+
+	switch v.Action {
+	case "allow":
+		return StageResult{Action: ActionContinue}, nil
+	case "block":
+		return StageResult{Action: ActionBlock, Status: v.Status, Reason: v.Reason}, nil
+	case "modify":
+		h := req.bodyHeader()
+		for k, v := range v.SetHeaders {
+			h.Set(k, v)
+		}
+		for _, k := range v.RemoveHeaders {
+			h.Del(k)
+		}
+		return StageResult{Action: ActionModify}, nil
+	}
+	return StageResult{}, fmt.Errorf("callout to %s: unknown action %q", c.URL, v.Action)
+}
+
+// call sends req to the callout service and decodes its verdict.
+func (c *Callout) call(req *Request) (*CalloutVerdict, error) {
+	msg := CalloutMessage{Method: req.Method}
+	if ip, ok := req.ClientIP(); ok {
+		msg.ClientIP = ip.String()
+	}
+	if r := req.Request; r != nil {
+		msg.URL = r.URL.String()
+		msg.RequestMethod = r.Method
+		msg.RequestHeader = r.Header
+	}
+	if r := req.Response; r != nil {
+		msg.Status = r.StatusCode
+		msg.ResponseHeader = r.Header
+		if msg.URL == "" && r.Request != nil && r.Request.URL != nil {
+			msg.URL = r.Request.URL.String()
+		}
+	}
+	meta, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var body io.Reader = http.NoBody
+	if req.hasBody {
+		memLimit := c.BodyMemory
+		if memLimit <= 0 {
+			memLimit = 1 << 20
+		}
+		bb, err := req.BufferedBody(memLimit)
+		if err != nil {
+			return nil, err
+		}
+		body = io.NewSectionReader(bb, 0, bb.Size())
+	}
+
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL, body)
+	if err != nil {
+		return nil, err
+	}
+	hreq.Header.Set(CalloutMessageHeader, string(meta))
+	hreq.Header.Set("Content-Type", "application/octet-stream")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	v := new(CalloutVerdict)
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		v.Action = "allow"
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("malformed verdict: %v", err)
+		}
+	}
+	return v, nil
+}
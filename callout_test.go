@@ -0,0 +1,80 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCallout(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg CalloutMessage
+		if err := json.Unmarshal([]byte(r.Header.Get(CalloutMessageHeader)), &msg); err != nil {
+			t.Errorf("bad message header: %v", err)
+		}
+		body, _ := io.ReadAll(r.Body)
+		switch {
+		case strings.HasSuffix(msg.URL, "/slow"):
+			time.Sleep(200 * time.Millisecond)
+			w.WriteHeader(http.StatusNoContent)
+		case strings.Contains(string(body), "secret"):
+			json.NewEncoder(w).Encode(CalloutVerdict{Action: "block", Reason: "leak"})
+		case msg.RequestHeader.Get("X-Tag") != "":
+			json.NewEncoder(w).Encode(CalloutVerdict{
+				Action:        "modify",
+				SetHeaders:    map[string]string{"X-Checked": "yes"},
+				RemoveHeaders: []string{"X-Tag"},
+			})
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer api.Close()
+
+	request := func(path, header, body string) string {
+		httpHdr := "POST " + path + " HTTP/1.1\r\nHost: www.example.com\r\n" + header + "\r\n"
+		return "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr +
+			strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+	}
+	c := &Callout{URL: api.URL, Timeout: 50 * time.Millisecond}
+	srv := &Server{Handler: c}
+
+	resp := roundTrip(t, srv, request("/ok", "", "hello"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Errorf("expected 204 for an allowed request:\n%s", resp)
+	}
+
+	resp = roundTrip(t, srv, request("/upload", "", "top secret"))
+	if !strings.Contains(resp, "HTTP/1.1 403 Forbidden\r\n") || !strings.Contains(resp, "leak") {
+		t.Errorf("expected a block page:\n%s", resp)
+	}
+
+	resp = roundTrip(t, srv, request("/tagged", "X-Tag: 1\r\n", "hello"))
+	if !strings.Contains(resp, "X-Checked: yes\r\n") || strings.Contains(resp, "X-Tag") ||
+		!strings.Contains(resp, "\r\n5\r\nhello\r\n") {
+		t.Errorf("expected the modified request with its body:\n%s", resp)
+	}
+
+	resp = roundTrip(t, srv, request("/slow", "", "hello"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 500 ") {
+		t.Errorf("expected 500 when the callout times out:\n%s", resp)
+	}
+	c.FailOpen = true
+	resp = roundTrip(t, srv, request("/slow", "", "hello"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Errorf("expected 204 from a fail-open callout:\n%s", resp)
+	}
+}
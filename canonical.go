@@ -0,0 +1,403 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Putting the URLs of encapsulated requests in canonical form.
+
+package icap
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// defaultPorts are the ports that CanonicalURL removes, by scheme.
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ws":    "80",
+	"wss":   "443",
+	"ftp":   "21",
+}
+
+// CanonicalURL returns a copy of u in canonical form, so that the
+// different ways of writing the same URL match the same policies and
+// are logged alike:
+//
+//   - the scheme and host are lowercased, and the host is converted as by
+//     CanonicalHost;
+//   - the port is removed if it is the default for the scheme;
+//   - percent-escapes of unreserved characters are decoded, and the hex
+//     digits of the others are uppercased;
+//   - "." and ".." path segments are resolved, and an empty path becomes
+//     "/" if there is a host;
+//   - the fragment is removed.
+//
+// The query is left in its original order.
+func CanonicalURL(u *url.URL) *url.URL {
+	c := *u
+	c.Scheme = strings.ToLower(c.Scheme)
+	c.Fragment, c.RawFragment = "", ""
+
+	if c.Host != "" {
+		host, port := c.Hostname(), c.Port()
+		host = CanonicalHost(host)
+		if port == defaultPorts[c.Scheme] {
+			port = ""
+		}
+		switch {
+		case port != "":
+			c.Host = net.JoinHostPort(host, port)
+		case strings.Contains(host, ":"):
+			c.Host = "[" + host + "]"
+		default:
+			c.Host = host
+		}
+	}
+
+	if c.Opaque == "" {
+		p := removeDotSegments(normalizeEscapes(c.EscapedPath()))
+		if p == "" && c.Host != "" {
+			p = "/"
+		}
+		if unescaped, err := url.PathUnescape(p); err == nil {
+			c.Path, c.RawPath = unescaped, p
+		}
+	}
+	c.RawQuery = normalizeEscapes(c.RawQuery)
+	return &c
+}
+
+// CanonicalHost returns host, a host name or IP address without a port,
+// in canonical form: IP addresses in their standard notation, and names
+// lowercased and without a trailing dot, with internationalized labels
+// converted to their ASCII ("xn--") form.
+func CanonicalHost(host string) string {
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return ip.Unmap().String()
+	}
+	host = strings.Map(func(r rune) rune {
+		switch r {
+		case '。', '．', '｡': // ideographic and fullwidth full stops
+			return '.'
+		}
+		return r
+	}, host)
+	host = strings.TrimSuffix(strings.ToLower(norm.NFC.String(host)), ".")
+
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		if encoded, err := punycode(label); err == nil {
+			labels[i] = "xn--" + encoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// UnicodeHost returns host with the labels in ASCII ("xn--") form
+// converted to Unicode, for display or for comparing how names look.
+// Labels that aren't valid Punycode are left alone.
+func UnicodeHost(host string) string {
+	if !strings.Contains(host, "xn--") && !strings.Contains(host, "XN--") {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if len(label) > 4 && strings.EqualFold(label[:4], "xn--") {
+			if decoded, err := unpunycode(label[4:]); err == nil {
+				labels[i] = decoded
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// CanonicalURL returns the URL of the encapsulated HTTP request (the
+// request that a RESPMOD response answers) in canonical form, with the
+// host from its Host header if the request line gave only a path. It
+// returns nil if there is no encapsulated request.
+func (req *Request) CanonicalURL() *url.URL {
+	hr := req.Request
+	if hr == nil && req.Response != nil {
+		hr = req.Response.Request
+	}
+	if hr == nil || hr.URL == nil {
+		return nil
+	}
+	u := *hr.URL
+	if u.Host == "" && hr.Host != "" {
+		u.Host = hr.Host
+		if u.Scheme == "" {
+			u.Scheme = "http"
+		}
+	}
+	return CanonicalURL(&u)
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeEscapes decodes the percent-escapes in s that stand for
+// unreserved characters, and uppercases the hex digits of the rest.
+func normalizeEscapes(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' || i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := unhex(s[i+1])<<4 | unhex(s[i+2])
+		if isUnreserved(c) {
+			b.WriteByte(c)
+		} else {
+			b.WriteString(strings.ToUpper(s[i : i+3]))
+		}
+		i += 2
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c <= '9':
+		return c - '0'
+	case c <= 'F':
+		return c - 'A' + 10
+	}
+	return c - 'a' + 10
+}
+
+// isUnreserved reports whether c is an unreserved character
+// (RFC 3986, section 2.3).
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// removeDotSegments resolves the "." and ".." segments of an escaped
+// path (RFC 3986, section 5.2.4).
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+	segments := strings.Split(p, "/")
+	var out []string
+	for i, s := range segments {
+		last := i == len(segments)-1
+		switch s {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 || len(out) == 1 && out[0] != "" {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, s)
+		}
+	}
+	if strings.HasPrefix(p, "/") && (len(out) == 0 || out[0] != "") {
+		out = append([]string{""}, out...)
+	}
+	return strings.Join(out, "/")
+}
+
+// Parameters of the Punycode encoding (RFC 3492, section 5).
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+)
+
+var (
+	errPunycodeOverflow = errors.New("icap: punycode overflow")
+	errPunycodeInvalid  = errors.New("icap: invalid punycode")
+)
+
+// punycode encodes s with the Punycode algorithm (RFC 3492, section 6.3),
+// without the "xn--" prefix.
+func punycode(s string) (string, error) {
+	runes := []rune(s)
+	var out []byte
+	for _, r := range runes {
+		if r < 0x80 {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	const maxInt = 1<<31 - 1
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled < len(runes) {
+		m := maxInt
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if m-n > (maxInt-delta)/(handled+1) {
+			return "", errPunycodeOverflow
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				if delta++; delta == maxInt {
+					return "", errPunycodeOverflow
+				}
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := k - bias
+				if t < punyTMin {
+					t = punyTMin
+				} else if t > punyTMax {
+					t = punyTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// unpunycode decodes s with the Punycode algorithm (RFC 3492, section
+// 6.2).
+func unpunycode(s string) (string, error) {
+	var out []rune
+	if b := strings.LastIndexByte(s, '-'); b >= 0 {
+		for i := 0; i < b; i++ {
+			if s[i] >= 0x80 {
+				return "", errPunycodeInvalid
+			}
+			out = append(out, rune(s[i]))
+		}
+		s = s[b+1:]
+	}
+
+	const maxInt = 1<<31 - 1
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos := 0; pos < len(s); {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(s) {
+				return "", errPunycodeInvalid
+			}
+			digit := punyDigitValue(s[pos])
+			pos++
+			if digit < 0 {
+				return "", errPunycodeInvalid
+			}
+			if digit > (maxInt-i)/w {
+				return "", errPunycodeOverflow
+			}
+			i += digit * w
+			t := k - bias
+			if t < punyTMin {
+				t = punyTMin
+			} else if t > punyTMax {
+				t = punyTMax
+			}
+			if digit < t {
+				break
+			}
+			if w > maxInt/(punyBase-t) {
+				return "", errPunycodeOverflow
+			}
+			w *= punyBase - t
+		}
+		x := len(out) + 1
+		bias = punyAdapt(i-oldi, x, oldi == 0)
+		if i/x > maxInt-n {
+			return "", errPunycodeOverflow
+		}
+		n += i / x
+		i %= x
+		out = append(out, 0)
+		copy(out[i+1:], out[i:])
+		out[i] = rune(n)
+		i++
+	}
+	return string(out), nil
+}
+
+func punyDigitValue(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c-'0') + 26
+	case 'a' <= c && c <= 'z':
+		return int(c - 'a')
+	case 'A' <= c && c <= 'Z':
+		return int(c - 'A')
+	}
+	return -1
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+// punyAdapt is the bias adaptation function (RFC 3492, section 6.1).
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > (punyBase-punyTMin)*punyTMax/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
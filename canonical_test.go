@@ -0,0 +1,73 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"HTTP://WWW.Example.COM:80/a/./b/../c?q=%7e%2f#frag", "http://www.example.com/a/c?q=~%2F"},
+		{"https://example.com:443", "https://example.com/"},
+		{"https://example.com:8443/", "https://example.com:8443/"},
+		{"http://example.com./%7Euser/%e2%82%ac", "http://example.com/~user/%E2%82%AC"},
+		{"http://example.com/a/b/..", "http://example.com/a/"},
+		{"http://example.com/../../x", "http://example.com/x"},
+		{"http://bücher.example/", "http://xn--bcher-kva.example/"},
+		{"http://日本語。JP/", "http://xn--wgv71a119e.jp/"},
+		{"http://[::FFFF:192.0.2.1]:80/", "http://192.0.2.1/"},
+		{"http://[2001:DB8::1]:8080/", "http://[2001:db8::1]:8080/"},
+	} {
+		u, err := url.Parse(tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := CanonicalURL(u).String(); got != tt.want {
+			t.Errorf("CanonicalURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPunycode(t *testing.T) {
+	// Examples from RFC 3492, section 7.1.
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+		{"MajiでKoiする5秒前", "MajiKoi5-783gue6qz075azm5e"},
+		{"パフィーdeルンバ", "de-jg4avhby1noc0d"},
+	} {
+		if got, err := punycode(tt.in); err != nil || got != tt.want {
+			t.Errorf("punycode(%q) = %q, %v; want %q", tt.in, got, err, tt.want)
+		}
+		if got, err := unpunycode(tt.want); err != nil || got != tt.in {
+			t.Errorf("unpunycode(%q) = %q, %v; want %q", tt.want, got, err, tt.in)
+		}
+	}
+}
+
+func TestRequestCanonicalURL(t *testing.T) {
+	httpReq, _ := http.NewRequest("GET", "/Path/./x", nil)
+	httpReq.Host = "WWW.Example.com:80"
+	req := &Request{Method: "REQMOD", Request: httpReq}
+	if got := req.CanonicalURL().String(); got != "http://www.example.com/Path/x" {
+		t.Errorf("CanonicalURL = %q", got)
+	}
+}
+
+func TestUnicodeHost(t *testing.T) {
+	if got := UnicodeHost("www.XN--bcher-kva.example"); got != "www.bücher.example" {
+		t.Errorf("UnicodeHost = %q", got)
+	}
+	if got := UnicodeHost("xn--!!.example"); got != "xn--!!.example" {
+		t.Errorf("UnicodeHost of invalid label = %q", got)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Parsing the capabilities advertised in OPTIONS responses.
+
+package icap
+
+import (
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capabilities describes an ICAP service as advertised by the headers
+// of its OPTIONS response (RFC 3507, section 4.10.2).
+type Capabilities struct {
+	Methods   []string // methods the service supports, including extensions
+	Service   string   // description of the service
+	ISTag     string   // the service tag, including its quotes
+	ServiceID string   // short identifier of the service
+	Allow     []string // optional features, such as "204"
+
+	// Preview is the number of preview bytes the service wants,
+	// or -1 if it doesn't advertise support for previews.
+	Preview int
+
+	// The file extensions for which the client should send a preview,
+	// send nothing, or send the complete body. An entry of "*" stands
+	// for all extensions not listed elsewhere.
+	TransferPreview  []string
+	TransferIgnore   []string
+	TransferComplete []string
+
+	// MaxConnections is the number of connections the service accepts
+	// from a client, or 0 if it doesn't say.
+	MaxConnections int
+
+	// TTL is how long the capabilities remain valid, or 0 if the
+	// service doesn't say.
+	TTL time.Duration
+
+	// OptBodyType is the format of the opt-body of the response,
+	// from its Opt-body-type header.
+	OptBodyType string
+
+	// Extensions holds the headers that RFC 3507 doesn't define, such
+	// as vendor-specific headers reporting license status.
+	Extensions textproto.MIMEHeader
+}
+
+// standardOptionsHeaders lists the headers of an OPTIONS response
+// that are defined by RFC 3507 or are general ICAP headers.
+var standardOptionsHeaders = map[string]bool{
+	"Allow":             true,
+	"Cache-Control":     true,
+	"Connection":        true,
+	"Date":              true,
+	"Encapsulated":      true,
+	"Expires":           true,
+	"Istag":             true,
+	"Max-Connections":   true,
+	"Methods":           true,
+	"Opt-Body-Type":     true,
+	"Options-Ttl":       true,
+	"Pragma":            true,
+	"Preview":           true,
+	"Service":           true,
+	"Server":            true,
+	"Service-Id":        true,
+	"Trailer":           true,
+	"Transfer-Complete": true,
+	"Transfer-Ignore":   true,
+	"Transfer-Preview":  true,
+	"Upgrade":           true,
+}
+
+// ParseCapabilities parses the headers of an OPTIONS response.
+// A malformed numeric header yields an error, but the other fields
+// are still filled in.
+func ParseCapabilities(h textproto.MIMEHeader) (*Capabilities, error) {
+	c := &Capabilities{
+		Methods:          splitList(h, "Methods"),
+		Service:          h.Get("Service"),
+		ISTag:            h.Get("ISTag"),
+		ServiceID:        h.Get("Service-ID"),
+		Allow:            splitList(h, "Allow"),
+		Preview:          -1,
+		TransferPreview:  splitList(h, "Transfer-Preview"),
+		TransferIgnore:   splitList(h, "Transfer-Ignore"),
+		TransferComplete: splitList(h, "Transfer-Complete"),
+		OptBodyType:      h.Get("Opt-body-type"),
+		Extensions:       make(textproto.MIMEHeader),
+	}
+	for k, vv := range h {
+		if !standardOptionsHeaders[textproto.CanonicalMIMEHeaderKey(k)] {
+			c.Extensions[k] = append([]string(nil), vv...)
+		}
+	}
+
+	var firstErr error
+	number := func(name string) int {
+		v := strings.TrimSpace(h.Get(name))
+		if v == "" {
+			return -1
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("icap: malformed %s header %q", name, v)
+			}
+			return -1
+		}
+		return n
+	}
+	c.Preview = number("Preview")
+	if n := number("Max-Connections"); n > 0 {
+		c.MaxConnections = n
+	}
+	if n := number("Options-TTL"); n > 0 {
+		c.TTL = time.Duration(n) * time.Second
+	}
+	return c, firstErr
+}
+
+// Capabilities parses the headers of r, which should be a response
+// to an OPTIONS request.
+func (r *Response) Capabilities() (*Capabilities, error) {
+	return ParseCapabilities(r.Header)
+}
+
+// AllowsFeature reports whether the service listed feature,
+// such as "204", in its Allow header.
+func (c *Capabilities) AllowsFeature(feature string) bool {
+	for _, f := range c.Allow {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList returns the elements of the comma-separated lists in
+// all the values of the named header, without surrounding whitespace.
+func splitList(h textproto.MIMEHeader, name string) []string {
+	var list []string
+	for _, v := range h.Values(name) {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,117 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package charset detects the character encoding of text bodies and
+// converts them to UTF-8 and back, so that transformers that work on
+// UTF-8 text don't corrupt pages in legacy encodings.
+package charset
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"regexp"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// sniffLen is the number of bytes at the start of a body that are searched
+// for a byte order mark or a declaration of the encoding.
+const sniffLen = 1024
+
+var (
+	metaCharset = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([a-z0-9_:.-]+)`)
+	xmlEncoding = regexp.MustCompile(`^<\?xml[^>]+encoding\s*=\s*["']([a-zA-Z0-9_:.-]+)`)
+)
+
+// Detect returns the encoding of a text body and its name in the WHATWG
+// Encoding Standard, such as "windows-1252". It looks at, in order, a byte
+// order mark at the start of head (the first bytes of the body), the
+// charset parameter of contentType, and an HTML meta element or XML
+// declaration in head. If none of them names a known encoding, the body is
+// taken to be UTF-8.
+func Detect(contentType string, head []byte) (enc encoding.Encoding, name string) {
+	switch {
+	case bytes.HasPrefix(head, []byte("\xef\xbb\xbf")):
+		return unicode.UTF8, "utf-8"
+	case bytes.HasPrefix(head, []byte("\xfe\xff")):
+		return lookup("utf-16be")
+	case bytes.HasPrefix(head, []byte("\xff\xfe")):
+		return lookup("utf-16le")
+	}
+
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		if enc, name := lookup(params["charset"]); enc != nil {
+			return enc, name
+		}
+	}
+
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	for _, re := range []*regexp.Regexp{metaCharset, xmlEncoding} {
+		if m := re.FindSubmatch(head); m != nil {
+			if enc, name := lookup(string(m[1])); enc != nil {
+				// A document that could be read as ASCII to find the
+				// declaration can't really be UTF-16.
+				if name == "utf-16be" || name == "utf-16le" {
+					return unicode.UTF8, "utf-8"
+				}
+				return enc, name
+			}
+		}
+	}
+	return unicode.UTF8, "utf-8"
+}
+
+// lookup returns the encoding with the given label, or nil if the label
+// is unknown.
+func lookup(label string) (encoding.Encoding, string) {
+	if label == "" {
+		return nil, ""
+	}
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return nil, ""
+	}
+	name, _ := htmlindex.Name(enc)
+	return enc, name
+}
+
+// NewReader returns a reader that converts the body read from r to UTF-8,
+// detecting its encoding with Detect, and the name of the encoding.
+// UTF-8 bodies are passed through unchanged, even if they contain
+// invalid bytes.
+func NewReader(r io.Reader, contentType string) (io.Reader, string) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(sniffLen)
+	enc, name := Detect(contentType, head)
+	if name == "utf-8" {
+		return br, name
+	}
+	return transform.NewReader(br, enc.NewDecoder()), name
+}
+
+// NewWriter returns a writer that converts UTF-8 text to the named
+// encoding and writes it to w. Characters that the encoding can't
+// represent are written as HTML numeric character references where
+// possible. It must be closed to flush the conversion; closing it doesn't
+// close w. If the encoding is UTF-8 or unknown, text is written unchanged.
+func NewWriter(w io.Writer, name string) io.WriteCloser {
+	enc, name := lookup(name)
+	if enc == nil || name == "utf-8" {
+		return nopCloser{w}
+	}
+	return transform.NewWriter(w, encoding.HTMLEscapeUnsupported(enc.NewEncoder()))
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,124 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package charset
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/intra-sh/icap"
+	"github.com/intra-sh/icap/icaptest"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestDetect(t *testing.T) {
+	for _, c := range []struct {
+		contentType, head, want string
+	}{
+		{"text/html", "<p>hello", "utf-8"},
+		{"text/html; charset=ISO-8859-1", "<p>hello", "windows-1252"},
+		{"text/html; charset=shift_jis", "\xef\xbb\xbf<p>", "utf-8"},
+		{"text/html", "\xff\xfe<\x00p\x00", "utf-16le"},
+		{"text/html", `<html><head><meta http-equiv="Content-Type" content="text/html; charset=koi8-r">`, "koi8-r"},
+		{"text/html", `<meta charset='euc-kr'>`, "euc-kr"},
+		{"text/html", `<meta charset="utf-16">`, "utf-8"},
+		{"application/xhtml+xml", `<?xml version="1.0" encoding="windows-1251"?>`, "windows-1251"},
+		{"text/html; charset=bogus", "<p>", "utf-8"},
+	} {
+		if _, name := Detect(c.contentType, []byte(c.head)); name != c.want {
+			t.Errorf("Detect(%q, %q) = %s, want %s", c.contentType, c.head, name, c.want)
+		}
+	}
+}
+
+func TestUTF8(t *testing.T) {
+	upper := icap.TransformerFunc(func(dst io.Writer, src io.Reader) error {
+		b, err := io.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(bytes.ToUpper(b))
+		return err
+	})
+
+	in, _ := charmap.Windows1252.NewEncoder().String("<p>crème brûlée €")
+	var out bytes.Buffer
+	if err := UTF8("text/html; charset=windows-1252", upper).Transform(&out, strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := charmap.Windows1252.NewEncoder().String("<P>CRÈME BRÛLÉE €")
+	if out.String() != want {
+		t.Errorf("windows-1252 output = %q, want %q", out.String(), want)
+	}
+
+	in, _ = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String("<p>héllo")
+	out.Reset()
+	if err := UTF8("text/html", upper).Transform(&out, strings.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	want, _ = unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String("<P>HÉLLO")
+	if out.String() != want {
+		t.Errorf("UTF-16 output = %q, want %q", out.String(), want)
+	}
+
+	// Characters the encoding lacks become character references.
+	w := NewWriter(&out, "iso-8859-2")
+	out.Reset()
+	io.WriteString(w, "ł☃")
+	w.Close()
+	if out.String() != "\xb3&#9731;" {
+		t.Errorf("ISO-8859-2 output = %q", out.String())
+	}
+
+	// Invalid UTF-8 is left alone.
+	out.Reset()
+	copyBody := icap.TransformerFunc(func(dst io.Writer, src io.Reader) error {
+		_, err := io.Copy(dst, src)
+		return err
+	})
+	if err := UTF8("text/plain", copyBody).Transform(&out, strings.NewReader("a\xffb")); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "a\xffb" {
+		t.Errorf("UTF-8 output = %q", out.String())
+	}
+}
+
+func TestTransformStageCompressed(t *testing.T) {
+	upper := icap.TransformerFunc(func(dst io.Writer, src io.Reader) error {
+		b, err := io.ReadAll(src)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(bytes.ToUpper(b))
+		return err
+	})
+	srv := &icap.Server{Handler: &icap.Pipeline{Stages: []icap.Stage{&TransformStage{Transformer: upper}}}}
+
+	latin1, _ := charmap.ISO8859_1.NewEncoder().String("crème brûlée")
+	want, _ := charmap.ISO8859_1.NewEncoder().String("CRÈME BRÛLÉE")
+	for _, coding := range []string{"br", "zstd"} {
+		body := icaptest.Encode(t, coding, latin1)
+		httpHdr := "HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+			"Content-Encoding: " + coding + "\r\n" +
+			"\r\n"
+		resp := icaptest.RoundTrip(t, srv, "RESPMOD icap://icap.example.net/charset ICAP/1.0\r\n"+
+			"Host: icap.example.net\r\n"+
+			"Encapsulated: res-hdr=0, res-body="+strconv.Itoa(len(httpHdr))+"\r\n"+
+			"\r\n"+httpHdr+
+			strconv.FormatInt(int64(len(body)), 16)+"\r\n"+body+"\r\n0\r\n\r\n")
+		if strings.Contains(resp, "Content-Encoding") {
+			t.Errorf("%s: Content-Encoding kept after decompression:\n%s", coding, resp)
+		}
+		if got := icaptest.Unchunk(t, resp); got != want {
+			t.Errorf("%s: body = %q, want %q", coding, got, want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Transformers that work on UTF-8 text.
+
+package charset
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/intra-sh/icap"
+)
+
+// UTF8 returns a Transformer for bodies with the given Content-Type that
+// runs t on the body converted to UTF-8, and converts t's output back to
+// the body's encoding.
+func UTF8(contentType string, t icap.Transformer) icap.Transformer {
+	return icap.TransformerFunc(func(dst io.Writer, src io.Reader) error {
+		r, name := NewReader(src, contentType)
+		w := NewWriter(dst, name)
+		if err := t.Transform(w, r); err != nil {
+			return err
+		}
+		return w.Close()
+	})
+}
+
+// A TransformStage is like icap.TransformStage, but Transformer works on
+// UTF-8 text, whatever the encoding of the body.
+type TransformStage struct {
+	Transformer icap.Transformer
+
+	// Types lists the media types to transform, such as "text/html".
+	// An entry such as "text/*" matches all subtypes. If Types is empty,
+	// every body is transformed.
+	Types []string
+}
+
+// Process applies the transformer to the body of req, if it matches.
+func (s *TransformStage) Process(req *icap.Request) (icap.StageResult, error) {
+	var h http.Header
+	switch {
+	case req.Method == "REQMOD" && req.Request != nil:
+		h = req.Request.Header
+	case req.Method == "RESPMOD" && req.Response != nil:
+		h = req.Response.Header
+	default:
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	if !icap.CanDecompress(h) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	contentType := h.Get("Content-Type")
+	if !icap.MatchMediaType(contentType, s.Types) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	if _, err := req.DecompressBody(); err != nil {
+		return icap.StageResult{}, err
+	}
+	if !req.TransformBody(UTF8(contentType, s.Transformer)) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	return icap.StageResult{Action: icap.ActionModify}, nil
+}
@@ -9,6 +9,7 @@ package icap
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -24,7 +25,7 @@ var errLineTooLong = errors.New("header line too long")
 //
 // NewChunkedReader is not needed by normal applications. The http package
 // automatically decodes chunking when reading response bodies.
-func newChunkedReader(r io.Reader) io.Reader {
+func newChunkedReader(r io.Reader) *chunkedReader {
 	br, ok := r.(*bufio.Reader)
 	if !ok {
 		br = bufio.NewReader(r)
@@ -33,24 +34,48 @@ func newChunkedReader(r io.Reader) io.Reader {
 }
 
 type chunkedReader struct {
-	r   *bufio.Reader
-	n   uint64 // unread bytes in chunk
-	err error
-	buf [2]byte
+	r    *bufio.Reader
+	n    uint64 // unread bytes in chunk
+	err  error
+	buf  [2]byte
+	ieof bool // the last chunk carried the ICAP "ieof" extension
+
+	stats *parserStats // records the chunk sizes, if not nil
+
+	looseIEOF bool // see CompatProfile.LooseIEOF
+	sawIEOF   bool // a chunk of data carried ieof (with looseIEOF)
 }
 
 func (cr *chunkedReader) beginChunk() {
-	// chunk-size CRLF
+	// chunk-size [; chunk-ext] CRLF
 	var line []byte
 	line, cr.err = readLine(cr.r)
 	if cr.err != nil {
 		return
 	}
+	var ext []byte
+	if i := bytes.IndexByte(line, ';'); i != -1 {
+		line, ext = trimTrailingWhitespace(line[:i]), line[i+1:]
+	}
 	cr.n, cr.err = parseHexUint(line)
 	if cr.err != nil {
 		return
 	}
+	if cr.n > 0 {
+		cr.stats.chunk(cr.n)
+		cr.sawIEOF = cr.sawIEOF || cr.looseIEOF && isIEOF(ext, true)
+	}
 	if cr.n == 0 {
+		cr.ieof = cr.sawIEOF || isIEOF(ext, cr.looseIEOF)
+		// Skip the trailer, up to and including the final CRLF.
+		for {
+			if line, cr.err = readLine(cr.r); cr.err != nil {
+				return
+			}
+			if len(line) == 0 {
+				break
+			}
+		}
 		cr.err = io.EOF
 	}
 }
@@ -0,0 +1,687 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Sending ICAP requests.
+
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intra-sh/icap/icaptrace"
+)
+
+// A Client sends ICAP requests to a server. Each call to Do uses a new
+// connection, which is closed when the response has been read.
+// The zero value is a usable client without timeouts.
+type Client struct {
+	// DialContext, if not nil, is used to open connections.
+	// Otherwise a net.Dialer is used.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// ConnectTimeout limits the time taken to open a connection.
+	ConnectTimeout time.Duration
+
+	// ResponseHeaderTimeout limits the time spent waiting for the server's
+	// response header, including a 100 Continue after a preview,
+	// once the request header (and preview) has been written.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleTimeout limits the time spent writing or reading
+	// each chunk of an encapsulated body.
+	IdleTimeout time.Duration
+
+	// Backends, if not nil, chooses the server to connect to,
+	// instead of the host in the request URL.
+	Backends *Backends
+
+	// Dialect formats requests and parses the Encapsulated headers of
+	// responses. If nil, StrictDialect is used.
+	Dialect Dialect
+
+	// Signer, if not nil, signs each request (see SignatureVerifier).
+	Signer *RequestSigner
+
+	// Compression, if not nil, is offered to the server, to compress
+	// encapsulated bodies on the wire (see TransportCompression).
+	Compression *TransportCompression
+}
+
+func (c *Client) dialect() Dialect {
+	if c.Dialect == nil {
+		return StrictDialect{}
+	}
+	return c.Dialect
+}
+
+// DefaultClient is the Client used by Do.
+var DefaultClient = &Client{}
+
+// A Response represents the response to an ICAP request sent by a Client.
+type Response struct {
+	Status     string // e.g. "200 OK"
+	StatusCode int    // e.g. 200
+	Proto      string // e.g. "ICAP/1.0"
+	Header     textproto.MIMEHeader
+
+	// The encapsulated HTTP messages. The body of the message, if any,
+	// streams from the connection; closing it closes the connection.
+	Request  *http.Request
+	Response *http.Response
+
+	// OptBody is the body of an OPTIONS response (an opt-body section),
+	// or nil if there is none. Closing it closes the connection.
+	OptBody io.ReadCloser
+
+	received time.Time // when the response header was read
+}
+
+// OptionsExpiry returns the time when the capabilities in an OPTIONS
+// response expire, according to its Options-TTL header. The TTL counts
+// from when the response arrived, not from its Date header, so that
+// the expiry is not skewed by a difference between the clocks of the
+// client and the server. ok is false if there is no valid Options-TTL.
+func (r *Response) OptionsExpiry() (expiry time.Time, ok bool) {
+	ttl, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get("Options-TTL")), 10, 64)
+	if err != nil || ttl < 0 {
+		return time.Time{}, false
+	}
+	return r.received.Add(time.Duration(ttl) * time.Second), true
+}
+
+// NewRequest returns a Request for a client to send to the ICAP service
+// at urlStr. For REQMOD, httpReq is the message to adapt; for RESPMOD,
+// httpResp is, and httpReq may be the request that it answers.
+// To send a preview, set the Preview header to the number of body bytes
+// to include in it.
+func NewRequest(method, urlStr string, httpReq *http.Request, httpResp *http.Response) (*Request, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icap" || u.Host == "" {
+		return nil, &badStringError{"unsupported ICAP URL", urlStr}
+	}
+	return &Request{
+		Method:   method,
+		RawURL:   urlStr,
+		URL:      u,
+		Proto:    "ICAP/1.0",
+		Header:   make(textproto.MIMEHeader),
+		Request:  httpReq,
+		Response: httpResp,
+	}, nil
+}
+
+// Do sends req using DefaultClient.
+func Do(ctx context.Context, req *Request) (*Response, error) {
+	return DefaultClient.Do(ctx, req)
+}
+
+// Do sends req and returns the server's response.
+// If ctx is canceled or times out, dialing, writing the request and reading
+// the response (including the body of an encapsulated message) are aborted
+// and the context's error is returned.
+// The hooks of an icaptrace.ClientTrace in ctx are called as the
+// transaction progresses.
+func (c *Client) Do(ctx context.Context, req *Request) (*Response, error) {
+	if req.URL == nil {
+		return nil, errors.New("icap: request has no URL")
+	}
+	cc, err := c.open(ctx, req.URL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cc.roundTrip(req)
+	if err != nil {
+		err = contextError(ctx, err)
+		cc.finish(err)
+		return nil, err
+	}
+	return resp, nil
+}
+
+// open connects to the service at u for a transaction.
+func (c *Client) open(ctx context.Context, u *url.URL) (*clientConn, error) {
+	trace := icaptrace.ContextClientTrace(ctx)
+	rwc, release, err := c.dial(ctx, u)
+	if err != nil {
+		err = contextError(ctx, err)
+		if trace != nil && trace.Done != nil {
+			trace.Done(icaptrace.DoneInfo{Err: err})
+		}
+		return nil, err
+	}
+	if trace != nil && trace.GotConn != nil {
+		trace.GotConn(icaptrace.GotConnInfo{Conn: rwc})
+	}
+
+	cc := &clientConn{
+		ctx:     ctx,
+		rwc:     rwc,
+		client:  c,
+		trace:   trace,
+		release: release,
+		br:      bufio.NewReader(rwc),
+		bw:      bufio.NewWriter(rwc),
+	}
+	cc.stop = context.AfterFunc(ctx, cc.cancel)
+	return cc, nil
+}
+
+// dial opens a connection for a transaction with the service at u.
+// The release function must be called when the transaction is over.
+func (c *Client) dial(ctx context.Context, u *url.URL) (rwc net.Conn, release func(), err error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "1344")
+	}
+	release = func() {}
+	if c.Backends != nil {
+		if addr, release, err = c.Backends.acquire(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.ConnectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.ConnectTimeout)
+		defer cancel()
+	}
+	if c.DialContext != nil {
+		rwc, err = c.DialContext(ctx, "tcp", addr)
+	} else {
+		var d net.Dialer
+		rwc, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return rwc, release, nil
+}
+
+// contextError returns the context's error instead of err
+// if err was caused by canceling ctx.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("icap: %w (%v)", ctxErr, err)
+	}
+	return err
+}
+
+// aLongTimeAgo is a deadline in the past, used to abort blocked I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// A clientConn is the connection used for a single client transaction.
+type clientConn struct {
+	ctx     context.Context
+	rwc     net.Conn
+	client  *Client
+	trace   *icaptrace.ClientTrace
+	br      *bufio.Reader
+	bw      *bufio.Writer
+	stop    func() bool // stops the context's cancellation hook
+	release func()      // ends the transaction for the client's Backends
+
+	gotFirstByte bool // the server has started responding
+
+	mu       sync.Mutex
+	canceled bool
+	closed   bool
+}
+
+// cancel aborts any I/O on the connection.
+func (cc *clientConn) cancel() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.canceled = true
+	cc.rwc.SetDeadline(aLongTimeAgo)
+}
+
+// setReadTimeout sets the read deadline d from now, or clears it
+// if d is zero, unless the transaction has been canceled.
+func (cc *clientConn) setReadTimeout(d time.Duration) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.canceled {
+		cc.rwc.SetReadDeadline(deadline(d))
+	}
+}
+
+// setWriteTimeout is like setReadTimeout for the write deadline.
+func (cc *clientConn) setWriteTimeout(d time.Duration) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if !cc.canceled {
+		cc.rwc.SetWriteDeadline(deadline(d))
+	}
+}
+
+func deadline(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func (cc *clientConn) close() error {
+	return cc.finish(nil)
+}
+
+// finish closes the connection, ending the transaction with err.
+func (cc *clientConn) finish(err error) error {
+	cc.mu.Lock()
+	if cc.closed {
+		cc.mu.Unlock()
+		return nil
+	}
+	cc.closed = true
+	cc.stop()
+	closeErr := cc.rwc.Close()
+	cc.mu.Unlock()
+	cc.release()
+
+	if cc.trace != nil && cc.trace.Done != nil {
+		cc.trace.Done(icaptrace.DoneInfo{Err: err})
+	}
+	return closeErr
+}
+
+func (cc *clientConn) roundTrip(req *Request) (*Response, error) {
+	raw := &RawRequest{
+		Method:        req.Method,
+		URL:           req.URL,
+		Header:        req.Header,
+		ContentLength: -1,
+	}
+	var err error
+	if req.Request != nil {
+		if raw.RequestHeader, err = httpRequestHeader(req.Request, nil, true); err != nil {
+			return nil, err
+		}
+	}
+	if req.Response != nil {
+		if raw.ResponseHeader, err = httpResponseHeader(req.Response, nil); err != nil {
+			return nil, err
+		}
+	}
+	if p := req.bodyPtr(); p != nil && *p != nil && *p != http.NoBody {
+		raw.Body = *p
+	}
+
+	rr, err := cc.roundTripRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	return cc.parseResponse(req, rr)
+}
+
+// roundTripRaw sends req and reads the response header. If Body is an
+// io.Closer, it is closed.
+func (cc *clientConn) roundTripRaw(req *RawRequest) (*RawResponse, error) {
+	reqHdr, respHdr := req.RequestHeader, req.ResponseHeader
+	var err error
+
+	body := req.Body
+	if c, ok := body.(io.Closer); ok {
+		defer c.Close()
+	}
+	if req.ContentLength == 0 {
+		body = nil
+	}
+	if s := cc.client.Signer; s != nil {
+		signed := *req
+		if body, err = s.signBody(&signed, body); err != nil {
+			return nil, err
+		}
+		req = &signed
+	}
+
+	// Build the Encapsulated header.
+	var encap []Section
+	offset := 0
+	if reqHdr != nil {
+		encap = append(encap, Section{"req-hdr", 0})
+		offset = len(reqHdr)
+	}
+	if respHdr != nil {
+		encap = append(encap, Section{"res-hdr", offset})
+		offset += len(respHdr)
+	}
+	switch {
+	case body == nil:
+		encap = append(encap, Section{"null-body", offset})
+	case req.Method == "REQMOD":
+		encap = append(encap, Section{"req-body", offset})
+	case req.Method == "OPTIONS":
+		encap = append(encap, Section{"opt-body", offset})
+	default:
+		encap = append(encap, Section{"res-body", offset})
+	}
+
+	header := make(textproto.MIMEHeader, len(req.Header)+2)
+	for k, v := range req.Header {
+		header[k] = v
+	}
+	if header.Get("Host") == "" {
+		header.Set("Host", req.URL.Host)
+	}
+	header.Set("Encapsulated", cc.client.dialect().FormatEncapsulated(encap))
+	if z := cc.client.Compression; z != nil {
+		header.Set(CompressionHeader, z.token())
+	}
+
+	preview := -1
+	if body != nil {
+		if p := header.Get("Preview"); p != "" {
+			if preview, err = strconv.Atoi(p); err != nil || preview < 0 {
+				return nil, &badStringError{"invalid Preview header", p}
+			}
+		}
+	} else {
+		header.Del("Preview")
+	}
+
+	cc.setWriteTimeout(cc.client.IdleTimeout)
+	fmt.Fprintf(cc.bw, "%s %s ICAP/1.0\r\n", req.Method, req.URL)
+	http.Header(header).Write(cc.bw)
+	cc.bw.WriteString("\r\n")
+	cc.bw.Write(reqHdr)
+	cc.bw.Write(respHdr)
+	if cc.trace != nil && cc.trace.WroteHeaders != nil {
+		cc.trace.WroteHeaders()
+	}
+
+	if body == nil {
+		if err := cc.bw.Flush(); err != nil {
+			return nil, err
+		}
+		return cc.readResponse()
+	}
+
+	if preview < 0 {
+		if err := cc.writeBody(body, req.ContentLength, nil); err != nil {
+			return nil, err
+		}
+		return cc.readResponse()
+	}
+
+	buf := make([]byte, preview)
+	n, err := io.ReadFull(body, buf)
+	ieof := err == io.EOF || err == io.ErrUnexpectedEOF || int64(n) == req.ContentLength
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	if n > 0 {
+		fmt.Fprintf(cc.bw, "%x\r\n", n)
+		cc.bw.Write(buf[:n])
+		cc.bw.WriteString("\r\n")
+	}
+	if ieof {
+		cc.bw.WriteString("0; ieof\r\n\r\n")
+	} else {
+		cc.bw.WriteString("0\r\n\r\n")
+	}
+	if err := cc.bw.Flush(); err != nil {
+		return nil, err
+	}
+
+	if cc.trace != nil && cc.trace.PreviewSent != nil {
+		cc.trace.PreviewSent(n, ieof)
+	}
+
+	resp, err := cc.readResponse()
+	if err != nil || resp.StatusCode != StatusContinue {
+		return resp, err
+	}
+	if ieof {
+		return nil, errors.New("icap: server sent 100 Continue after a complete preview")
+	}
+	if cc.trace != nil && cc.trace.Got100Continue != nil {
+		cc.trace.Got100Continue()
+	}
+	length := req.ContentLength
+	if length > 0 {
+		length -= int64(n)
+	}
+	var z *TransportCompression
+	if cc.client.Compression.accepts(resp.Header.Get(CompressionHeader)) {
+		z = cc.client.Compression
+	}
+	if err := cc.writeBody(body, length, z); err != nil {
+		return nil, err
+	}
+	return cc.readResponse()
+}
+
+// writeBody writes the rest of body in chunked encoding. If length is not
+// negative, it is the length of the rest of the body, which is sent as a
+// single chunk. If z is not nil, the body is compressed with it, in
+// chunks of unknown length.
+func (cc *clientConn) writeBody(body io.Reader, length int64, z *TransportCompression) error {
+	buf := make([]byte, 32*1024)
+	var cw io.WriteCloser = NewChunkedWriter(cc.bw)
+	if z != nil {
+		cw = z.newWriter(cw)
+	}
+	oneChunk := length >= 0 && z == nil
+	if length >= 0 {
+		if length > 0 && oneChunk {
+			fmt.Fprintf(cc.bw, "%x\r\n", length)
+		}
+		body = io.LimitReader(body, length)
+	}
+	var written int64
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			cc.setWriteTimeout(cc.client.IdleTimeout)
+			if oneChunk {
+				_, err = cc.bw.Write(buf[:n])
+			} else {
+				_, err = cw.Write(buf[:n])
+			}
+			if err != nil {
+				return err
+			}
+			if err := cc.bw.Flush(); err != nil {
+				return err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	cc.setWriteTimeout(cc.client.IdleTimeout)
+	if length >= 0 {
+		if written < length {
+			return fmt.Errorf("icap: body is %d bytes shorter than ContentLength", length-written)
+		}
+		if length > 0 && oneChunk {
+			cc.bw.WriteString("\r\n")
+		}
+	}
+	if err := cw.Close(); err != nil {
+		return err
+	}
+	cc.bw.WriteString("\r\n")
+	return cc.bw.Flush()
+}
+
+// readResponse reads an ICAP response header and the encapsulated HTTP
+// headers. If there is no encapsulated body, the connection is closed.
+func (cc *clientConn) readResponse() (*RawResponse, error) {
+	cc.setReadTimeout(cc.client.ResponseHeaderTimeout)
+	if !cc.gotFirstByte {
+		if _, err := cc.br.Peek(1); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		cc.gotFirstByte = true
+		if cc.trace != nil && cc.trace.FirstResponseByte != nil {
+			cc.trace.FirstResponseByte()
+		}
+	}
+	resp, err := readRawResponse(cc.br, cc.client.dialect())
+	if err != nil || resp.StatusCode == StatusContinue {
+		return resp, err
+	}
+	cc.setReadTimeout(0)
+
+	if resp.BodySection == "" {
+		cc.close()
+	} else {
+		var r io.Reader = newChunkedReader(cc.br)
+		if cc.client.Compression.accepts(resp.Header.Get(CompressionHeader)) {
+			r = cc.client.Compression.newReader(r)
+		}
+		resp.Body = &clientBody{cc: cc, r: r}
+	}
+	return resp, nil
+}
+
+// readRawResponse reads an ICAP response header, and the encapsulated
+// HTTP headers unless it is a 100 Continue, from br.
+func readRawResponse(br *bufio.Reader, d Dialect) (*RawResponse, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 2 || !strings.HasPrefix(f[0], "ICAP/") {
+		return nil, &badStringError{"malformed ICAP response", line}
+	}
+	resp := &RawResponse{Proto: f[0], Status: strings.Join(f[1:], " ")}
+	if resp.StatusCode, err = strconv.Atoi(f[1]); err != nil || len(f[1]) != 3 {
+		return nil, &badStringError{"malformed ICAP status code", f[1]}
+	}
+	if resp.Header, err = tp.ReadMIMEHeader(); err != nil {
+		return nil, err
+	}
+	resp.received = time.Now()
+	if resp.StatusCode == StatusContinue {
+		return resp, nil
+	}
+
+	e := encapsulation{}
+	if s := resp.Header.Get("Encapsulated"); s != "" {
+		if e, err = parseEncapsulated(d, s, nil); err != nil {
+			return nil, err
+		}
+	}
+	if resp.RequestHeader, resp.ResponseHeader, err = e.readHeaders(br); err != nil {
+		return nil, err
+	}
+
+	resp.BodySection = e.body
+	return resp, nil
+}
+
+// parseResponse parses the encapsulated HTTP headers of the response to req.
+func (cc *clientConn) parseResponse(req *Request, rr *RawResponse) (*Response, error) {
+	resp, err := newResponse(req, rr)
+	if err != nil {
+		return nil, err
+	}
+	if rr.Body != nil && resp.Request == nil && resp.Response == nil && resp.OptBody == nil {
+		// A body without an HTTP message has nowhere to go.
+		if _, err := io.Copy(io.Discard, rr.Body); err != nil {
+			return nil, err
+		}
+		cc.close()
+	}
+	return resp, nil
+}
+
+// newResponse parses the encapsulated HTTP headers of rr, the response to
+// req (which may be nil), and attaches its body to the message it belongs to.
+func newResponse(req *Request, rr *RawResponse) (*Response, error) {
+	resp := &Response{
+		Status:     rr.Status,
+		StatusCode: rr.StatusCode,
+		Proto:      rr.Proto,
+		Header:     rr.Header,
+		received:   rr.received,
+	}
+	reqHdr, respHdr := rr.RequestHeader, rr.ResponseHeader
+
+	var body io.ReadCloser = http.NoBody
+	if rr.Body != nil {
+		body = rr.Body
+	}
+	var err error
+	if reqHdr != nil {
+		if resp.Request, err = http.ReadRequest(bufio.NewReader(bytes.NewReader(reqHdr))); err != nil {
+			return nil, fmt.Errorf("error while parsing HTTP request: %v", err)
+		}
+		resp.Request.Body = http.NoBody
+		if respHdr == nil {
+			resp.Request.Body = body
+		}
+	}
+	if respHdr != nil {
+		var httpReq *http.Request
+		if req != nil {
+			httpReq = req.Request
+			if req.Response != nil && req.Response.Request != nil {
+				httpReq = req.Response.Request
+			}
+		}
+		if resp.Response, err = http.ReadResponse(bufio.NewReader(bytes.NewReader(respHdr)), httpReq); err != nil {
+			return nil, fmt.Errorf("error while parsing HTTP response: %v", err)
+		}
+		resp.Response.Body = body
+	}
+
+	if rr.BodySection == "opt-body" && reqHdr == nil && respHdr == nil {
+		resp.OptBody = body
+	}
+	return resp, nil
+}
+
+// A clientBody reads an encapsulated body from a server's response.
+// It closes the connection at the end of the body or when it is closed.
+type clientBody struct {
+	cc *clientConn
+	r  io.Reader // the chunked reader, decompressing if necessary
+}
+
+func (b *clientBody) Read(p []byte) (n int, err error) {
+	b.cc.setReadTimeout(b.cc.client.IdleTimeout)
+	n, err = b.r.Read(p)
+	if err == io.EOF {
+		b.cc.close()
+	} else if err != nil {
+		err = contextError(b.cc.ctx, err)
+		b.cc.finish(err)
+	}
+	return n, err
+}
+
+func (b *clientBody) Close() error {
+	return b.cc.close()
+}
@@ -0,0 +1,415 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intra-sh/icap/icaptrace"
+)
+
+// startServer serves handler on a loopback listener and returns
+// the URL of the service at path.
+func startServer(t *testing.T, srv *Server, path string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.Serve(l)
+	return "icap://" + l.Addr().String() + path
+}
+
+func TestClientPreview(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		if string(req.Preview) != "hello" {
+			t.Errorf("preview = %q, want %q", req.Preview, "hello")
+		}
+		body, err := io.ReadAll(req.Request.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		req.Request.Header.Set("X-Body", string(body))
+		w.WriteHeader(StatusOK, req.Request, false)
+	})}
+	u := startServer(t, srv, "/reqmod")
+
+	httpReq, _ := http.NewRequest("POST", "http://www.example.com/", strings.NewReader("hello, world"))
+	req, err := NewRequest("REQMOD", u, httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Preview", "5")
+	resp, err := Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != StatusOK || resp.Request == nil {
+		t.Fatalf("unexpected response: %+v", resp)
+	}
+	if got := resp.Request.Header.Get("X-Body"); got != "hello, world" {
+		t.Errorf("server read body %q, want %q", got, "hello, world")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		<-release
+		w.WriteHeader(StatusNoContent, nil, false)
+	})}
+	u := startServer(t, srv, "/reqmod")
+
+	httpReq, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req, err := NewRequest("REQMOD", u, httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = Do(ctx, req)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want context.DeadlineExceeded", err)
+	}
+
+	c := &Client{ResponseHeaderTimeout: 50 * time.Millisecond}
+	_, err = c.Do(context.Background(), req)
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+}
+
+func TestClientResponseBody(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		req.Response.Header.Del("Content-Length")
+		w.WriteHeader(StatusOK, req.Response, true)
+		io.Copy(w, req.Response.Body)
+		io.WriteString(w, " (scanned)")
+	})}
+	u := startServer(t, srv, "/respmod")
+
+	httpResp := &http.Response{
+		StatusCode: 200,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/plain"}},
+		Body:       io.NopCloser(strings.NewReader("content")),
+	}
+	req, err := NewRequest("RESPMOD", u, nil, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&Client{IdleTimeout: time.Second}).Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Response == nil {
+		t.Fatalf("no encapsulated response: %+v", resp)
+	}
+	defer resp.Response.Body.Close()
+	body, err := io.ReadAll(resp.Response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "content (scanned)" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestClientRaw(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		req.Response.Header.Del("Content-Length")
+		req.Response.Header.Set("X-Preview", string(req.Preview))
+		body, err := io.ReadAll(req.Response.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(StatusOK, req.Response, true)
+		w.Write(body)
+		io.WriteString(w, " (scanned)")
+	})}
+	u := startServer(t, srv, "/respmod")
+
+	respHdr := []byte("HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 11\r\n\r\n")
+	for _, length := range []int64{11, -1} {
+		req, err := NewRawRequest("RESPMOD", u, nil, respHdr, strings.NewReader("hello world"), length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Preview", "5")
+		resp, err := DefaultClient.DoRaw(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != StatusOK || resp.BodySection != "res-body" || resp.Body == nil {
+			t.Fatalf("unexpected response: %+v", resp)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "hello world (scanned)" {
+			t.Errorf("length %d: body = %q", length, body)
+		}
+		if !strings.Contains(string(resp.ResponseHeader), "X-Preview: hello\r\n") ||
+			!strings.HasSuffix(string(resp.ResponseHeader), "\r\n\r\n") {
+			t.Errorf("length %d: response header = %q", length, resp.ResponseHeader)
+		}
+	}
+
+	req, _ := NewRawRequest("RESPMOD", u, nil, []byte("HTTP/1.1 200 OK\r\n"), nil, 0)
+	if _, err := DefaultClient.DoRaw(context.Background(), req); err == nil {
+		t.Error("unterminated header accepted")
+	}
+	req, _ = NewRawRequest("RESPMOD", u, nil, respHdr, strings.NewReader("short"), 11)
+	if _, err := DefaultClient.DoRaw(context.Background(), req); err == nil {
+		t.Error("short body accepted")
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		io.Copy(io.Discard, req.Request.Body)
+		w.WriteHeader(StatusNoContent, nil, false)
+	})}
+	u := startServer(t, srv, "/reqmod")
+
+	var mu sync.Mutex
+	var events []string
+	event := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	ctx := icaptrace.WithClientTrace(context.Background(), &icaptrace.ClientTrace{
+		GotConn:           func(icaptrace.GotConnInfo) { event("GotConn") },
+		WroteHeaders:      func() { event("WroteHeaders") },
+		PreviewSent:       func(int, bool) { event("PreviewSent") },
+		Got100Continue:    func() { event("Got100Continue") },
+		FirstResponseByte: func() { event("FirstResponseByte") },
+		Done: func(info icaptrace.DoneInfo) {
+			if info.Err != nil {
+				t.Error(info.Err)
+			}
+			event("Done")
+		},
+	})
+
+	httpReq, _ := http.NewRequest("POST", "http://www.example.com/", strings.NewReader("hello, world"))
+	req, err := NewRequest("REQMOD", u, httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Preview", "5")
+	if _, err := Do(ctx, req); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"GotConn", "WroteHeaders", "PreviewSent", "FirstResponseByte", "Got100Continue", "Done"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("events = %v, want %v", events, want)
+	}
+}
+
+func TestClientOptionsExpiry(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		// A server whose clock is a day behind.
+		w.Header().Set("Date", time.Now().Add(-24*time.Hour).UTC().Format(http.TimeFormat))
+		w.Header().Set("Options-TTL", "3600")
+		w.WriteHeader(StatusOK, nil, false)
+	})}
+	u := startServer(t, srv, "/options")
+
+	req, err := NewRequest("OPTIONS", u, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	resp, err := Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiry, ok := resp.OptionsExpiry()
+	if !ok {
+		t.Fatal("no expiry for response with Options-TTL")
+	}
+	if expiry.Before(before.Add(time.Hour)) || expiry.After(time.Now().Add(time.Hour)) {
+		t.Errorf("expiry %v is not an hour after the response arrived", expiry)
+	}
+}
+
+func TestClientOptBody(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		if req.OptBody == nil {
+			t.Error("no opt-body in OPTIONS request")
+		} else if body, err := io.ReadAll(req.OptBody); err != nil || string(body) != "client state" {
+			t.Errorf("opt-body = %q, %v; want %q", body, err, "client state")
+		}
+		w.Header().Set("Methods", "REQMOD")
+		w.Header().Set("Opt-body-type", "text/plain")
+		w.Header().Set("X-License-Status", "expired")
+		w.WriteHeader(StatusOK, nil, true)
+		io.WriteString(w, "service state")
+	})}
+	u := startServer(t, srv, "/options")
+
+	req, err := NewRequest("OPTIONS", u, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Opt-body-type", "text/plain")
+	req.OptBody = io.NopCloser(strings.NewReader("client state"))
+	resp, err := Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.OptBody == nil {
+		t.Fatal("no opt-body in OPTIONS response")
+	}
+	body, err := io.ReadAll(resp.OptBody)
+	if err != nil || string(body) != "service state" {
+		t.Errorf("response opt-body = %q, %v; want %q", body, err, "service state")
+	}
+	c, err := resp.Capabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.OptBodyType != "text/plain" {
+		t.Errorf("OptBodyType = %q, want %q", c.OptBodyType, "text/plain")
+	}
+	if got := c.Extensions.Get("X-License-Status"); got != "expired" {
+		t.Errorf("X-License-Status extension = %q, want %q", got, "expired")
+	}
+	if got := c.Extensions.Get("Methods"); got != "" {
+		t.Errorf("Methods is listed as an extension: %q", got)
+	}
+}
+
+func TestParseCapabilities(t *testing.T) {
+	h := textproto.MIMEHeader{
+		"Methods":           {"RESPMOD, LOG"},
+		"Istag":             {`"W3E4R7U9-L2E4-2"`},
+		"Allow":             {"204, 206"},
+		"Preview":           {"2048"},
+		"Transfer-Preview":  {"*"},
+		"Transfer-Ignore":   {"jpg,jpeg, gif", "png"},
+		"Transfer-Complete": {"asp, bat, exe, com"},
+		"Max-Connections":   {"1000"},
+		"Options-Ttl":       {"7200"},
+		"X-License-Status":  {"valid; expires=2030-01-01"},
+	}
+	c, err := ParseCapabilities(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Capabilities{
+		Methods:          []string{"RESPMOD", "LOG"},
+		ISTag:            `"W3E4R7U9-L2E4-2"`,
+		Allow:            []string{"204", "206"},
+		Preview:          2048,
+		TransferPreview:  []string{"*"},
+		TransferIgnore:   []string{"jpg", "jpeg", "gif", "png"},
+		TransferComplete: []string{"asp", "bat", "exe", "com"},
+		MaxConnections:   1000,
+		TTL:              2 * time.Hour,
+		Extensions:       textproto.MIMEHeader{"X-License-Status": {"valid; expires=2030-01-01"}},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v\nwant %+v", c, want)
+	}
+	if !c.AllowsFeature("204") {
+		t.Error("AllowsFeature(\"204\") = false")
+	}
+
+	h.Set("Preview", "lots")
+	if c, err := ParseCapabilities(h); err == nil || c.Preview != -1 || c.MaxConnections != 1000 {
+		t.Errorf("malformed Preview: got %+v, %v", c, err)
+	}
+}
+
+type resolverFunc func() []string
+
+func (f resolverFunc) Resolve(ctx context.Context) ([]Target, error) {
+	return StaticResolver(f()).Resolve(ctx)
+}
+
+func TestBackends(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusNoContent, nil, false)
+	})}
+	u := startServer(t, srv, "/reqmod")
+	addr := strings.TrimPrefix(strings.TrimSuffix(u, "/reqmod"), "icap://")
+
+	var mu sync.Mutex
+	addrs := []string{"192.0.2.1:1344", addr}
+	var changes [][]string
+	b := &Backends{
+		Resolver: resolverFunc(func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return addrs
+		}),
+		OnChange: func(added, removed []string) {
+			changes = append(changes, removed)
+		},
+	}
+	if err := b.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A transaction in progress on the server that is about to be removed.
+	_, release, err := b.acquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, release2, _ := b.acquire()
+	release2()
+
+	mu.Lock()
+	addrs = []string{addr}
+	mu.Unlock()
+	b.Refresh(context.Background())
+	if got := b.Draining(); len(got) != 1 || got[0] != "192.0.2.1:1344" {
+		t.Errorf("Draining() = %v", got)
+	}
+	if len(changes) != 2 || len(changes[1]) != 1 {
+		t.Errorf("OnChange removals = %v", changes)
+	}
+	release()
+	if got := b.Draining(); len(got) != 0 {
+		t.Errorf("Draining() after release = %v", got)
+	}
+
+	// The request URL names a host that doesn't exist;
+	// the client connects to the backend instead.
+	req, err := NewRequest("OPTIONS", "icap://icap.invalid/reqmod", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&Client{Backends: b}).Do(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != StatusNoContent {
+		t.Errorf("status = %d", resp.StatusCode)
+	}
+}
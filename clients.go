@@ -0,0 +1,317 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Statistics on each client, and penalties for clients that misbehave.
+
+package icap
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A ClientPolicy makes a Server keep statistics on each client address
+// (see Server.ClientStats), and penalizes clients whose requests fail too
+// often or whose bodies arrive too slowly, to contain broken peers.
+// The zero value keeps statistics without penalizing anyone.
+type ClientPolicy struct {
+	// MaxClients is the number of addresses to keep statistics on;
+	// those seen least recently are forgotten. If zero, 10000 are kept.
+	MaxClients int
+
+	// MaxErrorRate, if positive, is the fraction of a client's
+	// transactions that may fail before it is penalized. A transaction
+	// fails if its request can't be parsed or it is answered with a
+	// 4xx status.
+	MaxErrorRate float64
+
+	// MinThroughput, if positive, is the lowest average rate, in bytes
+	// per second, at which a client may send encapsulated bodies before
+	// it is penalized.
+	MinThroughput float64
+
+	// MinRequests is the number of transactions over which MaxErrorRate
+	// and MinThroughput are judged. If zero, 20 are needed. They are
+	// counted afresh after each penalty.
+	MinRequests int64
+
+	// Action is what happens to a penalized client.
+	Action ClientAction
+
+	// Penalty is how long a penalty lasts. If zero, it lasts a minute.
+	Penalty time.Duration
+
+	// ThrottleDelay is how long each transaction of a client penalized
+	// with ClientThrottle waits before it is read. If zero, a second.
+	ThrottleDelay time.Duration
+}
+
+// A ClientAction is the way a ClientPolicy penalizes a client.
+type ClientAction int
+
+const (
+	// ClientThrottle delays each of the client's transactions by the
+	// policy's ThrottleDelay.
+	ClientThrottle ClientAction = iota
+
+	// ClientReject refuses the client's new connections with
+	// 503 Service Unavailable.
+	ClientReject
+)
+
+// throughputMinBody is the size of the smallest body that counts toward
+// a client's throughput; the time to send a smaller one is mostly latency.
+const throughputMinBody = 16 << 10
+
+// ClientStats is a snapshot of the statistics a Server keeps on a
+// client address.
+type ClientStats struct {
+	Addr        netip.Addr
+	Connections int64 // connections accepted
+	Active      int64 // connections open
+	Rejected    int64 // connections refused because of a penalty
+	Requests    int64 // transactions, including those that couldn't be parsed
+	Errors      int64 // failed transactions; see ClientPolicy.MaxErrorRate
+
+	ErrorRate float64 // Errors / Requests
+
+	// BodyBytes is the size of the encapsulated bodies, of at least
+	// 16 KiB, that the client sent, and BodyTime the time from the start
+	// of each of their requests to the end of its body. Throughput is
+	// BodyBytes / BodyTime, in bytes per second.
+	BodyBytes  int64
+	BodyTime   time.Duration
+	Throughput float64
+
+	LastSeen       time.Time
+	PenalizedUntil time.Time // zero if the client has never been penalized
+}
+
+// A clientTracker keeps the statistics on the clients of a Server.
+type clientTracker struct {
+	srv     *Server
+	policy  *ClientPolicy
+	mu      sync.Mutex // for adding to clients
+	clients *Cache[string, *clientEntry]
+}
+
+// A clientEntry holds the statistics on one client address.
+type clientEntry struct {
+	t     *clientTracker
+	mu    sync.Mutex
+	stats ClientStats
+
+	// The transactions since the last penalty.
+	requests, errors int64
+	bodyBytes        int64
+	bodyTime         time.Duration
+}
+
+// clientTracker returns the server's clientTracker, or nil if it has no
+// ClientPolicy.
+func (srv *Server) clientTracker() *clientTracker {
+	if srv == nil || srv.ClientPolicy == nil {
+		return nil
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.clients == nil {
+		max := srv.ClientPolicy.MaxClients
+		if max <= 0 {
+			max = 10000
+		}
+		srv.clients = &clientTracker{
+			srv:     srv,
+			policy:  srv.ClientPolicy,
+			clients: NewCache[string, *clientEntry](max, 0),
+		}
+	}
+	return srv.clients
+}
+
+// client returns the entry for the client at addr, or nil if clients
+// aren't tracked or addr isn't an IP address.
+func (t *clientTracker) client(addr net.Addr) *clientEntry {
+	if t == nil {
+		return nil
+	}
+	ap, ok := addrPort(addr)
+	if !ok {
+		return nil
+	}
+	key := ap.Addr().String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.clients.Get(key)
+	if !ok {
+		e = &clientEntry{t: t, stats: ClientStats{Addr: ap.Addr()}}
+		t.clients.Add(key, e)
+	}
+	return e
+}
+
+// penalized reports whether e is serving a penalty, and if so, which.
+func (e *clientEntry) penalized(now time.Time) (ClientAction, bool) {
+	if e.stats.PenalizedUntil.IsZero() || !now.Before(e.stats.PenalizedUntil) {
+		return 0, false
+	}
+	return e.t.policy.Action, true
+}
+
+// connOpened records a new connection from the client, and reports
+// false if it should be refused.
+func (e *clientEntry) connOpened() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	e.stats.LastSeen = now
+	if a, ok := e.penalized(now); ok && a == ClientReject {
+		e.stats.Rejected++
+		return false
+	}
+	e.stats.Connections++
+	e.stats.Active++
+	return true
+}
+
+func (e *clientEntry) connClosed() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.stats.Active--
+	e.mu.Unlock()
+}
+
+// throttleDelay returns how long the client's next transaction should wait.
+func (e *clientEntry) throttleDelay() time.Duration {
+	if e == nil {
+		return 0
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if a, ok := e.penalized(time.Now()); !ok || a != ClientThrottle {
+		return 0
+	}
+	if d := e.t.policy.ThrottleDelay; d > 0 {
+		return d
+	}
+	return time.Second
+}
+
+// transaction records a transaction: whether it failed, and the size of
+// its body and the time taken to receive it, if that counts toward the
+// client's throughput.
+func (e *clientEntry) transaction(failed bool, bodyBytes int64, bodyTime time.Duration) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	now := time.Now()
+	s := &e.stats
+	s.LastSeen = now
+	s.Requests++
+	e.requests++
+	if failed {
+		s.Errors++
+		e.errors++
+	}
+	if bodyBytes >= throughputMinBody && bodyTime > 0 {
+		s.BodyBytes += bodyBytes
+		s.BodyTime += bodyTime
+		e.bodyBytes += bodyBytes
+		e.bodyTime += bodyTime
+	}
+
+	var penalized bool
+	p := e.t.policy
+	minRequests := p.MinRequests
+	if minRequests <= 0 {
+		minRequests = 20
+	}
+	if _, serving := e.penalized(now); !serving && e.requests >= minRequests {
+		tooManyErrors := p.MaxErrorRate > 0 && float64(e.errors)/float64(e.requests) > p.MaxErrorRate
+		tooSlow := p.MinThroughput > 0 && e.bodyTime > 0 && float64(e.bodyBytes)/e.bodyTime.Seconds() < p.MinThroughput
+		if tooManyErrors || tooSlow {
+			penalty := p.Penalty
+			if penalty <= 0 {
+				penalty = time.Minute
+			}
+			s.PenalizedUntil = now.Add(penalty)
+			e.requests, e.errors, e.bodyBytes, e.bodyTime = 0, 0, 0, 0
+			penalized = true
+		}
+	}
+	snapshot := e.snapshot()
+	e.mu.Unlock()
+
+	if penalized {
+		e.t.srv.trace().clientPenalized(snapshot)
+	}
+}
+
+// snapshot returns a copy of the statistics. e.mu must be held.
+func (e *clientEntry) snapshot() ClientStats {
+	s := e.stats
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+	}
+	if s.BodyTime > 0 {
+		s.Throughput = float64(s.BodyBytes) / s.BodyTime.Seconds()
+	}
+	return s
+}
+
+// ClientStats returns the statistics on the clients the server has seen,
+// ordered by address, if it has a ClientPolicy.
+func (srv *Server) ClientStats() []ClientStats {
+	t := srv.clientTracker()
+	if t == nil {
+		return nil
+	}
+	var stats []ClientStats
+	for _, e := range t.clients.Values() {
+		e.mu.Lock()
+		stats = append(stats, e.snapshot())
+		e.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Addr.Less(stats[j].Addr) })
+	return stats
+}
+
+// serveClientStats writes the server's ClientStats as JSON.
+func (srv *Server) serveClientStats(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	stats := srv.ClientStats()
+	if stats == nil {
+		stats = []ClientStats{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(stats)
+}
+
+// recordClientTransaction records the outcome of w's transaction in the
+// statistics on its client.
+func (w *respWriter) recordClientTransaction() {
+	e := w.conn.client
+	if e == nil {
+		return
+	}
+	req := w.req
+	var bodyTime time.Duration
+	if end := req.bodyEnd.Load(); end != 0 && !req.start.IsZero() {
+		bodyTime = time.Unix(0, end).Sub(req.start)
+	}
+	e.transaction(w.status >= 400 && w.status < 500, req.PreviewBytes+req.BodyBytes(), bodyTime)
+}
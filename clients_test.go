@@ -0,0 +1,82 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientPenalty(t *testing.T) {
+	penalized := make(chan ClientStats, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(StatusBadRequest, nil, false)
+		}),
+		ClientPolicy: &ClientPolicy{
+			MaxErrorRate: 0.5,
+			MinRequests:  2,
+			Action:       ClientReject,
+		},
+		Trace: &ServerTrace{
+			ClientPenalized: func(s ClientStats) { penalized <- s },
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	exchange := func(msg string) string {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(c, msg)
+		c.(*net.TCPConn).CloseWrite()
+		resp, _ := io.ReadAll(c)
+		return string(resp)
+	}
+
+	// One transaction that can't be parsed, and one answered with 400.
+	exchange("NONSENSE\r\n\r\n")
+	exchange("OPTIONS icap://icap.example.net/options ICAP/1.0\r\nHost: icap.example.net\r\nEncapsulated: null-body=0\r\n\r\n")
+
+	select {
+	case s := <-penalized:
+		if s.Requests != 2 || s.Errors != 2 || s.PenalizedUntil.IsZero() {
+			t.Errorf("stats passed to ClientPenalized = %+v", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client wasn't penalized")
+	}
+
+	if resp := exchange(""); !strings.HasPrefix(resp, "ICAP/1.0 503 ") {
+		t.Errorf("unexpected response to penalized client:\n%s", resp)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/clients", nil))
+	var stats []ClientStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("decoding %s: %v", rec.Body, err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got stats on %d clients, want 1", len(stats))
+	}
+	s := stats[0]
+	if s.Addr.String() != "127.0.0.1" || s.Connections != 2 || s.Rejected != 1 || s.ErrorRate != 1 {
+		t.Errorf("ClientStats = %+v", s)
+	}
+}
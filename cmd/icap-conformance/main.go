@@ -0,0 +1,152 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Icap-conformance checks an ICAP server for conformance to RFC 3507.
+
+Usage:
+
+	icap-conformance [flags] icap://host[:port]/service
+
+It connects to the service and sends it a series of probes on the wire:
+an OPTIONS request, requests with and without Allow: 204, previews that
+do and don't hold the whole body, and malformed requests such as a bad
+Encapsulated header or an oversized header. It prints a report with a
+PASS, WARN or FAIL line for each probe, and exits with status 1 if any
+probe failed.
+
+The flags are:
+
+	-method REQMOD|RESPMOD
+		the method to probe the service with; by default the first
+		one listed in the Methods header of its OPTIONS response
+	-timeout duration
+		how long to wait for each response (default 10s)
+	-header-size n
+		the size in bytes of the oversized header (default 1 MiB)
+	-json
+		print the report as JSON
+	-v
+		print each message sent and received, annotated as by
+		icap.Format, before the report (on standard error with -json)
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func main() {
+	method := flag.String("method", "", "the method to probe the service with (REQMOD or RESPMOD)")
+	timeout := flag.Duration("timeout", 10*time.Second, "how long to wait for each response")
+	headerSize := flag.Int("header-size", 1<<20, "the size in bytes of the oversized header")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	verbose := flag.Bool("v", false, "print each message sent and received")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: icap-conformance [flags] icap://host[:port]/service")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c, err := newChecker(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "icap-conformance:", err)
+		os.Exit(2)
+	}
+	c.Method = strings.ToUpper(*method)
+	c.Timeout = *timeout
+	c.HeaderSize = *headerSize
+	if *verbose {
+		c.Verbose = os.Stdout
+		if *asJSON {
+			c.Verbose = os.Stderr
+		}
+	}
+
+	report := c.Run()
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// newChecker returns a checker for the service at rawURL.
+func newChecker(rawURL string) (*checker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icap" || u.Host == "" {
+		return nil, fmt.Errorf("not an ICAP URL: %s", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr += ":1344"
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	return &checker{
+		URL:        u.String(),
+		Host:       u.Hostname(),
+		Addr:       addr,
+		Timeout:    10 * time.Second,
+		HeaderSize: 1 << 20,
+	}, nil
+}
+
+// A Report holds the results of a run of the probes.
+type Report struct {
+	URL     string
+	Method  string
+	Results []Result
+	Passed  int
+	Warned  int
+	Failed  int
+}
+
+// A Result is the outcome of one probe.
+type Result struct {
+	Probe   string
+	Outcome string // PASS, WARN or FAIL
+	Detail  string
+}
+
+func (r *Report) add(probe, outcome, detail string) {
+	r.Results = append(r.Results, Result{probe, outcome, detail})
+	switch outcome {
+	case pass:
+		r.Passed++
+	case warn:
+		r.Warned++
+	default:
+		r.Failed++
+	}
+}
+
+// WriteText writes r in a form for people to read.
+func (r *Report) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%s (%s)\n\n", r.URL, r.Method)
+	for _, res := range r.Results {
+		fmt.Fprintf(w, "%-4s  %-22s %s\n", res.Outcome, res.Probe, res.Detail)
+	}
+	fmt.Fprintf(w, "\n%d passed, %d warnings, %d failed\n", r.Passed, r.Warned, r.Failed)
+}
@@ -0,0 +1,550 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The conformance probes, which talk to the server on the wire.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+// The outcomes of a probe.
+const (
+	pass = "PASS"
+	warn = "WARN"
+	fail = "FAIL"
+)
+
+// A checker runs the probes against one ICAP service.
+type checker struct {
+	URL        string // the service URL, used in request lines
+	Host       string // the Host header
+	Addr       string // the address to connect to
+	Method     string // REQMOD or RESPMOD; if empty, set from OPTIONS
+	Timeout    time.Duration
+	HeaderSize int
+
+	// Verbose, if not nil, receives a rendering of each message
+	// sent and received (see icap.Format).
+	Verbose io.Writer
+}
+
+// A probe checks one aspect of the server's behavior.
+type probe struct {
+	name string
+	run  func(c *checker) (outcome, detail string)
+}
+
+// probes lists the probes in the order they run. The OPTIONS probe comes
+// first, since it chooses the method for the others.
+var probes = []probe{
+	{"options", (*checker).options},
+	{"keep-alive", (*checker).keepAlive},
+	{"no-204-without-allow", (*checker).no204WithoutAllow},
+	{"allow-204", (*checker).allow204},
+	{"preview-ieof", (*checker).previewIEOF},
+	{"preview-continue", func(c *checker) (string, string) { return c.preview(10) }},
+	{"preview-zero", func(c *checker) (string, string) { return c.preview(0) }},
+	{"bad-encapsulated", (*checker).badEncapsulated},
+	{"missing-encapsulated", (*checker).missingEncapsulated},
+	{"bad-chunk", (*checker).badChunk},
+	{"unknown-method", (*checker).unknownMethod},
+	{"huge-header", (*checker).hugeHeader},
+}
+
+// Run runs all the probes and reports their results.
+func (c *checker) Run() *Report {
+	r := &Report{URL: c.URL}
+	for _, p := range probes {
+		if c.Verbose != nil {
+			fmt.Fprintf(c.Verbose, "=== %s\n", p.name)
+		}
+		outcome, detail := p.run(c)
+		r.add(p.name, outcome, detail)
+	}
+	r.Method = c.Method
+	return r
+}
+
+// sampleBody is the encapsulated body sent by the probes.
+const sampleBody = "The quick brown fox jumps over the lazy dog.\n"
+
+// chunk returns s as a chunk of a chunked body.
+func chunk(s string) string {
+	return strconv.FormatInt(int64(len(s)), 16) + "\r\n" + s + "\r\n"
+}
+
+// message returns a request using the checker's method, with extra
+// (complete header lines) added to its ICAP header, an encapsulated HTTP
+// message whose body is sampleBody, and body (already chunked) following.
+func (c *checker) message(extra, body string) string {
+	var enc, hdrs string
+	if c.Method == "REQMOD" {
+		hdrs = "POST http://conformance.example/upload HTTP/1.1\r\n" +
+			"Host: conformance.example\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Content-Length: " + strconv.Itoa(len(sampleBody)) + "\r\n" +
+			"\r\n"
+		enc = "req-hdr=0, req-body=" + strconv.Itoa(len(hdrs))
+	} else {
+		reqHdr := "GET http://conformance.example/ HTTP/1.1\r\n" +
+			"Host: conformance.example\r\n" +
+			"\r\n"
+		resHdr := "HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Content-Length: " + strconv.Itoa(len(sampleBody)) + "\r\n" +
+			"\r\n"
+		hdrs = reqHdr + resHdr
+		enc = "req-hdr=0, res-hdr=" + strconv.Itoa(len(reqHdr)) + ", res-body=" + strconv.Itoa(len(hdrs))
+	}
+	return c.Method + " " + c.URL + " ICAP/1.0\r\n" +
+		"Host: " + c.Host + "\r\n" +
+		extra +
+		"Encapsulated: " + enc + "\r\n" +
+		"\r\n" + hdrs + body
+}
+
+// optionsRequest returns an OPTIONS request, with extra added to its header.
+func (c *checker) optionsRequest(extra string) string {
+	return "OPTIONS " + c.URL + " ICAP/1.0\r\n" +
+		"Host: " + c.Host + "\r\n" +
+		extra +
+		"Encapsulated: null-body=0\r\n" +
+		"\r\n"
+}
+
+// A session is a connection to the server. It keeps a copy of
+// everything sent and received, for linting and for Verbose.
+type session struct {
+	conn    net.Conn
+	br      *bufio.Reader
+	r       *textproto.Reader
+	timeout time.Duration
+	verbose io.Writer
+
+	sent     bytes.Buffer
+	received bytes.Buffer
+	sentAt   []int // the offsets in sent of the requests
+	starts   []int // the offsets in received of the responses
+}
+
+func (c *checker) dial() (*session, error) {
+	conn, err := net.DialTimeout("tcp", c.Addr, c.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	s := &session{conn: conn, timeout: c.Timeout, verbose: c.Verbose}
+	s.br = bufio.NewReader(io.TeeReader(conn, &s.received))
+	s.r = textproto.NewReader(s.br)
+	return s, nil
+}
+
+func (s *session) close() {
+	s.conn.Close()
+	if s.verbose == nil {
+		return
+	}
+	dumpMessages(s.verbose, "sent", s.sent.Bytes(), s.sentAt)
+	dumpMessages(s.verbose, "received", s.received.Bytes(), s.starts)
+}
+
+// dumpMessages renders the messages in buf, which start at the offsets
+// in starts.
+func dumpMessages(w io.Writer, label string, buf []byte, starts []int) {
+	for i, start := range starts {
+		end := len(buf)
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		fmt.Fprintln(w, "---", label)
+		icap.Format(w, buf[start:end])
+	}
+}
+
+// send sends a request.
+func (s *session) send(msg string) error {
+	s.sentAt = append(s.sentAt, s.sent.Len())
+	return s.sendRest(msg)
+}
+
+// sendRest sends the rest of a request's body, after 100 Continue.
+func (s *session) sendRest(msg string) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	s.sent.WriteString(msg)
+	_, err := io.WriteString(s.conn, msg)
+	return err
+}
+
+// consumed returns the number of bytes of received that have been read.
+func (s *session) consumed() int {
+	return s.received.Len() - s.br.Buffered()
+}
+
+// A reply is the status line and header of a response.
+type reply struct {
+	Status string // e.g. "200 OK"
+	Code   int
+	Header textproto.MIMEHeader
+
+	// Raw is the whole response, once its body has been read.
+	Raw []byte
+}
+
+// read reads the status line and header of a response.
+func (s *session) read() (*reply, error) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	s.starts = append(s.starts, s.consumed())
+	line, err := s.r.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, status, ok := strings.Cut(line, " ")
+	if !ok || !strings.HasPrefix(proto, "ICAP/") {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	code, err := strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed status line %q", line)
+	}
+	h, err := s.r.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &reply{Status: status, Code: code, Header: h}, nil
+}
+
+// readBody reads and discards the encapsulated message of rep, and
+// sets rep.Raw.
+func (s *session) readBody(rep *reply) error {
+	err := s.discardBody(rep)
+	if err == nil {
+		rep.Raw = s.received.Bytes()[s.starts[len(s.starts)-1]:s.consumed()]
+	}
+	return err
+}
+
+func (s *session) discardBody(rep *reply) error {
+	enc := rep.Header.Get("Encapsulated")
+	if enc == "" {
+		return nil
+	}
+	last, offset := "", 0
+	for _, item := range strings.Split(enc, ",") {
+		name, off, _ := strings.Cut(strings.TrimSpace(item), "=")
+		n, err := strconv.Atoi(strings.TrimSpace(off))
+		if err != nil {
+			return fmt.Errorf("malformed Encapsulated header %q", enc)
+		}
+		if n >= offset {
+			last, offset = name, n
+		}
+	}
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+	if _, err := io.CopyN(io.Discard, s.r.R, int64(offset)); err != nil {
+		return err
+	}
+	if last == "null-body" {
+		return nil
+	}
+	for {
+		line, err := s.r.ReadLine()
+		if err != nil {
+			return err
+		}
+		size, _, _ := strings.Cut(line, ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			return fmt.Errorf("malformed chunk size %q", line)
+		}
+		if n == 0 {
+			_, err := s.r.ReadMIMEHeader() // the trailer
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, s.r.R, n+2); err != nil {
+			return err
+		}
+	}
+}
+
+// exchange sends msg on a new connection and reads the response. Since
+// the server may answer before reading all of a request it rejects,
+// an error sending msg is ignored if a response arrives.
+func (c *checker) exchange(msg string) (*reply, error) {
+	s, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+	werr := s.send(msg)
+	rep, err := s.read()
+	if err != nil {
+		if werr != nil && !isTimeout(err) {
+			err = werr
+		}
+		return nil, err
+	}
+	if rep.Code != 100 {
+		if err := s.readBody(rep); err != nil {
+			return rep, fmt.Errorf("reading the body of %s: %w", rep.Status, err)
+		}
+	}
+	return rep, nil
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// failure describes the error from a probe that expected a response.
+func (c *checker) failure(err error) (string, string) {
+	if isTimeout(err) {
+		return fail, fmt.Sprintf("no response within %v", c.Timeout)
+	}
+	return fail, err.Error()
+}
+
+// final evaluates the final response to a valid request.
+func (c *checker) final(rep *reply, err error, what string) (string, string) {
+	if err != nil {
+		return c.failure(err)
+	}
+	switch rep.Code {
+	case 200, 204:
+		if rep.Header.Get("ISTag") == "" {
+			return fail, what + rep.Status + " without an ISTag header"
+		}
+		if findings := icap.Lint(rep.Raw); len(findings) > 0 {
+			detail := fmt.Sprintf("%s%s, but %v", what, rep.Status, findings[0])
+			if len(findings) > 1 {
+				detail += fmt.Sprintf(" (and %d more problems)", len(findings)-1)
+			}
+			return warn, detail
+		}
+		return pass, what + rep.Status
+	case 100:
+		return fail, what + "100 Continue without a preview to continue"
+	}
+	return warn, what + "unexpected " + rep.Status
+}
+
+// rejected evaluates the response to an invalid request; strict, if
+// set, makes accepting it a failure instead of a warning.
+func (c *checker) rejected(rep *reply, err error, strict bool) (string, string) {
+	switch {
+	case err != nil && rep == nil && isTimeout(err):
+		return fail, fmt.Sprintf("no response within %v", c.Timeout)
+	case err != nil && rep == nil:
+		return warn, "connection closed without an error response"
+	case rep.Code >= 400 && rep.Code < 500:
+		return pass, rep.Status
+	case rep.Code >= 200 && rep.Code < 300 && strict:
+		return fail, "accepted with " + rep.Status
+	case rep.Code >= 200 && rep.Code < 300:
+		return warn, "accepted with " + rep.Status
+	}
+	return warn, "unexpected " + rep.Status
+}
+
+func (c *checker) options() (string, string) {
+	rep, err := c.exchange(c.optionsRequest(""))
+	if err != nil {
+		return c.failure(err)
+	}
+	if rep.Code != 200 {
+		return fail, "OPTIONS answered with " + rep.Status
+	}
+	var missing []string
+	for _, h := range []string{"ISTag", "Methods", "Encapsulated"} {
+		if rep.Header.Get(h) == "" {
+			missing = append(missing, h)
+		}
+	}
+	if len(missing) > 0 {
+		return fail, "missing " + strings.Join(missing, ", ")
+	}
+	methods := rep.Header.Get("Methods")
+	if c.Method == "" {
+		for _, m := range strings.Split(methods, ",") {
+			if m = strings.ToUpper(strings.TrimSpace(m)); m == "REQMOD" || m == "RESPMOD" {
+				c.Method = m
+				break
+			}
+		}
+		if c.Method == "" {
+			c.Method = "RESPMOD"
+		}
+	}
+	tag := rep.Header.Get("ISTag")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' || len(tag) > 34 {
+		return warn, fmt.Sprintf("ISTag %s is not a quoted string of up to 32 characters", tag)
+	}
+	return pass, fmt.Sprintf("Methods: %s, ISTag: %s", methods, tag)
+}
+
+func (c *checker) keepAlive() (string, string) {
+	s, err := c.dial()
+	if err != nil {
+		return c.failure(err)
+	}
+	defer s.close()
+	announced := false // the first response said Connection: close
+	for i := 0; i < 2; i++ {
+		err := s.send(c.optionsRequest(""))
+		var rep *reply
+		if err == nil {
+			rep, err = s.read()
+		}
+		if err == nil {
+			err = s.readBody(rep)
+		}
+		switch {
+		case err != nil && i == 0:
+			return c.failure(err)
+		case err != nil && isTimeout(err):
+			return fail, fmt.Sprintf("no response to the second request within %v", c.Timeout)
+		case err != nil && announced:
+			return warn, "the server closes connections after each response"
+		case err != nil:
+			return warn, "connection closed after the first response without Connection: close"
+		}
+		if i == 0 {
+			announced = strings.EqualFold(rep.Header.Get("Connection"), "close")
+		}
+	}
+	if announced {
+		return warn, "the connection stayed open after a response with Connection: close"
+	}
+	return pass, "two requests answered on one connection"
+}
+
+func (c *checker) no204WithoutAllow() (string, string) {
+	rep, err := c.exchange(c.message("", chunk(sampleBody)+"0\r\n\r\n"))
+	if err == nil && rep.Code == 204 {
+		return fail, "204 No Content though the request had neither Allow: 204 nor Preview"
+	}
+	return c.final(rep, err, "")
+}
+
+func (c *checker) allow204() (string, string) {
+	rep, err := c.exchange(c.message("Allow: 204\r\n", chunk(sampleBody)+"0\r\n\r\n"))
+	return c.final(rep, err, "")
+}
+
+func (c *checker) previewIEOF() (string, string) {
+	rep, err := c.exchange(c.message(
+		"Allow: 204\r\nPreview: "+strconv.Itoa(len(sampleBody))+"\r\n",
+		chunk(sampleBody)+"0; ieof\r\n\r\n"))
+	if err == nil && rep.Code == 100 {
+		return fail, "100 Continue after a preview that ended with ieof"
+	}
+	return c.final(rep, err, "")
+}
+
+// preview sends a preview of n bytes of the body, and the rest of it if
+// the server asks for it with 100 Continue.
+func (c *checker) preview(n int) (string, string) {
+	s, err := c.dial()
+	if err != nil {
+		return c.failure(err)
+	}
+	defer s.close()
+	body := ""
+	if n > 0 {
+		body = chunk(sampleBody[:n])
+	}
+	if err := s.send(c.message("Allow: 204\r\nPreview: "+strconv.Itoa(n)+"\r\n", body+"0\r\n\r\n")); err != nil {
+		return c.failure(err)
+	}
+	rep, err := s.read()
+	if err != nil {
+		return c.failure(err)
+	}
+	what := "answered from the preview with "
+	if rep.Code == 100 {
+		if err := s.sendRest(chunk(sampleBody[n:]) + "0\r\n\r\n"); err != nil {
+			return c.failure(err)
+		}
+		if rep, err = s.read(); err == nil && rep.Code == 100 {
+			return fail, "a second 100 Continue"
+		}
+		what = "100 Continue, then "
+	}
+	if err == nil {
+		err = s.readBody(rep)
+	}
+	return c.final(rep, err, what)
+}
+
+func (c *checker) badEncapsulated() (string, string) {
+	rep, err := c.exchange(c.Method + " " + c.URL + " ICAP/1.0\r\n" +
+		"Host: " + c.Host + "\r\n" +
+		"Encapsulated: res-hdr=zero; res-body\r\n" +
+		"\r\n" +
+		"HTTP/1.1 200 OK\r\n\r\n")
+	return c.rejected(rep, err, true)
+}
+
+func (c *checker) missingEncapsulated() (string, string) {
+	// Encapsulated is required, but a server that takes its absence to
+	// mean there is no encapsulated message is only being lenient.
+	msg := c.message("", chunk(sampleBody)+"0\r\n\r\n")
+	i := strings.Index(msg, "Encapsulated: ")
+	j := i + strings.Index(msg[i:], "\r\n") + 2
+	rep, err := c.exchange(msg[:i] + msg[j:])
+	return c.rejected(rep, err, false)
+}
+
+func (c *checker) badChunk() (string, string) {
+	// The server may have sent its response header before reading
+	// the body, so accepting the request is only a warning.
+	rep, err := c.exchange(c.message("", "zz\r\n"+sampleBody+"\r\n0\r\n\r\n"))
+	return c.rejected(rep, err, false)
+}
+
+func (c *checker) unknownMethod() (string, string) {
+	rep, err := c.exchange("FROBNICATE " + c.URL + " ICAP/1.0\r\n" +
+		"Host: " + c.Host + "\r\n" +
+		"Encapsulated: null-body=0\r\n" +
+		"\r\n")
+	if err == nil && (rep.Code == 405 || rep.Code == 501) {
+		return pass, rep.Status
+	}
+	outcome, detail := c.rejected(rep, err, true)
+	if outcome == pass {
+		outcome, detail = warn, rep.Status+" instead of 405 or 501"
+	}
+	return outcome, detail
+}
+
+func (c *checker) hugeHeader() (string, string) {
+	rep, err := c.exchange(c.optionsRequest("X-Conformance-Padding: " + strings.Repeat("a", c.HeaderSize) + "\r\n"))
+	var outcome, detail string
+	switch {
+	case err != nil && isTimeout(err):
+		return fail, fmt.Sprintf("no response within %v", c.Timeout)
+	case err != nil && rep == nil:
+		outcome, detail = pass, "connection closed"
+	case rep.Code >= 400:
+		outcome, detail = pass, rep.Status
+	default:
+		outcome, detail = warn, fmt.Sprintf("accepted a %d-byte header with %s", c.HeaderSize, rep.Status)
+	}
+	if _, err := c.exchange(c.optionsRequest("")); err != nil {
+		return fail, detail + ", then stopped answering: " + err.Error()
+	}
+	return outcome, detail
+}
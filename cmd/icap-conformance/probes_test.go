@@ -0,0 +1,85 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+// check runs the probes against a server using h.
+func check(t *testing.T, h icap.HandlerFunc) *Report {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go (&icap.Server{Handler: h}).Serve(l)
+
+	c, err := newChecker("icap://" + l.Addr().String() + "/respmod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Timeout = 2 * time.Second
+	c.HeaderSize = 256 << 10
+	return c.Run()
+}
+
+func service(w icap.ResponseWriter, req *icap.Request) {
+	h := w.Header()
+	h.Set("ISTag", `"conformance-1"`)
+	switch req.Method {
+	case "OPTIONS":
+		h.Set("Methods", "RESPMOD")
+		h.Set("Allow", "204")
+		h.Set("Preview", "0")
+		w.WriteHeader(icap.StatusOK, nil, false)
+	case "RESPMOD":
+		icap.Unmodified(w, req)
+	default:
+		w.WriteHeader(icap.StatusMethodNotAllowed, nil, false)
+	}
+}
+
+func TestSelfCheck(t *testing.T) {
+	r := check(t, service)
+	var text strings.Builder
+	r.WriteText(&text)
+	if r.Failed > 0 || r.Method != "RESPMOD" || len(r.Results) != len(probes) {
+		t.Errorf("report:\n%s", text.String())
+	}
+}
+
+func TestAlways204(t *testing.T) {
+	r := check(t, func(w icap.ResponseWriter, req *icap.Request) {
+		if req.Method != "OPTIONS" {
+			if req.Response != nil {
+				io.Copy(io.Discard, req.Response.Body)
+			}
+			w.Header().Set("ISTag", `"lazy"`)
+			w.WriteHeader(icap.StatusNoContent, nil, false)
+			return
+		}
+		service(w, req)
+	})
+	for _, res := range r.Results {
+		switch res.Probe {
+		case "no-204-without-allow":
+			if res.Outcome != fail {
+				t.Errorf("%s: %s %s", res.Probe, res.Outcome, res.Detail)
+			}
+		case "preview-continue":
+			if res.Outcome != pass || !strings.HasPrefix(res.Detail, "100 Continue, then 204") {
+				t.Errorf("%s: %s %s", res.Probe, res.Outcome, res.Detail)
+			}
+		}
+	}
+}
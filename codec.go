@@ -0,0 +1,227 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Decompression of encapsulated bodies, with a registry of content-codings.
+
+package icap
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// A Codec decompresses one HTTP content-coding, such as gzip. Codecs
+// for gzip, deflate, br and zstd are built in; others can be added with
+// RegisterCodec.
+type Codec struct {
+	// NewReader returns a reader of the decompressed form of r.
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var codecs = struct {
+	sync.RWMutex
+	m map[string]Codec
+}{m: map[string]Codec{
+	"gzip":    {NewReader: newGzipReader},
+	"x-gzip":  {NewReader: newGzipReader},
+	"deflate": {NewReader: newDeflateReader},
+	"br":      {NewReader: newBrotliReader},
+	"zstd":    {NewReader: newZstdReader},
+}}
+
+// RegisterCodec makes c available for the content-coding name (which is
+// not case-sensitive), replacing any codec already registered for it.
+// gzip, deflate, br and zstd are registered by default.
+func RegisterCodec(name string, c Codec) {
+	if c.NewReader == nil {
+		panic("icap: RegisterCodec with nil NewReader")
+	}
+	codecs.Lock()
+	defer codecs.Unlock()
+	codecs.m[strings.ToLower(name)] = c
+}
+
+// LookupCodec returns the codec registered for the content-coding name.
+func LookupCodec(name string) (Codec, bool) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	c, ok := codecs.m[strings.ToLower(name)]
+	return c, ok
+}
+
+// An UnsupportedEncodingError is returned when a body is compressed with
+// a content-coding that has no registered Codec.
+type UnsupportedEncodingError struct {
+	Coding string
+}
+
+func (e *UnsupportedEncodingError) Error() string {
+	return fmt.Sprintf("icap: unsupported content-coding %q", e.Coding)
+}
+
+// contentCodings returns the content-codings listed in h, in the order
+// they were applied, leaving out identity.
+func contentCodings(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, c := range strings.Split(v, ",") {
+			c = strings.ToLower(strings.TrimSpace(c))
+			if c != "" && c != "identity" {
+				codings = append(codings, c)
+			}
+		}
+	}
+	return codings
+}
+
+// CanDecompress reports whether every content-coding listed in the
+// Content-Encoding header of h has a registered Codec. It is true for a
+// body that isn't compressed.
+func CanDecompress(h http.Header) bool {
+	for _, c := range contentCodings(h) {
+		if _, ok := LookupCodec(c); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// decompress returns a reader of the decompressed form of src, which is
+// compressed as h's Content-Encoding header describes. Closing it closes
+// the decoders and src.
+func decompress(h http.Header, src io.ReadCloser) (io.ReadCloser, error) {
+	codings := contentCodings(h)
+	d := &decompressedBody{Reader: src, src: src}
+	// The codings are undone in the reverse of the order they were applied.
+	for i := len(codings) - 1; i >= 0; i-- {
+		codec, ok := LookupCodec(codings[i])
+		if !ok {
+			return nil, &UnsupportedEncodingError{codings[i]}
+		}
+		ld := &lazyDecoder{src: d.Reader, newReader: codec.NewReader}
+		d.decoders = append(d.decoders, ld)
+		d.Reader = ld
+	}
+	return d, nil
+}
+
+// A lazyDecoder opens its decoder on the first Read, since opening a
+// decoder usually reads the header of the compressed data.
+type lazyDecoder struct {
+	src       io.Reader
+	newReader func(io.Reader) (io.ReadCloser, error)
+	rc        io.ReadCloser
+	err       error
+}
+
+func (d *lazyDecoder) Read(p []byte) (int, error) {
+	if d.rc == nil && d.err == nil {
+		d.rc, d.err = d.newReader(d.src)
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.rc.Read(p)
+}
+
+// A decompressedBody is the decompressed form of an encapsulated body.
+type decompressedBody struct {
+	io.Reader
+	decoders []*lazyDecoder
+	src      io.Closer // the compressed body
+}
+
+func (b *decompressedBody) Close() error {
+	for _, d := range b.decoders {
+		if d.rc != nil {
+			d.rc.Close()
+		}
+	}
+	return b.src.Close()
+}
+
+// DecompressBody replaces the body of the encapsulated message (the HTTP
+// request for REQMOD, the HTTP response for RESPMOD) with its
+// decompressed form, as it is read, and removes the Content-Encoding and
+// Content-Length headers, so that the message is sent on uncompressed.
+// It reports whether the body was compressed. If a coding has no
+// registered Codec, the body is left alone and the error is an
+// *UnsupportedEncodingError.
+func (req *Request) DecompressBody() (bool, error) {
+	body := req.bodyPtr()
+	if body == nil || *body == nil || !req.hasBody {
+		return false, nil
+	}
+	h := req.bodyHeader()
+	if len(contentCodings(h)) == 0 {
+		return false, nil
+	}
+	r, err := decompress(h, *body)
+	if err != nil {
+		return false, err
+	}
+	*body = r
+	switch {
+	case req.Method == "REQMOD":
+		req.Request.ContentLength = -1
+	case req.Method == "RESPMOD":
+		req.Response.ContentLength = -1
+	}
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+
+	if req.bufferedBody != nil {
+		// The new body is read from the buffered one, so it must
+		// be kept until the transaction is over.
+		req.encodedBody = req.bufferedBody
+		req.bufferedBody = nil
+	}
+	return true, nil
+}
+
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// newDeflateReader decodes the deflate coding, which RFC 9110 defines as
+// the zlib format, but which some servers send as raw deflate data.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(2)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if len(head) == 2 && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+func newBrotliReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(brotli.NewReader(r)), nil
+}
+
+// zstdMaxWindow limits the window of zstd data to the 8 MB that RFC 9659
+// allows for the zstd content-coding, so that a body can't make the
+// decoder allocate much more.
+const zstdMaxWindow = 8 << 20
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
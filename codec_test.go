@@ -0,0 +1,177 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipped(s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func brotlied(s string) []byte {
+	var buf bytes.Buffer
+	bw := brotli.NewWriter(&buf)
+	io.WriteString(bw, s)
+	bw.Close()
+	return buf.Bytes()
+}
+
+func zstded(s string) []byte {
+	var buf bytes.Buffer
+	zw, _ := zstd.NewWriter(&buf)
+	io.WriteString(zw, s)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func compressedResponse(encoding string, body []byte) *Request {
+	h := http.Header{"Content-Type": {"text/plain"}}
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	return &Request{
+		Method:   "RESPMOD",
+		Response: &http.Response{Header: h, ContentLength: int64(len(body)), Body: io.NopCloser(bytes.NewReader(body))},
+		hasBody:  true,
+	}
+}
+
+func TestDecompressBody(t *testing.T) {
+	const text = "The quick brown fox jumps over the lazy dog."
+
+	var zlibbed, deflated bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	io.WriteString(zw, text)
+	zw.Close()
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	io.WriteString(fw, text)
+	fw.Close()
+
+	var stacked bytes.Buffer
+	zw = zlib.NewWriter(&stacked)
+	zw.Write(gzipped(text))
+	zw.Close()
+
+	tests := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"gzip", gzipped(text)},
+		{"X-GZIP", gzipped(text)},
+		{"deflate", zlibbed.Bytes()},
+		{"deflate", deflated.Bytes()},
+		{"gzip, deflate", stacked.Bytes()},
+		{"br", brotlied(text)},
+		{"zstd", zstded(text)},
+	}
+	for _, tt := range tests {
+		req := compressedResponse(tt.encoding, tt.body)
+		ok, err := req.DecompressBody()
+		if !ok || err != nil {
+			t.Errorf("%s: DecompressBody = %v, %v", tt.encoding, ok, err)
+			continue
+		}
+		got, err := io.ReadAll(req.Response.Body)
+		if err != nil || string(got) != text {
+			t.Errorf("%s: body = %q, %v", tt.encoding, got, err)
+		}
+		if h := req.Response.Header; h.Get("Content-Encoding") != "" || req.Response.ContentLength != -1 {
+			t.Errorf("%s: headers not updated: %v, length %d", tt.encoding, h, req.Response.ContentLength)
+		}
+	}
+
+	req := compressedResponse("identity", []byte(text))
+	if ok, err := req.DecompressBody(); ok || err != nil {
+		t.Errorf("identity: DecompressBody = %v, %v", ok, err)
+	}
+
+	req = compressedResponse("compress", []byte("\x1f\x9d\x90hello"))
+	var uerr *UnsupportedEncodingError
+	if _, err := req.DecompressBody(); !errors.As(err, &uerr) || uerr.Coding != "compress" {
+		t.Errorf("compress: DecompressBody error = %v", err)
+	}
+	if req.Response.Header.Get("Content-Encoding") != "compress" {
+		t.Error("compress: headers changed although the body couldn't be decompressed")
+	}
+
+	// A zstd frame whose window is larger than the coding allows.
+	req = compressedResponse("zstd", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0xa0})
+	req.DecompressBody()
+	if _, err := io.ReadAll(req.Response.Body); !errors.Is(err, zstd.ErrWindowSizeExceeded) {
+		t.Errorf("zstd: error for a 1 GB window = %v", err)
+	}
+}
+
+func TestRegisterCodec(t *testing.T) {
+	// A toy coding that upper-cases the body on decompression.
+	RegisterCodec("x-upper", Codec{NewReader: func(r io.Reader) (io.ReadCloser, error) {
+		data, err := io.ReadAll(r)
+		return io.NopCloser(strings.NewReader(strings.ToUpper(string(data)))), err
+	}})
+	defer func() {
+		codecs.Lock()
+		delete(codecs.m, "x-upper")
+		codecs.Unlock()
+	}()
+
+	h := http.Header{"Content-Encoding": {"gzip, X-Upper"}}
+	if !CanDecompress(h) {
+		t.Fatal("CanDecompress is false for registered codings")
+	}
+	req := compressedResponse(h.Get("Content-Encoding"), []byte("hello"))
+	req.Response.Header = h
+	if _, err := req.DecompressBody(); err != nil {
+		t.Fatal(err)
+	}
+	// x-upper was applied last, so it is undone first, and gzip can't
+	// decode what it produces.
+	if _, err := io.ReadAll(req.Response.Body); err == nil {
+		t.Error("expected an error decoding gzip")
+	}
+
+	req = compressedResponse("x-upper", []byte("hello"))
+	req.DecompressBody()
+	if got, _ := io.ReadAll(req.Response.Body); string(got) != "HELLO" {
+		t.Errorf("body = %q", got)
+	}
+}
+
+func TestDecodeCompressedBody(t *testing.T) {
+	req := compressedResponse("gzip", gzipped(`{"user":{"email":"a@example.com"}}`))
+	req.Response.Header.Set("Content-Type", "application/json")
+	d, err := req.DecodeBody(1 << 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := d.Get("user.email"); v != "a@example.com" {
+		t.Errorf("user.email = %v", v)
+	}
+	if req.Response.Header.Get("Content-Encoding") != "gzip" {
+		t.Error("DecodeBody changed the message")
+	}
+
+	req = compressedResponse("gzip", gzipped(`{"padding":"`+strings.Repeat("x", 2000)+`"}`))
+	req.Response.Header.Set("Content-Type", "application/json")
+	if _, err := req.DecodeBody(1 << 10); err != ErrBodyTooLarge {
+		t.Errorf("decompressed body over the limit: err = %v", err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Compatibility profiles for clients that deviate from RFC 3507.
+
+package icap
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// A CompatProfile works around the nonstandard behavior of a family of
+// ICAP clients. Set Server.Compat to one of the predefined profiles, or
+// to a profile of your own. Each workaround is off unless its field is
+// set, since each one bends the protocol for clients that behave.
+type CompatProfile struct {
+	Name string // e.g. "c-icap"
+
+	// Dialect, if not nil, is used to parse requests when
+	// Server.Dialect is nil.
+	Dialect Dialect
+
+	// Assume204 treats every request as allowing 204 No Modifications
+	// (see Request.Allows204), for clients that expect 204 responses
+	// without sending Allow: 204.
+	Assume204 bool
+
+	// LooseIEOF accepts the ieof chunk extension in any case and among
+	// other extensions, and on the last chunk of data of a preview as
+	// well as on the zero-length chunk that ends it. Clients that send
+	// their whole body after Preview: 0, marking the data chunk with
+	// ieof, would otherwise be sent 100 Continue and wait forever.
+	LooseIEOF bool
+
+	// RFCHeaderCase writes the names of ICAP response headers as
+	// RFC 3507 spells them (ISTag, Options-TTL, Service-ID) rather than
+	// in Go's canonical form (Istag, Options-Ttl, Service-Id), for
+	// clients that match header names case-sensitively.
+	RFCHeaderCase bool
+}
+
+var (
+	// CICAPCompat suits clients built on the c-icap client library,
+	// and others that share their quirks.
+	CICAPCompat = &CompatProfile{
+		Name:          "c-icap",
+		Dialect:       LenientDialect{},
+		Assume204:     true,
+		LooseIEOF:     true,
+		RFCHeaderCase: true,
+	}
+
+	// SquidCompat suits Squid and the clients derived from it.
+	SquidCompat = &CompatProfile{
+		Name:          "squid",
+		Dialect:       LenientDialect{},
+		LooseIEOF:     true,
+		RFCHeaderCase: true,
+	}
+)
+
+// noCompat is the profile of a server without workarounds.
+var noCompat CompatProfile
+
+func (srv *Server) compat() *CompatProfile {
+	if srv == nil || srv.Compat == nil {
+		return &noCompat
+	}
+	return srv.Compat
+}
+
+// rfcHeaderNames maps the canonical forms of ICAP header names to the
+// spelling used in RFC 3507, where they differ.
+var rfcHeaderNames = map[string]string{
+	"Istag":       "ISTag",
+	"Options-Ttl": "Options-TTL",
+	"Service-Id":  "Service-ID",
+	"X-Client-Ip": "X-Client-IP",
+	"X-Server-Ip": "X-Server-IP",
+}
+
+// writeRFCHeader writes h in wire format like h.Write, but with the
+// header names spelled as in RFC 3507.
+func writeRFCHeader(w io.Writer, h http.Header) error {
+	var buf bytes.Buffer
+	if err := h.Write(&buf); err != nil {
+		return err
+	}
+	for _, line := range strings.SplitAfter(buf.String(), "\r\n") {
+		if name, rest, ok := strings.Cut(line, ":"); ok {
+			if rfc, ok := rfcHeaderNames[name]; ok {
+				line = rfc + ":" + rest
+			}
+		}
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isIEOF reports whether ext, the extensions of a chunk, is the ieof
+// extension, or with loose set, whether it includes it in any case.
+func isIEOF(ext []byte, loose bool) bool {
+	if !loose {
+		return bytes.Equal(bytes.TrimSpace(ext), []byte("ieof"))
+	}
+	for _, e := range bytes.Split(ext, []byte(";")) {
+		if bytes.EqualFold(bytes.TrimSpace(e), []byte("ieof")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func compatRequest(header, body string) string {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	return "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		header +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr + body
+}
+
+func TestCompatLooseIEOF(t *testing.T) {
+	tests := []struct {
+		body, want string
+	}{
+		// The whole body after Preview: 0, with ieof on its data chunk.
+		{"5; ieof\r\nhello\r\n0\r\n\r\n", "hello"},
+		// ieof in upper case, after another extension.
+		{"0; x=1; IEOF\r\n\r\n", ""},
+	}
+	for _, tt := range tests {
+		var got string
+		var readErr error
+		h := HandlerFunc(func(w ResponseWriter, req *Request) {
+			b, err := io.ReadAll(req.Response.Body)
+			got, readErr = string(b), err
+			w.WriteHeader(StatusNoContent, nil, false)
+		})
+
+		resp := roundTrip(t, &Server{Handler: h}, compatRequest("Preview: 0\r\n", tt.body))
+		if !strings.HasPrefix(resp, "ICAP/1.0 100 Continue") {
+			t.Errorf("%q without Compat: no 100 Continue:\n%s", tt.body, resp)
+		}
+
+		resp = roundTrip(t, &Server{Handler: h, Compat: CICAPCompat}, compatRequest("Preview: 0\r\n", tt.body))
+		if !strings.HasPrefix(resp, "ICAP/1.0 204") || got != tt.want || readErr != nil {
+			t.Errorf("%q with Compat: body %q (err %v), response:\n%s", tt.body, got, readErr, resp)
+		}
+	}
+}
+
+func TestCompatAssume204(t *testing.T) {
+	request := compatRequest("", "5\r\nhello\r\n0\r\n\r\n")
+	if resp := roundTrip(t, &Server{Handler: HandlerFunc(Unmodified)}, request); !strings.HasPrefix(resp, "ICAP/1.0 200") {
+		t.Errorf("without Compat:\n%s", resp)
+	}
+	if resp := roundTrip(t, &Server{Handler: HandlerFunc(Unmodified), Compat: CICAPCompat}, request); !strings.HasPrefix(resp, "ICAP/1.0 204") {
+		t.Errorf("with Compat:\n%s", resp)
+	}
+	if resp := roundTrip(t, &Server{Handler: HandlerFunc(Unmodified), Compat: SquidCompat}, request); !strings.HasPrefix(resp, "ICAP/1.0 200") {
+		t.Errorf("with SquidCompat:\n%s", resp)
+	}
+}
+
+func TestCompatHeaderCase(t *testing.T) {
+	var method string
+	h := HandlerFunc(func(w ResponseWriter, req *Request) {
+		method = req.Method
+		w.Header().Set("ISTag", `"compat-1"`)
+		w.Header().Set("Options-TTL", "60")
+		w.Header().Set("Methods", "RESPMOD")
+		w.WriteHeader(StatusOK, nil, false)
+	})
+	// A client that writes its method and header names in lower case.
+	request := "options icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"host: icap.example.net\r\n" +
+		"encapsulated: null-body=0\r\n" +
+		"\r\n"
+
+	resp := roundTrip(t, &Server{Handler: h}, request)
+	if method != "options" || !strings.Contains(resp, "\r\nIstag: ") {
+		t.Errorf("without Compat: method %q, response:\n%s", method, resp)
+	}
+	resp = roundTrip(t, &Server{Handler: h, Compat: SquidCompat}, request)
+	if method != "OPTIONS" {
+		t.Errorf("with Compat: method %q", method)
+	}
+	for _, want := range []string{"ICAP/1.0 200 OK\r\n", "\r\nISTag: \"compat-1\"\r\n", "\r\nOptions-TTL: 60\r\n", "\r\nMethods: RESPMOD\r\n"} {
+		if !strings.Contains(resp, want) {
+			t.Errorf("response lacks %q:\n%s", want, resp)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Compression of encapsulated bodies on the wire between Client and Server.
+
+package icap
+
+import (
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+)
+
+// CompressionHeader is the ICAP header that negotiates transport
+// compression. A Client with Compression set offers it in each request;
+// a Server that accepts it marks its 100 Continue and its responses with
+// bodies with it.
+const CompressionHeader = "X-ICAP-Compression"
+
+// A TransportCompression compresses encapsulated bodies with deflate on
+// the wire between a Client and a Server, to save bandwidth when the
+// proxy and the ICAP server are far apart. It is an extension that only
+// this package's Client and Server understand; other servers ignore the
+// offer, and other clients never make it, so it is safe to enable on
+// either side.
+//
+// The server's response bodies are compressed whenever the client
+// offers compression. The client's request body is compressed only
+// after a preview, once the server's 100 Continue has accepted the
+// offer, since the server can't be asked sooner.
+//
+// The bodies are decompressed before handlers and callers see them, so
+// it makes no difference to anything but the connection.
+type TransportCompression struct {
+	// Dictionary, if not nil, is a preset dictionary (see
+	// flate.NewWriterDict): content typical of the bodies, such as
+	// common HTML and JavaScript, which makes small bodies compress
+	// much better. The client and server must have the same dictionary;
+	// if they don't, compression is not used.
+	Dictionary []byte
+
+	// Level is the flate compression level. If zero or invalid,
+	// flate.DefaultCompression is used.
+	Level int
+}
+
+// token returns the value of CompressionHeader for t, which names its
+// dictionary by a hash.
+func (t *TransportCompression) token() string {
+	if len(t.Dictionary) == 0 {
+		return "deflate"
+	}
+	sum := sha256.Sum256(t.Dictionary)
+	return "deflate; dict=" + hex.EncodeToString(sum[:4])
+}
+
+// accepts reports whether value, a CompressionHeader field, offers the
+// compression t does. A nil t accepts nothing.
+func (t *TransportCompression) accepts(value string) bool {
+	if t == nil || value == "" {
+		return false
+	}
+	want := strings.ReplaceAll(t.token(), " ", "")
+	for _, offer := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.ReplaceAll(strings.TrimSpace(offer), " ", ""), want) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TransportCompression) level() int {
+	if t.Level == 0 || t.Level < flate.HuffmanOnly || t.Level > flate.BestCompression {
+		return flate.DefaultCompression
+	}
+	return t.Level
+}
+
+// newWriter returns a writer that compresses what is written to it and
+// writes it to w. Closing it finishes the compressed stream and closes w.
+func (t *TransportCompression) newWriter(w io.WriteCloser) io.WriteCloser {
+	// NewWriterDict fails only for an invalid level.
+	fw, _ := flate.NewWriterDict(w, t.level(), t.Dictionary)
+	return &deflateWriter{fw: fw, w: w}
+}
+
+// newReader returns a reader that decompresses the stream read from r.
+// Once the compressed stream has ended, the rest of r is discarded, so
+// that r is read to its end.
+func (t *TransportCompression) newReader(r io.Reader) io.Reader {
+	return &inflateReader{fr: flate.NewReaderDict(r, t.Dictionary), r: r}
+}
+
+// A deflateWriter compresses the body written to a chunked writer.
+type deflateWriter struct {
+	fw *flate.Writer
+	w  io.WriteCloser
+}
+
+// Write compresses p, flushing it through to the chunked writer so that
+// the body streams as it is written.
+func (d *deflateWriter) Write(p []byte) (int, error) {
+	n, err := d.fw.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, d.fw.Flush()
+}
+
+func (d *deflateWriter) Close() error {
+	err := d.fw.Close()
+	if cerr := d.w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// An inflateReader decompresses a body read from a chunked reader.
+type inflateReader struct {
+	fr io.ReadCloser
+	r  io.Reader
+}
+
+func (z *inflateReader) Read(p []byte) (int, error) {
+	n, err := z.fr.Read(p)
+	if err == io.EOF {
+		if _, derr := io.Copy(io.Discard, z.r); derr != nil {
+			return n, derr
+		}
+	}
+	return n, err
+}
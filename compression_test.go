@@ -0,0 +1,126 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// A countingConn counts the bytes read and written on a connection.
+type countingConn struct {
+	net.Conn
+	read, written *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(int64(n))
+	return n, err
+}
+
+func TestTransportCompression(t *testing.T) {
+	dict := []byte("hello, world")
+	body := strings.Repeat("hello, world ", 1000)
+
+	for _, tc := range []struct {
+		name       string
+		server     *TransportCompression
+		client     *TransportCompression
+		compressed bool
+	}{
+		{"both", &TransportCompression{Dictionary: dict}, &TransportCompression{Dictionary: dict}, true},
+		{"no dictionary", &TransportCompression{}, &TransportCompression{Level: 1}, true},
+		{"different dictionaries", &TransportCompression{Dictionary: dict}, &TransportCompression{}, false},
+		{"server only", &TransportCompression{}, nil, false},
+		{"client only", nil, &TransportCompression{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := &Server{Compression: tc.server, Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+				got, err := io.ReadAll(req.Request.Body)
+				if err != nil {
+					t.Error(err)
+				}
+				if string(got) != body {
+					t.Errorf("server read %d bytes, want %d", len(got), len(body))
+				}
+				req.Request.Body = io.NopCloser(bytes.NewReader(got))
+				w.WriteHeader(StatusOK, req.Request, true)
+				io.WriteString(w, strings.ToUpper(body))
+			})}
+			u := startServer(t, srv, "/reqmod")
+
+			var read, written atomic.Int64
+			c := &Client{
+				Compression: tc.client,
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+					if err != nil {
+						return nil, err
+					}
+					return countingConn{conn, &read, &written}, nil
+				},
+			}
+			httpReq, _ := http.NewRequest("POST", "http://www.example.com/", strings.NewReader(body))
+			req, err := NewRequest("REQMOD", u, httpReq, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Preview", "5")
+			resp, err := c.Do(context.Background(), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != StatusOK || resp.Request == nil {
+				t.Fatalf("unexpected response: %+v", resp)
+			}
+			got, err := io.ReadAll(resp.Request.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != strings.ToUpper(body) {
+				t.Errorf("client read %d bytes, want %d", len(got), len(body))
+			}
+
+			small := func(n int64) bool { return n < int64(len(body))/4 }
+			if small(written.Load()) != tc.compressed || small(read.Load()) != tc.compressed {
+				t.Errorf("client wrote %d bytes and read %d for a %d-byte body; compressed = %v", written.Load(), read.Load(), len(body), tc.compressed)
+			}
+			if (resp.Header.Get(CompressionHeader) != "") != tc.compressed {
+				t.Errorf("%s: %q", CompressionHeader, resp.Header.Get(CompressionHeader))
+			}
+		})
+	}
+}
+
+func TestTransportCompressionAccepts(t *testing.T) {
+	z := &TransportCompression{Dictionary: []byte("dictionary")}
+	tok := z.token()
+	for _, value := range []string{tok, "gzip, " + tok, strings.ToUpper(tok), strings.ReplaceAll(tok, " ", "")} {
+		if !z.accepts(value) {
+			t.Errorf("%q not accepted", value)
+		}
+	}
+	for _, value := range []string{"", "deflate", "deflate; dict=00000000"} {
+		if z.accepts(value) {
+			t.Errorf("%q accepted", value)
+		}
+	}
+	if (*TransportCompression)(nil).accepts("deflate") {
+		t.Error("nil TransportCompression accepted deflate")
+	}
+}
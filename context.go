@@ -0,0 +1,141 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Request contexts, and typed keys for the values they carry.
+
+package icap
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// A ContextKey identifies a value of type T in a context.Context. Keys
+// made by separate calls to NewContextKey are distinct even if their
+// names are the same, so packages that define their own keys don't
+// collide.
+type ContextKey[T any] struct {
+	name string
+}
+
+// NewContextKey returns a new key. The name is used only by String.
+func NewContextKey[T any](name string) *ContextKey[T] {
+	return &ContextKey[T]{name: name}
+}
+
+func (k *ContextKey[T]) String() string {
+	return "icap context key " + k.name
+}
+
+// WithValue returns a context based on ctx that carries v under k.
+func (k *ContextKey[T]) WithValue(ctx context.Context, v T) context.Context {
+	return context.WithValue(ctx, k, v)
+}
+
+// Value returns the value carried under k by ctx.
+func (k *ContextKey[T]) Value(ctx context.Context) (v T, ok bool) {
+	v, ok = ctx.Value(k).(T)
+	return v, ok
+}
+
+// The keys for the values shared by the package's handlers and
+// middleware. A Server puts the user and trace ID in the context of each
+// request it receives; middleware may replace them, for example after
+// authenticating the user another way.
+var (
+	userKey    = NewContextKey[string]("user")
+	policyKey  = NewContextKey[string]("policy")
+	traceIDKey = NewContextKey[string]("trace ID")
+)
+
+// ContextWithUser returns a context based on ctx that carries the name
+// of the user on whose behalf a request is made.
+func ContextWithUser(ctx context.Context, user string) context.Context {
+	return userKey.WithValue(ctx, user)
+}
+
+// UserFromContext returns the user name carried by ctx. For a request
+// received by a Server, it is initially req.AuthenticatedUser(), if that
+// is not empty.
+func UserFromContext(ctx context.Context) (user string, ok bool) {
+	return userKey.Value(ctx)
+}
+
+// ContextWithPolicy returns a context based on ctx that carries the
+// name of the filtering policy that applies to a request, as chosen by
+// middleware for the user or the client.
+func ContextWithPolicy(ctx context.Context, policy string) context.Context {
+	return policyKey.WithValue(ctx, policy)
+}
+
+// PolicyFromContext returns the policy name carried by ctx.
+func PolicyFromContext(ctx context.Context) (policy string, ok bool) {
+	return policyKey.Value(ctx)
+}
+
+// ContextWithTraceID returns a context based on ctx that carries id, the
+// ID that ties together the logs and traces of a transaction.
+func ContextWithTraceID(ctx context.Context, id string) context.Context {
+	return traceIDKey.WithValue(ctx, id)
+}
+
+// TraceIDFromContext returns the trace ID carried by ctx. For a request
+// received by a Server, it is the trace ID from the request's W3C
+// traceparent header, or a random one if there is none.
+func TraceIDFromContext(ctx context.Context) (id string, ok bool) {
+	return traceIDKey.Value(ctx)
+}
+
+// Context returns the request's context. For a request received by a
+// Server, it is canceled when the transaction is over. For other
+// requests, it is context.Background() unless SetContext has been
+// called.
+func (req *Request) Context() context.Context {
+	if req.ctx == nil {
+		return context.Background()
+	}
+	return req.ctx
+}
+
+// SetContext replaces the request's context, usually with one derived
+// from it that carries more values, for the handlers that req is passed
+// to next.
+func (req *Request) SetContext(ctx context.Context) {
+	if ctx == nil {
+		panic("nil context")
+	}
+	req.ctx = ctx
+}
+
+// newRequestContext returns the context for a request received by a
+// Server.
+func newRequestContext(req *Request) (context.Context, context.CancelCauseFunc) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if user := req.AuthenticatedUser(); user != "" {
+		ctx = ContextWithUser(ctx, user)
+	}
+	id, ok := parseTraceparent(req.Header.Get("Traceparent"))
+	if !ok {
+		var b [16]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	return ContextWithTraceID(ctx, id), cancel
+}
+
+// parseTraceparent returns the trace ID from a W3C traceparent header,
+// such as "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func parseTraceparent(v string) (id string, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 {
+		return "", false
+	}
+	id = strings.ToLower(parts[1])
+	if _, err := hex.DecodeString(id); err != nil || id == strings.Repeat("0", 32) {
+		return "", false
+	}
+	return id, true
+}
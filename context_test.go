@@ -0,0 +1,59 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"context"
+	"testing"
+)
+
+func TestContextKey(t *testing.T) {
+	a := NewContextKey[string]("name")
+	b := NewContextKey[string]("name")
+	ctx := a.WithValue(context.Background(), "from a")
+	if v, ok := a.Value(ctx); !ok || v != "from a" {
+		t.Errorf("a.Value = %q, %v", v, ok)
+	}
+	if v, ok := b.Value(ctx); ok {
+		t.Errorf("b.Value = %q, a key with the same name collided", v)
+	}
+	if v, ok := PolicyFromContext(ContextWithPolicy(ctx, "strict")); !ok || v != "strict" {
+		t.Errorf("PolicyFromContext = %q, %v", v, ok)
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	var ctx context.Context
+	var user, traceID string
+	records := make(chan *AuditRecord, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			ctx = req.Context()
+			user, _ = UserFromContext(ctx)
+			traceID, _ = TraceIDFromContext(ctx)
+			req.SetContext(ContextWithUser(ctx, "bob"))
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		Audit: func(r *AuditRecord) { records <- r },
+	}
+	roundTrip(t, srv, "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"X-Authenticated-User: V2luTlQ6Ly9FWEFNUExFL2FsaWNl\r\n"+
+		"Traceparent: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01\r\n"+
+		"Encapsulated: null-body=0\r\n\r\n")
+
+	if user != "EXAMPLE/alice" {
+		t.Errorf("user = %q, want EXAMPLE/alice", user)
+	}
+	if traceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace ID = %q", traceID)
+	}
+	if ctx.Err() == nil {
+		t.Error("context not canceled after the transaction")
+	}
+	if r := <-records; r.User != "bob" {
+		t.Errorf("audit record has user %q; want the one set by the handler", r.User)
+	}
+}
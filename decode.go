@@ -0,0 +1,186 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Inspection and modification of JSON and form-encoded bodies.
+
+package icap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupportedBody is returned by DecodeBody when the body is not JSON
+// or form-encoded, or is compressed with a coding that has no registered
+// Codec.
+var ErrUnsupportedBody = errors.New("icap: body is not JSON or form-encoded")
+
+// A DecodedBody is the parsed body of an encapsulated message.
+type DecodedBody struct {
+	// JSON is the decoded value of a JSON body, made of the types used
+	// by encoding/json, with numbers as json.Number so that they are
+	// written back unchanged. It is nil for a form.
+	JSON interface{}
+
+	// Form holds the fields of a form-encoded body. It is nil for JSON.
+	Form url.Values
+}
+
+// DecodeBody parses the body of the encapsulated message (the HTTP request
+// for REQMOD, the HTTP response for RESPMOD) if its Content-Type is
+// application/json (or another JSON type, such as application/ld+json)
+// or application/x-www-form-urlencoded. Bodies larger than maxSize bytes
+// give ErrBodyTooLarge, whether compressed or not. A body compressed with
+// a registered Codec is decompressed. The body is read with BufferedBody,
+// so the message can still be sent on unchanged.
+func (req *Request) DecodeBody(maxSize int64) (*DecodedBody, error) {
+	h := req.bodyHeader()
+	if !CanDecompress(h) {
+		return nil, ErrUnsupportedBody
+	}
+	mediaType, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	isJSON := mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	if !isJSON && mediaType != "application/x-www-form-urlencoded" {
+		return nil, ErrUnsupportedBody
+	}
+
+	bb, err := req.BufferedBody(maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if !bb.InMemory() {
+		return nil, ErrBodyTooLarge
+	}
+	r, err := decompress(h, io.NopCloser(io.NewSectionReader(bb, 0, bb.Size())))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, ErrBodyTooLarge
+	}
+
+	if isJSON {
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		var v interface{}
+		if err := d.Decode(&v); err != nil {
+			return nil, err
+		}
+		return &DecodedBody{JSON: v}, nil
+	}
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, err
+	}
+	return &DecodedBody{Form: form}, nil
+}
+
+// Get returns the field at path, a list of names separated by dots, such
+// as "user.email". For a form, path is the name of a field, and the value
+// is its first value. Elements of JSON arrays are selected by index.
+func (d *DecodedBody) Get(path string) (interface{}, bool) {
+	if d.Form != nil {
+		if vv, ok := d.Form[path]; ok && len(vv) > 0 {
+			return vv[0], true
+		}
+		return nil, false
+	}
+	v := d.JSON
+	for _, name := range strings.Split(path, ".") {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = c[name]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(name)
+			if err != nil || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			v = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Delete removes the field at path, as interpreted by Get, and reports
+// whether there was such a field. JSON array elements can't be removed.
+func (d *DecodedBody) Delete(path string) bool {
+	if d.Form != nil {
+		_, ok := d.Form[path]
+		d.Form.Del(path)
+		return ok
+	}
+	parent := d
+	name := path
+	if i := strings.LastIndexByte(path, '.'); i >= 0 {
+		v, ok := d.Get(path[:i])
+		if !ok {
+			return false
+		}
+		parent = &DecodedBody{JSON: v}
+		name = path[i+1:]
+	}
+	obj, ok := parent.JSON.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, ok = obj[name]
+	delete(obj, name)
+	return ok
+}
+
+// Encode returns the body in its original format. JSON objects are written
+// with their keys sorted.
+func (d *DecodedBody) Encode() ([]byte, error) {
+	if d.Form != nil {
+		return []byte(d.Form.Encode()), nil
+	}
+	return json.Marshal(d.JSON)
+}
+
+// SetDecodedBody replaces the body of the encapsulated message with d,
+// encoded and uncompressed, and updates its Content-Length. The handler must then send the
+// message on, for example by returning ActionModify from a Stage.
+func (req *Request) SetDecodedBody(d *DecodedBody) error {
+	body := req.bodyPtr()
+	if body == nil {
+		return errors.New("icap: no encapsulated message to set the body of")
+	}
+	data, err := d.Encode()
+	if err != nil {
+		return err
+	}
+	*body = io.NopCloser(bytes.NewReader(data))
+	n := int64(len(data))
+	switch {
+	case req.Method == "REQMOD":
+		req.Request.ContentLength = n
+	case req.Method == "RESPMOD":
+		req.Response.ContentLength = n
+	}
+	req.bodyHeader().Set("Content-Length", strconv.FormatInt(n, 10))
+	req.bodyHeader().Del("Content-Encoding")
+	req.hasBody = true
+
+	if req.bufferedBody != nil {
+		req.bufferedBody.close()
+	}
+	req.bufferedBody = &BufferedBody{SectionReader: io.NewSectionReader(bytes.NewReader(data), 0, n)}
+	return nil
+}
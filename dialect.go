@@ -0,0 +1,226 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Dialects: the variations of the ICAP wire format spoken by different
+// implementations.
+
+package icap
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Dialect parses and formats the parts of an ICAP message whose syntax
+// varies between implementations. Interoperability fixes for a particular
+// vendor belong in a Dialect rather than in the core parser.
+type Dialect interface {
+	// ParseRequestLine splits the first line of a request into its
+	// method, URI, and protocol version. Deviations that it tolerates
+	// are recorded in diag.
+	ParseRequestLine(line string, diag *Diagnostics) (method, uri, proto string, err error)
+
+	// ParseEncapsulated parses the value of an Encapsulated header.
+	// The sections are returned in the order they appear in the message.
+	// Deviations that it tolerates are recorded in diag.
+	ParseEncapsulated(value string, diag *Diagnostics) ([]Section, error)
+
+	// FormatEncapsulated formats sections as the value of an
+	// Encapsulated header.
+	FormatEncapsulated(sections []Section) string
+}
+
+// A Section is an entry in an Encapsulated header: the name of a part of
+// the encapsulated message ("req-hdr", "res-hdr", "req-body", "res-body",
+// "opt-body", or "null-body") and its offset from the start of the
+// encapsulated data.
+type Section struct {
+	Name   string
+	Offset int
+}
+
+// A Diagnostic describes a deviation from RFC 3507 that was tolerated
+// while parsing a request.
+type Diagnostic struct {
+	Part    string // the part of the message: "request-line" or "Encapsulated"
+	Problem string // what was wrong with it
+	Value   string // the text as received
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%s: %s: %q", d.Part, d.Problem, d.Value)
+}
+
+// Diagnostics collects the Diagnostic records for a request.
+type Diagnostics []Diagnostic
+
+// Add records a Diagnostic. It does nothing if d is nil.
+func (d *Diagnostics) Add(part, problem, value string) {
+	if d != nil {
+		*d = append(*d, Diagnostic{part, problem, value})
+	}
+}
+
+// StrictDialect implements the syntax of RFC 3507 exactly.
+// It is the default.
+type StrictDialect struct{}
+
+func (StrictDialect) ParseRequestLine(line string, diag *Diagnostics) (method, uri, proto string, err error) {
+	f := strings.SplitN(line, " ", 3)
+	if len(f) < 3 {
+		return "", "", "", &badStringError{"malformed ICAP request", line}
+	}
+	return f[0], f[1], f[2], nil
+}
+
+func (StrictDialect) ParseEncapsulated(value string, diag *Diagnostics) ([]Section, error) {
+	var sections []Section
+	for _, item := range strings.Split(value, ", ") {
+		eq := strings.Index(item, "=")
+		if eq == -1 {
+			return nil, &badStringError{"malformed Encapsulated: header", value}
+		}
+		offset, err := strconv.Atoi(item[eq+1:])
+		if err != nil {
+			return nil, &badStringError{"malformed Encapsulated: header", value}
+		}
+		sections = append(sections, Section{Name: item[:eq], Offset: offset})
+	}
+	return sections, nil
+}
+
+func (StrictDialect) FormatEncapsulated(sections []Section) string {
+	items := make([]string, len(sections))
+	for i, s := range sections {
+		items[i] = s.Name + "=" + strconv.Itoa(s.Offset)
+	}
+	return strings.Join(items, ", ")
+}
+
+// LenientDialect accepts common deviations from RFC 3507:
+//
+//   - methods in lower or mixed case, which are converted to upper case;
+//   - runs of spaces or tabs between the parts of the request line;
+//   - a request line without a protocol version, taken to be ICAP/1.0;
+//   - Encapsulated entries in any order, in any case, and separated by
+//     commas with or without spaces.
+//
+// Each deviation it accepts is recorded in the request's Diagnostics.
+// It formats messages the same way as StrictDialect.
+type LenientDialect struct {
+	StrictDialect
+}
+
+func (LenientDialect) ParseRequestLine(line string, diag *Diagnostics) (method, uri, proto string, err error) {
+	f := strings.Fields(line)
+	switch len(f) {
+	case 2:
+		diag.Add("request-line", "missing protocol version", line)
+		f = append(f, "ICAP/1.0")
+	case 3:
+		if strings.Join(f, " ") != line {
+			diag.Add("request-line", "irregular whitespace", line)
+		}
+	default:
+		return "", "", "", &badStringError{"malformed ICAP request", line}
+	}
+	method, proto = strings.ToUpper(f[0]), strings.ToUpper(f[2])
+	if method != f[0] {
+		diag.Add("request-line", "method not in upper case", f[0])
+	}
+	if proto != f[2] {
+		diag.Add("request-line", "protocol not in upper case", f[2])
+	}
+	return method, f[1], proto, nil
+}
+
+func (LenientDialect) ParseEncapsulated(value string, diag *Diagnostics) ([]Section, error) {
+	var sections []Section
+	if _, err := (StrictDialect{}).ParseEncapsulated(value, nil); err != nil {
+		diag.Add("Encapsulated", "irregular separators or spacing", value)
+	}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, off, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, &badStringError{"malformed Encapsulated: header", value}
+		}
+		offset, err := strconv.Atoi(strings.TrimSpace(off))
+		if err != nil {
+			return nil, &badStringError{"malformed Encapsulated: header", value}
+		}
+		lower := strings.ToLower(strings.TrimSpace(name))
+		if lower != name {
+			diag.Add("Encapsulated", "section name not in lower case", name)
+		}
+		sections = append(sections, Section{Name: lower, Offset: offset})
+	}
+	sorted := func(i, j int) bool { return sections[i].Offset < sections[j].Offset }
+	if !sort.SliceIsSorted(sections, sorted) {
+		diag.Add("Encapsulated", "sections out of order", value)
+		sort.SliceStable(sections, sorted)
+	}
+	return sections, nil
+}
+
+// dialect returns the Dialect the server uses to parse requests.
+func (srv *Server) dialect() Dialect {
+	switch {
+	case srv != nil && srv.Dialect != nil:
+		return srv.Dialect
+	case srv.compat().Dialect != nil:
+		return srv.compat().Dialect
+	}
+	return StrictDialect{}
+}
+
+// newEncapsulation computes the layout of the encapsulated data from the
+// sections of an Encapsulated header.
+func newEncapsulation(sections []Section, diag *Diagnostics) (e encapsulation, err error) {
+	for i, s := range sections {
+		if i > 0 && s.Offset < sections[i-1].Offset {
+			return e, fmt.Errorf("Encapsulated: section %s out of order", s.Name)
+		}
+		length := -1 // unknown for a header at the end of the list
+		if i+1 < len(sections) {
+			length = sections[i+1].Offset - s.Offset
+		} else if s.Name == "req-hdr" || s.Name == "res-hdr" {
+			diag.Add("Encapsulated", "no body section", s.Name)
+		}
+		switch s.Name {
+		case "req-hdr":
+			e.reqHdrLen = length
+		case "res-hdr":
+			e.respHdrLen = length
+		case "req-body", "res-body", "opt-body", "null-body":
+			if i+1 < len(sections) {
+				return e, fmt.Errorf("%s must be the last section", s.Name)
+			}
+			if s.Name != "null-body" {
+				e.body = s.Name
+			}
+		default:
+			return e, &badStringError{"invalid key for Encapsulated: header", s.Name}
+		}
+		if i == 0 {
+			e.initialOffset = s.Offset
+		}
+	}
+	return e, nil
+}
+
+// parseEncapsulated parses the value of an Encapsulated header with d,
+// recording tolerated deviations in diag.
+func parseEncapsulated(d Dialect, s string, diag *Diagnostics) (encapsulation, error) {
+	sections, err := d.ParseEncapsulated(s, diag)
+	if err != nil {
+		return encapsulation{}, err
+	}
+	return newEncapsulation(sections, diag)
+}
@@ -0,0 +1,462 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Discovery of the ICAP servers a Client sends requests to.
+
+package icap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrNoBackends is returned by Client.Do when its Backends has no
+// servers to send the request to.
+var ErrNoBackends = errors.New("icap: no backends available")
+
+// A Target is an ICAP server found by a Resolver. As with DNS SRV records
+// (RFC 2782), the servers with the lowest Priority get the requests while
+// any of them are available, and each of those gets a share of them in
+// proportion to its Weight.
+type Target struct {
+	Addr     string // "host:port"
+	Priority uint16
+	Weight   uint16
+}
+
+// A Resolver returns the ICAP servers that provide a service.
+type Resolver interface {
+	Resolve(ctx context.Context) ([]Target, error)
+}
+
+// A StaticResolver is a Resolver with a fixed list of addresses, all with
+// the same priority and weight.
+type StaticResolver []string
+
+// Resolve returns the addresses in r as Targets.
+func (r StaticResolver) Resolve(context.Context) ([]Target, error) {
+	targets := make([]Target, len(r))
+	for i, addr := range r {
+		targets[i] = Target{Addr: addr}
+	}
+	return targets, nil
+}
+
+// An SRVResolver finds servers through DNS SRV records, such as those
+// for _icap._tcp.example.com, with their priorities and weights.
+type SRVResolver struct {
+	Service string // e.g. "icap"
+	Proto   string // e.g. "tcp"
+	Name    string // e.g. "example.com"
+
+	// Resolver is used for the lookups; if nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+}
+
+// Resolve looks up the SRV records.
+func (r *SRVResolver) Resolve(ctx context.Context) ([]Target, error) {
+	res := r.Resolver
+	if res == nil {
+		res = net.DefaultResolver
+	}
+	_, srvs, err := res.LookupSRV(ctx, r.Service, r.Proto, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]Target, len(srvs))
+	for i, srv := range srvs {
+		host := srv.Target
+		if n := len(host); n > 0 && host[n-1] == '.' {
+			host = host[:n-1]
+		}
+		targets[i] = Target{
+			Addr:     net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		}
+	}
+	return targets, nil
+}
+
+// Backends is a set of ICAP servers, discovered by a Resolver, among which
+// a Client spreads its requests. The set is refreshed periodically once
+// Start has been called. A server that disappears from the set gets no new
+// requests, but the transactions already in progress on it are allowed to
+// finish.
+//
+// If ProbeURL is set, Start also sends an OPTIONS request to each server
+// periodically. A server that fails to answer it with 200 OK gets no new
+// requests until it answers again, and one that advertises
+// Max-Connections gets no more transactions at once than that.
+type Backends struct {
+	Resolver Resolver
+
+	// Interval is the time between refreshes; if zero, 30 seconds.
+	Interval time.Duration
+
+	// OnChange, if not nil, is called after a refresh that changes the set,
+	// with the addresses that were added and removed.
+	OnChange func(added, removed []string)
+
+	// ProbeURL is the URL of the service that health probes ask for the
+	// OPTIONS of, such as "icap://icap.example.net/reqmod". Each probe is
+	// sent to a server of the set, whatever the host in the URL. If
+	// empty, servers aren't probed.
+	ProbeURL string
+
+	// ProbeInterval is the time between probes of a server; if zero, 10
+	// seconds. A server whose Options-TTL is shorter is probed again when
+	// its OPTIONS response expires.
+	ProbeInterval time.Duration
+
+	// ProbeTimeout limits the time each probe may take; if zero, 5 seconds.
+	ProbeTimeout time.Duration
+
+	// ProbeClient, if not nil, sends the probes; its Backends is ignored.
+	ProbeClient *Client
+
+	// OnHealthChange, if not nil, is called when a probe finds that a
+	// server has become unhealthy, with the error, or healthy again.
+	OnHealthChange func(addr string, healthy bool, err error)
+
+	mu       sync.Mutex
+	active   []*backend
+	draining map[string]*backend
+	stop     context.CancelFunc
+}
+
+type backend struct {
+	addr     string
+	priority uint16
+	weight   uint16
+	current  int // for smooth weighted round robin
+	inFlight int
+
+	unhealthy bool      // the last probe failed
+	maxConns  int       // from the last probe's Max-Connections; 0 if none
+	nextProbe time.Time // when the server is due to be probed
+}
+
+// Start resolves the set of servers, and probes them if ProbeURL is set.
+// Then it keeps refreshing and probing them in the background until ctx
+// is done or Stop is called. Errors from later refreshes leave the
+// previous set in place.
+func (b *Backends) Start(ctx context.Context) error {
+	if err := b.Refresh(ctx); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	if b.ProbeURL != "" {
+		b.probeDue(ctx)
+		go b.probeLoop(ctx)
+	}
+	b.mu.Lock()
+	if b.stop != nil {
+		b.stop()
+	}
+	b.stop = cancel
+	b.mu.Unlock()
+
+	interval := b.Interval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				b.Refresh(ctx)
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops the background refreshes.
+func (b *Backends) Stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stop != nil {
+		b.stop()
+		b.stop = nil
+	}
+}
+
+// Refresh resolves the set of servers now.
+func (b *Backends) Refresh(ctx context.Context) error {
+	targets, err := b.Resolver.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	current := make(map[string]*backend, len(b.active))
+	for _, be := range b.active {
+		current[be.addr] = be
+	}
+	var added []string
+	active := make([]*backend, 0, len(targets))
+	seen := make(map[string]bool, len(targets))
+	for _, t := range targets {
+		addr := t.Addr
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		be := current[addr]
+		if be == nil {
+			if be = b.draining[addr]; be != nil {
+				delete(b.draining, addr)
+			} else {
+				be = &backend{addr: addr}
+				added = append(added, addr)
+			}
+		}
+		be.priority, be.weight = t.Priority, t.Weight
+		active = append(active, be)
+	}
+	var removed []string
+	for addr, be := range current {
+		if seen[addr] {
+			continue
+		}
+		removed = append(removed, addr)
+		if be.inFlight > 0 {
+			if b.draining == nil {
+				b.draining = make(map[string]*backend)
+			}
+			b.draining[addr] = be
+		}
+	}
+	b.active = active
+	b.mu.Unlock()
+
+	if b.OnChange != nil && (len(added) > 0 || len(removed) > 0) {
+		b.OnChange(added, removed)
+	}
+	return nil
+}
+
+// Addrs returns the addresses of the servers that receive new requests.
+func (b *Backends) Addrs() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := make([]string, len(b.active))
+	for i, be := range b.active {
+		addrs[i] = be.addr
+	}
+	return addrs
+}
+
+// Unhealthy returns the addresses of the servers whose last health probe
+// failed.
+func (b *Backends) Unhealthy() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var addrs []string
+	for _, be := range b.active {
+		if be.unhealthy {
+			addrs = append(addrs, be.addr)
+		}
+	}
+	return addrs
+}
+
+// Draining returns the addresses of removed servers that still have
+// transactions in progress.
+func (b *Backends) Draining() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := make([]string, 0, len(b.draining))
+	for addr := range b.draining {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// acquire picks a server for a new transaction: one of the healthy
+// servers with the lowest priority that have room for another
+// transaction, chosen in proportion to their weights.
+// The release function must be called when the transaction is over.
+func (b *Backends) acquire() (addr string, release func(), err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var tier []*backend
+	for _, be := range b.active {
+		if be.unhealthy || be.maxConns > 0 && be.inFlight >= be.maxConns {
+			continue
+		}
+		switch {
+		case len(tier) == 0 || be.priority < tier[0].priority:
+			tier = append(tier[:0], be)
+		case be.priority == tier[0].priority:
+			tier = append(tier, be)
+		}
+	}
+	if len(tier) == 0 {
+		return "", nil, ErrNoBackends
+	}
+	be := pickWeighted(tier)
+	be.inFlight++
+	var once sync.Once
+	return be.addr, func() { once.Do(func() { b.release(be) }) }, nil
+}
+
+// pickWeighted chooses among tier by smooth weighted round robin, so that
+// each server gets requests in proportion to its weight, spread out
+// rather than in bursts. Servers of weight 0 are chosen only if all in
+// the tier have weight 0, in which case they take turns.
+func pickWeighted(tier []*backend) *backend {
+	total := 0
+	for _, be := range tier {
+		total += int(be.weight)
+	}
+	var best *backend
+	for _, be := range tier {
+		w := int(be.weight)
+		if total == 0 {
+			w = 1
+		}
+		be.current += w
+		if best == nil || be.current > best.current {
+			best = be
+		}
+	}
+	if total == 0 {
+		total = len(tier)
+	}
+	best.current -= total
+	return best
+}
+
+func (b *Backends) release(be *backend) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	be.inFlight--
+	if be.inFlight == 0 && b.draining[be.addr] == be {
+		delete(b.draining, be.addr)
+	}
+}
+
+// probeLoop probes the servers as they become due, until ctx is done.
+func (b *Backends) probeLoop(ctx context.Context) {
+	for {
+		t := time.NewTimer(b.probeDue(ctx))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// probeDue probes the servers that are due, and returns the time until
+// the next one is.
+func (b *Backends) probeDue(ctx context.Context) time.Duration {
+	interval := b.ProbeInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	now := time.Now()
+	b.mu.Lock()
+	var due []*backend
+	for _, be := range b.active {
+		if !now.Before(be.nextProbe) {
+			due = append(due, be)
+		}
+	}
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, be := range due {
+		wg.Add(1)
+		go func(be *backend) {
+			defer wg.Done()
+			b.probe(ctx, be, interval)
+		}(be)
+	}
+	wg.Wait()
+
+	wait := interval
+	now = time.Now()
+	b.mu.Lock()
+	for _, be := range b.active {
+		if d := be.nextProbe.Sub(now); d < wait {
+			wait = max(d, 0)
+		}
+	}
+	b.mu.Unlock()
+	return wait
+}
+
+// probe sends an OPTIONS request to be, and records the result.
+func (b *Backends) probe(ctx context.Context, be *backend, interval time.Duration) {
+	timeout := b.ProbeTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var c Client
+	if b.ProbeClient != nil {
+		c = *b.ProbeClient
+	}
+	c.Backends = nil
+	dial := c.DialContext
+	c.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		if dial != nil {
+			return dial(ctx, network, be.addr)
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, be.addr)
+	}
+
+	var caps *Capabilities
+	req, err := NewRequest("OPTIONS", b.ProbeURL, nil, nil)
+	if err == nil {
+		var resp *Response
+		if resp, err = c.Do(ctx, req); err == nil {
+			if resp.OptBody != nil {
+				resp.OptBody.Close()
+			}
+			if resp.StatusCode != StatusOK {
+				err = fmt.Errorf("icap: OPTIONS probe got status %d", resp.StatusCode)
+			} else {
+				caps, _ = resp.Capabilities()
+			}
+		}
+	}
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		// Stopped, rather than a verdict on the server.
+		return
+	}
+
+	next := interval
+	b.mu.Lock()
+	wasHealthy := !be.unhealthy
+	be.unhealthy = err != nil
+	if caps != nil {
+		be.maxConns = caps.MaxConnections
+		if caps.TTL > 0 && caps.TTL < next {
+			next = caps.TTL
+		}
+	}
+	be.nextProbe = time.Now().Add(next)
+	b.mu.Unlock()
+
+	if wasHealthy == (err != nil) && b.OnHealthChange != nil {
+		b.OnHealthChange(be.addr, err == nil, err)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// srvRecord is an SRV record served by fakeDNS.
+type srvRecord struct {
+	priority, weight, port uint16
+	target                 string
+}
+
+// fakeDNS returns a net.Resolver that answers every query with records,
+// over a DNS-over-TCP connection made with net.Pipe.
+func fakeDNS(records func() []srvRecord) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go func() {
+				defer server.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(server, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(server, query); err != nil {
+					return
+				}
+				resp := dnsResponse(query, records())
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				server.Write(append(length[:], resp...))
+			}()
+			return client, nil
+		},
+	}
+}
+
+// dnsResponse returns the response to query, a single-question DNS
+// message, with records as the answers.
+func dnsResponse(query []byte, records []srvRecord) []byte {
+	// The question runs from the end of the header to the end of its
+	// name, followed by its type and class.
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5
+
+	resp := append([]byte(nil), query[:2]...) // ID
+	resp = binary.BigEndian.AppendUint16(resp, 0x8180)
+	resp = binary.BigEndian.AppendUint16(resp, 1) // questions
+	resp = binary.BigEndian.AppendUint16(resp, uint16(len(records)))
+	resp = binary.BigEndian.AppendUint32(resp, 0) // authority and additional
+	resp = append(resp, query[12:end]...)
+	for _, r := range records {
+		var target []byte
+		for _, label := range strings.Split(strings.TrimSuffix(r.target, "."), ".") {
+			target = append(target, byte(len(label)))
+			target = append(target, label...)
+		}
+		target = append(target, 0)
+
+		resp = append(resp, 0xc0, 12)                  // the name in the question
+		resp = binary.BigEndian.AppendUint16(resp, 33) // SRV
+		resp = binary.BigEndian.AppendUint16(resp, 1)  // IN
+		resp = binary.BigEndian.AppendUint32(resp, 60) // TTL
+		resp = binary.BigEndian.AppendUint16(resp, uint16(6+len(target)))
+		resp = binary.BigEndian.AppendUint16(resp, r.priority)
+		resp = binary.BigEndian.AppendUint16(resp, r.weight)
+		resp = binary.BigEndian.AppendUint16(resp, r.port)
+		resp = append(resp, target...)
+	}
+	return resp
+}
+
+func TestSRVBackends(t *testing.T) {
+	records := []srvRecord{
+		{20, 5, 1344, "backup.example.com."},
+		{10, 3, 1344, "big.example.com."},
+		{10, 1, 1345, "small.example.com."},
+		{10, 0, 1344, "spare.example.com."},
+	}
+	b := &Backends{Resolver: &SRVResolver{
+		Service:  "icap",
+		Proto:    "tcp",
+		Name:     "example.com",
+		Resolver: fakeDNS(func() []srvRecord { return records }),
+	}}
+	if err := b.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.Addrs(); len(got) != 4 {
+		t.Fatalf("Addrs() = %v", got)
+	}
+
+	pick := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			addr, release, err := b.acquire()
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+			counts[addr]++
+		}
+		return counts
+	}
+
+	// The lowest priority tier gets every request, shared by weight.
+	counts := pick(400)
+	if counts["big.example.com:1344"] != 300 || counts["small.example.com:1345"] != 100 || len(counts) != 2 {
+		t.Errorf("priority 10 with weights 3, 1 and 0: picks = %v", counts)
+	}
+
+	// Without them, the next tier does.
+	records = records[:1]
+	if err := b.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if counts := pick(10); counts["backup.example.com:1344"] != 10 {
+		t.Errorf("priority 20 alone: picks = %v", counts)
+	}
+
+	// Servers of weight 0 take turns when no other has a weight.
+	records = []srvRecord{{0, 0, 1344, "a.example.com."}, {0, 0, 1344, "b.example.com."}}
+	if err := b.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if counts := pick(10); counts["a.example.com:1344"] != 5 || counts["b.example.com:1344"] != 5 {
+		t.Errorf("weights of 0: picks = %v", counts)
+	}
+}
+
+func TestBackendsProbe(t *testing.T) {
+	var probes atomic.Int32
+	healthy := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		if req.Method == "OPTIONS" {
+			probes.Add(1)
+			w.Header().Set("Methods", "REQMOD")
+			w.Header().Set("Max-Connections", "1")
+			w.Header().Set("Options-TTL", "1")
+		}
+		w.WriteHeader(StatusOK, nil, false)
+	})}
+	var failing atomic.Bool
+	failing.Store(true)
+	flaky := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		if failing.Load() {
+			w.WriteHeader(StatusServiceUnavailable, nil, false)
+			return
+		}
+		w.WriteHeader(StatusOK, nil, false)
+	})}
+	addrOf := func(u string) string {
+		return strings.TrimSuffix(strings.TrimPrefix(u, "icap://"), "/reqmod")
+	}
+	good := addrOf(startServer(t, healthy, "/reqmod"))
+	bad := addrOf(startServer(t, flaky, "/reqmod"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	type change struct {
+		addr    string
+		healthy bool
+	}
+	changes := make(chan change, 10)
+	b := &Backends{
+		Resolver:      StaticResolver{good, bad, down},
+		ProbeURL:      "icap://icap.example.net/reqmod",
+		ProbeInterval: time.Hour,
+		OnHealthChange: func(addr string, healthy bool, err error) {
+			if healthy != (err == nil) {
+				t.Errorf("OnHealthChange(%s, %v, %v)", addr, healthy, err)
+			}
+			changes <- change{addr, healthy}
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+
+	unhealthy := b.Unhealthy()
+	sort.Strings(unhealthy)
+	want := []string{bad, down}
+	sort.Strings(want)
+	if strings.Join(unhealthy, " ") != strings.Join(want, " ") {
+		t.Errorf("Unhealthy() = %v, want %v", unhealthy, want)
+	}
+	for i := 0; i < 2; i++ {
+		if c := <-changes; c.healthy || c.addr == good {
+			t.Errorf("health change %+v", c)
+		}
+	}
+
+	// Only the healthy server gets transactions, one at a time, as its
+	// Max-Connections says.
+	addr, release, err := b.acquire()
+	if err != nil || addr != good {
+		t.Fatalf("acquire() = %q, %v; want %q", addr, err, good)
+	}
+	if _, _, err := b.acquire(); err != ErrNoBackends {
+		t.Errorf("acquire() beyond Max-Connections: err = %v", err)
+	}
+	release()
+	if addr, release, err := b.acquire(); err != nil || addr != good {
+		t.Errorf("acquire() after release = %q, %v", addr, err)
+	} else {
+		release()
+	}
+
+	// The healthy server is probed again when its Options-TTL expires,
+	// long before ProbeInterval.
+	for deadline := time.Now().Add(3 * time.Second); probes.Load() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("server not probed again after its Options-TTL")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.Stop()
+
+	// An unhealthy server gets transactions again once it recovers.
+	b = &Backends{
+		Resolver:      StaticResolver{bad},
+		ProbeURL:      "icap://icap.example.net/reqmod",
+		ProbeInterval: 20 * time.Millisecond,
+		OnHealthChange: func(addr string, healthy bool, err error) {
+			changes <- change{addr, healthy}
+		},
+	}
+	if err := b.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Stop()
+	if c := <-changes; c.addr != bad || c.healthy {
+		t.Errorf("health change %+v", c)
+	}
+	if _, _, err := b.acquire(); err != ErrNoBackends {
+		t.Errorf("acquire() with no healthy server: err = %v", err)
+	}
+	failing.Store(false)
+	select {
+	case c := <-changes:
+		if c.addr != bad || !c.healthy {
+			t.Errorf("health change %+v", c)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no health change after recovery")
+	}
+	if addr, release, err := b.acquire(); err != nil || addr != bad {
+		t.Errorf("acquire() after recovery = %q, %v", addr, err)
+	} else {
+		release()
+	}
+}
@@ -38,11 +38,11 @@ Basic usage example:
 		case "OPTIONS":
 			h.Set("Methods", "REQMOD, RESPMOD")
 			h.Set("Allow", "204")
-			w.WriteHeader(200, nil, false)
+			w.WriteHeader(icap.StatusOK, nil, false)
 		case "REQMOD", "RESPMOD":
-			w.WriteHeader(204, nil, false) // No modifications
+			w.WriteHeader(icap.StatusNoContent, nil, false) // No modifications
 		default:
-			w.WriteHeader(405, nil, false)
+			w.WriteHeader(icap.StatusMethodNotAllowed, nil, false)
 		}
 	}
 */
@@ -0,0 +1,164 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Running a request through a server's handlers without a network.
+
+package icap
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+)
+
+// A DryRunResult is the outcome of Server.DryRun.
+type DryRunResult struct {
+	// Response is the ICAP response as the server wrote it, in wire
+	// format, including any 100 Continue sent before it. It can be
+	// rendered with Dump.
+	Response []byte
+
+	// Audit is the audit record of the transaction, redacted according
+	// to the server's AuditPolicy but not subject to its sampling. It is
+	// produced even if the server has no Audit hook.
+	Audit *AuditRecord
+}
+
+// DryRun sends req to srv's handler over an in-memory connection, as a
+// Client would, and returns the response the handler wrote and the
+// audit record of the transaction. It is meant for developing handlers
+// and checking a configuration: no listener is needed, and the
+// transaction is not counted among the server's connections.
+func (srv *Server) DryRun(ctx context.Context, req *Request) (*DryRunResult, error) {
+	handler := srv.Handler
+	if handler == nil {
+		handler = DefaultServeMux
+	}
+	serverEnd, clientEnd := net.Pipe()
+	c, err := newConn(serverEnd, srv, handler)
+	if err != nil {
+		return nil, err
+	}
+	c.detached = true
+	result := new(DryRunResult)
+	c.auditSink = func(r *AuditRecord) { result.Audit = r }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.serve(srv.DebugLevel)
+	}()
+
+	dc := newDryRunConn(clientEnd)
+	client := &Client{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dc, nil
+		},
+	}
+	resp, err := client.Do(ctx, req)
+	if err == nil {
+		err = drainResponse(resp)
+	}
+	dc.Close()
+	<-done
+	if err != nil {
+		return nil, err
+	}
+	result.Response = dc.received.Bytes()
+	return result, nil
+}
+
+// drainResponse reads the body of resp to the end, so that the whole
+// response is received.
+func drainResponse(resp *Response) error {
+	var body io.ReadCloser
+	switch {
+	case resp.OptBody != nil:
+		body = resp.OptBody
+	case resp.Response != nil && resp.Response.Body != nil:
+		body = resp.Response.Body
+	case resp.Request != nil && resp.Request.Body != nil:
+		body = resp.Request.Body
+	default:
+		return nil
+	}
+	_, err := io.Copy(io.Discard, body)
+	body.Close()
+	return err
+}
+
+// A dryRunConn is the client end of the connection used by DryRun. It
+// keeps a copy of the data read from its Conn, and queues the data
+// written to it, to be sent in the background: net.Pipe has no buffer,
+// so a client blocked writing the end of a request body would otherwise
+// keep the server from writing a response that it has started early.
+type dryRunConn struct {
+	net.Conn
+	received bytes.Buffer
+
+	mu      sync.Mutex
+	cond    sync.Cond
+	pending []byte
+	err     error // from writing to Conn
+	closed  bool
+}
+
+func newDryRunConn(c net.Conn) *dryRunConn {
+	dc := &dryRunConn{Conn: c}
+	dc.cond.L = &dc.mu
+	go dc.send()
+	return dc
+}
+
+func (c *dryRunConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.received.Write(p[:n])
+	return n, err
+}
+
+func (c *dryRunConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.pending = append(c.pending, p...)
+	c.cond.Signal()
+	return len(p), nil
+}
+
+// send writes the queued data to c.Conn until c is closed.
+func (c *dryRunConn) send() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		for len(c.pending) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		if c.closed {
+			return
+		}
+		data := c.pending
+		c.pending = nil
+		c.mu.Unlock()
+		_, err := c.Conn.Write(data)
+		c.mu.Lock()
+		if err != nil {
+			c.err = err
+			return
+		}
+	}
+}
+
+func (c *dryRunConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Signal()
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,60 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("/respmod", func(w ResponseWriter, req *Request) {
+		req.Response.Header.Set("X-Checked", "1")
+		req.Audit().AddModification("X-Checked added")
+		w.Header().Set("ISTag", `"dry-run"`)
+		w.WriteHeader(StatusOK, req.Response, true)
+		io.Copy(w, req.Response.Body)
+	})
+	srv := &Server{Handler: mux}
+
+	httpReq, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	httpResp := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain"}},
+		Body:          io.NopCloser(strings.NewReader("hello, world")),
+		ContentLength: -1,
+		Request:       httpReq,
+	}
+	req, err := NewRequest("RESPMOD", "icap://icap.example.net/respmod", httpReq, httpResp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := srv.DryRun(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := string(result.Response)
+	if !strings.HasPrefix(resp, "ICAP/1.0 200 ") || !strings.Contains(resp, "X-Checked: 1") || !strings.Contains(resp, "hello, world") {
+		t.Errorf("unexpected response:\n%s", resp)
+	}
+	if findings := Lint(result.Response); len(findings) > 0 {
+		t.Errorf("response has problems: %v", findings)
+	}
+	a := result.Audit
+	if a == nil {
+		t.Fatal("no audit record")
+	}
+	if a.Service != "/respmod" || a.Status != StatusOK || a.Verdict != VerdictModify || len(a.Modifications) != 1 {
+		t.Errorf("audit record = %+v", a)
+	}
+}
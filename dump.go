@@ -0,0 +1,423 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Rendering ICAP messages in wire format for people to read, and checking
+// them for violations of RFC 3507.
+
+package icap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A Finding is a violation of RFC 3507 found in a message by Lint or
+// Format.
+type Finding struct {
+	Offset  int    // where the problem is, in bytes from the start of the message
+	Problem string // what is wrong
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("byte %d: %s", f.Offset, f.Problem)
+}
+
+// Lint checks msg, an ICAP request or response in wire format, for
+// violations of RFC 3507: malformed start lines and header lines, missing
+// headers, Encapsulated offsets that don't match the encapsulated HTTP
+// headers, malformed chunks, and previews of the wrong length. msg may
+// hold a request together with the rest of its body sent after
+// 100 Continue.
+func Lint(msg []byte) []Finding {
+	d := newDumper(msg, io.Discard)
+	d.dump()
+	return d.findings
+}
+
+// Format writes an annotated rendering of msg to w: each line of the ICAP
+// header and of the encapsulated HTTP headers with its byte offset, each
+// chunk of the body with its size, labels for the sections named in the
+// Encapsulated header, and a note after each line where Lint finds a
+// problem. It returns the problems found.
+func Format(w io.Writer, msg []byte) ([]Finding, error) {
+	d := newDumper(msg, w)
+	d.dump()
+	return d.findings, d.err
+}
+
+// Dump returns the rendering of msg that Format would write.
+func Dump(msg []byte) string {
+	var b strings.Builder
+	Format(&b, msg)
+	return b.String()
+}
+
+// A dumper renders a message and collects the problems in it.
+type dumper struct {
+	msg      []byte
+	pos      int // the offset of the next line
+	w        io.Writer
+	err      error // the first error writing to w
+	findings []Finding
+}
+
+func newDumper(msg []byte, w io.Writer) *dumper {
+	return &dumper{msg: msg, w: w}
+}
+
+func (d *dumper) printf(format string, args ...interface{}) {
+	if d.err == nil {
+		_, d.err = fmt.Fprintf(d.w, format, args...)
+	}
+}
+
+// add records a problem at offset and notes it in the rendering.
+func (d *dumper) add(offset int, format string, args ...interface{}) {
+	f := Finding{offset, fmt.Sprintf(format, args...)}
+	d.findings = append(d.findings, f)
+	d.printf("%8s! %s\n", "", f.Problem)
+}
+
+// line returns the next line, without its line ending, and its offset.
+// ok is false if the message ends before the line does.
+func (d *dumper) line() (line string, offset int, ok bool) {
+	offset = d.pos
+	i := bytes.IndexByte(d.msg[d.pos:], '\n')
+	if i < 0 {
+		d.pos = len(d.msg)
+		return string(d.msg[offset:]), offset, false
+	}
+	d.pos += i + 1
+	line = string(d.msg[offset : offset+i])
+	if !strings.HasSuffix(line, "\r") {
+		defer d.add(offset+i, "line ends with a bare LF")
+	} else {
+		line = line[:len(line)-1]
+	}
+	shown := line
+	if len(shown) > maxDumpLine {
+		shown = fmt.Sprintf("%s... (%d bytes)", shown[:maxDumpLine], len(line))
+	}
+	d.printf("%s\n", strings.TrimRight(fmt.Sprintf("%6d  %s", offset, printable(shown)), " "))
+	return line, offset, true
+}
+
+// maxDumpLine is the length at which lines are cut off in a rendering.
+const maxDumpLine = 200
+
+// printable quotes s if it contains control characters or invalid UTF-8.
+func printable(s string) string {
+	if strings.IndexFunc(s, func(r rune) bool { return r < ' ' || r == 0x7f || r == utf8.RuneError }) < 0 {
+		return s
+	}
+	return strconv.Quote(s)
+}
+
+func (d *dumper) dump() {
+	kind := "request"
+	if bytes.HasPrefix(d.msg, []byte("ICAP/")) {
+		kind = "response"
+	}
+	d.printf("ICAP %s (%d bytes)\n", kind, len(d.msg))
+	first, _, ok := d.line()
+	if !ok {
+		d.add(d.pos, "message ends inside the start line")
+		d.summary()
+		return
+	}
+	response := kind == "response"
+	var method string
+	var code int
+	if response {
+		code = d.statusLine(first)
+	} else {
+		method = d.requestLine(first)
+	}
+
+	header := d.header("ICAP header")
+	if header == nil {
+		d.summary()
+		return
+	}
+	switch {
+	case response && code == StatusContinue:
+		d.extra()
+		d.summary()
+		return
+	case response:
+		if tag := header.Get("ISTag"); tag == "" {
+			d.add(d.pos, "missing ISTag header")
+		} else if len(tag) < 2 || len(tag) > 34 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+			d.add(d.pos, "ISTag %s is not a quoted string of up to 32 characters", tag)
+		}
+	case header.Get("Host") == "":
+		d.add(d.pos, "missing Host header")
+	}
+
+	enc := header.Get("Encapsulated")
+	if enc == "" {
+		d.add(d.pos, "missing Encapsulated header")
+		d.summary()
+		return
+	}
+	sections, err := StrictDialect{}.ParseEncapsulated(enc, nil)
+	if err != nil {
+		var diag Diagnostics
+		if sections, err = (LenientDialect{}).ParseEncapsulated(enc, &diag); err == nil {
+			for _, p := range diag {
+				d.add(d.pos, "Encapsulated: %s", p.Problem)
+			}
+		}
+	}
+	if err == nil {
+		_, err = newEncapsulation(sections, nil)
+	}
+	if err == nil && sections[0].Offset != 0 {
+		err = fmt.Errorf("first section %s is at %d, not 0", sections[0].Name, sections[0].Offset)
+	}
+	if err != nil {
+		if _, ok := err.(*badStringError); !ok {
+			err = fmt.Errorf("Encapsulated: %v", err)
+		}
+		d.add(d.pos, "%v", err)
+		d.summary()
+		return
+	}
+	last := sections[len(sections)-1].Name
+	switch {
+	case response && code == StatusNoContent && last != "null-body":
+		d.add(d.pos, "204 response with a %s", last)
+	case method == "REQMOD" && (last == "res-body" || last == "opt-body"),
+		method == "RESPMOD" && (last == "req-body" || last == "opt-body"),
+		method == "OPTIONS" && last != "opt-body" && last != "null-body":
+		d.add(d.pos, "%s request with a %s", method, last)
+	}
+
+	// After an offset that doesn't match the message, the rendering
+	// follows the message rather than the Encapsulated header.
+	base := d.pos
+	for i, s := range sections[:len(sections)-1] {
+		if !d.httpHeader(s, base, sections[i+1].Offset) {
+			d.summary()
+			return
+		}
+	}
+	if last != "null-body" {
+		d.body(last, base, header.Get("Preview"))
+	}
+	d.extra()
+	d.summary()
+}
+
+// statusLine checks the status line of a response and returns its code.
+func (d *dumper) statusLine(line string) int {
+	f := strings.SplitN(line, " ", 3)
+	if f[0] != "ICAP/1.0" {
+		d.add(0, "unsupported protocol version %s", f[0])
+	}
+	if len(f) < 2 || len(f[1]) != 3 {
+		d.add(0, "malformed status line")
+		return 0
+	}
+	code, err := strconv.Atoi(f[1])
+	if err != nil || code < 100 {
+		d.add(0, "malformed status code %s", f[1])
+	}
+	return code
+}
+
+// requestLine checks the request line of a request and returns its method.
+func (d *dumper) requestLine(line string) string {
+	method, uri, proto, err := StrictDialect{}.ParseRequestLine(line, nil)
+	if err == nil && (strings.Contains(proto, " ") || !isToken(method)) {
+		err = &badStringError{"malformed ICAP request", line}
+	}
+	if err != nil {
+		var diag Diagnostics
+		method, uri, proto, err = LenientDialect{}.ParseRequestLine(line, &diag)
+		if err != nil {
+			d.add(0, "malformed request line")
+			return ""
+		}
+		for _, p := range diag {
+			d.add(0, "request line: %s", p.Problem)
+		}
+	}
+	if proto != "ICAP/1.0" {
+		d.add(0, "unsupported protocol version %s", proto)
+	}
+	if u, err := url.Parse(uri); err != nil || (u.Scheme != "icap" && u.Scheme != "icaps") || u.Host == "" {
+		d.add(0, "request URI %s is not an icap:// URL", uri)
+	}
+	return method
+}
+
+// header renders and checks the header lines up to the blank line that
+// ends them, and returns the header, or nil if the message ends first.
+func (d *dumper) header(what string) textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader)
+	for {
+		line, offset, ok := d.line()
+		if !ok {
+			d.add(offset, "message ends inside the %s", what)
+			return nil
+		}
+		if line == "" {
+			return h
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			d.add(offset, "obsolete line folding")
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !isToken(name) {
+			d.add(offset, "malformed header line")
+			continue
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+}
+
+// httpHeader renders and checks the encapsulated HTTP header s, which
+// the Encapsulated header says ends at next, relative to base. It reports
+// whether the message continues after it.
+func (d *dumper) httpHeader(s Section, base, next int) bool {
+	start := d.pos
+	d.printf("%s (encapsulated offset %d, %d bytes)\n", s.Name, s.Offset, next-s.Offset)
+	first, _, ok := d.line()
+	if ok {
+		f := strings.SplitN(first, " ", 3)
+		switch {
+		case s.Name == "req-hdr" && (len(f) != 3 || !strings.HasPrefix(f[2], "HTTP/")):
+			d.add(start, "malformed HTTP request line")
+		case s.Name == "res-hdr" && (len(f) < 2 || !strings.HasPrefix(f[0], "HTTP/") || len(f[1]) != 3):
+			d.add(start, "malformed HTTP status line")
+		}
+		ok = d.header(s.Name) != nil
+	} else {
+		d.add(start, "message ends inside the %s", s.Name)
+	}
+	if !ok {
+		return false
+	}
+	if d.pos-base != next {
+		d.add(d.pos, "%s ends at encapsulated offset %d, but the Encapsulated header says %d", s.Name, d.pos-base, next)
+	}
+	return true
+}
+
+// body renders and checks a chunked body, including the part sent after
+// 100 Continue if there is a preview.
+func (d *dumper) body(name string, base int, preview string) {
+	d.printf("%s (encapsulated offset %d, chunked)\n", name, d.pos-base)
+	if preview == "" {
+		d.chunks(-1)
+		return
+	}
+	n, err := strconv.Atoi(preview)
+	if err != nil || n < 0 {
+		d.add(d.pos, "malformed Preview header %q", preview)
+		n = -1
+	}
+	if ieof, ok := d.chunks(n); ok && !ieof && d.pos < len(d.msg) {
+		d.printf("rest of %s (after 100 Continue)\n", name)
+		d.chunks(-1)
+	}
+}
+
+// chunks renders and checks chunks up to the last one. If preview is not
+// negative, they are the preview of that many bytes. It reports whether
+// the last chunk had the ieof extension, and whether the chunks were
+// well-formed and complete.
+func (d *dumper) chunks(preview int) (ieof, ok bool) {
+	total := 0
+	for {
+		line, offset, ok := d.line()
+		if !ok {
+			d.add(offset, "message ends inside the body")
+			return false, false
+		}
+		size, ext, _ := strings.Cut(line, ";")
+		ext = strings.TrimSpace(ext)
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			d.add(offset, "malformed chunk size %q", size)
+			return false, false
+		}
+		if ext == "ieof" {
+			ieof = true
+			if n > 0 {
+				d.add(offset, "ieof on a chunk that is not the last")
+			}
+			if preview < 0 {
+				d.add(offset, "ieof outside a preview")
+			}
+		}
+		if n == 0 {
+			break
+		}
+		total += int(n)
+		data := d.msg[d.pos:]
+		if int64(len(data)) < n {
+			d.printf("%8s%d bytes of data\n", "", len(data))
+			d.add(len(d.msg), "message ends inside a chunk of %d bytes", n)
+			d.pos = len(d.msg)
+			return false, false
+		}
+		data = data[:n]
+		sample := data
+		if len(sample) > 40 {
+			sample = sample[:40]
+		}
+		d.printf("%8s%d bytes: %q", "", n, sample)
+		if len(sample) < len(data) {
+			d.printf("...")
+		}
+		d.printf("\n")
+		d.pos += int(n)
+		if !bytes.HasPrefix(d.msg[d.pos:], []byte("\r\n")) {
+			d.add(d.pos, "chunk data not followed by CRLF")
+			return false, false
+		}
+		d.pos += 2
+	}
+	for {
+		line, offset, ok := d.line()
+		if !ok {
+			d.add(offset, "message ends inside the chunk trailer")
+			return ieof, false
+		}
+		if line == "" {
+			break
+		}
+	}
+	if preview >= 0 && (total > preview || total < preview && !ieof) {
+		d.add(d.pos, "preview of %d bytes, but the Preview header says %d", total, preview)
+	}
+	return ieof, true
+}
+
+// extra flags bytes after the end of the message.
+func (d *dumper) extra() {
+	if n := len(d.msg) - d.pos; n > 0 {
+		d.add(d.pos, "%d bytes after the end of the message", n)
+	}
+}
+
+func (d *dumper) summary() {
+	switch len(d.findings) {
+	case 0:
+		d.printf("no problems found\n")
+	case 1:
+		d.printf("1 problem found\n")
+	default:
+		d.printf("%d problems found\n", len(d.findings))
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+const lintHTTPHeaders = "GET / HTTP/1.1\r\n" +
+	"Host: www.example.com\r\n" +
+	"\r\n" +
+	"HTTP/1.1 200 OK\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n"
+
+func TestLint(t *testing.T) {
+	tests := []struct {
+		name, msg string
+		problems  []string
+	}{
+		{
+			"valid request",
+			"RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+				"Host: icap.example.net\r\n" +
+				"Preview: 4\r\n" +
+				"Encapsulated: req-hdr=0, res-hdr=41, res-body=86\r\n" +
+				"\r\n" + lintHTTPHeaders +
+				"4\r\nhell\r\n0\r\n\r\n" +
+				"7\r\no world\r\n0\r\n\r\n",
+			nil,
+		},
+		{
+			"valid response",
+			"ICAP/1.0 204 No Modifications\r\n" +
+				"ISTag: \"x\"\r\n" +
+				"Encapsulated: null-body=0\r\n" +
+				"\r\n",
+			nil,
+		},
+		{
+			"wrong offset",
+			"RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+				"Host: icap.example.net\r\n" +
+				"Encapsulated: req-hdr=0, res-hdr=40, res-body=86\r\n" +
+				"\r\n" + lintHTTPHeaders +
+				"0\r\n\r\n",
+			[]string{"req-hdr ends at encapsulated offset 41, but the Encapsulated header says 40"},
+		},
+		{
+			"lenient request",
+			"respmod  icap://icap.example.net/respmod ICAP/1.0\n" +
+				"Encapsulated: res-hdr=41,req-hdr=0, res-body=86\r\n" +
+				"\r\n" + lintHTTPHeaders +
+				"0\r\n\r\n",
+			[]string{
+				"line ends with a bare LF",
+				"request line: irregular whitespace",
+				"request line: method not in upper case",
+				"missing Host header",
+				"Encapsulated: irregular separators or spacing",
+				"Encapsulated: sections out of order",
+			},
+		},
+		{
+			"bad chunks",
+			"ICAP/1.0 200 OK\r\n" +
+				"ISTag: \"x\"\r\n" +
+				"Encapsulated: res-hdr=0, res-body=45\r\n" +
+				"\r\n" + lintHTTPHeaders[41:] +
+				"4; ieof\r\nhelloXX0\r\n\r\n",
+			[]string{
+				"ieof on a chunk that is not the last",
+				"ieof outside a preview",
+				"chunk data not followed by CRLF",
+				"8 bytes after the end of the message",
+			},
+		},
+		{
+			"short preview",
+			"REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+				"Host: icap.example.net\r\n" +
+				"Preview: 10\r\n" +
+				"Encapsulated: req-hdr=0, res-body=41\r\n" +
+				"\r\n" + lintHTTPHeaders[:41] +
+				"4\r\nhell\r\n0\r\n\r\n",
+			[]string{
+				"REQMOD request with a res-body",
+				"preview of 4 bytes, but the Preview header says 10",
+			},
+		},
+		{
+			"truncated",
+			"ICAP/1.0 200 OK\r\n" +
+				"Encapsulated: res-hdr=0, res-body=43\r\n" +
+				"\r\n" +
+				"HTTP/1.1 200 OK\r\n",
+			[]string{"missing ISTag header", "message ends inside the res-hdr"},
+		},
+	}
+
+	for _, tt := range tests {
+		findings := Lint([]byte(tt.msg))
+		var problems []string
+		for _, f := range findings {
+			problems = append(problems, f.Problem)
+		}
+		if strings.Join(problems, "\n") != strings.Join(tt.problems, "\n") {
+			t.Errorf("%s: got problems\n%s\nwant\n%s\n%s", tt.name, strings.Join(problems, "\n"), strings.Join(tt.problems, "\n"), Dump([]byte(tt.msg)))
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	msg := "ICAP/1.0 200 OK\r\n" +
+		"ISTag: \"x\"\r\n" +
+		"Encapsulated: res-hdr=0, res-body=42\r\n" +
+		"\r\n" + lintHTTPHeaders[41:] +
+		"b\r\nhello world\r\n0\r\n\r\n"
+	want := `ICAP response (135 bytes)
+     0  ICAP/1.0 200 OK
+    17  ISTag: "x"
+    29  Encapsulated: res-hdr=0, res-body=42
+    67
+res-hdr (encapsulated offset 0, 42 bytes)
+    69  HTTP/1.1 200 OK
+    86  Content-Type: text/plain
+   112
+        ! res-hdr ends at encapsulated offset 45, but the Encapsulated header says 42
+res-body (encapsulated offset 45, chunked)
+   114  b
+        11 bytes: "hello world"
+   130  0
+   133
+1 problem found
+`
+	if got := Dump([]byte(msg)); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestBadRequestTrace(t *testing.T) {
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: res-hdr=zero\r\n" +
+		"\r\n"
+	got := make(chan []Finding, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		Trace: &ServerTrace{
+			BadRequest: func(c net.Conn, head []byte, err error) {
+				if string(head) != request {
+					t.Errorf("head = %q", head)
+				}
+				got <- Lint(head)
+			},
+		},
+	}
+	roundTrip(t, srv, request)
+	findings := <-got
+	if len(findings) != 1 || findings[0].Problem != `malformed Encapsulated: header "res-hdr=zero"` {
+		t.Errorf("findings = %v", findings)
+	}
+}
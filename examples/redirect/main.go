@@ -45,7 +45,7 @@ func toGolang(w icap.ResponseWriter, req *icap.Request) {
 		h.Set("Allow", "204")
 		h.Set("Preview", "0")
 		h.Set("Transfer-Preview", "*")
-		w.WriteHeader(200, nil, false)
+		w.WriteHeader(icap.StatusOK, nil, false)
 	case "REQMOD":
 		switch req.Request.Host {
 		case "gateway":
@@ -55,17 +55,17 @@ func toGolang(w icap.ResponseWriter, req *icap.Request) {
 			// Redirect the user to a more interesting language.
 			req.Request.Host = "golang.org"
 			req.Request.URL.Host = "golang.org"
-			w.WriteHeader(200, req.Request, false)
+			w.WriteHeader(icap.StatusOK, req.Request, false)
 			// TODO: copy the body (if any) from the original request.
 		default:
 			// Return the request unmodified.
-			w.WriteHeader(204, nil, false)
+			w.WriteHeader(icap.StatusNoContent, nil, false)
 		}
 	case "ERRDUMMY":
-		w.WriteHeader(400, nil, false)
+		w.WriteHeader(icap.StatusBadRequest, nil, false)
 		fmt.Println("Malformed request")
 	default:
-		w.WriteHeader(405, nil, false)
+		w.WriteHeader(icap.StatusMethodNotAllowed, nil, false)
 		fmt.Println("Invalid request method")
 	}
 }
@@ -3,7 +3,14 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 
 	"github.com/intra-sh/icap"
@@ -12,12 +19,23 @@ import (
 var ISTag = "\"GOLANG\""
 
 func main() {
+	dryRun := flag.String("dry-run", "", "run the HTTP request (and response) in `file` through the services and print the result, instead of serving")
+	flag.Parse()
+
 	// Handle REQMOD requests
 	icap.HandleFunc("/reqmod", reqmodHandler)
 
 	// Handle RESPMOD requests
 	icap.HandleFunc("/respmod", respmodHandler)
 
+	if *dryRun != "" {
+		if err := runDryRun(*dryRun); err != nil {
+			fmt.Println("Dry run failed:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Start the server
 	fmt.Println("Starting ICAP server on port 1344...")
 	if err := icap.ListenAndServe(":1344", nil); err != nil {
@@ -38,7 +56,7 @@ func reqmodHandler(w icap.ResponseWriter, req *icap.Request) {
 		h.Set("Allow", "204")
 		h.Set("Preview", "0")
 		h.Set("Transfer-Preview", "*")
-		w.WriteHeader(200, nil, false)
+		w.WriteHeader(icap.StatusOK, nil, false)
 		fmt.Println("OPTIONS request processed")
 	case "REQMOD":
 		// Modify the request
@@ -49,10 +67,10 @@ func reqmodHandler(w icap.ResponseWriter, req *icap.Request) {
 			// Log some information
 			fmt.Printf("Processing request to: %s\n", req.Request.URL)
 		}
-		w.WriteHeader(200, req.Request, false)
+		w.WriteHeader(icap.StatusOK, req.Request, false)
 		fmt.Println("REQMOD request processed")
 	default:
-		w.WriteHeader(405, nil, false)
+		w.WriteHeader(icap.StatusMethodNotAllowed, nil, false)
 		fmt.Println("Invalid request method:", req.Method)
 	}
 }
@@ -69,7 +87,7 @@ func respmodHandler(w icap.ResponseWriter, req *icap.Request) {
 		h.Set("Allow", "204")
 		h.Set("Preview", "0")
 		h.Set("Transfer-Preview", "*")
-		w.WriteHeader(200, nil, false)
+		w.WriteHeader(icap.StatusOK, nil, false)
 		fmt.Println("OPTIONS request processed")
 	case "RESPMOD":
 		// Process the response
@@ -78,10 +96,54 @@ func respmodHandler(w icap.ResponseWriter, req *icap.Request) {
 			req.Response.Header.Add("X-ICAP-Processed", "true")
 			fmt.Println("Processing response from:", req.Request.URL)
 		}
-		w.WriteHeader(200, req.Response, false)
+		w.WriteHeader(icap.StatusOK, req.Response, false)
 		fmt.Println("RESPMOD request processed")
 	default:
-		w.WriteHeader(405, nil, false)
+		w.WriteHeader(icap.StatusMethodNotAllowed, nil, false)
 		fmt.Println("Invalid request method:", req.Method)
 	}
 }
+
+// runDryRun reads an HTTP request, optionally followed by an HTTP response,
+// from the named file, and sends it to the REQMOD or RESPMOD service
+// without opening a listener. It prints the ICAP response and the audit
+// record of the transaction.
+func runDryRun(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReader(bytes.NewReader(data))
+	httpReq, err := http.ReadRequest(br)
+	if err != nil {
+		return fmt.Errorf("reading HTTP request: %v", err)
+	}
+	body, err := io.ReadAll(httpReq.Body)
+	if err != nil {
+		return fmt.Errorf("reading HTTP request body: %v", err)
+	}
+	httpReq.Body = io.NopCloser(bytes.NewReader(body))
+
+	method, service := "REQMOD", "/reqmod"
+	var httpResp *http.Response
+	if _, err := br.Peek(1); err == nil {
+		httpResp, err = http.ReadResponse(br, httpReq)
+		if err != nil {
+			return fmt.Errorf("reading HTTP response: %v", err)
+		}
+		method, service = "RESPMOD", "/respmod"
+	}
+
+	req, err := icap.NewRequest(method, "icap://localhost"+service, httpReq, httpResp)
+	if err != nil {
+		return err
+	}
+	result, err := new(icap.Server).DryRun(context.Background(), req)
+	if err != nil {
+		return err
+	}
+	fmt.Println(icap.Dump(result.Response))
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result.Audit)
+}
@@ -0,0 +1,120 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Reading one streamed body with several consumers.
+
+package icap
+
+import (
+	"io"
+	"sync"
+)
+
+// A MultiConsumer feeds one body to several consumers, such as a scanner,
+// a logger and a transformer, which read it concurrently. The body is read
+// only as fast as the slowest consumer allows, holding at most BufferSize
+// bytes for each consumer, so it never needs to be buffered in full.
+type MultiConsumer struct {
+	// BufferSize is the number of bytes read ahead of each consumer.
+	// If zero, 64 KB is used.
+	BufferSize int
+
+	consumers []func(io.Reader) error
+}
+
+// Add adds a consumer. It is called in its own goroutine with a reader
+// for the body. A consumer that returns before reading to the end doesn't
+// hold up the others.
+func (m *MultiConsumer) Add(consumer func(r io.Reader) error) {
+	m.consumers = append(m.consumers, consumer)
+}
+
+// A fanoutReader is the reader of the body given to one consumer.
+type fanoutReader struct {
+	chunks chan []byte
+	done   chan struct{} // closed when the consumer returns
+	cur    []byte        // the unread part of the current chunk
+	err    error         // returned after the last chunk; set before chunks is closed
+}
+
+func (r *fanoutReader) Read(p []byte) (int, error) {
+	if len(r.cur) == 0 {
+		c, ok := <-r.chunks
+		if !ok {
+			return 0, r.err
+		}
+		r.cur = c
+	}
+	n := copy(p, r.cur)
+	r.cur = r.cur[n:]
+	return n, nil
+}
+
+// Run reads body and passes it to every consumer, and waits for them to
+// return. It returns the first error returned by a consumer; an error
+// reading body is returned to the consumers by their readers.
+func (m *MultiConsumer) Run(body io.Reader) error {
+	size := m.BufferSize
+	if size <= 0 {
+		size = 64 << 10
+	}
+	chunkSize := size
+	if chunkSize > 32<<10 {
+		chunkSize = 32 << 10
+	}
+
+	readers := make([]*fanoutReader, len(m.consumers))
+	errs := make([]error, len(m.consumers))
+	var wg sync.WaitGroup
+	for i, consumer := range m.consumers {
+		r := &fanoutReader{
+			chunks: make(chan []byte, size/chunkSize),
+			done:   make(chan struct{}),
+		}
+		readers[i] = r
+		wg.Add(1)
+		go func(i int, consumer func(io.Reader) error) {
+			defer wg.Done()
+			defer close(r.done)
+			errs[i] = consumer(r)
+		}(i, consumer)
+	}
+
+	var readErr error
+	for readErr == nil {
+		// Each chunk is a new slice, since the consumers share it.
+		chunk := make([]byte, chunkSize)
+		n, err := body.Read(chunk)
+		readErr = err
+		if n == 0 {
+			continue
+		}
+		active := 0
+		for _, r := range readers {
+			select {
+			case r.chunks <- chunk[:n]:
+				active++
+			case <-r.done:
+			}
+		}
+		if active == 0 {
+			break
+		}
+	}
+	if readErr == nil {
+		readErr = io.ErrClosedPipe
+	}
+	for _, r := range readers {
+		r.err = readErr
+		close(r.chunks)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
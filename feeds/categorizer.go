@@ -0,0 +1,109 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A stage that categorizes requests by the feeds their URLs are listed in.
+
+package feeds
+
+import (
+	"net/url"
+
+	"github.com/intra-sh/icap"
+)
+
+// CategoryAnnotation is the key of the annotation in which a Categorizer
+// records the name of the category of a request.
+const CategoryAnnotation = "feeds.category"
+
+// A Category is a named set of domains and URLs, such as "malware" or
+// "gambling". Either feed may be nil.
+type Category struct {
+	Name    string
+	Domains *Feed[*DomainList]
+	URLs    *Feed[*URLList]
+
+	// Block makes the Categorizer block requests in the category.
+	Block bool
+
+	// Confusables makes hosts that look like the listed domains match
+	// too, such as "pаypal.com" with a Cyrillic "а" for "paypal.com"
+	// (see DomainList.MatchConfusable).
+	Confusables bool
+}
+
+// match reports whether u is in the category.
+func (c *Category) match(u *url.URL) bool {
+	if c.Domains != nil {
+		if l, ok := c.Domains.Get(); ok && (l.Match(u.Host) || c.Confusables && l.MatchConfusable(u.Host)) {
+			return true
+		}
+	}
+	if c.URLs != nil {
+		if l, ok := c.URLs.Get(); ok && l.Match(u) {
+			return true
+		}
+	}
+	return false
+}
+
+// A Categorizer is an icap.Stage that finds the first of Categories that
+// lists the URL of the encapsulated HTTP request, and records its name in
+// the CategoryAnnotation annotation for later stages. If the category is
+// to be blocked, the request is blocked.
+type Categorizer struct {
+	Categories []*Category
+
+	// Database, if not nil, is looked up for URLs that none of
+	// Categories lists. Its categories named in BlockCategories are
+	// blocked.
+	Database        *CategoryDB
+	BlockCategories []string
+
+	// Status and Reason make up the block page; if they are zero, 403
+	// and "Blocked: " followed by the name of the category are used.
+	Status int
+	Reason string
+}
+
+// Process categorizes req.
+func (c *Categorizer) Process(req *icap.Request) (icap.StageResult, error) {
+	u := req.CanonicalURL()
+	if u == nil {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	name, block, ok := c.categorize(u)
+	if !ok {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	req.SetAnnotation(CategoryAnnotation, name)
+	if !block {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	reason := c.Reason
+	if reason == "" {
+		reason = "Blocked: " + name
+	}
+	return icap.StageResult{Action: icap.ActionBlock, Status: c.Status, Reason: reason}, nil
+}
+
+// categorize returns the category of u, and whether it is to be blocked.
+func (c *Categorizer) categorize(u *url.URL) (name string, block, ok bool) {
+	for _, cat := range c.Categories {
+		if cat.match(u) {
+			return cat.Name, cat.Block, true
+		}
+	}
+	if c.Database == nil {
+		return "", false, false
+	}
+	if name, ok = c.Database.LookupURL(u); !ok {
+		return "", false, false
+	}
+	for _, b := range c.BlockCategories {
+		if b == name {
+			return name, true, true
+		}
+	}
+	return name, false, true
+}
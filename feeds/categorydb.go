@@ -0,0 +1,449 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Memory-mapped category databases for very large lists.
+
+package feeds
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/intra-sh/icap"
+)
+
+// A CategoryDB maps domains and URLs to categories, like a set of
+// Categories, but for databases with millions of entries: the database
+// is a file, written by a CategoryDBBuilder, that is mapped into memory
+// instead of being loaded onto the Go heap, and lookups don't allocate.
+//
+// Reload replaces the database atomically; the old file is unmapped once
+// the lookups using it have finished. A CategoryDB is safe for concurrent
+// use.
+type CategoryDB struct {
+	current atomic.Pointer[mappedDB]
+}
+
+// OpenCategoryDB maps the database in the file path.
+func OpenCategoryDB(path string) (*CategoryDB, error) {
+	db := new(CategoryDB)
+	if err := db.Reload(path); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reload maps the database in the file path, and replaces the current one
+// with it. If the file can't be mapped, the current database is kept.
+func (db *CategoryDB) Reload(path string) error {
+	m, err := openMappedDB(path)
+	if err != nil {
+		return err
+	}
+	if old := db.current.Swap(m); old != nil {
+		old.release()
+	}
+	return nil
+}
+
+// Close unmaps the database. Lookups after Close find nothing.
+func (db *CategoryDB) Close() error {
+	if old := db.current.Swap(nil); old != nil {
+		old.release()
+	}
+	return nil
+}
+
+// acquire returns the current database, which must be released after
+// use, or nil if there is none.
+func (db *CategoryDB) acquire() *mappedDB {
+	for {
+		m := db.current.Load()
+		if m == nil || m.acquire() {
+			return m
+		}
+		// m was unmapped after it was replaced; try the new one.
+	}
+}
+
+// Len returns the number of entries in the database.
+func (db *CategoryDB) Len() int {
+	m := db.acquire()
+	if m == nil {
+		return 0
+	}
+	defer m.release()
+	return m.domains.n + m.urls.n
+}
+
+// LookupHost returns the category of host, or of the closest domain it
+// belongs to that is in the database. host must be in canonical form,
+// without a port (see icap.CanonicalHost).
+func (db *CategoryDB) LookupHost(host string) (category string, ok bool) {
+	m := db.acquire()
+	if m == nil {
+		return "", false
+	}
+	defer m.release()
+	return m.lookupHost(host)
+}
+
+// LookupURL returns the category of u: of the URL, with or without its
+// query string, if it is in the database, and otherwise of its host. u
+// must be in canonical form (see icap.CanonicalURL), as
+// icap.Request.CanonicalURL returns it.
+func (db *CategoryDB) LookupURL(u *url.URL) (category string, ok bool) {
+	m := db.acquire()
+	if m == nil {
+		return "", false
+	}
+	defer m.release()
+	host, path := u.Hostname(), u.EscapedPath()
+	if u.RawQuery != "" {
+		if i := m.urls.search(host, path, "?", u.RawQuery); i >= 0 {
+			return m.category(m.urls, i), true
+		}
+	}
+	if i := m.urls.search(host, path, "", ""); i >= 0 {
+		return m.category(m.urls, i), true
+	}
+	return m.lookupHost(host)
+}
+
+// The file format of a category database. All integers are little-endian.
+//
+//	magic             "ICAPCDB1"
+//	categories        uint32 count, then each name as a uint16 length and bytes
+//	domains, urls     two tables of sorted keys, each:
+//	                  uint32 count n
+//	                  (n+1) uint32 offsets of the keys in the key data
+//	                  n uint16 category numbers
+//	                  the key data
+const categoryDBMagic = "ICAPCDB1"
+
+var errBadCategoryDB = errors.New("feeds: malformed category database")
+
+// A mappedDB is a category database mapped into memory.
+type mappedDB struct {
+	data       []byte
+	unmap      func() error
+	categories []string
+	domains    keyTable
+	urls       keyTable
+
+	// refs counts the CategoryDB holding the database and the lookups
+	// using it. Once it has dropped to zero, the database is unmapped and
+	// refs is set to a large negative number, so that it can't be used
+	// again.
+	refs atomic.Int64
+}
+
+const unmappedRefs = math.MinInt64 / 2
+
+func openMappedDB(path string) (*mappedDB, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m, err := parseMappedDB(data)
+	if err != nil {
+		unmap()
+		return nil, fmt.Errorf("feeds: %s: %v", path, err)
+	}
+	m.unmap = unmap
+	m.refs.Store(1)
+	return m, nil
+}
+
+func (m *mappedDB) acquire() bool {
+	if m.refs.Add(1) > 0 {
+		return true
+	}
+	m.refs.Add(-1)
+	return false
+}
+
+func (m *mappedDB) release() {
+	if m.refs.Add(-1) == 0 && m.refs.CompareAndSwap(0, unmappedRefs) {
+		m.unmap()
+	}
+}
+
+func (m *mappedDB) category(t keyTable, i int) string {
+	return m.categories[binary.LittleEndian.Uint16(t.cats[2*i:])]
+}
+
+func (m *mappedDB) lookupHost(host string) (string, bool) {
+	for host != "" {
+		if i := m.domains.search(host, "", "", ""); i >= 0 {
+			return m.category(m.domains, i), true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return "", false
+}
+
+// parseMappedDB checks the structure of data, so that lookups can't go
+// out of bounds, and returns the database it holds.
+func parseMappedDB(data []byte) (*mappedDB, error) {
+	if len(data) < len(categoryDBMagic)+4 || string(data[:len(categoryDBMagic)]) != categoryDBMagic {
+		return nil, errBadCategoryDB
+	}
+	m := &mappedDB{data: data}
+	p := data[len(categoryDBMagic):]
+	count := binary.LittleEndian.Uint32(p)
+	p = p[4:]
+	if count > math.MaxUint16+1 {
+		return nil, errBadCategoryDB
+	}
+	for i := uint32(0); i < count; i++ {
+		if len(p) < 2 {
+			return nil, errBadCategoryDB
+		}
+		n := int(binary.LittleEndian.Uint16(p))
+		if len(p) < 2+n {
+			return nil, errBadCategoryDB
+		}
+		m.categories = append(m.categories, string(p[2:2+n]))
+		p = p[2+n:]
+	}
+	var err error
+	if m.domains, p, err = parseKeyTable(p, len(m.categories)); err != nil {
+		return nil, err
+	}
+	if m.urls, p, err = parseKeyTable(p, len(m.categories)); err != nil {
+		return nil, err
+	}
+	if len(p) != 0 {
+		return nil, errBadCategoryDB
+	}
+	return m, nil
+}
+
+// A keyTable is a sorted table of keys in a mapped database.
+type keyTable struct {
+	n       int
+	offsets []byte // n+1 uint32
+	cats    []byte // n uint16
+	keys    []byte
+}
+
+func parseKeyTable(p []byte, categories int) (t keyTable, rest []byte, err error) {
+	if len(p) < 4 {
+		return t, nil, errBadCategoryDB
+	}
+	n := uint64(binary.LittleEndian.Uint32(p))
+	p = p[4:]
+	if uint64(len(p)) < 4*(n+1)+2*n {
+		return t, nil, errBadCategoryDB
+	}
+	t.n = int(n)
+	t.offsets, p = p[:4*(n+1)], p[4*(n+1):]
+	t.cats, p = p[:2*n], p[2*n:]
+	size := uint64(binary.LittleEndian.Uint32(t.offsets[4*n:]))
+	if uint64(len(p)) < size {
+		return t, nil, errBadCategoryDB
+	}
+	t.keys, p = p[:size], p[size:]
+
+	prev := uint32(0)
+	for i := 0; i <= t.n; i++ {
+		off := binary.LittleEndian.Uint32(t.offsets[4*i:])
+		if off < prev || (i == 0 && off != 0) {
+			return t, nil, errBadCategoryDB
+		}
+		prev = off
+		if i < t.n && int(binary.LittleEndian.Uint16(t.cats[2*i:])) >= categories {
+			return t, nil, errBadCategoryDB
+		}
+	}
+	return t, p, nil
+}
+
+func (t keyTable) key(i int) []byte {
+	start := binary.LittleEndian.Uint32(t.offsets[4*i:])
+	end := binary.LittleEndian.Uint32(t.offsets[4*i+4:])
+	return t.keys[start:end]
+}
+
+// search returns the index of the key a+b+c+d, or -1 if it isn't in the
+// table. The key is compared in parts so that it needn't be built.
+func (t keyTable) search(a, b, c, d string) int {
+	lo, hi := 0, t.n
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		switch cmp := compareParts(t.key(mid), a, b, c, d); {
+		case cmp == 0:
+			return mid
+		case cmp < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return -1
+}
+
+// compareParts compares key with the concatenation of the parts.
+func compareParts(key []byte, a, b, c, d string) int {
+	for _, part := range [...]string{a, b, c, d} {
+		for i := 0; i < len(part); i++ {
+			switch {
+			case len(key) == 0:
+				return -1
+			case key[0] < part[i]:
+				return -1
+			case key[0] > part[i]:
+				return 1
+			}
+			key = key[1:]
+		}
+	}
+	if len(key) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// A CategoryDBBuilder collects entries for a category database, and
+// writes the file that OpenCategoryDB maps. The entries are held in
+// memory until the file is written.
+type CategoryDBBuilder struct {
+	categories []string
+	index      map[string]uint16
+	domains    map[string]uint16
+	urls       map[string]uint16
+}
+
+// Add adds an entry to category. An entry with a "/" is a URL, with or
+// without a scheme, and any other entry is a domain, which matches its
+// subdomains too. If an entry is added to two categories, the later one
+// wins.
+func (b *CategoryDBBuilder) Add(category, entry string) error {
+	if b.index == nil {
+		b.index = make(map[string]uint16)
+		b.domains = make(map[string]uint16)
+		b.urls = make(map[string]uint16)
+	}
+	c, ok := b.index[category]
+	if !ok {
+		if len(b.categories) > math.MaxUint16 || len(category) > math.MaxUint16 {
+			return fmt.Errorf("feeds: too many categories, or too long a name")
+		}
+		c = uint16(len(b.categories))
+		b.categories = append(b.categories, category)
+		b.index[category] = c
+	}
+
+	if !strings.Contains(entry, "/") {
+		b.domains[icap.CanonicalHost(entry)] = c
+		return nil
+	}
+	if !strings.Contains(entry, "://") {
+		entry = "http://" + entry
+	}
+	u, err := url.Parse(entry)
+	if err != nil {
+		return err
+	}
+	b.urls[urlKey(icap.CanonicalURL(u))] = c
+	return nil
+}
+
+// AddList adds the entries of a list, one per line, to category. The list
+// is in the format ParseDomains and ParseURLs read.
+func (b *CategoryDBBuilder) AddList(category string, r io.Reader) error {
+	return scanLines(r, func(line int, text string) error {
+		f := strings.Fields(text)
+		if len(f) > 1 && net.ParseIP(f[0]) != nil {
+			f = f[1:]
+		}
+		for _, entry := range f {
+			if err := b.Add(category, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// WriteTo writes the database to w.
+func (b *CategoryDBBuilder) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countingWriter{w: bw}
+	le := binary.LittleEndian
+	var buf [4]byte
+
+	io.WriteString(cw, categoryDBMagic)
+	le.PutUint32(buf[:], uint32(len(b.categories)))
+	cw.Write(buf[:4])
+	for _, name := range b.categories {
+		le.PutUint16(buf[:], uint16(len(name)))
+		cw.Write(buf[:2])
+		io.WriteString(cw, name)
+	}
+	for _, table := range []map[string]uint16{b.domains, b.urls} {
+		keys := make([]string, 0, len(table))
+		size := 0
+		for k := range table {
+			keys = append(keys, k)
+			size += len(k)
+		}
+		if uint64(size) > math.MaxUint32 {
+			return cw.n, errors.New("feeds: category database too large")
+		}
+		sort.Strings(keys)
+		le.PutUint32(buf[:], uint32(len(keys)))
+		cw.Write(buf[:4])
+		off := 0
+		for _, k := range keys {
+			le.PutUint32(buf[:], uint32(off))
+			cw.Write(buf[:4])
+			off += len(k)
+		}
+		le.PutUint32(buf[:], uint32(off))
+		cw.Write(buf[:4])
+		for _, k := range keys {
+			le.PutUint16(buf[:], table[k])
+			cw.Write(buf[:2])
+		}
+		for _, k := range keys {
+			io.WriteString(cw, k)
+		}
+	}
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+// A countingWriter counts the bytes written, and keeps the first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,53 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Detecting domain names that look like others.
+
+package feeds
+
+import (
+	"strings"
+
+	"github.com/intra-sh/icap"
+	"golang.org/x/text/unicode/norm"
+)
+
+// confusables maps characters to the Latin letters or digits they are
+// easily mistaken for. It is a small subset of the Unicode confusables
+// data (UTS #39), covering the Cyrillic and Greek letters that phishing
+// domains most often use, and the digits that stand in for letters.
+var confusables = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'ԁ': 'd', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k',
+	'ӏ': 'l', 'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'у': 'y', 'ԝ': 'w',
+	'х': 'x', 'с': 'c',
+
+	// Greek
+	'α': 'a', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o',
+	'ρ': 'p', 'υ': 'u', 'χ': 'x',
+
+	// Latin
+	'ı': 'i', 'ɑ': 'a', 'ɡ': 'g',
+
+	// Digits
+	'0': 'o', '1': 'l',
+}
+
+// skeletonReplacer replaces the sequences of letters that look like a
+// single letter.
+var skeletonReplacer = strings.NewReplacer("rn", "m", "vv", "w")
+
+// skeleton returns the form of host, a canonical host name, in which
+// names that look alike are equal: its labels in Unicode, in compatibility
+// form, with confusable characters replaced by the ones they look like.
+func skeleton(host string) string {
+	host = norm.NFKC.String(icap.UnicodeHost(host))
+	host = strings.Map(func(r rune) rune {
+		if c, ok := confusables[r]; ok {
+			return c
+		}
+		return r
+	}, strings.ToLower(host))
+	return skeletonReplacer.Replace(host)
+}
@@ -0,0 +1,224 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package feeds loads threat intelligence feeds, such as lists of blocked
+// domains, URLs or file hashes, and keeps them up to date.
+//
+// A Feed reads its list from a file or an HTTP URL and parses it with a
+// function such as ParseDomains. Run refreshes it on a schedule; each new
+// version replaces the old one atomically, so lookups never see a partly
+// loaded list, and a failed refresh leaves the old list in place. Requests
+// for HTTP feeds are conditional on the ETag and Last-Modified of the last
+// version, and files are read again only when they change.
+//
+// The lists are used by the Categorizer stage and, through HashReputation,
+// by icap.ReputationStage. Category databases too large for the Go heap
+// can be built with CategoryDBBuilder and mapped with OpenCategoryDB.
+package feeds
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Feed is a list loaded from Source and parsed by Parse. It is safe for
+// concurrent use.
+type Feed[T any] struct {
+	// Source is the name of a file, or an http or https URL.
+	Source string
+
+	// Parse parses the list.
+	Parse func(r io.Reader) (T, error)
+
+	// Interval is the time between refreshes by Run.
+	// If zero, one hour is used.
+	Interval time.Duration
+
+	// Client fetches HTTP feeds. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	current atomic.Pointer[T]
+	version atomic.Pointer[string]
+
+	mu           sync.Mutex // held during a refresh
+	etag         string
+	lastModified string
+	modTime      time.Time
+
+	statsMu sync.Mutex
+	stats   Stats
+}
+
+// Stats describes the state of a Feed.
+type Stats struct {
+	// Entries is the number of entries in the current list, if the list
+	// has a Len method.
+	Entries int
+
+	Loads       uint64    // times a new version has been loaded
+	Errors      uint64    // refreshes that failed
+	LastRefresh time.Time // when the feed was last checked successfully
+	LastError   error     // the error of the last refresh, or nil
+}
+
+// Get returns the current list. It reports false if no list has been
+// loaded yet.
+func (f *Feed[T]) Get() (T, bool) {
+	if p := f.current.Load(); p != nil {
+		return *p, true
+	}
+	var zero T
+	return zero, false
+}
+
+// Version returns a hash of the content the current list was parsed from,
+// or "" if no list has been loaded yet. It changes whenever a different
+// list is loaded, so it can be one of the Versions of an
+// icap.ContentISTag.
+func (f *Feed[T]) Version() string {
+	if p := f.version.Load(); p != nil {
+		return *p
+	}
+	return ""
+}
+
+// Stats returns the state of the feed.
+func (f *Feed[T]) Stats() Stats {
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	return f.stats
+}
+
+// Refresh loads the feed again if it has changed.
+func (f *Feed[T]) Refresh(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.refresh(ctx)
+
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	f.stats.LastError = err
+	if err != nil {
+		f.stats.Errors++
+	} else {
+		f.stats.LastRefresh = time.Now()
+	}
+	return err
+}
+
+// Run refreshes the feed immediately and then every Interval, until ctx
+// is done. Errors are recorded in the feed's Stats.
+func (f *Feed[T]) Run(ctx context.Context) {
+	interval := f.Interval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		f.Refresh(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (f *Feed[T]) refresh(ctx context.Context) error {
+	if strings.HasPrefix(f.Source, "http://") || strings.HasPrefix(f.Source, "https://") {
+		return f.fetch(ctx)
+	}
+
+	fi, err := os.Stat(f.Source)
+	if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(f.modTime) && f.current.Load() != nil {
+		return nil
+	}
+	file, err := os.Open(f.Source)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := f.load(file); err != nil {
+		return err
+	}
+	f.modTime = fi.ModTime()
+	return nil
+}
+
+// fetch loads an HTTP feed, unless the server says it hasn't changed.
+func (f *Feed[T]) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.Source, nil)
+	if err != nil {
+		return err
+	}
+	if f.current.Load() != nil {
+		if f.etag != "" {
+			req.Header.Set("If-None-Match", f.etag)
+		}
+		if f.lastModified != "" {
+			req.Header.Set("If-Modified-Since", f.lastModified)
+		}
+	}
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("feeds: fetching %s: unexpected status %s", f.Source, resp.Status)
+	}
+	if err := f.load(resp.Body); err != nil {
+		return err
+	}
+	f.etag = resp.Header.Get("ETag")
+	f.lastModified = resp.Header.Get("Last-Modified")
+	return nil
+}
+
+// load parses a new version of the list and makes it current.
+func (f *Feed[T]) load(r io.Reader) error {
+	h := sha256.New()
+	list, err := f.Parse(io.TeeReader(r, h))
+	if err != nil {
+		return fmt.Errorf("feeds: parsing %s: %v", f.Source, err)
+	}
+	// Read whatever Parse left, so that the hash covers all the content.
+	if _, err := io.Copy(h, r); err != nil {
+		return fmt.Errorf("feeds: reading %s: %v", f.Source, err)
+	}
+	version := hex.EncodeToString(h.Sum(nil))
+	f.current.Store(&list)
+	f.version.Store(&version)
+
+	f.statsMu.Lock()
+	defer f.statsMu.Unlock()
+	f.stats.Loads++
+	f.stats.Entries = 0
+	if l, ok := any(list).(interface{ Len() int }); ok {
+		f.stats.Entries = l.Len()
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package feeds
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+func TestFileFeed(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "domains.txt")
+	if err := os.WriteFile(name, []byte("# ads\nads.example.com\n0.0.0.0 tracker.example.net\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &Feed[*DomainList]{Source: name, Parse: ParseDomains}
+	if _, ok := f.Get(); ok || f.Version() != "" {
+		t.Error("Get succeeded before the feed was loaded")
+	}
+	if err := f.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	l, _ := f.Get()
+	version := f.Version()
+	if version == "" {
+		t.Error("no version after loading")
+	}
+	for host, want := range map[string]bool{
+		"ads.example.com":       true,
+		"img.ads.example.com":   true,
+		"TRACKER.example.net.":  true,
+		"example.com":           false,
+		"bads.example.com":      false,
+		"ads.example.com:8080":  true,
+		"tracker.example.net.x": false,
+	} {
+		if l.Match(host) != want {
+			t.Errorf("Match(%q) = %v, want %v", host, !want, want)
+		}
+	}
+
+	// An unchanged file isn't loaded again.
+	f.Refresh(context.Background())
+	if s := f.Stats(); s.Loads != 1 || s.Entries != 2 {
+		t.Errorf("stats after unchanged refresh: %+v", s)
+	}
+
+	// A malformed new version leaves the old list in place.
+	os.WriteFile(name, []byte("ads.example.com\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(name, later, later)
+	f.Parse = func(io.Reader) (*DomainList, error) {
+		return nil, os.ErrInvalid
+	}
+	if err := f.Refresh(context.Background()); err == nil {
+		t.Error("Refresh succeeded with a failing parser")
+	}
+	if l2, _ := f.Get(); l2 != l || f.Version() != version {
+		t.Error("failed refresh replaced the list")
+	}
+	if s := f.Stats(); s.Errors != 1 || s.LastError == nil {
+		t.Errorf("stats after failed refresh: %+v", s)
+	}
+}
+
+func TestHTTPFeed(t *testing.T) {
+	bad := sha256.Sum256([]byte("evil file"))
+	var fetches, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(hex.EncodeToString(bad[:]) + "  evil.exe\n"))
+	}))
+	defer srv.Close()
+
+	f := &Feed[*HashList]{Source: srv.URL + "/hashes", Parse: ParseHashes}
+	for i := 0; i < 2; i++ {
+		if err := f.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fetches != 2 || notModified != 1 {
+		t.Errorf("%d fetches, %d not modified; want 2 and 1", fetches, notModified)
+	}
+	if s := f.Stats(); s.Loads != 1 || s.Entries != 1 {
+		t.Errorf("stats: %+v", s)
+	}
+
+	r := &HashReputation{Feed: f, Reputation: icap.ReputationBad}
+	if rep, _ := r.Lookup(crypto.SHA256, bad[:]); rep != icap.ReputationBad {
+		t.Errorf("Lookup(bad) = %v", rep)
+	}
+	good := sha256.Sum256([]byte("good file"))
+	if rep, _ := r.Lookup(crypto.SHA256, good[:]); rep != icap.ReputationUnknown {
+		t.Errorf("Lookup(good) = %v", rep)
+	}
+}
+
+func TestCategorizer(t *testing.T) {
+	gambling := &Feed[*DomainList]{Source: "gambling", Parse: ParseDomains}
+	gambling.load(strings.NewReader("casino.example\n"))
+	malware := &Feed[*URLList]{Source: "malware", Parse: ParseURLs}
+	malware.load(strings.NewReader("https://files.example.com/evil.exe\n"))
+
+	c := &Categorizer{Categories: []*Category{
+		{Name: "malware", URLs: malware, Block: true},
+		{Name: "gambling", Domains: gambling},
+	}}
+	for _, tc := range []struct {
+		url      string
+		category string
+		action   icap.StageAction
+	}{
+		{"http://files.example.com/evil.exe?x=1", "malware", icap.ActionBlock},
+		{"http://www.casino.example/", "gambling", icap.ActionContinue},
+		{"http://www.example.com/", "", icap.ActionContinue},
+	} {
+		hr, _ := http.NewRequest("GET", tc.url, nil)
+		req := &icap.Request{Method: "REQMOD", Request: hr}
+		res, err := c.Process(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		category, _ := icap.Annotation[string](req, CategoryAnnotation)
+		if res.Action != tc.action || category != tc.category {
+			t.Errorf("%s: got action %v, category %q; want %v, %q", tc.url, res.Action, category, tc.action, tc.category)
+		}
+	}
+}
+
+func TestDomainListIDN(t *testing.T) {
+	l, err := ParseDomains(strings.NewReader("bücher.example\nxn--wgv71a119e.jp\npaypal.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		host       string
+		match      bool
+		confusable bool
+	}{
+		{"www.xn--bcher-kva.example", true, true},
+		{"BÜCHER.example:443", true, true},
+		{"日本語。jp", true, true},
+		{"bucher.example", false, false},
+		{"xn--pypal-4ve.com", false, true}, // Cyrillic а
+		{"www.paypa1.com", false, true},
+		{"paypal.com.", true, true},
+		{"paypals.com", false, false},
+	} {
+		if got := l.Match(tc.host); got != tc.match {
+			t.Errorf("Match(%q) = %v, want %v", tc.host, got, tc.match)
+		}
+		if got := l.MatchConfusable(tc.host); got != tc.confusable {
+			t.Errorf("MatchConfusable(%q) = %v, want %v", tc.host, got, tc.confusable)
+		}
+	}
+
+	urls, err := ParseURLs(strings.NewReader("bücher.example/%7Eshop/\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse("https://xn--bcher-kva.example/~shop/?q=1")
+	if !urls.Match(u) {
+		t.Errorf("URLList doesn't match %v", u)
+	}
+}
+
+// writeCategoryDB writes a category database built by b to a temporary
+// file, and returns its name.
+func writeCategoryDB(t *testing.T, b *CategoryDBBuilder) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "categories.db")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := b.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestCategoryDB(t *testing.T) {
+	var b CategoryDBBuilder
+	if err := b.AddList("gambling", strings.NewReader("casino.example\n0.0.0.0 poker.example\nbücher.example\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.AddList("malware", strings.NewReader("files.example.com/evil.exe\nhttps://files.example.com/x?id=1\nevil.example\n")); err != nil {
+		t.Fatal(err)
+	}
+	db, err := OpenCategoryDB(writeCategoryDB(t, &b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Len() != 6 {
+		t.Errorf("Len() = %d, want 6", db.Len())
+	}
+
+	for _, tc := range []struct {
+		url, category string
+	}{
+		{"http://www.casino.example/", "gambling"},
+		{"http://poker.example/", "gambling"},
+		{"http://xn--bcher-kva.example/", "gambling"},
+		{"http://files.example.com/evil.exe?a=b", "malware"},
+		{"http://files.example.com/x?id=1", "malware"},
+		{"http://files.example.com/x?id=2", ""},
+		{"http://a.evil.example/", "malware"},
+		{"http://example.com/", ""},
+		{"http://casino.example.org/", ""},
+	} {
+		u, _ := url.Parse(tc.url)
+		category, _ := db.LookupURL(icap.CanonicalURL(u))
+		if category != tc.category {
+			t.Errorf("LookupURL(%s) = %q, want %q", tc.url, category, tc.category)
+		}
+	}
+
+	u, _ := url.Parse("http://www.casino.example/page?x=1")
+	if n := testing.AllocsPerRun(100, func() { db.LookupURL(u) }); n != 0 {
+		t.Errorf("LookupURL allocates %v times", n)
+	}
+
+	c := &Categorizer{Database: db, BlockCategories: []string{"malware"}}
+	for _, tc := range []struct {
+		url    string
+		action icap.StageAction
+	}{
+		{"http://files.example.com/evil.exe", icap.ActionBlock},
+		{"http://casino.example/", icap.ActionContinue},
+	} {
+		hr, _ := http.NewRequest("GET", tc.url, nil)
+		res, err := c.Process(&icap.Request{Method: "REQMOD", Request: hr})
+		if err != nil || res.Action != tc.action {
+			t.Errorf("%s: got action %v, %v; want %v", tc.url, res.Action, err, tc.action)
+		}
+	}
+
+	// Reload swaps in a new database, and a bad file leaves it in place.
+	var b2 CategoryDBBuilder
+	b2.Add("news", "casino.example")
+	if err := db.Reload(writeCategoryDB(t, &b2)); err != nil {
+		t.Fatal(err)
+	}
+	if category, _ := db.LookupHost("casino.example"); category != "news" {
+		t.Errorf("after Reload, LookupHost = %q", category)
+	}
+	bad := filepath.Join(t.TempDir(), "bad.db")
+	os.WriteFile(bad, []byte("ICAPCDB1\x05\x00\x00\x00"), 0o644)
+	if err := db.Reload(bad); err == nil {
+		t.Error("malformed database loaded")
+	}
+	if db.Len() != 1 {
+		t.Errorf("after failed Reload, Len() = %d", db.Len())
+	}
+
+	// Lookups go on while the database is swapped.
+	name := writeCategoryDB(t, &b2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			db.Reload(name)
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if category, _ := db.LookupHost("casino.example"); category != "news" {
+			t.Fatalf("during Reload, LookupHost = %q", category)
+		}
+	}
+}
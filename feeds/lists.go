@@ -0,0 +1,228 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Parsing of domain, URL and hash lists.
+
+package feeds
+
+import (
+	"bufio"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/intra-sh/icap"
+)
+
+// scanLines calls fn for each line of r, with comments (starting with #)
+// and surrounding space removed, skipping blank lines.
+func scanLines(r io.Reader, fn func(line int, text string) error) error {
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if err := fn(line, text); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+	}
+	return sc.Err()
+}
+
+// A DomainList is a set of domains. A domain matches its subdomains too.
+// Internationalized domains match whether they are written in Unicode or
+// in their ASCII ("xn--") form.
+type DomainList struct {
+	domains map[string]struct{}
+
+	// skeletons holds the skeletons of domains, for MatchConfusable.
+	skeletonsOnce sync.Once
+	skeletons     map[string]struct{}
+}
+
+// ParseDomains parses a list of domains, one per line. Lines in the format
+// of a hosts file, such as "0.0.0.0 ads.example.com", are also accepted.
+func ParseDomains(r io.Reader) (*DomainList, error) {
+	l := &DomainList{domains: make(map[string]struct{})}
+	err := scanLines(r, func(line int, text string) error {
+		f := strings.Fields(text)
+		if len(f) > 1 && net.ParseIP(f[0]) != nil {
+			f = f[1:]
+		}
+		for _, d := range f {
+			l.domains[icap.CanonicalHost(d)] = struct{}{}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Len returns the number of domains in the list.
+func (l *DomainList) Len() int {
+	return len(l.domains)
+}
+
+// Match reports whether host, or a domain it belongs to, is in the list.
+// A port number in host is ignored.
+func (l *DomainList) Match(host string) bool {
+	return matchDomain(l.domains, icap.CanonicalHost(stripPort(host)))
+}
+
+// MatchConfusable reports whether host, or a domain it belongs to, looks
+// like a domain in the list: whether it would match if characters that
+// are easily confused, such as the Latin "a" and the Cyrillic "а", were
+// the same. It is meant for catching lookalike domains in phishing
+// lists; a host that Match matches is matched too.
+func (l *DomainList) MatchConfusable(host string) bool {
+	l.skeletonsOnce.Do(func() {
+		l.skeletons = make(map[string]struct{}, len(l.domains))
+		for d := range l.domains {
+			l.skeletons[skeleton(d)] = struct{}{}
+		}
+	})
+	return matchDomain(l.skeletons, skeleton(icap.CanonicalHost(stripPort(host))))
+}
+
+// matchDomain reports whether host or one of its parent domains is in set.
+func matchDomain(set map[string]struct{}, host string) bool {
+	for host != "" {
+		if _, ok := set[host]; ok {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			break
+		}
+		host = host[i+1:]
+	}
+	return false
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// A URLList is a set of URLs. Entries are compared without their scheme,
+// so "example.com/path" matches both http and https, and in canonical
+// form (see icap.CanonicalURL).
+type URLList struct {
+	urls map[string]struct{}
+}
+
+// ParseURLs parses a list of URLs, one per line, with or without a scheme.
+func ParseURLs(r io.Reader) (*URLList, error) {
+	l := &URLList{urls: make(map[string]struct{})}
+	err := scanLines(r, func(line int, text string) error {
+		if !strings.Contains(text, "://") {
+			text = "http://" + text
+		}
+		u, err := url.Parse(text)
+		if err != nil {
+			return err
+		}
+		l.urls[urlKey(icap.CanonicalURL(u))] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// urlKey returns the form of u, a canonical URL, used to compare URLs.
+func urlKey(u *url.URL) string {
+	key := urlKeyNoQuery(u)
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+	return key
+}
+
+// urlKeyNoQuery is urlKey without the query string.
+func urlKeyNoQuery(u *url.URL) string {
+	return u.Hostname() + u.EscapedPath()
+}
+
+// Len returns the number of URLs in the list.
+func (l *URLList) Len() int {
+	return len(l.urls)
+}
+
+// Match reports whether u is in the list, either exactly or without its
+// query string.
+func (l *URLList) Match(u *url.URL) bool {
+	u = icap.CanonicalURL(u)
+	if _, ok := l.urls[urlKey(u)]; ok {
+		return true
+	}
+	_, ok := l.urls[urlKeyNoQuery(u)]
+	return ok
+}
+
+// A HashList is a set of file hashes.
+type HashList struct {
+	sums map[string]struct{}
+}
+
+// ParseHashes parses a list of hashes in hexadecimal, one per line.
+// A line may hold other fields after the hash, such as a file name.
+func ParseHashes(r io.Reader) (*HashList, error) {
+	l := &HashList{sums: make(map[string]struct{})}
+	err := scanLines(r, func(line int, text string) error {
+		sum, err := hex.DecodeString(strings.Fields(text)[0])
+		if err != nil {
+			return err
+		}
+		l.sums[string(sum)] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Len returns the number of hashes in the list.
+func (l *HashList) Len() int {
+	return len(l.sums)
+}
+
+// Contains reports whether sum is in the list.
+func (l *HashList) Contains(sum []byte) bool {
+	_, ok := l.sums[string(sum)]
+	return ok
+}
+
+// A HashReputation is an icap.HashReputation that gives the files whose
+// hashes are in the current list of Feed the reputation Reputation:
+// ReputationBad for a blocklist, ReputationGood for an allowlist.
+type HashReputation struct {
+	Feed       *Feed[*HashList]
+	Reputation icap.Reputation
+}
+
+// Lookup returns the reputation of sum. The hash function doesn't matter,
+// since the sums of different functions differ in length.
+func (r *HashReputation) Lookup(h crypto.Hash, sum []byte) (icap.Reputation, error) {
+	if l, ok := r.Feed.Get(); ok && l.Contains(sum) {
+		return r.Reputation, nil
+	}
+	return icap.ReputationUnknown, nil
+}
@@ -0,0 +1,19 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package feeds
+
+import "os"
+
+// mapFile reads the file path into memory, since mapping files isn't
+// supported on this platform.
+func mapFile(path string) (data []byte, unmap func() error, err error) {
+	data, err = os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
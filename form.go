@@ -0,0 +1,156 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Streaming access to multipart/form-data uploads.
+
+package icap
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+)
+
+// ErrNotForm is returned when a body that should be multipart/form-data
+// isn't, or has no boundary.
+var ErrNotForm = errors.New("icap: body is not multipart/form-data")
+
+// A FormPart is one field of a multipart/form-data body, such as an
+// uploaded file.
+type FormPart struct {
+	Header      textproto.MIMEHeader
+	Name        string // the name of the form field
+	FileName    string // the name of the uploaded file; empty if the part isn't a file
+	ContentType string
+
+	// Content streams the content of the part, with any
+	// quoted-printable encoding removed. It can only be read until the
+	// next part is requested.
+	Content io.Reader
+}
+
+// IsFile reports whether p is an uploaded file.
+func (p *FormPart) IsFile() bool {
+	return p.FileName != ""
+}
+
+// A FormReader iterates over the parts of a multipart/form-data body as
+// it arrives, without buffering the whole form.
+type FormReader struct {
+	mr *multipart.Reader
+}
+
+// NewFormReader returns a FormReader that reads the form from r, with the
+// boundary given by contentType.
+func NewFormReader(r io.Reader, contentType string) (*FormReader, error) {
+	boundary, err := formBoundary(contentType)
+	if err != nil {
+		return nil, err
+	}
+	return &FormReader{mr: multipart.NewReader(r, boundary)}, nil
+}
+
+// FormReader returns a FormReader for the body of the encapsulated HTTP
+// request, which must be multipart/form-data. Reading parts consumes the
+// body.
+func (req *Request) FormReader() (*FormReader, error) {
+	if req.Request == nil || req.Request.Body == nil || !req.hasBody {
+		return nil, ErrNotForm
+	}
+	return NewFormReader(req.Request.Body, req.Request.Header.Get("Content-Type"))
+}
+
+// Next returns the next part of the form, or io.EOF after the last one.
+func (r *FormReader) Next() (*FormPart, error) {
+	p, err := r.mr.NextPart()
+	if err != nil {
+		return nil, err
+	}
+	return &FormPart{
+		Header:      p.Header,
+		Name:        p.FormName(),
+		FileName:    p.FileName(),
+		ContentType: p.Header.Get("Content-Type"),
+		Content:     p,
+	}, nil
+}
+
+// formBoundary returns the boundary parameter of contentType, which must
+// be multipart/form-data.
+func formBoundary(contentType string) (string, error) {
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil || mt != "multipart/form-data" || params["boundary"] == "" {
+		return "", ErrNotForm
+	}
+	return params["boundary"], nil
+}
+
+// A FormRewriter is a Transformer for multipart/form-data bodies that
+// lets Rewrite keep, replace or drop each part of the form as it streams
+// through. The form is written with the same boundary, so the
+// Content-Type header of the message stays valid.
+type FormRewriter struct {
+	Boundary string
+
+	// Rewrite is called for each part in turn. It returns the content to
+	// send for the part: part.Content, unread, to keep the part as it
+	// is; another reader to replace it, such as an io.TeeReader that
+	// scans part.Content as it is sent; or nil to drop the part. It may
+	// change part.Header, for example to fix the Content-Type of a
+	// replaced file. If it returns an error, the body is cut off.
+	Rewrite func(part *FormPart) (io.Reader, error)
+}
+
+// Transform rewrites the form read from src.
+func (f *FormRewriter) Transform(dst io.Writer, src io.Reader) error {
+	fr := &FormReader{mr: multipart.NewReader(src, f.Boundary)}
+	mw := multipart.NewWriter(dst)
+	if err := mw.SetBoundary(f.Boundary); err != nil {
+		return err
+	}
+	for {
+		part, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		content, err := f.Rewrite(part)
+		if err != nil {
+			return err
+		}
+		if content == nil {
+			continue
+		}
+		pw, err := mw.CreatePart(part.Header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(pw, content); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// RewriteForm replaces the body of the encapsulated HTTP request, which
+// must be multipart/form-data, with the form as rewritten by fn while the
+// new body is read (see FormRewriter). It returns ErrNotForm if the
+// request has no form, or req isn't a REQMOD request.
+func (req *Request) RewriteForm(fn func(part *FormPart) (io.Reader, error)) error {
+	if req.Method != "REQMOD" || req.Request == nil || !req.hasBody {
+		return ErrNotForm
+	}
+	boundary, err := formBoundary(req.Request.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+	if !req.TransformBody(&FormRewriter{Boundary: boundary, Rewrite: fn}) {
+		return ErrNotForm
+	}
+	return nil
+}
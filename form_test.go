@@ -0,0 +1,105 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// testForm returns a multipart/form-data body with a text field and two
+// files, and its Content-Type.
+func testForm(t *testing.T) (body, contentType string) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("comment", "see attached")
+	fw, _ := mw.CreateFormFile("upload", "report.txt")
+	io.WriteString(fw, "quarterly numbers")
+	fw, _ = mw.CreateFormFile("upload", "eicar.com")
+	io.WriteString(fw, "X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR")
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String(), mw.FormDataContentType()
+}
+
+func TestFormReader(t *testing.T) {
+	body, contentType := testForm(t)
+	fr, err := NewFormReader(strings.NewReader(body), contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		p, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(p.Content)
+		got = append(got, p.Name+"|"+p.FileName+"|"+strconv.FormatBool(p.IsFile())+"|"+string(content))
+	}
+	want := []string{
+		"comment||false|see attached",
+		"upload|report.txt|true|quarterly numbers",
+		"upload|eicar.com|true|X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parts:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	if _, err := NewFormReader(strings.NewReader(body), "text/plain"); err != ErrNotForm {
+		t.Errorf("NewFormReader with text/plain: err = %v", err)
+	}
+}
+
+func TestRewriteForm(t *testing.T) {
+	body, contentType := testForm(t)
+	var scanned []string
+	stage := StageFunc(func(req *Request) (StageResult, error) {
+		err := req.RewriteForm(func(p *FormPart) (io.Reader, error) {
+			switch {
+			case !p.IsFile():
+				return p.Content, nil
+			case p.FileName == "eicar.com":
+				return nil, nil
+			}
+			p.Header.Set("Content-Type", "text/plain")
+			scanned = append(scanned, p.FileName)
+			return io.MultiReader(p.Content, strings.NewReader(" (scanned)")), nil
+		})
+		if err != nil {
+			return StageResult{}, err
+		}
+		return StageResult{Action: ActionModify}, nil
+	})
+
+	httpHdr := "POST /upload HTTP/1.1\r\nHost: www.example.com\r\n" +
+		"Content-Type: " + contentType + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+	request := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr +
+		strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+	srv := &Server{Handler: &Pipeline{Stages: []Stage{stage}}}
+	resp := roundTrip(t, srv, request)
+
+	if !strings.HasPrefix(resp, "ICAP/1.0 200 ") {
+		t.Fatalf("response:\n%s", resp)
+	}
+	if len(scanned) != 1 || scanned[0] != "report.txt" {
+		t.Errorf("scanned %q", scanned)
+	}
+	if strings.Contains(resp, "EICAR") || !strings.Contains(resp, " (scanned)") ||
+		!strings.Contains(resp, "see attached") {
+		t.Errorf("rewritten form:\n%s", resp)
+	}
+}
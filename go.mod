@@ -1,7 +1,11 @@
 module github.com/intra-sh/icap
 
-go 1.21
+go 1.22
 
 require (
-	
-)
\ No newline at end of file
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
+	github.com/tetratelabs/wazero v1.8.2
+	github.com/yuin/gopher-lua v1.1.1
+	golang.org/x/text v0.22.0
+)
@@ -0,0 +1,84 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Hashing of encapsulated bodies as they stream through.
+
+package icap
+
+import (
+	"crypto"
+	"hash"
+	"io"
+
+	// The hashes commonly used for file reputation.
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+)
+
+// HashBody makes the body of the encapsulated message (the HTTP request for
+// REQMOD, the HTTP response for RESPMOD) compute the given hashes as it is
+// read, whether by the handler, by BufferedBody, or while it is copied to
+// the response. Once the body has been read to the end, the sums are
+// available from BodyHash. Hashes that are not linked into the binary are
+// ignored; MD5, SHA-1 and SHA-256 always are.
+//
+// HashBody must be called before any of the body is read. Server.BodyHashes
+// calls it for every request.
+func (req *Request) HashBody(hashes ...crypto.Hash) {
+	body := req.bodyPtr()
+	if body == nil || *body == nil {
+		return
+	}
+	hr := &hashingReader{ReadCloser: *body, req: req, hashes: make(map[crypto.Hash]hash.Hash)}
+	for _, h := range hashes {
+		if h.Available() {
+			hr.hashes[h] = h.New()
+		}
+	}
+	if len(hr.hashes) > 0 {
+		*body = hr
+	}
+}
+
+// BodyHash returns the sum of the body computed with h, which must have
+// been requested with HashBody or Server.BodyHashes. It reports false if
+// the body has not yet been read to the end.
+func (req *Request) BodyHash(h crypto.Hash) ([]byte, bool) {
+	req.hashMu.Lock()
+	defer req.hashMu.Unlock()
+	sum, ok := req.bodySums[h]
+	return sum, ok
+}
+
+// A hashingReader hashes a body as it is read, and stores the sums in req
+// when it reaches the end.
+type hashingReader struct {
+	io.ReadCloser
+	req    *Request
+	hashes map[crypto.Hash]hash.Hash
+	done   bool
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.done {
+		return n, err
+	}
+	for _, h := range r.hashes {
+		h.Write(p[:n])
+	}
+	if err == io.EOF {
+		r.done = true
+		r.req.hashMu.Lock()
+		if r.req.bodySums == nil {
+			r.req.bodySums = make(map[crypto.Hash][]byte, len(r.hashes))
+		}
+		for k, h := range r.hashes {
+			r.req.bodySums[k] = h.Sum(nil)
+		}
+		r.req.hashMu.Unlock()
+	}
+	return n, err
+}
@@ -0,0 +1,167 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Order- and case-preserving handling of encapsulated HTTP headers.
+
+package icap
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A HeaderField is a single line of an encapsulated HTTP header,
+// with the field name exactly as it appeared on the wire.
+type HeaderField struct {
+	Name  string
+	Value string
+}
+
+// A RawHeader lists the fields of an encapsulated HTTP header
+// in the order in which they were received.
+type RawHeader []HeaderField
+
+// Get returns the first value associated with the given name,
+// compared case-insensitively.
+func (h RawHeader) Get(name string) string {
+	for _, f := range h {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// parseRawHeader parses an HTTP header block (including its start line)
+// into a RawHeader. Obsolete line folding is joined with a single space.
+func parseRawHeader(block []byte) RawHeader {
+	var h RawHeader
+	lines := bytes.Split(block, []byte("\n"))
+	for i, line := range lines {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if i == 0 {
+			continue // request or status line
+		}
+		if len(line) == 0 {
+			break
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(h) > 0 {
+				last := &h[len(h)-1]
+				last.Value += " " + string(bytes.TrimSpace(line))
+			}
+			continue
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		h = append(h, HeaderField{
+			Name:  string(line[:colon]),
+			Value: string(bytes.Trim(line[colon+1:], " \t")),
+		})
+	}
+	return h
+}
+
+var headerNewlineToSpace = strings.NewReplacer("\n", " ", "\r", " ")
+
+// write writes the fields of cur to w, following the order and name casing of h.
+// Fields of cur that are not in h are written afterwards in sorted order.
+// Keys for which exclude is true are omitted.
+func (h RawHeader) write(w io.Writer, cur http.Header, exclude map[string]bool) error {
+	used := make(map[string]int)
+	for _, f := range h {
+		key := http.CanonicalHeaderKey(f.Name)
+		if exclude[key] {
+			continue
+		}
+		vv := cur[key]
+		if used[key] >= len(vv) {
+			continue
+		}
+		v := headerNewlineToSpace.Replace(vv[used[key]])
+		used[key]++
+		if _, err := fmt.Fprintf(w, "%s: %s\r\n", f.Name, strings.TrimSpace(v)); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]string, 0, len(cur))
+	for k, vv := range cur {
+		if !exclude[k] && used[k] < len(vv) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range cur[k][used[k]:] {
+			v = headerNewlineToSpace.Replace(v)
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", k, strings.TrimSpace(v)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A messageSnapshot records an encapsulated HTTP message as it was parsed,
+// so that a message returned unmodified can be written back byte for byte.
+type messageSnapshot struct {
+	raw    []byte      // the header block as received
+	start  string      // the fields that make up the start line
+	header http.Header // a copy of the parsed header
+}
+
+func snapshotRequest(raw []byte, r *http.Request) *messageSnapshot {
+	return &messageSnapshot{
+		raw:    raw,
+		start:  requestStart(r),
+		header: r.Header.Clone(),
+	}
+}
+
+func snapshotResponse(raw []byte, r *http.Response) *messageSnapshot {
+	return &messageSnapshot{
+		raw:    raw,
+		start:  responseStart(r),
+		header: r.Header.Clone(),
+	}
+}
+
+func requestStart(r *http.Request) string {
+	u := ""
+	if r.URL != nil {
+		u = r.URL.String()
+	}
+	return r.Method + " " + u + " " + r.Proto + " " + r.Host
+}
+
+func responseStart(r *http.Response) string {
+	return fmt.Sprintf("%s %d %s", r.Proto, r.StatusCode, r.Status)
+}
+
+// unmodified reports whether the message described by start and header
+// is identical to the snapshot.
+func (s *messageSnapshot) unmodified(start string, header http.Header) bool {
+	if s == nil || s.start != start || len(s.header) != len(header) {
+		return false
+	}
+	for k, vv := range s.header {
+		cur, ok := header[k]
+		if !ok || len(cur) != len(vv) {
+			return false
+		}
+		for i := range vv {
+			if cur[i] != vv[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPreserveHeaderOrder(t *testing.T) {
+	httpHdr := "GET /index.html HTTP/1.1\r\n" +
+		"host: www.example.com\r\n" +
+		"x-lower: 1\r\n" +
+		"Accept: */*\r\n" +
+		"X-Remove: gone\r\n" +
+		"\r\n"
+	request := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr
+
+	mux := NewServeMux()
+	mux.HandleFunc("/reqmod", func(w ResponseWriter, req *Request) {
+		req.Request.Header.Del("X-Remove")
+		req.Request.Header.Set("X-Added", "yes")
+		w.WriteHeader(StatusOK, req.Request, false)
+	})
+
+	resp := roundTrip(t, &Server{Handler: mux, PreserveHeaderOrder: true}, request)
+	want := "GET /index.html HTTP/1.1\r\n" +
+		"host: www.example.com\r\n" +
+		"x-lower: 1\r\n" +
+		"Accept: */*\r\n" +
+		"X-Added: yes\r\n" +
+		"\r\n"
+	if !strings.HasSuffix(resp, want) {
+		t.Errorf("encapsulated header not preserved.\nGot:\n%s\nWant suffix:\n%s", resp, want)
+	}
+
+	resp = roundTrip(t, &Server{Handler: mux}, request)
+	if !strings.Contains(resp, "X-Lower: 1\r\n") {
+		t.Errorf("default mode should canonicalize headers:\n%s", resp)
+	}
+}
+
+func TestPassthroughUnmodified(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"content-type:text/plain\r\n" +
+		"X-Spacing:   odd  \r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: res-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr
+
+	echo := HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusOK, req.Response, false)
+	})
+	resp := roundTrip(t, &Server{Handler: echo, PassthroughUnmodified: true}, request)
+	if !strings.HasSuffix(resp, "\r\n\r\n"+httpHdr) {
+		t.Errorf("unmodified response not passed through byte for byte:\n%q", resp)
+	}
+
+	modify := HandlerFunc(func(w ResponseWriter, req *Request) {
+		req.Response.Header.Set("X-Modified", "1")
+		w.WriteHeader(StatusOK, req.Response, false)
+	})
+	resp = roundTrip(t, &Server{Handler: modify, PassthroughUnmodified: true}, request)
+	if !strings.Contains(resp, "\r\n\r\nHTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n") ||
+		!strings.Contains(resp, "X-Modified: 1\r\n") {
+		t.Errorf("modified response should be re-serialized:\n%q", resp)
+	}
+}
+
+func TestHeaderPolicy(t *testing.T) {
+	warned := make(chan string, 10)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.Header().Set("Methods", "RESPMOD")
+			w.Header().Set("X-Internal", "secret")
+			w.Header().Set("X-Debug", "1")
+			w.Header().Set("Encapsulated", "bogus")
+			w.WriteHeader(StatusOK, nil, false)
+		}),
+		HeaderPolicy: &HeaderPolicy{
+			Allow:   []string{"Methods", "X-Debug"},
+			Strip:   []string{"x-debug"},
+			ISTag:   StaticISTag("rules-42"),
+			Service: "Example Scanner",
+			Warn: func(req *Request, name, value string) {
+				warned <- name
+			},
+		},
+	}
+	resp := roundTrip(t, srv, "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n\r\n")
+
+	for _, want := range []string{
+		"Methods: RESPMOD\r\n",
+		"Istag: \"rules-42\"\r\n",
+		"Service: Example Scanner\r\n",
+		"Encapsulated: null-body=0\r\n",
+	} {
+		if !strings.Contains(resp, want) {
+			t.Errorf("response lacks %q:\n%s", want, resp)
+		}
+	}
+	if strings.Contains(resp, "X-Internal") || strings.Contains(resp, "X-Debug") {
+		t.Errorf("filtered headers were sent:\n%s", resp)
+	}
+	close(warned)
+	var names []string
+	for name := range warned {
+		names = append(names, name)
+	}
+	if len(names) != 1 || names[0] != "Encapsulated" {
+		t.Errorf("warnings = %v, want [Encapsulated]", names)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Filtering and injection of ICAP response headers.
+
+package icap
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// An ISTagProvider supplies the ISTag (ICAP service tag) for responses.
+// The tag should change whenever the service's behavior changes,
+// so that clients invalidate the responses they have cached.
+type ISTagProvider interface {
+	ISTag(req *Request) string
+}
+
+// A StaticISTag is an ISTagProvider that always returns the same tag.
+type StaticISTag string
+
+// ISTag returns t.
+func (t StaticISTag) ISTag(*Request) string { return string(t) }
+
+// managedHeaders lists the ICAP response headers that the library
+// computes itself, replacing whatever a handler has set.
+var managedHeaders = map[string]bool{
+	"Encapsulated": true,
+	"Connection":   true,
+}
+
+// A HeaderPolicy controls the ICAP headers of the responses a Server sends.
+type HeaderPolicy struct {
+	// Allow, if not empty, lists the headers that handlers may send;
+	// others are removed. The headers that the policy or the library
+	// add (ISTag, Service, Date, Encapsulated and Connection) are
+	// always allowed.
+	Allow []string
+
+	// Strip lists headers that are removed from every response.
+	Strip []string
+
+	// ISTag, if not nil, supplies the ISTag of responses whose handler
+	// doesn't set one. The tag is quoted if necessary.
+	ISTag ISTagProvider
+
+	// Service, if not empty, is the Service header of responses whose
+	// handler doesn't set one.
+	Service string
+
+	// Warn is called when a handler sets a header that the library
+	// manages, and which will be replaced. If Warn is nil,
+	// the warning is logged.
+	Warn func(req *Request, name, value string)
+}
+
+// apply filters header, the ICAP header of the response to req,
+// and adds the headers required by the policy.
+func (p *HeaderPolicy) apply(req *Request, header http.Header) {
+	for k, vv := range header {
+		if managedHeaders[k] && len(vv) > 0 {
+			p.warn(req, k, vv[0])
+		}
+	}
+
+	for _, k := range p.Strip {
+		if k = http.CanonicalHeaderKey(k); !managedHeaders[k] {
+			header.Del(k)
+		}
+	}
+	if len(p.Allow) > 0 {
+		allowed := map[string]bool{"Istag": true, "Service": true, "Date": true}
+		for _, k := range p.Allow {
+			allowed[http.CanonicalHeaderKey(k)] = true
+		}
+		for k := range header {
+			if !allowed[k] && !managedHeaders[k] {
+				delete(header, k)
+			}
+		}
+	}
+
+	if header.Get("ISTag") == "" {
+		if tag := p.istag(req); tag != "" {
+			header.Set("ISTag", tag)
+		}
+	}
+	if p.Service != "" && header.Get("Service") == "" {
+		header.Set("Service", p.Service)
+	}
+}
+
+// istag returns the ISTag that the policy gives the response to req,
+// quoted, or "" if it gives none.
+func (p *HeaderPolicy) istag(req *Request) string {
+	if p == nil || p.ISTag == nil {
+		return ""
+	}
+	tag := p.ISTag.ISTag(req)
+	if tag != "" && !strings.HasPrefix(tag, `"`) {
+		tag = strconv.Quote(tag)
+	}
+	return tag
+}
+
+func (p *HeaderPolicy) warn(req *Request, name, value string) {
+	if p.Warn != nil {
+		p.Warn(req, name, value)
+		return
+	}
+	log.Printf("icap: handler for %s %s set %s: %q, which is managed by the server", req.Method, req.RawURL, name, value)
+}
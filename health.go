@@ -0,0 +1,75 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Health and readiness signals for orchestration probes.
+
+package icap
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Healthy reports whether the server can make progress on requests.
+// It is false while the server is saturated: all MaxConns connections
+// are in use, or all handler goroutines are busy and their queue is full.
+// A server stays healthy while it shuts down.
+func (srv *Server) Healthy() bool {
+	return !srv.saturated()
+}
+
+// Ready reports whether the server should be sent new connections:
+// it is serving at least one listener, is not shutting down,
+// and is not saturated.
+func (srv *Server) Ready() bool {
+	srv.mu.Lock()
+	listening := len(srv.listeners) > 0
+	srv.mu.Unlock()
+	return listening && !srv.shuttingDown() && !srv.saturated()
+}
+
+// saturated reports whether the server has no capacity for more work:
+// all MaxConns connections are open, or all handler goroutines are busy
+// and their queue is full.
+func (srv *Server) saturated() bool {
+	if srv.MaxConns > 0 && srv.OpenConns() >= srv.MaxConns {
+		return true
+	}
+	if p := srv.workerPool(); p != nil && p.full() {
+		return true
+	}
+	return false
+}
+
+// HealthHandler returns an HTTP handler for liveness and readiness
+// probes, to be served on a separate HTTP listener. Requests for a path
+// ending in /readyz report Ready, and all others report Healthy, with
+// 200 OK or 503 Service Unavailable. A path ending in /stats returns the
+// server's ParserStats as JSON, and one ending in /clients its
+// ClientStats.
+func (srv *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/stats") {
+			srv.serveStats(w)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/clients") {
+			srv.serveClientStats(w)
+			return
+		}
+		ok := srv.Healthy()
+		if strings.HasSuffix(r.URL.Path, "/readyz") {
+			ok = srv.Ready()
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		if !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "unavailable\n")
+			return
+		}
+		io.WriteString(w, "ok\n")
+	})
+}
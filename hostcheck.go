@@ -0,0 +1,121 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Checking that the Host header of an encapsulated request agrees with its URL.
+
+package icap
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HostMismatch reports whether the Host header of the encapsulated HTTP
+// request names a different authority than its request URL, and returns
+// both. Hosts are compared in canonical form (see CanonicalHost), and a
+// port that is the default for the URL's scheme is the same as no port.
+// A request whose URL has no host, or that has no Host header, doesn't
+// mismatch.
+//
+// net/http drops the Host header of a request with an absolute URL, so
+// the header as received (in RawRequestHeader) is used, unless a handler
+// has set one in the request's Header.
+func (req *Request) HostMismatch() (urlHost, headerHost string, mismatch bool) {
+	hr := req.Request
+	if hr == nil || hr.URL == nil || hr.URL.Host == "" {
+		return "", "", false
+	}
+	headerHost = httpHost(req)
+	if headerHost == "" {
+		return "", "", false
+	}
+	scheme := strings.ToLower(hr.URL.Scheme)
+	if hostKey(hr.URL.Host, scheme) == hostKey(headerHost, scheme) {
+		return "", "", false
+	}
+	return hr.URL.Host, headerHost, true
+}
+
+// hostKey returns the form of hostport used to compare authorities.
+func hostKey(hostport, scheme string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+	if port == defaultPorts[scheme] {
+		port = ""
+	}
+	return CanonicalHost(host) + ":" + port
+}
+
+// A HostAction is what a HostCheck does with a request whose Host header
+// and URL disagree.
+type HostAction int
+
+const (
+	// HostLog lets the request through unchanged.
+	HostLog HostAction = iota
+
+	// HostFix replaces the Host header with the authority of the URL,
+	// which is the one an HTTP server must use (RFC 9112, section 3.2.2).
+	HostFix
+
+	// HostBlock blocks the request.
+	HostBlock
+)
+
+// A HostCheck is a Stage that finds REQMOD requests whose Host header
+// and URL name different hosts (see Request.HostMismatch). Proxies and
+// servers disagree about which of the two wins, so a request that
+// carries both can slip past a policy that looks at the other one.
+// Every mismatch is logged and recorded in the audit record; Action
+// decides what else is done.
+type HostCheck struct {
+	Action HostAction
+
+	// Status and Reason make up the block page; if they are zero, 400
+	// and "The Host header doesn't match the URL." are used.
+	Status int
+	Reason string
+
+	// Log is called for each mismatch. If Log is nil, the mismatch is
+	// logged with the standard logger.
+	Log func(req *Request, urlHost, headerHost string)
+}
+
+// Process checks the encapsulated HTTP request of req.
+func (c *HostCheck) Process(req *Request) (StageResult, error) {
+	if req.Method != "REQMOD" {
+		return StageResult{Action: ActionContinue}, nil
+	}
+	urlHost, headerHost, mismatch := req.HostMismatch()
+	if !mismatch {
+		return StageResult{Action: ActionContinue}, nil
+	}
+	req.Audit().AddScanResult("host-check", "Host "+headerHost+" doesn't match URL "+urlHost)
+	if c.Log != nil {
+		c.Log(req, urlHost, headerHost)
+	} else {
+		log.Printf("icap: Host header %q of %s doesn't match URL host %q", headerHost, req.RawURL, urlHost)
+	}
+
+	switch c.Action {
+	case HostFix:
+		req.Request.Host = urlHost
+		req.Request.Header.Set("Host", urlHost)
+		return StageResult{Action: ActionModify}, nil
+	case HostBlock:
+		status, reason := c.Status, c.Reason
+		if status == 0 {
+			status = http.StatusBadRequest
+		}
+		if reason == "" {
+			reason = "The Host header doesn't match the URL."
+		}
+		return StageResult{Action: ActionBlock, Status: status, Reason: reason}, nil
+	}
+	return StageResult{Action: ActionContinue}, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestHostCheck(t *testing.T) {
+	request := func(target, host string) string {
+		httpHdr := "GET " + target + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+		return "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr
+	}
+
+	for _, tc := range []struct {
+		target, host string
+		action       HostAction
+		want         string
+		mismatch     bool
+	}{
+		{"/index.html", "www.example.com", HostBlock, "ICAP/1.0 204 ", false},
+		{"http://www.example.com/", "WWW.Example.com:80", HostBlock, "ICAP/1.0 204 ", false},
+		{"http://bücher.example/", "xn--bcher-kva.example", HostBlock, "ICAP/1.0 204 ", false},
+		{"http://www.example.com/", "evil.example", HostLog, "ICAP/1.0 204 ", true},
+		{"http://www.example.com/", "evil.example", HostBlock, "HTTP/1.1 400 Bad Request\r\n", true},
+		{"http://www.example.com/", "evil.example", HostFix, "Host: www.example.com\r\n", true},
+		{"https://www.example.com:8443/", "www.example.com", HostBlock, "HTTP/1.1 400 Bad Request\r\n", true},
+	} {
+		var logged bool
+		check := &HostCheck{
+			Action: tc.action,
+			Log:    func(req *Request, urlHost, headerHost string) { logged = true },
+		}
+		srv := &Server{Handler: &Pipeline{Stages: []Stage{check}}}
+		resp := roundTrip(t, srv, request(tc.target, tc.host))
+		if !strings.Contains(resp, tc.want) || logged != tc.mismatch {
+			t.Errorf("%s with Host %s, action %d: logged = %v, response:\n%s", tc.target, tc.host, tc.action, logged, resp)
+		}
+		if tc.action == HostFix && strings.Contains(resp, tc.host) {
+			t.Errorf("fixed request still has Host %s:\n%s", tc.host, resp)
+		}
+	}
+}
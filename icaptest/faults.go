@@ -0,0 +1,156 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package icaptest provides utilities for testing ICAP clients, such as
+// proxies, against an icap.Server.
+package icaptest
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+// A FaultInjector is an icap.Handler that injects faults into the REQMOD
+// and RESPMOD transactions it passes to Handler, at random with the
+// configured rates, so that the bypass and retry behavior of a proxy can
+// be checked against a server that misbehaves. Each rate is a
+// probability from 0 to 1.
+//
+// A transaction gets at most one of the error, drop and malformed
+// faults, which together should not add up to more than 1; it may also
+// be delayed. Handler must write its response on the goroutine that
+// calls its ServeICAP method, since dropping the connection panics with
+// icap.ErrAbortHandler.
+type FaultInjector struct {
+	Handler icap.Handler
+
+	// Delay is how long a delayed transaction is held before Handler
+	// is called, at DelayRate.
+	Delay     time.Duration
+	DelayRate float64
+
+	// ErrorRate is the rate of answering with 500 Server Error instead
+	// of calling Handler.
+	ErrorRate float64
+
+	// DropRate is the rate of closing the connection partway through
+	// the response: after half the first write of the body, or instead
+	// of a response without a body.
+	DropRate float64
+
+	// MalformedRate is the rate of sending a malformed chunk in the
+	// body of the response (or a malformed status line, for a response
+	// without a body), and then closing the connection.
+	MalformedRate float64
+
+	// Rand, if not nil, is used instead of rand.Float64 to draw the
+	// faults, such as to make them repeatable.
+	Rand func() float64
+
+	requests, delayed, errors, dropped, malformed atomic.Uint64
+}
+
+// FaultStats counts the transactions a FaultInjector has seen and the
+// faults it has injected.
+type FaultStats struct {
+	Requests  uint64
+	Delayed   uint64
+	Errors    uint64
+	Dropped   uint64
+	Malformed uint64
+}
+
+// Stats returns the counts of transactions and faults so far.
+func (f *FaultInjector) Stats() FaultStats {
+	return FaultStats{
+		Requests:  f.requests.Load(),
+		Delayed:   f.delayed.Load(),
+		Errors:    f.errors.Load(),
+		Dropped:   f.dropped.Load(),
+		Malformed: f.malformed.Load(),
+	}
+}
+
+func (f *FaultInjector) rand() float64 {
+	if f.Rand != nil {
+		return f.Rand()
+	}
+	return rand.Float64()
+}
+
+// ServeICAP passes req to f.Handler, injecting any faults drawn for it.
+func (f *FaultInjector) ServeICAP(w icap.ResponseWriter, req *icap.Request) {
+	h := f.Handler
+	if h == nil {
+		h = icap.NotFoundHandler()
+	}
+	if req.Method != "REQMOD" && req.Method != "RESPMOD" {
+		h.ServeICAP(w, req)
+		return
+	}
+	f.requests.Add(1)
+
+	if f.DelayRate > 0 && f.rand() < f.DelayRate {
+		f.delayed.Add(1)
+		t := time.NewTimer(f.Delay)
+		select {
+		case <-t.C:
+		case <-req.Context().Done():
+			t.Stop()
+		}
+	}
+
+	r := f.rand()
+	switch {
+	case r < f.ErrorRate:
+		f.errors.Add(1)
+		icap.Error(w, icap.StatusInternalServerError, "injected fault")
+	case r < f.ErrorRate+f.DropRate:
+		f.dropped.Add(1)
+		h.ServeICAP(&faultWriter{ResponseWriter: w}, req)
+		panic(icap.ErrAbortHandler)
+	case r < f.ErrorRate+f.DropRate+f.MalformedRate:
+		f.malformed.Add(1)
+		h.ServeICAP(&faultWriter{ResponseWriter: w, malformed: true}, req)
+		panic(icap.ErrAbortHandler)
+	default:
+		h.ServeICAP(w, req)
+	}
+}
+
+// A faultWriter breaks off a response: it lets the header through if
+// a body follows, and then aborts the handler at the first write, after
+// writing half of it (or a malformed chunk). A response without a body
+// is aborted before its header is sent.
+type faultWriter struct {
+	icap.ResponseWriter
+	malformed bool
+}
+
+func (w *faultWriter) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	if !hasBody || httpMessage == nil {
+		if w.malformed {
+			w.ResponseWriter.WriteRaw("ICAP/1.0 2x0 Malformed\r\n\r\n")
+		}
+		panic(icap.ErrAbortHandler)
+	}
+	w.ResponseWriter.WriteHeader(code, httpMessage, hasBody)
+}
+
+func (w *faultWriter) Write(p []byte) (int, error) {
+	if w.malformed {
+		w.ResponseWriter.WriteRaw("zz; not a chunk\r\n")
+	} else if len(p) > 1 {
+		w.ResponseWriter.Write(p[:len(p)/2])
+	}
+	panic(icap.ErrAbortHandler)
+}
+
+// SetBodyMode passes the body mode on to the underlying writer.
+func (w *faultWriter) SetBodyMode(mode icap.BodyMode) {
+	icap.SetBodyMode(w.ResponseWriter, mode)
+}
@@ -0,0 +1,133 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icaptest
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+// echo answers with the encapsulated request and a body, or with 204 if
+// the request has the header X-No-Body.
+var echo = icap.HandlerFunc(func(w icap.ResponseWriter, req *icap.Request) {
+	if req.Request.Header.Get("X-No-Body") != "" {
+		icap.Unmodified(w, req)
+		return
+	}
+	req.Request.Body = nil
+	w.WriteHeader(icap.StatusOK, req.Request, true)
+	io.WriteString(w, "hello, world")
+})
+
+func startServer(t *testing.T, srv *icap.Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.Serve(l)
+	return "icap://" + l.Addr().String() + "/reqmod"
+}
+
+// do sends a REQMOD request, and returns the response and its body.
+func do(t *testing.T, u string, noBody bool) (*icap.Response, string, error) {
+	t.Helper()
+	httpReq, _ := http.NewRequest("POST", "http://www.example.com/", strings.NewReader("data"))
+	if noBody {
+		httpReq.Header.Set("X-No-Body", "1")
+	}
+	req, err := icap.NewRequest("REQMOD", u, httpReq, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Allow", "204")
+	resp, err := icap.Do(context.Background(), req)
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.Request == nil {
+		return resp, "", nil
+	}
+	body, err := io.ReadAll(resp.Request.Body)
+	return resp, string(body), err
+}
+
+func TestFaultInjector(t *testing.T) {
+	for _, workers := range []int{0, 4} {
+		f := &FaultInjector{Handler: echo}
+		u := startServer(t, &icap.Server{Handler: f, MaxHandlerGoroutines: workers})
+
+		resp, body, err := do(t, u, false)
+		if err != nil || resp.StatusCode != icap.StatusOK || body != "hello, world" {
+			t.Fatalf("without faults: %v, %q, %v", resp, body, err)
+		}
+
+		f.ErrorRate = 1
+		if resp, _, err := do(t, u, false); err != nil || resp.StatusCode != icap.StatusInternalServerError {
+			t.Errorf("with ErrorRate 1: %v, %v", resp, err)
+		}
+
+		f.ErrorRate, f.DropRate = 0, 1
+		if _, _, err := do(t, u, true); err == nil {
+			t.Error("with DropRate 1, response without a body was received")
+		}
+		if resp, body, err := do(t, u, false); err == nil || resp == nil || body != "hello," {
+			t.Errorf("with DropRate 1: %v, %q, %v", resp, body, err)
+		}
+
+		f.DropRate, f.MalformedRate = 0, 1
+		if _, _, err := do(t, u, true); err == nil {
+			t.Error("with MalformedRate 1, response without a body was received")
+		}
+		if resp, body, err := do(t, u, false); err == nil || resp == nil || body != "" {
+			t.Errorf("with MalformedRate 1: %v, %q, %v", resp, body, err)
+		}
+
+		f.MalformedRate, f.DelayRate, f.Delay = 0, 1, 50*time.Millisecond
+		start := time.Now()
+		if _, _, err := do(t, u, true); err != nil {
+			t.Error(err)
+		}
+		if d := time.Since(start); d < f.Delay {
+			t.Errorf("with DelayRate 1, response took %v", d)
+		}
+
+		want := FaultStats{Requests: 7, Delayed: 1, Errors: 1, Dropped: 2, Malformed: 2}
+		if got := f.Stats(); got != want {
+			t.Errorf("Stats() = %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestFaultInjectorRates(t *testing.T) {
+	draws := []float64{0.05, 0.15, 0.25, 0.5}
+	f := &FaultInjector{
+		Handler:       icap.HandlerFunc(func(w icap.ResponseWriter, req *icap.Request) { icap.Unmodified(w, req) }),
+		ErrorRate:     0.1,
+		DropRate:      0.1,
+		MalformedRate: 0.1,
+		Rand: func() float64 {
+			r := draws[0]
+			draws = draws[1:]
+			return r
+		},
+	}
+	u := startServer(t, &icap.Server{Handler: f})
+	for range []int{0, 1, 2, 3} {
+		do(t, u, true)
+	}
+	want := FaultStats{Requests: 4, Errors: 1, Dropped: 1, Malformed: 1}
+	if got := f.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Helpers for sending raw transactions to a server in tests.
+
+package icaptest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/intra-sh/icap"
+	"github.com/klauspost/compress/zstd"
+)
+
+// RoundTrip serves srv on a loopback address, sends it request as it is,
+// closes the sending side of the connection, and returns everything srv
+// writes back. It stops the test if the connection fails.
+func RoundTrip(t testing.TB, srv *icap.Server, request string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, request)
+	c.(*net.TCPConn).CloseWrite()
+	resp, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp)
+}
+
+// Unchunk returns the encapsulated body of resp, a raw ICAP response
+// with an encapsulated HTTP header and a chunked body, such as one
+// returned by RoundTrip.
+func Unchunk(t testing.TB, resp string) string {
+	t.Helper()
+	i := strings.Index(resp, "\r\n\r\n")
+	if i < 0 {
+		t.Fatalf("malformed response:\n%q", resp)
+	}
+	j := strings.Index(resp[i+4:], "\r\n\r\n")
+	if j < 0 {
+		t.Fatalf("malformed response:\n%q", resp)
+	}
+	rest := resp[i+4+j+4:]
+	var body strings.Builder
+	for {
+		line, after, _ := strings.Cut(rest, "\r\n")
+		n, err := strconv.ParseInt(line, 16, 64)
+		if err != nil || n == 0 {
+			return body.String()
+		}
+		if int64(len(after)) < n+2 {
+			t.Fatalf("truncated chunk in response:\n%q", resp)
+		}
+		body.WriteString(after[:n])
+		rest = after[n+2:]
+	}
+}
+
+// Encode returns body compressed with the HTTP content-coding coding,
+// which is gzip, deflate, br or zstd, for testing how a server handles
+// compressed bodies.
+func Encode(t testing.TB, coding, body string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	default:
+		t.Fatalf("unknown content-coding %q", coding)
+	}
+	io.WriteString(w, body)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
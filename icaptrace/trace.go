@@ -0,0 +1,118 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package icaptrace provides hooks to trace the events of ICAP client
+// transactions, in the style of net/http/httptrace.
+package icaptrace
+
+import (
+	"context"
+	"net"
+)
+
+// A ClientTrace is a set of hooks called at various stages of an ICAP
+// transaction sent by an icap.Client. Any hook may be nil.
+// Hooks may be called from goroutines other than the one calling Do.
+type ClientTrace struct {
+	// GotConn is called when a connection to the server has been opened.
+	GotConn func(GotConnInfo)
+
+	// WroteHeaders is called after the ICAP header and the
+	// encapsulated HTTP headers have been written.
+	WroteHeaders func()
+
+	// PreviewSent is called after a preview of n body bytes has been
+	// written. ieof reports whether the preview held the whole body.
+	PreviewSent func(n int, ieof bool)
+
+	// Got100Continue is called when the server asks for the rest
+	// of the body after a preview.
+	Got100Continue func()
+
+	// FirstResponseByte is called when the first byte of the
+	// server's response is available.
+	FirstResponseByte func()
+
+	// Done is called when the transaction has finished and its
+	// connection has been closed.
+	Done func(DoneInfo)
+}
+
+// GotConnInfo is the argument to ClientTrace.GotConn.
+type GotConnInfo struct {
+	Conn net.Conn
+}
+
+// DoneInfo is the argument to ClientTrace.Done.
+type DoneInfo struct {
+	// Err is the error that ended the transaction, if any.
+	Err error
+}
+
+type clientEventContextKey struct{}
+
+// ContextClientTrace returns the ClientTrace associated with ctx,
+// or nil if there is none.
+func ContextClientTrace(ctx context.Context) *ClientTrace {
+	trace, _ := ctx.Value(clientEventContextKey{}).(*ClientTrace)
+	return trace
+}
+
+// WithClientTrace returns a context based on ctx that carries trace.
+// If ctx already has a ClientTrace, the hooks of both are called,
+// those of trace first.
+func WithClientTrace(ctx context.Context, trace *ClientTrace) context.Context {
+	if trace == nil {
+		panic("nil trace")
+	}
+	if old := ContextClientTrace(ctx); old != nil {
+		trace = trace.compose(old)
+	}
+	return context.WithValue(ctx, clientEventContextKey{}, trace)
+}
+
+// compose returns a ClientTrace that calls the hooks of t, then those of old.
+func (t *ClientTrace) compose(old *ClientTrace) *ClientTrace {
+	c := *t
+	c.GotConn = compose1(t.GotConn, old.GotConn)
+	c.WroteHeaders = compose0(t.WroteHeaders, old.WroteHeaders)
+	if t.PreviewSent == nil {
+		c.PreviewSent = old.PreviewSent
+	} else if old.PreviewSent != nil {
+		c.PreviewSent = func(n int, ieof bool) {
+			t.PreviewSent(n, ieof)
+			old.PreviewSent(n, ieof)
+		}
+	}
+	c.Got100Continue = compose0(t.Got100Continue, old.Got100Continue)
+	c.FirstResponseByte = compose0(t.FirstResponseByte, old.FirstResponseByte)
+	c.Done = compose1(t.Done, old.Done)
+	return &c
+}
+
+func compose0(f, g func()) func() {
+	switch {
+	case f == nil:
+		return g
+	case g == nil:
+		return f
+	}
+	return func() {
+		f()
+		g()
+	}
+}
+
+func compose1[T any](f, g func(T)) func(T) {
+	switch {
+	case f == nil:
+		return g
+	case g == nil:
+		return f
+	}
+	return func(v T) {
+		f(v)
+		g(v)
+	}
+}
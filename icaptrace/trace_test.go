@@ -0,0 +1,31 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icaptrace
+
+import (
+	"context"
+	"testing"
+)
+
+func TestWithClientTraceCompose(t *testing.T) {
+	var calls []string
+	ctx := WithClientTrace(context.Background(), &ClientTrace{
+		WroteHeaders: func() { calls = append(calls, "outer") },
+	})
+	ctx = WithClientTrace(ctx, &ClientTrace{
+		WroteHeaders: func() { calls = append(calls, "inner") },
+		Done:         func(DoneInfo) { calls = append(calls, "done") },
+	})
+
+	trace := ContextClientTrace(ctx)
+	trace.WroteHeaders()
+	trace.Done(DoneInfo{})
+	if len(calls) != 3 || calls[0] != "inner" || calls[1] != "outer" || calls[2] != "done" {
+		t.Errorf("calls = %v", calls)
+	}
+	if trace.Got100Continue != nil {
+		t.Error("unset hook should stay nil")
+	}
+}
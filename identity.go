@@ -0,0 +1,56 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The identity of the user on whose behalf a request is made.
+
+package icap
+
+import (
+	"encoding/base64"
+	"strings"
+	"unicode/utf8"
+)
+
+// AuthenticatedUser returns the name of the user that the ICAP client
+// authenticated, from the X-Authenticated-User header, or "" if there is
+// none. The header is usually base64-encoded, with a prefix naming the
+// authentication scheme, such as "WinNT://"; both are removed.
+func (req *Request) AuthenticatedUser() string {
+	return identityName(decodeIdentity(req.Header.Get("X-Authenticated-User")))
+}
+
+// AuthenticatedGroups returns the groups of the authenticated user, from
+// the X-Authenticated-Groups header, decoded like AuthenticatedUser.
+func (req *Request) AuthenticatedGroups() []string {
+	s := decodeIdentity(req.Header.Get("X-Authenticated-Groups"))
+	if s == "" {
+		return nil
+	}
+	var groups []string
+	for _, g := range strings.Split(s, ",") {
+		if g = identityName(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// decodeIdentity decodes a base64-encoded identity header. Values that
+// aren't valid base64, as some clients send, are returned as they are.
+func decodeIdentity(s string) string {
+	s = strings.TrimSpace(s)
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && utf8.Valid(b) {
+		return string(b)
+	}
+	return s
+}
+
+// identityName removes the scheme prefix from a user or group name.
+func identityName(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	return s
+}
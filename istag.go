@@ -0,0 +1,134 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// ISTags derived from the content of rule files.
+
+package icap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A ContentISTag is an ISTagProvider whose tag is a hash of the content of
+// the files that hold a service's rules or signatures, and of the versions
+// of its other rule sources. Any change to the rules produces a new tag,
+// so clients discard the responses they have cached, and the preview and
+// response caches miss, without the tag being changed by hand.
+//
+// Files are checked at most once per CheckInterval, and are read again
+// only if their size or modification time has changed. A ContentISTag must
+// not be copied after first use.
+type ContentISTag struct {
+	// Prefix is put at the start of the tag, for people to read, such as
+	// the name of the service. Only its first 16 bytes are used.
+	Prefix string
+
+	// Files are the names of the rule files.
+	Files []string
+
+	// Versions return the versions of rule sources that aren't files,
+	// such as the Version method of a feeds.Feed.
+	Versions []func() string
+
+	// CheckInterval is the minimum time between checks of the files.
+	// If zero, one second is used.
+	CheckInterval time.Duration
+
+	mu        sync.Mutex
+	tag       string
+	lastCheck time.Time
+	files     map[string]fileVersion
+	err       error // from the last check
+}
+
+// A fileVersion identifies the content of a file by its size and
+// modification time, and holds its hash.
+type fileVersion struct {
+	size    int64
+	modTime time.Time
+	sum     [sha256.Size]byte
+}
+
+// ISTag returns the current tag, in quotes, checking the files first if
+// CheckInterval has passed since they were last checked.
+func (t *ContentISTag) ISTag(*Request) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	interval := t.CheckInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if t.tag == "" || time.Since(t.lastCheck) >= interval {
+		t.check()
+	}
+	return t.tag
+}
+
+// Refresh checks the files now, and returns the error from the first file
+// that couldn't be read. A file that can't be read gives the tag a value
+// of its own, so the tag changes when a file disappears.
+func (t *ContentISTag) Refresh() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.check()
+	return t.err
+}
+
+// check hashes the files that have changed, and computes the tag.
+func (t *ContentISTag) check() {
+	t.lastCheck = time.Now()
+	t.err = nil
+	files := make(map[string]fileVersion, len(t.Files))
+	h := sha256.New()
+	for _, name := range t.Files {
+		v, err := t.fileVersion(name)
+		if err != nil && t.err == nil {
+			t.err = err
+		}
+		files[name] = v
+		io.WriteString(h, name)
+		h.Write([]byte{0})
+		h.Write(v.sum[:])
+	}
+	for _, version := range t.Versions {
+		io.WriteString(h, version())
+		h.Write([]byte{0})
+	}
+	t.files = files
+
+	prefix := t.Prefix
+	if len(prefix) > 16 {
+		prefix = prefix[:16]
+	}
+	t.tag = `"` + prefix + hex.EncodeToString(h.Sum(nil)[:8]) + `"`
+}
+
+// fileVersion returns the version of the file called name, reusing the
+// hash from the last check if the file hasn't changed.
+func (t *ContentISTag) fileVersion(name string) (fileVersion, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	if old, ok := t.files[name]; ok && old.size == fi.Size() && old.modTime.Equal(fi.ModTime()) {
+		return old, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return fileVersion{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fileVersion{}, err
+	}
+	v := fileVersion{size: fi.Size(), modTime: fi.ModTime()}
+	h.Sum(v.sum[:0])
+	return v, nil
+}
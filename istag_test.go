@@ -0,0 +1,69 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContentISTag(t *testing.T) {
+	dir := t.TempDir()
+	rules := filepath.Join(dir, "rules.txt")
+	sigs := filepath.Join(dir, "signatures.txt")
+	os.WriteFile(rules, []byte("block ads.example.com\n"), 0644)
+	os.WriteFile(sigs, []byte("eicar\n"), 0644)
+	feedVersion := "v1"
+	p := &ContentISTag{
+		Prefix:        "filter-",
+		Files:         []string{rules, sigs},
+		Versions:      []func() string{func() string { return feedVersion }},
+		CheckInterval: time.Hour,
+	}
+	if err := p.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	tag := p.ISTag(nil)
+	if !strings.HasPrefix(tag, `"filter-`) || len(tag) > 34 || tag[len(tag)-1] != '"' {
+		t.Fatalf("ISTag = %s", tag)
+	}
+	if p.ISTag(nil) != tag {
+		t.Error("tag changed without a change to the rules")
+	}
+
+	// Changes are noticed at the next check.
+	os.WriteFile(rules, []byte("block ads.example.org\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(rules, later, later)
+	if p.ISTag(nil) != tag {
+		t.Error("files checked before CheckInterval passed")
+	}
+	p.Refresh()
+	tag2 := p.ISTag(nil)
+	if tag2 == tag {
+		t.Error("tag unchanged after a rule file changed")
+	}
+
+	feedVersion = "v2"
+	p.Refresh()
+	tag3 := p.ISTag(nil)
+	if tag3 == tag2 {
+		t.Error("tag unchanged after a feed changed")
+	}
+
+	os.Remove(sigs)
+	if err := p.Refresh(); err == nil {
+		t.Error("Refresh succeeded with a missing file")
+	}
+	if p.ISTag(nil) == tag3 {
+		t.Error("tag unchanged after a file disappeared")
+	}
+	if findings := Lint([]byte("ICAP/1.0 204 No Content\r\nISTag: " + tag + "\r\nEncapsulated: null-body=0\r\n\r\n")); len(findings) > 0 {
+		t.Errorf("tag has problems: %v", findings)
+	}
+}
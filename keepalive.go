@@ -0,0 +1,73 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// TCP keep-alive and transaction watchdog for accepted connections.
+
+package icap
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// A KeepAliveConfig configures the TCP keep-alive probes that detect
+// dead peers on a server's accepted connections.
+type KeepAliveConfig struct {
+	Enable bool
+
+	// Idle is how long a connection must be idle before probes are sent.
+	// If zero, the operating system's default is used.
+	Idle time.Duration
+
+	// Interval is the time between unanswered probes, and Count is the
+	// number of unanswered probes after which the connection is dropped.
+	// If zero, the operating system's defaults are used. They are only
+	// supported on Linux, FreeBSD, NetBSD and DragonFly BSD.
+	Interval time.Duration
+	Count    int
+}
+
+// setKeepAlive applies the server's KeepAlive configuration to rw.
+func (srv *Server) setKeepAlive(rw net.Conn) {
+	if !srv.KeepAlive.Enable {
+		return
+	}
+	if nc, ok := rw.(interface{ NetConn() net.Conn }); ok {
+		rw = nc.NetConn() // a TLS connection
+	}
+	tc, ok := rw.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	ka := srv.KeepAlive
+	if err := tc.SetKeepAlive(true); err != nil {
+		log.Printf("icap: SetKeepAlive error: %v", err)
+		return
+	}
+	if ka.Idle > 0 {
+		tc.SetKeepAlivePeriod(ka.Idle)
+	}
+	if ka.Interval > 0 || ka.Count > 0 {
+		if err := setKeepAliveProbes(tc, ka.Interval, ka.Count); err != nil && err != ErrSockoptUnsupported {
+			log.Printf("icap: error setting keep-alive probes: %v", err)
+		}
+	}
+}
+
+// watchTransaction closes c if the transaction that is starting is still
+// in progress after the server's MaxTransactionTime. The returned function
+// must be called when the transaction ends.
+func (c *conn) watchTransaction() (stop func()) {
+	if c.server == nil || c.server.MaxTransactionTime <= 0 {
+		return func() {}
+	}
+	d := c.server.MaxTransactionTime
+	t := time.AfterFunc(d, func() {
+		log.Printf("icap: closing connection from %s: transaction took longer than %v", c.remoteAddr, d)
+		c.server.trace().transactionTimeout(c.netConn)
+		c.netConn.Close()
+	})
+	return func() { t.Stop() }
+}
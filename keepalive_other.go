@@ -0,0 +1,16 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(linux || freebsd || netbsd || dragonfly)
+
+package icap
+
+import (
+	"net"
+	"time"
+)
+
+func setKeepAliveProbes(tc *net.TCPConn, interval time.Duration, count int) error {
+	return ErrSockoptUnsupported
+}
@@ -0,0 +1,34 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || freebsd || netbsd || dragonfly
+
+package icap
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+func setKeepAliveProbes(tc *net.TCPConn, interval time.Duration, count int) error {
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if interval > 0 {
+			secs := int((interval + time.Second - 1) / time.Second)
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs)
+		}
+		if sockErr == nil && count > 0 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
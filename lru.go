@@ -0,0 +1,153 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A least-recently-used cache with expiry.
+
+package icap
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// A Cache holds up to a fixed number of values, discarding the least
+// recently used when it is full. Values may expire after a time to live.
+// It is safe for concurrent use. The package uses it for its own caches,
+// such as ResponseCache; filters can use it for things like verdicts
+// or lookups in external services.
+type Cache[K comparable, V any] struct {
+	max int
+	ttl time.Duration
+
+	mu    sync.Mutex
+	ll    *list.List
+	items map[K]*list.Element
+}
+
+type cacheEntry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time // zero if the entry doesn't expire
+}
+
+// NewCache returns a Cache that holds up to maxEntries values (or any
+// number, if maxEntries is zero or less), which expire ttl after they
+// are added (or never, if ttl is zero or less).
+func NewCache[K comparable, V any](maxEntries int, ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		max:   maxEntries,
+		ttl:   ttl,
+		ll:    list.New(),
+		items: make(map[K]*list.Element),
+	}
+}
+
+// Get returns the value stored under key, if it has not expired, and
+// marks it as recently used.
+func (c *Cache[K, V]) Get(key K) (v V, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return v, false
+	}
+	e := el.Value.(*cacheEntry[K, V])
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		return v, false
+	}
+	c.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Add stores value under key, with the cache's time to live.
+func (c *Cache[K, V]) Add(key K, value V) {
+	c.AddWithTTL(key, value, c.ttl)
+}
+
+// AddWithTTL stores value under key, to expire after ttl (or never, if
+// ttl is zero or less).
+func (c *Cache[K, V]) AddWithTTL(key K, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &cacheEntry[K, V]{key: key, value: value}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(e)
+	for c.max > 0 && c.ll.Len() > c.max {
+		c.remove(c.ll.Back())
+	}
+}
+
+// Remove removes the value stored under key, if any.
+func (c *Cache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *Cache[K, V]) remove(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry[K, V]).key)
+}
+
+// Purge removes all values.
+func (c *Cache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	clear(c.items)
+}
+
+// RemoveExpired removes the values that have expired, which are
+// otherwise removed only when they are looked up or crowded out by new
+// ones. It returns the number removed.
+func (c *Cache[K, V]) RemoveExpired() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		if e := el.Value.(*cacheEntry[K, V]); !e.expires.IsZero() && now.After(e.expires) {
+			c.remove(el)
+			n++
+		}
+		el = next
+	}
+	return n
+}
+
+// Len returns the number of entries, including any that have expired
+// but not yet been removed.
+func (c *Cache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Values returns the values that have not expired, most recently used
+// first.
+func (c *Cache[K, V]) Values() []V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	var vs []V
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		if e := el.Value.(*cacheEntry[K, V]); e.expires.IsZero() || now.Before(e.expires) {
+			vs = append(vs, e.value)
+		}
+	}
+	return vs
+}
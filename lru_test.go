@@ -0,0 +1,45 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCache(t *testing.T) {
+	c := NewCache[string, int](2, 0)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	if v, ok := c.Get("a"); !ok || v != 1 {
+		t.Errorf(`Get("a") = %d, %v`, v, ok)
+	}
+	c.Add("c", 3) // crowds out "b", the least recently used
+	if _, ok := c.Get("b"); ok {
+		t.Error(`"b" still cached`)
+	}
+	if got := c.Values(); !reflect.DeepEqual(got, []int{3, 1}) {
+		t.Errorf("Values = %v", got)
+	}
+
+	c.AddWithTTL("d", 4, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := c.Get("d"); ok {
+		t.Error(`expired "d" returned`)
+	}
+	c.AddWithTTL("e", 5, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if n := c.RemoveExpired(); n != 1 || c.Len() != 1 {
+		t.Errorf("RemoveExpired = %d, leaving %d", n, c.Len())
+	}
+
+	c.Remove("e")
+	c.Add("f", 6)
+	c.Purge()
+	if c.Len() != 0 {
+		t.Errorf("Len after Purge = %d", c.Len())
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package luascript runs adaptation rules written in Lua.
+//
+// A Script is run once for each REQMOD and RESPMOD request, in a fresh
+// interpreter with only the base, string, table and math libraries
+// (without the functions that load code or access files). It can use
+// these globals:
+//
+//	icap.method             the ICAP method, "REQMOD" or "RESPMOD"
+//	icap.url                the URL of the HTTP request
+//	icap.request_method     the method of the HTTP request
+//	icap.status             the status code of the HTTP response, or nil
+//	icap.header(name)       a header of the ICAP request, or nil
+//	icap.request_header(name)
+//	icap.response_header(name)
+//	                        a header of the HTTP request or response, or nil
+//	set_header(name, value) set a header of the message being adapted
+//	remove_header(name)     remove a header of the message being adapted
+//	allow()                 stop, passing the message on
+//	block([status,] reason) stop, replacing the message with a block page
+//
+// A script that returns without calling allow or block passes the message
+// on, with the changes made by set_header and remove_header.
+package luascript
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/intra-sh/icap"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// A Script is a compiled Lua script. It is an icap.Stage and an
+// icap.Handler, and is safe for concurrent use.
+type Script struct {
+	// Timeout limits the time each run of the script may take.
+	// Zero means no limit.
+	Timeout time.Duration
+
+	// FailOpen makes ServeICAP pass messages on unmodified when the
+	// script fails, instead of sending an ICAP 500 Server Error.
+	FailOpen bool
+
+	proto *lua.FunctionProto
+}
+
+// Compile compiles a script from its source. The name is used in
+// error messages.
+func Compile(name, source string) (*Script, error) {
+	chunk, err := parse.Parse(strings.NewReader(source), name)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{proto: proto}, nil
+}
+
+// CompileFile compiles the script in the named file.
+func CompileFile(name string) (*Script, error) {
+	source, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return Compile(name, string(source))
+}
+
+// ServeICAP runs the script for req and responds according to its verdict.
+func (s *Script) ServeICAP(w icap.ResponseWriter, req *icap.Request) {
+	p := icap.Pipeline{Stages: []icap.Stage{s}, FailOpen: s.FailOpen}
+	p.ServeICAP(w, req)
+}
+
+// unsafeGlobals are the functions of the base library that are removed
+// from the sandbox.
+var unsafeGlobals = []string{
+	"collectgarbage", "dofile", "getfenv", "load", "loadfile", "loadstring",
+	"module", "newproxy", "print", "require", "setfenv",
+}
+
+// stop is raised as an error by allow and block to end the script.
+const stop = lua.LString("luascript: stop")
+
+// A run holds the state of one run of a script.
+type run struct {
+	req     *icap.Request
+	result  icap.StageResult
+	stopped bool
+}
+
+// Process runs the script for req.
+func (s *Script) Process(req *icap.Request) (icap.StageResult, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafeGlobals {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	r := &run{req: req}
+	r.install(L)
+
+	if s.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+		L.SetContext(ctx)
+	}
+	L.Push(L.NewFunctionFromProto(s.proto))
+	err := L.PCall(0, 0, nil)
+	var apiErr *lua.ApiError
+	if err != nil && !(errors.As(err, &apiErr) && apiErr.Object == stop && r.stopped) {
+		return icap.StageResult{}, fmt.Errorf("luascript: %v", err)
+	}
+	return r.result, nil
+}
+
+// install sets the globals that make up the script's API.
+func (r *run) install(L *lua.LState) {
+	t := L.NewTable()
+	t.RawSetString("method", lua.LString(r.req.Method))
+	if hr := r.req.Request; hr != nil {
+		t.RawSetString("url", lua.LString(hr.URL.String()))
+		t.RawSetString("request_method", lua.LString(hr.Method))
+	}
+	if hr := r.req.Response; hr != nil {
+		t.RawSetString("status", lua.LNumber(hr.StatusCode))
+		if t.RawGetString("url") == lua.LNil && hr.Request != nil && hr.Request.URL != nil {
+			t.RawSetString("url", lua.LString(hr.Request.URL.String()))
+		}
+	}
+	t.RawSetString("header", L.NewFunction(headerFunc(http.Header(r.req.Header))))
+	if hr := r.req.Request; hr != nil {
+		t.RawSetString("request_header", L.NewFunction(headerFunc(hr.Header)))
+	}
+	if hr := r.req.Response; hr != nil {
+		t.RawSetString("response_header", L.NewFunction(headerFunc(hr.Header)))
+	}
+	L.SetGlobal("icap", t)
+
+	L.SetGlobal("set_header", L.NewFunction(func(L *lua.LState) int {
+		h := r.adapted()
+		if h == nil {
+			L.RaiseError("no message to modify")
+		}
+		h.Set(L.CheckString(1), L.CheckString(2))
+		r.result.Action = icap.ActionModify
+		return 0
+	}))
+	L.SetGlobal("remove_header", L.NewFunction(func(L *lua.LState) int {
+		h := r.adapted()
+		if h == nil {
+			L.RaiseError("no message to modify")
+		}
+		h.Del(L.CheckString(1))
+		r.result.Action = icap.ActionModify
+		return 0
+	}))
+	L.SetGlobal("allow", L.NewFunction(func(L *lua.LState) int {
+		r.stopped = true
+		L.Error(stop, 0)
+		return 0
+	}))
+	L.SetGlobal("block", L.NewFunction(func(L *lua.LState) int {
+		r.result = icap.StageResult{Action: icap.ActionBlock}
+		if L.GetTop() >= 2 {
+			r.result.Status = L.CheckInt(1)
+			r.result.Reason = L.CheckString(2)
+		} else {
+			r.result.Reason = L.OptString(1, "")
+		}
+		r.stopped = true
+		L.Error(stop, 0)
+		return 0
+	}))
+}
+
+// adapted returns the header of the message being adapted, or nil.
+func (r *run) adapted() http.Header {
+	switch {
+	case r.req.Method == "REQMOD" && r.req.Request != nil:
+		return r.req.Request.Header
+	case r.req.Method == "RESPMOD" && r.req.Response != nil:
+		return r.req.Response.Header
+	}
+	return nil
+}
+
+func headerFunc(h http.Header) lua.LGFunction {
+	return func(L *lua.LState) int {
+		name := L.CheckString(1)
+		if len(h.Values(name)) == 0 {
+			L.Push(lua.LNil)
+		} else {
+			L.Push(lua.LString(h.Get(name)))
+		}
+		return 1
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package luascript
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/intra-sh/icap"
+)
+
+func reqmod(t *testing.T, header string) *icap.Request {
+	t.Helper()
+	httpHdr := "GET http://www.example.com/page HTTP/1.1\r\nHost: www.example.com\r\n" + header + "\r\n"
+	raw := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr
+	req, err := icap.ReadRequest(bufio.NewReadWriter(bufio.NewReader(strings.NewReader(raw)), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestScript(t *testing.T) {
+	s, err := Compile("rules.lua", `
+		if icap.request_header("X-Block") then
+			block(451, "blocked " .. icap.url)
+		end
+		if string.find(icap.url, "example") then
+			set_header("X-Example", "yes")
+			remove_header("Host")
+			allow()
+		end
+		error("not reached")
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := reqmod(t, "")
+	res, err := s.Process(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != icap.ActionModify || req.Request.Header.Get("X-Example") != "yes" || req.Request.Header.Get("Host") != "" {
+		t.Errorf("unexpected result %+v, header %v", res, req.Request.Header)
+	}
+
+	res, err = s.Process(reqmod(t, "X-Block: 1\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := icap.StageResult{Action: icap.ActionBlock, Status: 451, Reason: "blocked http://www.example.com/page"}
+	if res != want {
+		t.Errorf("result = %+v, want %+v", res, want)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	for _, src := range []string{
+		`dofile("/etc/passwd")`,
+		`os.exit(1)`,
+		`io.open("/etc/passwd")`,
+		`require("os")`,
+		`load("return 1")`,
+	} {
+		s, err := Compile("sandbox.lua", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Process(reqmod(t, "")); err == nil {
+			t.Errorf("%s: no error", src)
+		}
+	}
+
+	s, err := Compile("loop.lua", `while true do end`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Timeout = 20 * time.Millisecond
+	start := time.Now()
+	if _, err := s.Process(reqmod(t, "")); err == nil {
+		t.Error("endless script did not fail")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("endless script ran for %v", d)
+	}
+}
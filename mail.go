@@ -0,0 +1,282 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Access to MIME email messages encapsulated by mail gateways.
+
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// A MailMessage is a MIME email message, such as one that a mail gateway
+// sends in the body of an ICAP request for scanning. Its parts are read as
+// they stream in.
+type MailMessage struct {
+	Header mail.Header
+
+	rawHeader []byte
+	body      *bufio.Reader
+}
+
+// ReadMailMessage reads the header of the message in r. The body is read
+// by Walk.
+func ReadMailMessage(r io.Reader) (*MailMessage, error) {
+	br := bufio.NewReader(r)
+	var raw []byte
+	for {
+		line, err := br.ReadSlice('\n')
+		raw = append(raw, line...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(raw) > 0 {
+			break // a message without a body
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+	}
+	// The blank line makes sure that the header is terminated.
+	block := append(bytes.Clone(raw), "\r\n"...)
+	h, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(block))).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &MailMessage{Header: mail.Header(h), rawHeader: raw, body: br}, nil
+}
+
+// MailMessage reads the header of the email message in the encapsulated
+// body: the body of the HTTP request for REQMOD, or of the HTTP response
+// for RESPMOD. Walking the message consumes the body.
+func (req *Request) MailMessage() (*MailMessage, error) {
+	body := req.bodyPtr()
+	if body == nil || *body == nil || !req.hasBody {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return ReadMailMessage(*body)
+}
+
+// A MailPart is a leaf of the MIME tree of a message: a body text or an
+// attachment. Attached messages (message/rfc822) are single parts.
+type MailPart struct {
+	Header      textproto.MIMEHeader
+	ContentType string // the media type, such as "text/plain"
+	FileName    string // the suggested file name, if any
+	Attachment  bool   // whether the part is an attachment rather than inline text
+
+	// Content streams the content of the part, with its
+	// Content-Transfer-Encoding (base64 or quoted-printable) removed.
+	// It can only be read until the next part is requested.
+	Content io.Reader
+}
+
+func newMailPart(h textproto.MIMEHeader, r io.Reader) *MailPart {
+	p := &MailPart{Header: h, ContentType: "text/plain", Content: r}
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err == nil {
+		p.ContentType = mt
+		p.FileName = params["name"]
+	}
+	disposition, params, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if err == nil {
+		if params["filename"] != "" {
+			p.FileName = params["filename"]
+		}
+		p.Attachment = disposition == "attachment"
+	}
+	if p.FileName != "" {
+		p.Attachment = true
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		p.Content = base64.NewDecoder(base64.StdEncoding, r) // line breaks are skipped
+	case "quoted-printable":
+		p.Content = quotedprintable.NewReader(r)
+	}
+	return p
+}
+
+// Walk calls fn for each leaf part of the message in turn, reading
+// nested multipart entities as it goes.
+func (m *MailMessage) Walk(fn func(part *MailPart) error) error {
+	return rewriteEntity(textproto.MIMEHeader(m.Header), m.body, nil, func(p *MailPart) (io.Reader, error) {
+		return nil, fn(p)
+	})
+}
+
+// A MailRewriter is a Transformer for MIME email messages that lets
+// Rewrite keep, replace or drop each leaf part of the message as it
+// streams through, such as to strip an infected attachment. The message
+// header, and the headers and boundaries of multipart entities, are kept.
+type MailRewriter struct {
+	// Rewrite is called for each leaf part in turn. It returns the
+	// content to send for the part: part.Content, unread, to keep it;
+	// another reader to replace it; or nil to drop the part. The content
+	// is encoded with the part's Content-Transfer-Encoding. Rewrite may
+	// change part.Header, except for a message that isn't multipart,
+	// whose header has already been sent.
+	Rewrite func(part *MailPart) (io.Reader, error)
+}
+
+// Transform rewrites the message read from src.
+func (m *MailRewriter) Transform(dst io.Writer, src io.Reader) error {
+	msg, err := ReadMailMessage(src)
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(msg.rawHeader); err != nil {
+		return err
+	}
+	return rewriteEntity(textproto.MIMEHeader(msg.Header), msg.body, dst, m.Rewrite)
+}
+
+// RewriteMail replaces the encapsulated body, an email message, with the
+// message as rewritten by fn while the new body is read (see
+// MailRewriter). It reports false if there is no body.
+func (req *Request) RewriteMail(fn func(part *MailPart) (io.Reader, error)) bool {
+	return req.TransformBody(&MailRewriter{Rewrite: fn})
+}
+
+// rewriteEntity reads the body of the MIME entity with header h from r,
+// calling fn for each of its leaf parts. If w is not nil, it writes the
+// body, with the parts replaced as fn says, to w.
+func rewriteEntity(h textproto.MIMEHeader, r io.Reader, w io.Writer, fn func(*MailPart) (io.Reader, error)) error {
+	boundary, ok := multipartBoundary(h)
+	if !ok {
+		p := newMailPart(h, r)
+		content, err := fn(p)
+		if err != nil || w == nil || content == nil {
+			return err
+		}
+		return writeEncoded(w, h.Get("Content-Transfer-Encoding"), content)
+	}
+
+	mr := multipart.NewReader(r, boundary)
+	var mw *multipart.Writer
+	if w != nil {
+		mw = multipart.NewWriter(w)
+		if err := mw.SetBoundary(boundary); err != nil {
+			return err
+		}
+	}
+	for {
+		raw, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, ok := multipartBoundary(raw.Header); ok {
+			var pw io.Writer
+			if mw != nil {
+				if pw, err = mw.CreatePart(raw.Header); err != nil {
+					return err
+				}
+			}
+			if err := rewriteEntity(raw.Header, raw, pw, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		p := newMailPart(raw.Header, raw)
+		content, err := fn(p)
+		if err != nil {
+			return err
+		}
+		if mw == nil || content == nil {
+			continue
+		}
+		pw, err := mw.CreatePart(p.Header)
+		if err != nil {
+			return err
+		}
+		if err := writeEncoded(pw, p.Header.Get("Content-Transfer-Encoding"), content); err != nil {
+			return err
+		}
+	}
+	if mw != nil {
+		return mw.Close()
+	}
+	return nil
+}
+
+// multipartBoundary returns the boundary of a multipart entity with
+// header h.
+func multipartBoundary(h textproto.MIMEHeader) (string, bool) {
+	mt, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mt, "multipart/") || params["boundary"] == "" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// writeEncoded copies content to w with the Content-Transfer-Encoding
+// encoding.
+func writeEncoded(w io.Writer, encoding string, content io.Reader) error {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		lw := &lineWrapper{w: w, width: 76}
+		enc := base64.NewEncoder(base64.StdEncoding, lw)
+		if _, err := io.Copy(enc, content); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, "\r\n")
+		return err
+	case "quoted-printable":
+		qw := quotedprintable.NewWriter(w)
+		if _, err := io.Copy(qw, content); err != nil {
+			return err
+		}
+		return qw.Close()
+	}
+	_, err := io.Copy(w, content)
+	return err
+}
+
+// A lineWrapper breaks what is written to it into lines of width bytes.
+type lineWrapper struct {
+	w     io.Writer
+	width int
+	col   int
+}
+
+func (lw *lineWrapper) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if lw.col == lw.width {
+			if _, err := io.WriteString(lw.w, "\r\n"); err != nil {
+				return written, err
+			}
+			lw.col = 0
+		}
+		n := min(len(p), lw.width-lw.col)
+		if _, err := lw.w.Write(p[:n]); err != nil {
+			return written, err
+		}
+		lw.col += n
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
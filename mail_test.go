@@ -0,0 +1,125 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+const testMail = "Received: from b.example by c.example\r\n" +
+	"Received: from a.example by b.example\r\n" +
+	"From: Alice <alice@example.com>\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"This is a multi-part message in MIME format.\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Caf=C3=A9 numbers attached.\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Numbers attached.</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/octet-stream; name=\"eicar.com\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment\r\n" +
+	"\r\n" +
+	"WDVPIVAlQEFQWzRcUFpYNTQoUF4pN0NDKTd9JEVJQ0FS\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/csv\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment; filename=\"q3.csv\"\r\n" +
+	"\r\n" +
+	"cTMsMTAw\r\n" +
+	"--outer--\r\n"
+
+func walkMail(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	m, err := ReadMailMessage(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []string
+	err = m.Walk(func(p *MailPart) error {
+		content, err := io.ReadAll(p.Content)
+		if err != nil {
+			return err
+		}
+		desc := p.ContentType + "|" + p.FileName + "|" + strings.TrimSpace(string(content))
+		if p.Attachment {
+			desc += "|attachment"
+		}
+		parts = append(parts, desc)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parts
+}
+
+func TestMailMessage(t *testing.T) {
+	m, err := ReadMailMessage(strings.NewReader(testMail))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Header.Get("Subject") != "Report" {
+		t.Errorf("Subject = %q", m.Header.Get("Subject"))
+	}
+	if from, err := m.Header.AddressList("From"); err != nil || from[0].Address != "alice@example.com" {
+		t.Errorf("From = %v, %v", from, err)
+	}
+
+	got := walkMail(t, strings.NewReader(testMail))
+	want := []string{
+		"text/plain||Café numbers attached.",
+		"text/html||<p>Numbers attached.</p>",
+		"application/octet-stream|eicar.com|X5O!P%@AP[4\\PZX54(P^)7CC)7}$EICAR|attachment",
+		"text/csv|q3.csv|q3,100|attachment",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parts:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestMailRewriter(t *testing.T) {
+	rw := &MailRewriter{Rewrite: func(p *MailPart) (io.Reader, error) {
+		switch p.FileName {
+		case "eicar.com":
+			return nil, nil
+		case "q3.csv":
+			return strings.NewReader("q3,200"), nil
+		}
+		return p.Content, nil
+	}}
+	var out bytes.Buffer
+	if err := rw.Transform(&out, strings.NewReader(testMail)); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(out.String(), testMail[:strings.Index(testMail, "\r\n\r\n")+4]) {
+		t.Errorf("message header not kept:\n%s", out.String())
+	}
+
+	got := walkMail(t, &out)
+	want := []string{
+		"text/plain||Café numbers attached.",
+		"text/html||<p>Numbers attached.</p>",
+		"text/csv|q3.csv|q3,200|attachment",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("rewritten parts:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
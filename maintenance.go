@@ -0,0 +1,96 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Maintenance mode for the services of a ServeMux.
+
+package icap
+
+import "strings"
+
+// A Maintenance describes how a service in maintenance mode answers
+// REQMOD and RESPMOD requests. Other requests, such as OPTIONS, are still
+// passed to the service's handler, so that clients keep seeing the
+// service; the ISTag of every response is changed while maintenance
+// lasts, so that clients discard what they have cached from the service.
+type Maintenance struct {
+	// FailOpen passes messages on unmodified, with 204 No Content if the
+	// client allows it, instead of refusing them.
+	FailOpen bool
+
+	// Status is the ICAP status of refused requests. If zero,
+	// 503 Service Unavailable is used.
+	Status int
+}
+
+// StartMaintenance puts the services whose paths match pattern into
+// maintenance mode, until EndMaintenance is called with the same
+// pattern. It may be called while the mux is serving requests.
+func (mux *ServeMux) StartMaintenance(pattern string, m Maintenance) {
+	if pattern == "" {
+		panic("icap: invalid pattern " + pattern)
+	}
+	mux.maintMu.Lock()
+	defer mux.maintMu.Unlock()
+	if mux.maintenance == nil {
+		mux.maintenance = make(map[string]Maintenance)
+	}
+	mux.maintenance[pattern] = m
+}
+
+// EndMaintenance takes the services whose paths match pattern out of
+// maintenance mode.
+func (mux *ServeMux) EndMaintenance(pattern string) {
+	mux.maintMu.Lock()
+	defer mux.maintMu.Unlock()
+	delete(mux.maintenance, pattern)
+}
+
+// maintenanceFor returns the maintenance mode for the service at hostPath
+// or path; the most specific pattern wins.
+func (mux *ServeMux) maintenanceFor(hostPath, path string) (m Maintenance, ok bool) {
+	mux.maintMu.RLock()
+	defer mux.maintMu.RUnlock()
+	n := 0
+	for pattern, v := range mux.maintenance {
+		if (pathMatch(pattern, hostPath) || pathMatch(pattern, path)) && (!ok || len(pattern) > n) {
+			m, ok, n = v, true, len(pattern)
+		}
+	}
+	return m, ok
+}
+
+// serve answers a request for a service in maintenance mode.
+// It reports whether the request has been answered.
+func (m Maintenance) serve(w ResponseWriter, req *Request) bool {
+	req.maintenance = true
+	if req.Method != "REQMOD" && req.Method != "RESPMOD" {
+		return false
+	}
+	if m.FailOpen {
+		req.Audit().SetVerdict(VerdictAllow, "service in maintenance")
+		Unmodified(w, req)
+		return true
+	}
+	status := m.Status
+	if status == 0 {
+		status = StatusServiceUnavailable
+	}
+	req.Audit().SetVerdict(VerdictError, "service in maintenance")
+	w.WriteHeader(status, nil, false)
+	return true
+}
+
+// maintenanceSuffix is added to ISTags during maintenance.
+const maintenanceSuffix = "-maint"
+
+// maintenanceTag returns the ISTag to send instead of tag during
+// maintenance. Tags are limited to 32 characters, so a long tag is
+// shortened to make room for the suffix.
+func maintenanceTag(tag string) string {
+	tag = strings.Trim(tag, `"`)
+	if len(tag)+len(maintenanceSuffix) > 32 {
+		tag = tag[:32-len(maintenanceSuffix)]
+	}
+	return `"` + tag + maintenanceSuffix + `"`
+}
@@ -0,0 +1,69 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	httpHdr := "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	reqmod := "REQMOD icap://icap.example.net/av ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Allow: 204\r\n" +
+		"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr
+	options := "OPTIONS icap://icap.example.net/av ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"\r\n"
+
+	mux := NewServeMux()
+	mux.HandleFunc("/av", func(w ResponseWriter, req *Request) {
+		w.Header().Set("ISTag", `"av-2024-05-01-signatures"`)
+		if req.Method == "OPTIONS" {
+			w.Header().Set("Methods", "REQMOD")
+			w.WriteHeader(StatusOK, nil, false)
+			return
+		}
+		w.WriteHeader(StatusOK, req.Request, false)
+	})
+	srv := &Server{Handler: mux}
+
+	mux.StartMaintenance("/av", Maintenance{})
+	resp := roundTrip(t, srv, reqmod)
+	if !strings.HasPrefix(resp, "ICAP/1.0 503") {
+		t.Errorf("request during maintenance not refused:\n%s", resp)
+	}
+	resp = roundTrip(t, srv, options)
+	if !strings.HasPrefix(resp, "ICAP/1.0 200") || !strings.Contains(resp, `Istag: "av-2024-05-01-signatures-maint"`) {
+		t.Errorf("OPTIONS during maintenance:\n%s", resp)
+	}
+
+	mux.StartMaintenance("/av", Maintenance{FailOpen: true})
+	resp = roundTrip(t, srv, reqmod)
+	if !strings.HasPrefix(resp, "ICAP/1.0 204") {
+		t.Errorf("request during fail-open maintenance:\n%s", resp)
+	}
+
+	mux.EndMaintenance("/av")
+	resp = roundTrip(t, srv, reqmod)
+	if !strings.HasPrefix(resp, "ICAP/1.0 200") || !strings.Contains(resp, `Istag: "av-2024-05-01-signatures"`) {
+		t.Errorf("request after maintenance:\n%s", resp)
+	}
+}
+
+func TestMaintenanceTag(t *testing.T) {
+	for tag, want := range map[string]string{
+		`"v1"`:                               `"v1-maint"`,
+		`"0123456789abcdef0123456789abcdef"`: `"0123456789abcdef0123456789-maint"`,
+		`"0123456789abcdef0123456789"`:       `"0123456789abcdef0123456789-maint"`,
+	} {
+		if got := maintenanceTag(tag); got != want {
+			t.Errorf("maintenanceTag(%s) = %s, want %s", tag, got, want)
+		}
+	}
+}
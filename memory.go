@@ -0,0 +1,115 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Accounting of the memory used to buffer transactions.
+
+package icap
+
+import (
+	"fmt"
+)
+
+// A MemoryLimitError is returned when buffering more data would exceed
+// the memory budget of a transaction or of the whole server.
+type MemoryLimitError struct {
+	Global bool  // true if the server's budget was exceeded
+	Limit  int64 // the budget in bytes
+}
+
+func (e *MemoryLimitError) Error() string {
+	if e.Global {
+		return fmt.Sprintf("icap: server memory budget of %d bytes exceeded", e.Limit)
+	}
+	return fmt.Sprintf("icap: transaction memory budget of %d bytes exceeded", e.Limit)
+}
+
+// Status returns the ICAP status code with which to abort the transaction:
+// 413 if the transaction's own budget was exceeded, or 500 if the server's was.
+func (e *MemoryLimitError) Status() int {
+	if e.Global {
+		return StatusInternalServerError
+	}
+	return StatusRequestEntityTooLarge
+}
+
+// Reserve accounts for n more bytes of memory used by the transaction, such
+// as a buffer held by a transformer. It returns a *MemoryLimitError, without
+// reserving anything, if that would exceed Server.MaxRequestMemory or
+// Server.MaxTotalMemory. The memory is released when the transaction ends.
+func (req *Request) Reserve(n int64) error {
+	if err := req.reserve(n); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (req *Request) reserve(n int64) *MemoryLimitError {
+	err := req.tryReserve(n)
+	if err != nil {
+		req.server.trace().memoryLimit(req, err)
+	}
+	return err
+}
+
+func (req *Request) tryReserve(n int64) *MemoryLimitError {
+	req.memMu.Lock()
+	defer req.memMu.Unlock()
+	srv := req.server
+	if srv == nil {
+		req.memUsed += n
+		return nil
+	}
+	if limit := srv.MaxRequestMemory; limit > 0 && req.memUsed+n > limit {
+		return &MemoryLimitError{Limit: limit}
+	}
+	if used := srv.memUsed.Add(n); srv.MaxTotalMemory > 0 && used > srv.MaxTotalMemory {
+		srv.memUsed.Add(-n)
+		return &MemoryLimitError{Global: true, Limit: srv.MaxTotalMemory}
+	}
+	req.memUsed += n
+	return nil
+}
+
+// MemoryUsed returns the number of bytes reserved by the transaction.
+func (req *Request) MemoryUsed() int64 {
+	req.memMu.Lock()
+	defer req.memMu.Unlock()
+	return req.memUsed
+}
+
+// releaseMemory returns the transaction's reservations to the server.
+func (req *Request) releaseMemory() {
+	req.memMu.Lock()
+	defer req.memMu.Unlock()
+	if req.server != nil {
+		req.server.memUsed.Add(-req.memUsed)
+	}
+	req.memUsed = 0
+}
+
+// headerSize returns the size of the encapsulated HTTP headers.
+func (req *Request) headerSize() int64 {
+	var n int64
+	if req.reqSnapshot != nil {
+		n += int64(len(req.reqSnapshot.raw))
+	}
+	if req.respSnapshot != nil {
+		n += int64(len(req.respSnapshot.raw))
+	}
+	return n
+}
+
+// MemoryInUse returns the number of bytes reserved by the transactions
+// in progress.
+func (srv *Server) MemoryInUse() int64 {
+	return srv.memUsed.Load()
+}
+
+// abortMemory answers a transaction that exceeded its memory budget.
+func (w *respWriter) abortMemory(err *MemoryLimitError) {
+	w.deferred, w.buffered = nil, nil
+	w.wroteHeader = false
+	w.closeConn = true
+	w.WriteHeader(err.Status(), nil, false)
+}
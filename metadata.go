@@ -0,0 +1,184 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Structured metadata in JSON sidecar headers.
+
+package icap
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// MetadataHeader is the ICAP header that carries structured metadata
+// between a proxy and an ICAP service, for context that has no standard
+// header, such as the user's session or device posture. Each header
+// field holds one item, in the form
+//
+//	X-ICAP-Metadata: schema; base64-encoded JSON
+//
+// where schema names the kind of metadata.
+const MetadataHeader = "X-ICAP-Metadata"
+
+// MaxMetadataSize is the longest header value that EncodeMetadata
+// produces and DecodeMetadata accepts. Proxies commonly limit header
+// lines to 8 KB.
+const MaxMetadataSize = 8 << 10
+
+// ErrMetadataTooLarge is returned for metadata whose encoded form is
+// longer than MaxMetadataSize.
+var ErrMetadataTooLarge = errors.New("icap: metadata too large")
+
+// A MetadataSchema describes a kind of metadata, so that DecodeMetadata
+// can decode it into a Go type and check it.
+type MetadataSchema struct {
+	// New returns a value to decode the JSON into, such as a pointer to
+	// a struct.
+	New func() interface{}
+
+	// Validate, if not nil, checks the decoded value.
+	Validate func(v interface{}) error
+}
+
+var metadataSchemas = struct {
+	sync.RWMutex
+	m map[string]MetadataSchema
+}{m: make(map[string]MetadataSchema)}
+
+// RegisterMetadataSchema registers s for the schema name (which is not
+// case-sensitive), replacing any schema already registered for it.
+func RegisterMetadataSchema(name string, s MetadataSchema) {
+	if s.New == nil {
+		panic("icap: RegisterMetadataSchema with nil New")
+	}
+	if !validSchemaName(name) {
+		panic("icap: invalid metadata schema name " + name)
+	}
+	metadataSchemas.Lock()
+	defer metadataSchemas.Unlock()
+	metadataSchemas.m[strings.ToLower(name)] = s
+}
+
+// LookupMetadataSchema returns the schema registered for name.
+func LookupMetadataSchema(name string) (MetadataSchema, bool) {
+	metadataSchemas.RLock()
+	defer metadataSchemas.RUnlock()
+	s, ok := metadataSchemas.m[strings.ToLower(name)]
+	return s, ok
+}
+
+// validSchemaName reports whether name can be used as a schema name:
+// letters, digits and "-", ".", "_" and "/".
+func validSchemaName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '.' || c == '_' || c == '/') {
+			return false
+		}
+	}
+	return true
+}
+
+// A Metadata is one item of metadata.
+type Metadata struct {
+	Schema string
+
+	// Value is the decoded value: the result of the schema's New
+	// function if it is registered, or the JSON as a json.RawMessage
+	// if it isn't.
+	Value interface{}
+}
+
+// EncodeMetadata returns the value of a MetadataHeader field holding v,
+// encoded as JSON, as metadata of the named schema.
+func EncodeMetadata(schema string, v interface{}) (string, error) {
+	if !validSchemaName(schema) {
+		return "", fmt.Errorf("icap: invalid metadata schema name %q", schema)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	value := schema + "; " + base64.StdEncoding.EncodeToString(data)
+	if len(value) > MaxMetadataSize {
+		return "", ErrMetadataTooLarge
+	}
+	return value, nil
+}
+
+// DecodeMetadata decodes the value of a MetadataHeader field. If the
+// schema is registered, the JSON is decoded into a value from its New
+// function and checked with its Validate function.
+func DecodeMetadata(value string) (Metadata, error) {
+	if len(value) > MaxMetadataSize {
+		return Metadata{}, ErrMetadataTooLarge
+	}
+	schema, encoded, ok := strings.Cut(value, ";")
+	schema = strings.TrimSpace(schema)
+	if !ok || !validSchemaName(schema) {
+		return Metadata{}, fmt.Errorf("icap: malformed metadata %q", value)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return Metadata{}, fmt.Errorf("icap: malformed %s metadata: %v", schema, err)
+	}
+
+	s, ok := LookupMetadataSchema(schema)
+	if !ok {
+		if !json.Valid(data) {
+			return Metadata{}, fmt.Errorf("icap: malformed %s metadata: invalid JSON", schema)
+		}
+		return Metadata{Schema: schema, Value: json.RawMessage(data)}, nil
+	}
+	v := s.New()
+	if err := json.Unmarshal(data, v); err != nil {
+		return Metadata{}, fmt.Errorf("icap: malformed %s metadata: %v", schema, err)
+	}
+	if s.Validate != nil {
+		if err := s.Validate(v); err != nil {
+			return Metadata{}, fmt.Errorf("icap: invalid %s metadata: %v", schema, err)
+		}
+	}
+	return Metadata{Schema: schema, Value: v}, nil
+}
+
+// AddMetadata adds a MetadataHeader field holding v, as metadata of the
+// named schema, to h: the header of an ICAP response, or of a client
+// Request converted with http.Header(req.Header).
+func AddMetadata(h http.Header, schema string, v interface{}) error {
+	value, err := EncodeMetadata(schema, v)
+	if err != nil {
+		return err
+	}
+	h.Add(MetadataHeader, value)
+	return nil
+}
+
+// Metadata decodes the MetadataHeader fields of req, in order. Items that
+// can't be decoded are skipped, and the first error is returned with the
+// others.
+func (req *Request) Metadata() ([]Metadata, error) {
+	var items []Metadata
+	var firstErr error
+	for _, value := range req.Header.Values(MetadataHeader) {
+		m, err := DecodeMetadata(value)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		items = append(items, m)
+	}
+	return items, firstErr
+}
@@ -0,0 +1,65 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+type testSession struct {
+	User   string   `json:"user"`
+	Groups []string `json:"groups"`
+}
+
+func TestMetadata(t *testing.T) {
+	RegisterMetadataSchema("test.session", MetadataSchema{
+		New: func() interface{} { return new(testSession) },
+		Validate: func(v interface{}) error {
+			if v.(*testSession).User == "" {
+				return errors.New("no user")
+			}
+			return nil
+		},
+	})
+
+	h := make(http.Header)
+	if err := AddMetadata(h, "test.session", testSession{User: "alice", Groups: []string{"staff"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddMetadata(h, "vendor/posture", map[string]bool{"managed": true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddMetadata(h, "test.session", testSession{}); err != nil {
+		t.Fatal(err)
+	}
+	h.Add(MetadataHeader, "broken; !!!")
+
+	req := &Request{Header: textproto.MIMEHeader(h)}
+	items, err := req.Metadata()
+	if err == nil || !strings.Contains(err.Error(), "no user") {
+		t.Errorf("err = %v, want the first error, from Validate", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("got %d items, want 2", len(items))
+	}
+	if s, ok := items[0].Value.(*testSession); !ok || s.User != "alice" || s.Groups[0] != "staff" {
+		t.Errorf("session = %#v", items[0].Value)
+	}
+	if raw, ok := items[1].Value.(json.RawMessage); !ok || string(raw) != `{"managed":true}` {
+		t.Errorf("unregistered schema: %#v", items[1].Value)
+	}
+
+	if _, err := EncodeMetadata("test.session", testSession{User: strings.Repeat("x", MaxMetadataSize)}); err != ErrMetadataTooLarge {
+		t.Errorf("EncodeMetadata of large value: err = %v", err)
+	}
+	if _, err := EncodeMetadata("bad name", 1); err == nil {
+		t.Error("EncodeMetadata accepted a schema name with a space")
+	}
+}
@@ -5,24 +5,33 @@
 package icap
 
 import (
-	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
 )
 
 // ServeMux is an ICAP request multiplexer.
 // It matches the URL of each incoming request against a list of registered
 // patterns and calls the handler for the pattern that
 // most closely matches the URL.
+// A ServeMux can also host several tenants, each with its own tree of
+// services; see HandleTenant. Handlers registered with HandleMethod
+// serve only one method, such as a vendor extension like LOG, and take
+// precedence over handlers for all methods.
 //
 // For more details, see the documentation for http.ServeMux
 type ServeMux struct {
-	m map[string]Handler
+	m       map[string]Handler
+	methods map[string]map[string]Handler // method -> pattern -> handler
+	tenants map[string]*Tenant
+
+	maintMu     sync.RWMutex
+	maintenance map[string]Maintenance // pattern -> mode; see StartMaintenance
 }
 
 // NewServeMux allocates and returns a new ServeMux.
-func NewServeMux() *ServeMux { return &ServeMux{make(map[string]Handler)} }
+func NewServeMux() *ServeMux { return &ServeMux{m: make(map[string]Handler)} }
 
 // DefaultServeMux is the default ServeMux used by Serve.
 var DefaultServeMux = NewServeMux()
@@ -59,38 +68,61 @@ func cleanPath(p string) string {
 
 // Find a handler on a handler map given a path string
 // Most-specific (longest) pattern wins
-func (mux *ServeMux) match(path string) Handler {
-	var h Handler
-	var n = 0
-	for k, v := range mux.m {
+func (mux *ServeMux) match(path string) (h Handler, pattern string) {
+	return matchHandler(mux.m, path)
+}
+
+func matchHandler(m map[string]Handler, path string) (h Handler, pattern string) {
+	for k, v := range m {
 		if !pathMatch(k, path) {
 			continue
 		}
-		if h == nil || len(k) > n {
-			n = len(k)
+		if h == nil || len(k) > len(pattern) {
+			pattern = k
 			h = v
 		}
 	}
-	return h
+	return h, pattern
 }
 
-// ServeICAP dispatches the request to the handler whose
-// pattern most closely matches the request URL.
+// ServeICAP dispatches the request to the tenant registered for its host,
+// or else to the handler whose pattern most closely matches the request URL.
 func (mux *ServeMux) ServeICAP(w ResponseWriter, r *Request) {
+	if t, ok := mux.tenants[requestHost(r)]; ok {
+		t.ServeICAP(w, r)
+		return
+	}
+
 	// Clean path to canonical form and redirect.
 	if p := cleanPath(r.URL.Path); p != r.URL.Path {
 		w.Header().Set("Location", p)
-		w.WriteHeader(http.StatusMovedPermanently, nil, false)
+		w.WriteHeader(StatusMovedPermanently, nil, false)
+		return
+	}
+	if m, ok := mux.maintenanceFor(r.URL.Host+r.URL.Path, r.URL.Path); ok && m.serve(w, r) {
 		return
 	}
-	// Host-specific pattern takes precedence over generic ones
-	h := mux.match(r.URL.Host + r.URL.Path)
+
+	// Method-specific patterns take precedence over patterns for all
+	// methods, and host-specific patterns over generic ones.
+	var h Handler
+	var pattern string
+	if m := mux.methods[r.Method]; m != nil {
+		h, pattern = matchHandler(m, r.URL.Host+r.URL.Path)
+		if h == nil {
+			h, pattern = matchHandler(m, r.URL.Path)
+		}
+	}
 	if h == nil {
-		h = mux.match(r.URL.Path)
+		h, pattern = mux.match(r.URL.Host + r.URL.Path)
+	}
+	if h == nil {
+		h, pattern = mux.match(r.URL.Path)
 	}
 	if h == nil {
 		h = NotFoundHandler()
 	}
+	r.ServicePath = pattern
 	h.ServeICAP(w, r)
 }
 
@@ -106,8 +138,63 @@ func (mux *ServeMux) Handle(pattern string, handler Handler) {
 	// If pattern is /tree/, insert permanent redirect for /tree.
 	n := len(pattern)
 	if n > 0 && pattern[n-1] == '/' {
-		mux.m[pattern[0:n-1]] = RedirectHandler(pattern, http.StatusMovedPermanently)
+		mux.m[pattern[0:n-1]] = RedirectHandler(pattern, StatusMovedPermanently)
+	}
+}
+
+// HandleMethod registers the handler for requests with the given method
+// and pattern. The method need not be one defined by RFC 3507.
+func (mux *ServeMux) HandleMethod(method, pattern string, handler Handler) {
+	if !isToken(method) {
+		panic("icap: invalid method " + method)
 	}
+	if pattern == "" {
+		panic("icap: invalid pattern " + pattern)
+	}
+	if mux.methods == nil {
+		mux.methods = make(map[string]map[string]Handler)
+	}
+	if mux.methods[method] == nil {
+		mux.methods[method] = make(map[string]Handler)
+	}
+	mux.methods[method][pattern] = handler
+}
+
+// HandleTenant routes all requests addressed to host (in the ICAP Host
+// header, or else in the request URI) to t, bypassing the mux's own patterns.
+// Register the same tenant under several hosts to give it aliases.
+func (mux *ServeMux) HandleTenant(host string, t *Tenant) {
+	if host == "" || t == nil {
+		panic("icap: invalid tenant for host " + host)
+	}
+	if mux.tenants == nil {
+		mux.tenants = make(map[string]*Tenant)
+	}
+	mux.tenants[strings.ToLower(host)] = t
+}
+
+// Close closes the handlers registered with mux, including those of its
+// tenants, that implement io.Closer, and returns the first error.
+func (mux *ServeMux) Close() error {
+	seen := make(map[interface{}]bool)
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, h := range mux.m {
+		keep(closeHandler(h, seen))
+	}
+	for _, m := range mux.methods {
+		for _, h := range m {
+			keep(closeHandler(h, seen))
+		}
+	}
+	for _, t := range mux.tenants {
+		keep(closeHandler(t.Handler, seen))
+	}
+	return firstErr
 }
 
 // HandleFunc registers the handler function for the given pattern.
@@ -127,9 +214,14 @@ func HandleFunc(pattern string, handler func(ResponseWriter, *Request)) {
 	DefaultServeMux.HandleFunc(pattern, handler)
 }
 
-// NotFound replies to the request with an HTTP 404 not found error.
+// NotFound replies to the request with an ICAP 404 Service Not Found
+// error (see Error).
 func NotFound(w ResponseWriter, r *Request) {
-	w.WriteHeader(http.StatusNotFound, nil, false)
+	msg := "no such service"
+	if r.URL != nil {
+		msg = "no service at " + r.URL.Path
+	}
+	Error(w, StatusNotFound, msg)
 }
 
 // NotFoundHandler returns a simple request handler
@@ -0,0 +1,142 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// IP address families and address-based access control.
+
+package icap
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// An IPMode selects the address families a Server listens on.
+type IPMode int
+
+const (
+	// DualStack listens on IPv6 and IPv4 when the address doesn't
+	// specify one; this is the default.
+	DualStack IPMode = iota
+
+	// IPv4Only listens on IPv4 only.
+	IPv4Only
+
+	// IPv6Only listens on IPv6 only, without accepting IPv4 clients
+	// through IPv4-mapped addresses.
+	IPv6Only
+)
+
+// network returns the network name to listen on for mode.
+func (mode IPMode) network() string {
+	switch mode {
+	case IPv4Only:
+		return "tcp4"
+	case IPv6Only:
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+// ParsePrefixes parses IP prefixes in CIDR notation, such as
+// "192.0.2.0/24" or "2001:db8::/32", for Server.AllowClients.
+// A bare address stands for itself alone. IPv4-mapped IPv6 addresses
+// are converted to IPv4.
+func ParsePrefixes(s ...string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(s))
+	for _, p := range s {
+		if !strings.Contains(p, "/") {
+			addr, err := netip.ParseAddr(p)
+			if err != nil {
+				return nil, err
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			return nil, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// matchPrefixes reports whether addr is in one of prefixes. IPv4-mapped
+// IPv6 addresses match IPv4 prefixes, so a dual-stack listener applies
+// the same rules to IPv4 clients as an IPv4 one.
+func matchPrefixes(prefixes []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAllowed reports whether a connection from addr is accepted
+// under srv.AllowClients.
+func (srv *Server) clientAllowed(addr net.Addr) bool {
+	if len(srv.AllowClients) == 0 {
+		return true
+	}
+	ap, ok := addrPort(addr)
+	return ok && matchPrefixes(srv.AllowClients, ap.Addr())
+}
+
+// addrPort converts a net.Addr to a netip.AddrPort, unmapping
+// IPv4-mapped addresses.
+func addrPort(addr net.Addr) (netip.AddrPort, bool) {
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		ap := ta.AddrPort()
+		return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), ap.IsValid()
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// RemoteAddrPort returns the address and port of the ICAP client,
+// with IPv4-mapped IPv6 addresses converted to IPv4. It reports false
+// if RemoteAddr is not an IP address and port.
+func (req *Request) RemoteAddrPort() (netip.AddrPort, bool) {
+	ap, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.AddrPort{}, false
+	}
+	return netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), true
+}
+
+// ClientIP returns the address of the HTTP client, from the X-Client-IP
+// header that ICAP clients commonly send.
+func (req *Request) ClientIP() (netip.Addr, bool) {
+	return headerIP(req.Header.Get("X-Client-Ip"))
+}
+
+// ServerIP returns the address of the HTTP origin server, from the
+// X-Server-IP header that ICAP clients commonly send.
+func (req *Request) ServerIP() (netip.Addr, bool) {
+	return headerIP(req.Header.Get("X-Server-Ip"))
+}
+
+// headerIP parses an IP address from a header value. IPv6 addresses
+// may be enclosed in brackets, as some clients send them.
+func headerIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
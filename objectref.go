@@ -0,0 +1,199 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Handing off large bodies out of band, by reference.
+
+package icap
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An ObjectStore keeps encapsulated bodies that are handed off instead of
+// being sent back to the client, for another process (such as a sidecar
+// of the client) to retrieve by reference.
+type ObjectStore interface {
+	// Put stores the body read from r and returns the reference to it.
+	Put(r io.Reader, info ObjectInfo) (ref string, err error)
+}
+
+// ObjectInfo describes a body given to an ObjectStore.
+type ObjectInfo struct {
+	Method      string // REQMOD or RESPMOD
+	URL         string // the URL of the HTTP request, if known
+	ContentType string // the Content-Type of the HTTP message
+	Size        int64  // the size given by Content-Length, or -1
+}
+
+// A DirObjectStore stores bodies as files in Dir, which it creates if
+// need be. The reference to each is the name of its file, which appears
+// only once the body has been written. Removing the files once they have
+// been retrieved is up to the retriever.
+type DirObjectStore struct {
+	Dir string
+}
+
+// Put stores the body read from r in a new file.
+func (s *DirObjectStore) Put(r io.Reader, info ObjectInfo) (string, error) {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return "", err
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	ref := hex.EncodeToString(id[:])
+
+	f, err := os.CreateTemp(s.Dir, ".partial-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(s.Dir, ref))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return ref, nil
+}
+
+// An ObjectHandoff is a Handler that lets the services of Handler hand
+// off large bodies instead of sending them back to the client. When the
+// client lists object-ref in its Allow header, an encapsulated message
+// whose body is at least MinSize bytes is answered, wherever Handler
+// would echo it (as Unmodified and Pipeline do), by storing the body in
+// Store and sending the message without its body, with the reference in
+// an X-Object-Ref header; see Request.HandOff, which Handler can also
+// call itself.
+//
+// Wrapping only some of the services of a ServeMux in an ObjectHandoff
+// limits the handoff to those services.
+type ObjectHandoff struct {
+	Handler Handler
+	Store   ObjectStore
+
+	// MinSize is the size of the smallest body to hand off.
+	// If zero, 16 MiB is used.
+	MinSize int64
+}
+
+// ServeICAP serves req with h.Handler.
+func (h *ObjectHandoff) ServeICAP(w ResponseWriter, req *Request) {
+	req.handoff = h
+	h.Handler.ServeICAP(w, req)
+}
+
+// wants reports whether the body of req should be handed off.
+func (h *ObjectHandoff) wants(req *Request) bool {
+	if !req.hasBody || !req.AllowsObjectRef() {
+		return false
+	}
+	min := h.MinSize
+	if min <= 0 {
+		min = 16 << 20
+	}
+	size := req.declaredSize()
+	if size <= 0 {
+		// Find the size by reading the body, keeping up to 1 MiB in
+		// memory and spooling the rest.
+		bb, err := req.BufferedBody(1 << 20)
+		if err != nil {
+			return false
+		}
+		size = bb.Size()
+	}
+	return size >= min
+}
+
+// AllowsObjectRef reports whether the client accepts bodies handed off
+// by reference, by listing object-ref in its Allow header.
+func (req *Request) AllowsObjectRef() bool {
+	for _, v := range strings.Split(req.Header.Get("Allow"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "object-ref") {
+			return true
+		}
+	}
+	return false
+}
+
+// declaredSize returns the Content-Length of the encapsulated message,
+// or -1 if it is unknown.
+func (req *Request) declaredSize() int64 {
+	switch {
+	case req.Method == "REQMOD" && req.Request != nil:
+		return req.Request.ContentLength
+	case req.Method == "RESPMOD" && req.Response != nil:
+		return req.Response.ContentLength
+	}
+	return -1
+}
+
+// HandOff stores the body of the encapsulated message in store, and
+// responds with 200 OK, the message without its body, an X-Object-Ref
+// header holding the reference to the body, and an X-Object-Size header
+// holding its size. It returns the reference. If it fails, no response
+// has been sent, but the body may have been partly read.
+func (req *Request) HandOff(w ResponseWriter, store ObjectStore) (string, error) {
+	body := req.bodyPtr()
+	if body == nil || *body == nil || !req.hasBody || req.Method == "OPTIONS" {
+		return "", errors.New("icap: no encapsulated body to hand off")
+	}
+	h := req.bodyHeader()
+	info := ObjectInfo{
+		Method:      req.Method,
+		ContentType: h.Get("Content-Type"),
+		Size:        req.declaredSize(),
+	}
+	if info.Size <= 0 {
+		info.Size = -1
+	}
+	if req.Request != nil && req.Request.URL != nil {
+		info.URL = req.Request.URL.String()
+	}
+
+	cr := &countingReader{r: *body}
+	ref, err := store.Put(cr, info)
+	if err != nil {
+		return "", err
+	}
+
+	var msg interface{} = req.Request
+	if req.Method == "RESPMOD" {
+		msg = req.Response
+	}
+	w.Header().Set("X-Object-Ref", ref)
+	w.Header().Set("X-Object-Size", strconv.FormatInt(cr.n.Load(), 10))
+	w.WriteHeader(StatusOK, msg, false)
+	return ref, nil
+}
+
+// handOff answers req by handing off its body, if its service is wrapped
+// in an ObjectHandoff that wants it to be. It reports whether it did.
+func (req *Request) handOff(w ResponseWriter) bool {
+	if req.handoff == nil || !req.handoff.wants(req) {
+		return false
+	}
+	if _, err := req.HandOff(w, req.handoff.Store); err != nil {
+		log.Printf("icap: error handing off body: %v", err)
+		req.Audit().SetVerdict(VerdictError, err.Error())
+		w.WriteHeader(StatusInternalServerError, nil, false)
+	}
+	return true
+}
@@ -0,0 +1,64 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestObjectHandoff(t *testing.T) {
+	dir := t.TempDir()
+	srv := &Server{Handler: &ObjectHandoff{
+		Handler: &Pipeline{},
+		Store:   &DirObjectStore{Dir: dir},
+		MinSize: 10,
+	}}
+
+	request := func(allow, body string) string {
+		httpHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+		return "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: " + allow + "\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr +
+			strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+	}
+
+	const big = "a body longer than the minimum"
+	resp := roundTrip(t, srv, request("object-ref", big))
+	m := regexp.MustCompile(`X-Object-Ref: ([0-9a-f]+)\r\n`).FindStringSubmatch(resp)
+	if m == nil {
+		t.Fatalf("no X-Object-Ref in response:\n%s", resp)
+	}
+	if !strings.Contains(resp, "null-body=") || strings.Contains(resp, big) {
+		t.Errorf("body sent back although it was handed off:\n%s", resp)
+	}
+	if !strings.Contains(resp, "X-Object-Size: "+strconv.Itoa(len(big))+"\r\n") {
+		t.Errorf("wrong or missing X-Object-Size:\n%s", resp)
+	}
+	stored, err := os.ReadFile(filepath.Join(dir, m[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != big {
+		t.Errorf("stored body = %q", stored)
+	}
+
+	// Without object-ref in Allow, or below MinSize, the body is echoed.
+	for _, tt := range []struct{ allow, body string }{
+		{"trailers", big},
+		{"object-ref", "small"},
+	} {
+		resp := roundTrip(t, &Server{Handler: srv.Handler}, request(tt.allow, tt.body))
+		if strings.Contains(resp, "X-Object-Ref") || !strings.Contains(resp, tt.body) {
+			t.Errorf("Allow: %s, body %q: unexpected response:\n%s", tt.allow, tt.body, resp)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Keeping the responses on a connection in the order of their requests.
+
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"sync"
+)
+
+// A responseQueue hands out the writers for the responses on a
+// connection, in the order their requests arrive. A client that
+// pipelines its requests matches the responses to them by order alone,
+// so a response must not be written before the ones ahead of it are
+// complete, even if the handlers run concurrently.
+type responseQueue struct {
+	mu   sync.Mutex
+	last chan struct{} // closed when the latest response is complete
+}
+
+// next returns the writer for the response to the next request, which
+// writes to w.
+func (q *responseQueue) next(w *bufio.Writer) *orderedWriter {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ow := &orderedWriter{w: w, turn: q.last, done: make(chan struct{})}
+	if ow.turn == nil {
+		ow.ready = true
+	}
+	q.last = ow.done
+	return ow
+}
+
+// An orderedWriter is the writer for one response. Until the responses
+// ahead of it are complete, it holds what is written to it; after that
+// it writes through to the connection.
+type orderedWriter struct {
+	w    *bufio.Writer // the connection
+	turn chan struct{} // closed when the response ahead is complete
+	done chan struct{} // closed when this response is complete
+
+	ready    bool         // the responses ahead are complete
+	held     bytes.Buffer // what was written before ready
+	finished bool
+}
+
+// check reports whether the responses ahead are complete, writing what
+// has been held once they are. If wait is set, it waits for them.
+func (ow *orderedWriter) check(wait bool) (bool, error) {
+	if ow.ready {
+		return true, nil
+	}
+	if wait {
+		<-ow.turn
+	} else {
+		select {
+		case <-ow.turn:
+		default:
+			return false, nil
+		}
+	}
+	ow.ready = true
+	_, err := ow.held.WriteTo(ow.w)
+	return true, err
+}
+
+func (ow *orderedWriter) Write(p []byte) (int, error) {
+	ready, err := ow.check(false)
+	if err != nil {
+		return 0, err
+	}
+	if !ready {
+		return ow.held.Write(p)
+	}
+	return ow.w.Write(p)
+}
+
+func (ow *orderedWriter) WriteString(s string) (int, error) {
+	return ow.Write([]byte(s))
+}
+
+// Flush waits for the responses ahead to be complete, and flushes the
+// connection.
+func (ow *orderedWriter) Flush() error {
+	if _, err := ow.check(true); err != nil {
+		return err
+	}
+	return ow.w.Flush()
+}
+
+// finish flushes the response and lets the next one be written. It may
+// be called more than once.
+func (ow *orderedWriter) finish() error {
+	if ow.finished {
+		return nil
+	}
+	ow.finished = true
+	defer close(ow.done)
+	return ow.Flush()
+}
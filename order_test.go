@@ -0,0 +1,81 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResponseQueueOrder(t *testing.T) {
+	var out bytes.Buffer
+	bw := bufio.NewWriter(&out)
+	var q responseQueue
+	writers := make([]*orderedWriter, 5)
+	for i := range writers {
+		writers[i] = q.next(bw)
+	}
+
+	// The responses are written, and finished, in reverse order.
+	var wg sync.WaitGroup
+	for i := len(writers) - 1; i >= 0; i-- {
+		ow := writers[i]
+		fmt.Fprintf(ow, "response %d begins\n", i)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fmt.Fprintf(ow, "response %d ends\n", i)
+			if err := ow.finish(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	var want strings.Builder
+	for i := range writers {
+		fmt.Fprintf(&want, "response %d begins\nresponse %d ends\n", i, i)
+	}
+	if out.String() != want.String() {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want.String())
+	}
+}
+
+func TestPipelinedResponses(t *testing.T) {
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("X-Path", req.URL.Path)
+		w.WriteHeader(StatusOK, nil, false)
+	})}
+	var raw strings.Builder
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(&raw, "OPTIONS icap://icap.example.net/svc%d ICAP/1.0\r\nHost: icap.example.net\r\nEncapsulated: null-body=0\r\n\r\n", i)
+	}
+	resp := roundTrip(t, srv, raw.String())
+
+	br := bufio.NewReader(strings.NewReader(resp))
+	for i := 0; i < 3; i++ {
+		var path string
+		for {
+			line, err := br.ReadString('\n')
+			if err == io.EOF {
+				t.Fatalf("response %d missing:\n%s", i, resp)
+			}
+			if line == "\r\n" {
+				break
+			}
+			if v, ok := strings.CutPrefix(line, "X-Path: "); ok {
+				path = strings.TrimSpace(v)
+			}
+		}
+		if want := fmt.Sprintf("/svc%d", i); path != want {
+			t.Errorf("response %d is for %s, want %s", i, path, want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Parsing ICAP messages from captured data, without waiting for more.
+
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+)
+
+// ErrIncomplete is returned by ParseRequest, ParseResponse and
+// ParseChunks when the data ends before the message does. The parse can
+// be tried again when more data has arrived.
+var ErrIncomplete = errors.New("icap: incomplete message")
+
+// A captureReader reads from data, noting whether more was asked for.
+type captureReader struct {
+	data   []byte
+	off    int
+	hitEnd bool
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	if r.off == len(r.data) {
+		r.hitEnd = true
+		return 0, io.EOF
+	}
+	n := copy(p, r.data[r.off:])
+	r.off += n
+	return n, nil
+}
+
+// parseCaptured runs parse on a reader of data, and returns the number of
+// bytes it used. If parse runs out of data, it returns ErrIncomplete, even
+// if parse didn't fail: a message never needs more than its own bytes,
+// and the chunked reader takes the end of the data in a chunk for the
+// end of the body.
+func parseCaptured(data []byte, parse func(br *bufio.Reader) error) (n int, err error) {
+	cr := &captureReader{data: data}
+	br := bufio.NewReader(cr)
+	err = parse(br)
+	if cr.hitEnd {
+		return 0, ErrIncomplete
+	}
+	if err != nil {
+		return 0, err
+	}
+	return cr.off - br.Buffered(), nil
+}
+
+// ParseRequest parses the ICAP request at the start of data, such as a
+// stream of client data captured from the network, as the server would
+// read it before sending any 100 Continue: the headers, and the body if
+// there is no preview, or the preview. The rest of the body after an
+// incomplete preview can be parsed with ParseChunks. The body that has
+// been read is left in the Body of the encapsulated message, or in
+// OptBody. n is the number of bytes of data that were used.
+func ParseRequest(data []byte) (req *Request, n int, err error) {
+	n, err = parseCaptured(data, func(br *bufio.Reader) error {
+		b := bufio.NewReadWriter(br, bufio.NewWriter(io.Discard))
+		req, err = readRequest(b, StrictDialect{})
+		if err != nil {
+			return err
+		}
+		if !req.hasBody {
+			return nil
+		}
+		body := req.bodyPtr()
+		if req.Header.Get("Preview") != "" {
+			if body != nil && *body != nil {
+				*body = io.NopCloser(bytes.NewReader(req.Preview))
+			}
+			return nil
+		}
+		var r io.Reader = newChunkedReader(br)
+		if body != nil && *body != nil {
+			r = *body
+		}
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if body != nil && *body != nil {
+			*body = io.NopCloser(bytes.NewReader(content))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return req, n, nil
+}
+
+// ParseResponse parses the ICAP response at the start of data, such as a
+// stream of server data captured from the network, with its body. req is
+// the request it answers, if known. The body is left in the Body of the
+// encapsulated message, or in OptBody. n is the number of bytes of data
+// that were used.
+func ParseResponse(data []byte, req *Request) (resp *Response, n int, err error) {
+	n, err = parseCaptured(data, func(br *bufio.Reader) error {
+		rr, err := readRawResponse(br, StrictDialect{})
+		if err != nil {
+			return err
+		}
+		if rr.BodySection != "" && rr.StatusCode != StatusContinue {
+			content, err := io.ReadAll(newChunkedReader(br))
+			if err != nil {
+				return err
+			}
+			rr.Body = io.NopCloser(bytes.NewReader(content))
+		}
+		resp, err = newResponse(req, rr)
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp, n, nil
+}
+
+// ParseChunks parses the chunked body at the start of data, such as the
+// rest of a body that a client sends after a 100 Continue. It returns the
+// body, whether the last chunk carried the ieof extension, and the
+// number of bytes of data that were used.
+func ParseChunks(data []byte) (body []byte, ieof bool, n int, err error) {
+	n, err = parseCaptured(data, func(br *bufio.Reader) error {
+		cr := newChunkedReader(br)
+		body, err = io.ReadAll(cr)
+		ieof = cr.ieof
+		return err
+	})
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return body, ieof, n, nil
+}
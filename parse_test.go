@@ -0,0 +1,75 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"testing"
+)
+
+func TestParseRequest(t *testing.T) {
+	reqHdr := "POST / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	msg := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: req-hdr=0, req-body=42\r\n\r\n" +
+		reqHdr +
+		"5\r\nhello\r\n0\r\n\r\n"
+	next := "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n\r\n"
+
+	for i := 0; i < len(msg); i++ {
+		if _, _, err := ParseRequest([]byte(msg[:i])); err != ErrIncomplete {
+			t.Fatalf("first %d bytes: error %v, want ErrIncomplete", i, err)
+		}
+	}
+	req, n, err := ParseRequest([]byte(msg + next))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(msg) {
+		t.Errorf("used %d bytes, want %d", n, len(msg))
+	}
+	if body, _ := io.ReadAll(req.Request.Body); string(body) != "hello" {
+		t.Errorf("body = %q", body)
+	}
+
+	if _, _, err := ParseRequest([]byte("REQMOD\r\n\r\n")); err == nil || err == ErrIncomplete {
+		t.Errorf("malformed request: error %v", err)
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	msg := "ICAP/1.0 200 OK\r\n" +
+		"Encapsulated: res-hdr=0, res-body=19\r\n\r\n" +
+		"HTTP/1.1 200 OK\r\n\r\n" +
+		"5\r\nhello\r\n0\r\n\r\n"
+	if _, _, err := ParseResponse([]byte(msg[:len(msg)-1]), nil); err != ErrIncomplete {
+		t.Errorf("truncated response: error %v, want ErrIncomplete", err)
+	}
+	resp, n, err := ParseResponse([]byte(msg), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(msg) || resp.StatusCode != StatusOK || resp.Response == nil {
+		t.Fatalf("ParseResponse = %+v, %d", resp, n)
+	}
+	if body, _ := io.ReadAll(resp.Response.Body); string(body) != "hello" {
+		t.Errorf("body = %q", body)
+	}
+
+	cont := "ICAP/1.0 100 Continue\r\n\r\n"
+	if resp, n, err := ParseResponse([]byte(cont+msg), nil); err != nil || resp.StatusCode != StatusContinue || n != len(cont) {
+		t.Errorf("100 Continue: %+v, %d, %v", resp, n, err)
+	}
+}
+
+func TestParseChunks(t *testing.T) {
+	body, ieof, n, err := ParseChunks([]byte("5\r\nhello\r\n0; ieof\r\n\r\nmore"))
+	if string(body) != "hello" || !ieof || n != 21 || err != nil {
+		t.Errorf("ParseChunks = %q, %v, %d, %v", body, ieof, n, err)
+	}
+	if _, _, _, err := ParseChunks([]byte("5\r\nhel")); err != ErrIncomplete {
+		t.Errorf("truncated chunk: error %v, want ErrIncomplete", err)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Composition of adaptation stages into a single handler.
+
+package icap
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// A StageAction tells a Pipeline what to do after a stage has run.
+type StageAction int
+
+const (
+	// ActionContinue goes on to the next stage.
+	ActionContinue StageAction = iota
+
+	// ActionModify records that the stage changed the encapsulated
+	// message, and goes on to the next stage.
+	ActionModify
+
+	// ActionBlock stops the pipeline and replaces the message with
+	// a block page.
+	ActionBlock
+
+	// ActionNoModification stops the pipeline. The message is sent on
+	// with any changes made by earlier stages.
+	ActionNoModification
+)
+
+// A StageResult is the outcome of running a Stage.
+type StageResult struct {
+	Action StageAction
+	Status int    // HTTP status code of the block page; 403 if zero
+	Reason string // body of the block page
+}
+
+// A Stage is one step of a Pipeline. It may inspect and change the
+// encapsulated messages of req; to read the body without consuming it,
+// use req.BufferedBody.
+type Stage interface {
+	Process(req *Request) (StageResult, error)
+}
+
+// The StageFunc type is an adapter to allow the use of ordinary functions
+// as pipeline stages.
+type StageFunc func(req *Request) (StageResult, error)
+
+// Process calls f(req).
+func (f StageFunc) Process(req *Request) (StageResult, error) {
+	return f(req)
+}
+
+// A Pipeline is a Handler that runs REQMOD and RESPMOD requests through
+// a sequence of stages (for example authentication, categorization,
+// virus scanning and DLP) and sends a single ICAP response for their
+// combined verdict. OPTIONS requests are answered with the methods and
+// 204 support that the pipeline provides.
+type Pipeline struct {
+	Stages []Stage
+
+	// FailOpen makes the pipeline send the message unmodified when
+	// a stage returns an error, instead of an ICAP 500 Server Error.
+	FailOpen bool
+}
+
+// ServeICAP runs the stages of the pipeline over req.
+func (p *Pipeline) ServeICAP(w ResponseWriter, req *Request) {
+	switch req.Method {
+	case "OPTIONS":
+		h := w.Header()
+		if h.Get("Methods") == "" {
+			h.Set("Methods", "REQMOD, RESPMOD")
+		}
+		h.Set("Allow", "204")
+		w.WriteHeader(StatusOK, nil, false)
+		return
+	case "REQMOD", "RESPMOD":
+	default:
+		w.WriteHeader(StatusMethodNotAllowed, nil, false)
+		return
+	}
+
+	modified := false
+stages:
+	for _, s := range p.Stages {
+		res, err := s.Process(req)
+		if err != nil {
+			log.Printf("icap: pipeline stage failed: %v", err)
+			if p.FailOpen {
+				req.Audit().SetVerdict(VerdictAllow, "failed open: "+err.Error())
+				Unmodified(w, req)
+			} else {
+				req.Audit().SetVerdict(VerdictError, err.Error())
+				w.WriteHeader(StatusInternalServerError, nil, false)
+			}
+			return
+		}
+
+		switch res.Action {
+		case ActionModify:
+			modified = true
+			req.Audit().AddModification(stageName(s))
+		case ActionBlock:
+			status := res.Status
+			if status == 0 {
+				status = http.StatusForbidden
+			}
+			req.Audit().SetVerdict(VerdictBlock, res.Reason)
+			writeBlockPage(w, status, res.Reason)
+			return
+		case ActionNoModification:
+			break stages
+		}
+	}
+
+	if modified {
+		req.Audit().defaultVerdict(VerdictModify, "")
+		writeMessage(w, req)
+	} else {
+		Unmodified(w, req)
+	}
+}
+
+// Close closes the stages of the pipeline that implement io.Closer,
+// and returns the first error.
+func (p *Pipeline) Close() error {
+	seen := make(map[interface{}]bool)
+	var firstErr error
+	for _, s := range p.Stages {
+		if err := closeHandler(s, seen); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// stageName describes s for audit records, by its type.
+func stageName(s Stage) string {
+	return strings.TrimPrefix(fmt.Sprintf("%T", s), "*")
+}
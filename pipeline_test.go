@@ -0,0 +1,54 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPipeline(t *testing.T) {
+	request := func(path string) string {
+		httpHdr := "GET " + path + " HTTP/1.1\r\n" +
+			"Host: www.example.com\r\n" +
+			"\r\n"
+		return "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr
+	}
+
+	tag := StageFunc(func(req *Request) (StageResult, error) {
+		if strings.HasPrefix(req.Request.URL.Path, "/tagged") {
+			req.Request.Header.Set("X-Tagged", "yes")
+			return StageResult{Action: ActionModify}, nil
+		}
+		return StageResult{}, nil
+	})
+	block := StageFunc(func(req *Request) (StageResult, error) {
+		if strings.HasSuffix(req.Request.URL.Path, ".exe") {
+			return StageResult{Action: ActionBlock, Reason: "no executables"}, nil
+		}
+		return StageResult{Action: ActionContinue}, nil
+	})
+	srv := &Server{Handler: &Pipeline{Stages: []Stage{tag, block}}}
+
+	resp := roundTrip(t, srv, request("/index.html"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Errorf("expected 204 when no stage modifies the request:\n%s", resp)
+	}
+
+	resp = roundTrip(t, srv, request("/tagged/index.html"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 200 ") || !strings.Contains(resp, "X-Tagged: yes\r\n") {
+		t.Errorf("expected the modified request:\n%s", resp)
+	}
+
+	resp = roundTrip(t, srv, request("/tagged/setup.exe"))
+	if !strings.Contains(resp, "HTTP/1.1 403 Forbidden\r\n") || !strings.HasSuffix(resp, "no executables\r\n0\r\n\r\n") {
+		t.Errorf("expected a block page:\n%s", resp)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Services that decide from the preview alone.
+
+package icap
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrPreviewOnly is the error from reading the body of a request served by
+// PreviewOnly past the end of its preview.
+var ErrPreviewOnly = errors.New("icap: body not available past the preview")
+
+// PreviewOnly is a Handler for services that inspect only the preview of
+// each body, such as ones that check file signatures. It advertises
+// Preview in OPTIONS responses, and guarantees that the rest of a body is
+// never requested: reading the body of a request past the preview fails
+// with ErrPreviewOnly instead of sending 100 Continue, so a transaction
+// ends as soon as Handler replies, and the connection is ready for the
+// next request without the rest of the body being read from it.
+//
+// Handler should reply with 204 No Content (see Unmodified) or with a
+// new message, such as a block page. A message with the original body can
+// be sent only if the preview held the whole body (see PreviewComplete).
+// Requests sent without a preview are passed to Handler with their whole
+// body.
+type PreviewOnly struct {
+	Handler Handler
+
+	// Preview is the size of the preview to advertise. If zero, 4096
+	// bytes are asked for.
+	Preview int
+}
+
+// ServeICAP serves req with p.Handler, limiting its body to the preview.
+func (p *PreviewOnly) ServeICAP(w ResponseWriter, req *Request) {
+	if req.Method == "OPTIONS" {
+		size := p.Preview
+		if size <= 0 {
+			size = 4096
+		}
+		w.Header().Set("Preview", strconv.Itoa(size))
+		w.Header().Set("Transfer-Preview", "*")
+	} else if req.Header.Get("Preview") != "" && !req.PreviewComplete() {
+		if body := req.bodyPtr(); body != nil && *body != nil {
+			*body = io.NopCloser(io.MultiReader(bytes.NewReader(req.Preview), errorReader{ErrPreviewOnly}))
+		}
+	}
+	p.Handler.ServeICAP(w, req)
+}
+
+// PreviewComplete reports whether req was sent with a preview that held
+// the whole of its body, ending with "0; ieof".
+func (req *Request) PreviewComplete() bool {
+	return req.previewIEOF
+}
+
+// DeclaredPreview returns the size of the preview given by req's Preview
+// header, or -1 if it has none or it isn't a valid size.
+func (req *Request) DeclaredPreview() int {
+	p := req.Header.Get("Preview")
+	if p == "" {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(p))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// ReceivedPreview returns the number of bytes of preview data that were
+// received, which may differ from DeclaredPreview if the client misbehaves.
+func (req *Request) ReceivedPreview() int {
+	return len(req.Preview)
+}
+
+// PreviewMismatch reports whether the preview of req didn't match its
+// Preview header: it held more bytes than declared, or fewer without
+// ending with ieof, so that the rest of the body may not be what the
+// client meant. See Server.PreviewMismatch.
+func (req *Request) PreviewMismatch() bool {
+	if !req.hasBody || req.Header.Get("Preview") == "" {
+		return false
+	}
+	declared := req.DeclaredPreview()
+	received := req.ReceivedPreview()
+	return declared < 0 || received > declared || received < declared && !req.previewIEOF
+}
+
+// A PreviewMismatchPolicy tells a Server what to do with requests whose
+// preview doesn't match their Preview header (see Request.PreviewMismatch).
+type PreviewMismatchPolicy int
+
+const (
+	// PreviewMismatchTolerate passes them to the handler like other
+	// requests. They are counted in ParserStats.PreviewMismatches.
+	PreviewMismatchTolerate PreviewMismatchPolicy = iota
+
+	// PreviewMismatchReject answers them with 400 Bad Request and closes
+	// the connection.
+	PreviewMismatchReject
+)
+
+// An errorReader returns err from every Read.
+type errorReader struct {
+	err error
+}
+
+func (r errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,114 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPreviewOnly(t *testing.T) {
+	var bodies []string
+	var errs []error
+	handler := &PreviewOnly{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			if req.Method == "OPTIONS" {
+				w.Header().Set("Methods", "RESPMOD")
+				w.WriteHeader(StatusOK, nil, false)
+				return
+			}
+			body, err := io.ReadAll(req.Response.Body)
+			bodies = append(bodies, string(body))
+			errs = append(errs, err)
+			Unmodified(w, req)
+		}),
+		Preview: 5,
+	}
+
+	resp := roundTrip(t, &Server{Handler: handler}, "OPTIONS icap://icap.example.net/scan ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: null-body=0\r\n\r\n")
+	if !strings.Contains(resp, "Preview: 5\r\n") || !strings.Contains(resp, "Methods: RESPMOD\r\n") {
+		t.Errorf("OPTIONS response:\n%s", resp)
+	}
+
+	respmod := func(preview string) string {
+		httpHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+		return "RESPMOD icap://icap.example.net/scan ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Preview: 5\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr + preview
+	}
+
+	// The rest of the body is never asked for, so the client doesn't send
+	// it, and the next request follows on the same connection.
+	resp = roundTrip(t, &Server{Handler: handler}, respmod("5\r\nMZ\x90\x00\x03\r\n0\r\n\r\n")+respmod("3\r\nabc\r\n0; ieof\r\n\r\n"))
+	if strings.Contains(resp, "100 Continue") || strings.Count(resp, "ICAP/1.0 204 ") != 2 {
+		t.Errorf("unexpected response:\n%s", resp)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("handler called %d times", len(bodies))
+	}
+	if bodies[0] != "MZ\x90\x00\x03" || errs[0] != ErrPreviewOnly {
+		t.Errorf("incomplete preview: read %q, %v", bodies[0], errs[0])
+	}
+	if bodies[1] != "abc" || errs[1] != nil {
+		t.Errorf("complete preview: read %q, %v", bodies[1], errs[1])
+	}
+}
+
+func TestPreviewMismatch(t *testing.T) {
+	respHdr := "HTTP/1.1 200 OK\r\n\r\n"
+	request := func(preview, chunks string) string {
+		return "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Preview: " + preview + "\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(respHdr)) + "\r\n\r\n" +
+			respHdr + chunks
+	}
+
+	for _, tc := range []struct {
+		name               string
+		raw                string
+		declared, received int
+		mismatch           bool
+	}{
+		{"exact", request("4", "4\r\nhell\r\n0\r\n\r\n"), 4, 4, false},
+		{"short body", request("10", "4\r\nhell\r\n0; ieof\r\n\r\n"), 10, 4, false},
+		{"short preview", request("10", "4\r\nhell\r\n0\r\n\r\n"), 10, 4, true},
+		{"long preview", request("2", "4\r\nhell\r\n0\r\n\r\n"), 2, 4, true},
+		{"malformed", request("many", "4\r\nhell\r\n0\r\n\r\n"), -1, 4, true},
+	} {
+		for _, policy := range []PreviewMismatchPolicy{PreviewMismatchTolerate, PreviewMismatchReject} {
+			var declared, received int
+			var mismatch, called bool
+			srv := &Server{
+				PreviewMismatch: policy,
+				Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+					called = true
+					declared, received, mismatch = req.DeclaredPreview(), req.ReceivedPreview(), req.PreviewMismatch()
+					w.WriteHeader(StatusNoContent, nil, false)
+				}),
+			}
+			resp := roundTrip(t, srv, tc.raw)
+			if policy == PreviewMismatchReject && tc.mismatch {
+				if called || !strings.HasPrefix(resp, "ICAP/1.0 400 ") {
+					t.Errorf("%s: mismatch not rejected:\n%s", tc.name, resp)
+				}
+			} else {
+				if !called || declared != tc.declared || received != tc.received || mismatch != tc.mismatch {
+					t.Errorf("%s: handler saw declared %d, received %d, mismatch %v", tc.name, declared, received, mismatch)
+				}
+			}
+			if n := srv.ParserStats().PreviewMismatches; (n != 0) != tc.mismatch {
+				t.Errorf("%s: PreviewMismatches = %d", tc.name, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Reusing the verdicts on repeated previews.
+
+package icap
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A PreviewCache is a Handler that remembers the verdict Handler gave on
+// each preview, and gives the same verdict at once when an identical
+// preview arrives again, as happens when thousands of clients fetch the
+// same object. Put one in front of each service that should use it, with
+// the TTL that suits the service.
+//
+// Previews are identified by a hash of their data, together with the
+// method, the service path, the Content-Type and Content-Length of the
+// encapsulated message, the ISTag, and the result of Key if it is set.
+// Only verdicts that the preview alone decided are reused: 204 No
+// Modifications, and block pages (encapsulated responses with a 4xx or
+// 5xx status). A verdict is not cached if Handler read the body past the
+// preview, unless the preview held the whole body.
+type PreviewCache struct {
+	Handler Handler
+
+	// ISTag supplies the current ISTag, so that changing it when the
+	// rules change makes every cached verdict stale. If nil, the ISTag
+	// of the server's HeaderPolicy is used, if there is one.
+	ISTag ISTagProvider
+
+	// Key, if not nil, returns more data to tell previews apart, such as
+	// the host of the request URL for a service whose verdicts depend on
+	// it.
+	Key func(req *Request) string
+
+	// MaxEntries limits the number of cached verdicts.
+	// If zero, 10000 is used.
+	MaxEntries int
+
+	// TTL limits how long a verdict is cached. If zero, 5 minutes is used.
+	TTL time.Duration
+
+	cache  atomic.Pointer[Cache[string, *cachedResponse]]
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// PreviewCacheStats describes the activity of a PreviewCache.
+type PreviewCacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+// Stats returns statistics about the cache.
+func (c *PreviewCache) Stats() PreviewCacheStats {
+	return PreviewCacheStats{
+		Entries: c.lru().Len(),
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+	}
+}
+
+func (c *PreviewCache) lru() *Cache[string, *cachedResponse] {
+	if l := c.cache.Load(); l != nil {
+		return l
+	}
+	max := c.MaxEntries
+	if max <= 0 {
+		max = 10000
+	}
+	ttl := c.TTL
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	c.cache.CompareAndSwap(nil, NewCache[string, *cachedResponse](max, ttl))
+	return c.cache.Load()
+}
+
+// ServeICAP answers req with a cached verdict if there is one, and
+// otherwise passes it to c.Handler and caches the verdict.
+func (c *PreviewCache) ServeICAP(w ResponseWriter, req *Request) {
+	h := c.Handler
+	if h == nil {
+		h = NotFoundHandler()
+	}
+	key, tag := c.key(req)
+	if key == "" {
+		h.ServeICAP(w, req)
+		return
+	}
+
+	if cr, ok := c.lru().Get(key); ok {
+		c.hits.Add(1)
+		cr.replay(w, req)
+		return
+	}
+	c.misses.Add(1)
+
+	rec := &recordingWriter{ResponseWriter: w, max: 64 << 10}
+	h.ServeICAP(rec, req)
+	if req.BodyBytes() > 0 && !req.PreviewComplete() {
+		return
+	}
+	if tag == "" {
+		tag = strings.Trim(rec.header.Get("ISTag"), `"`)
+	}
+	if cr := rec.result(tag); cr != nil && (cr.unmodified || cr.status >= 400) {
+		c.lru().Add(key, cr)
+	}
+}
+
+// key returns the cache key for req and the current ISTag, or "" if req
+// has no preview.
+func (c *PreviewCache) key(req *Request) (key, tag string) {
+	if req.Method != "REQMOD" && req.Method != "RESPMOD" || req.Header.Get("Preview") == "" {
+		return "", ""
+	}
+	if len(req.Preview) == 0 && !req.PreviewComplete() {
+		// An empty preview says nothing about the body.
+		return "", ""
+	}
+	p := c.ISTag
+	if p == nil {
+		if hp := req.server.headerPolicy(); hp != nil {
+			p = hp.ISTag
+		}
+	}
+	if p != nil {
+		tag = strings.Trim(p.ISTag(req), `"`)
+	}
+
+	hh := sha256.New()
+	bh := req.bodyHeader()
+	for _, s := range []string{
+		req.Method, req.URL.Path, tag, bh.Get("Content-Type"), bh.Get("Content-Length"),
+		strconv.FormatBool(req.PreviewComplete()),
+	} {
+		hh.Write([]byte(s))
+		hh.Write([]byte{0})
+	}
+	if c.Key != nil {
+		hh.Write([]byte(c.Key(req)))
+		hh.Write([]byte{0})
+	}
+	hh.Write(req.Preview)
+	return hex.EncodeToString(hh.Sum(nil)), tag
+}
@@ -0,0 +1,67 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPreviewCache(t *testing.T) {
+	var calls atomic.Int32
+	scanner := HandlerFunc(func(w ResponseWriter, req *Request) {
+		calls.Add(1)
+		switch {
+		case strings.Contains(string(req.Preview), "EICAR"):
+			writeBlockPage(w, http.StatusForbidden, "infected")
+		case strings.HasPrefix(string(req.Preview), "PK"):
+			// Archives need the whole body.
+			io.Copy(io.Discard, req.Response.Body)
+			Unmodified(w, req)
+		default:
+			Unmodified(w, req)
+		}
+	})
+	cache := &PreviewCache{Handler: scanner}
+
+	respmod := func(preview, rest string) string {
+		httpHdr := "HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n\r\n"
+		msg := "RESPMOD icap://icap.example.net/scan ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Preview: 5\r\n" +
+			"Allow: 204\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr + "5\r\n" + preview + "\r\n0\r\n\r\n"
+		if rest != "" {
+			msg += strconv.FormatInt(int64(len(rest)), 16) + "\r\n" + rest + "\r\n0\r\n\r\n"
+		}
+		return msg
+	}
+
+	for i, tc := range []struct {
+		preview, rest string
+		want          string
+		calls         int32
+	}{
+		{"hello", "", "ICAP/1.0 204 ", 1},
+		{"hello", "", "ICAP/1.0 204 ", 1},
+		{"EICAR", "", "HTTP/1.1 403 Forbidden\r\n", 2},
+		{"EICAR", "", "HTTP/1.1 403 Forbidden\r\n", 2},
+		{"PK\x03\x04\x14", "archive", "ICAP/1.0 204 ", 3},
+		{"PK\x03\x04\x14", "archive", "ICAP/1.0 204 ", 4},
+	} {
+		resp := roundTrip(t, &Server{Handler: cache}, respmod(tc.preview, tc.rest))
+		if !strings.Contains(resp, tc.want) || calls.Load() != tc.calls {
+			t.Errorf("request %d: handler called %d times, want %d; response:\n%s", i, calls.Load(), tc.calls, resp)
+		}
+	}
+	if s := cache.Stats(); s.Entries != 2 || s.Hits != 2 || s.Misses != 4 {
+		t.Errorf("stats = %+v", s)
+	}
+}
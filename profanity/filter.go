@@ -0,0 +1,258 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package profanity filters offensive language out of text bodies: it
+// masks configured words and phrases as the body streams through, and
+// blocks messages in which they are too frequent.
+package profanity
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/intra-sh/icap"
+	"github.com/intra-sh/icap/charset"
+)
+
+// MatchesAnnotation is the key of the annotation in which a Filter that
+// scans whole bodies records the number of matches in each category,
+// as a map[string]int.
+const MatchesAnnotation = "profanity.matches"
+
+// A Category is a named list of terms, such as "profanity" or "slurs".
+type Category struct {
+	Name string
+
+	// Terms are words or phrases, matched case-insensitively against
+	// whole words of the text.
+	Terms []string
+
+	// Threshold is the number of matches within the filter's Window that
+	// makes the filter block the message. If zero, matches are only masked.
+	Threshold int
+}
+
+// A Filter is an icap.Handler and an icap.Stage that looks for the terms
+// of Categories in text bodies of REQMOD and RESPMOD requests. Bodies in
+// legacy encodings are decoded as described in charset.Detect.
+//
+// If a category has a Threshold, the body is buffered and scanned before
+// it is sent on, so that the message can be blocked; otherwise it is
+// masked as it streams through.
+type Filter struct {
+	Categories []Category
+
+	// Mask replaces each letter of the terms that are found with an
+	// asterisk. Since the body changes, its Content-Length header is
+	// removed.
+	Mask bool
+
+	// Window is the number of words within which matches are counted
+	// against the thresholds. If zero, the whole body is counted.
+	Window int
+
+	// Types lists the media types to filter. If empty, text/html,
+	// text/plain and application/xhtml+xml are filtered.
+	Types []string
+
+	// BodyMemory is the number of bytes of each body kept in memory
+	// while it is scanned; larger bodies are spooled to disk.
+	// If zero, 1 MB is used.
+	BodyMemory int64
+
+	// Status and Reason make up the block page; if they are zero, 403
+	// and "Blocked: " followed by the name of the category are used.
+	Status int
+	Reason string
+
+	once    sync.Once
+	m       *matcher
+	scanAll bool
+}
+
+var defaultTypes = []string{"text/html", "text/plain", "application/xhtml+xml"}
+
+// ServeICAP filters req.
+func (f *Filter) ServeICAP(w icap.ResponseWriter, req *icap.Request) {
+	p := icap.Pipeline{Stages: []icap.Stage{f}}
+	p.ServeICAP(w, req)
+}
+
+// Process filters the body of req, if it is of one of the types.
+func (f *Filter) Process(req *icap.Request) (icap.StageResult, error) {
+	f.once.Do(f.init)
+
+	var h http.Header
+	switch {
+	case req.Method == "REQMOD" && req.Request != nil:
+		h = req.Request.Header
+	case req.Method == "RESPMOD" && req.Response != nil:
+		h = req.Response.Header
+	default:
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	if !icap.CanDecompress(h) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	contentType := h.Get("Content-Type")
+	types := f.Types
+	if len(types) == 0 {
+		types = defaultTypes
+	}
+	if !icap.MatchMediaType(contentType, types) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	if _, err := req.DecompressBody(); err != nil {
+		return icap.StageResult{}, err
+	}
+
+	if f.scanAll {
+		memLimit := f.BodyMemory
+		if memLimit <= 0 {
+			memLimit = 1 << 20
+		}
+		bb, err := req.BufferedBody(memLimit)
+		if err != nil {
+			return icap.StageResult{}, err
+		}
+		counts, blocked, err := f.scan(contentType, io.NewSectionReader(bb, 0, bb.Size()))
+		if err != nil {
+			return icap.StageResult{}, err
+		}
+		if len(counts) == 0 {
+			return icap.StageResult{Action: icap.ActionContinue}, nil
+		}
+		req.SetAnnotation(MatchesAnnotation, counts)
+		if blocked != "" {
+			reason := f.Reason
+			if reason == "" {
+				reason = "Blocked: " + blocked
+			}
+			return icap.StageResult{Action: icap.ActionBlock, Status: f.Status, Reason: reason}, nil
+		}
+	}
+
+	if !f.Mask {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	if !req.TransformBody(charset.UTF8(contentType, icap.TransformerFunc(f.mask))) {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	return icap.StageResult{Action: icap.ActionModify}, nil
+}
+
+func (f *Filter) init() {
+	f.m = compile(f.Categories)
+	for _, c := range f.Categories {
+		if c.Threshold > 0 {
+			f.scanAll = true
+		}
+	}
+}
+
+// scan counts the matches in each category in the body read from r. If a
+// category reaches its threshold, its name is returned as blocked.
+func (f *Filter) scan(contentType string, r io.Reader) (counts map[string]int, blocked string, err error) {
+	text, _ := charset.NewReader(r, contentType)
+	t := newTokenizer(text)
+
+	counts = make(map[string]int)
+	hits := make([][]int, len(f.Categories)) // word numbers of recent matches
+	var recent []string
+	for n := 0; ; {
+		text, word, err := t.next()
+		if err == io.EOF {
+			return counts, "", nil
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		if !word {
+			continue
+		}
+		n++
+		recent = f.m.push(recent, text)
+		for _, p := range f.m.match(recent) {
+			c := &f.Categories[p.cat]
+			counts[c.Name]++
+			if c.Threshold <= 0 {
+				continue
+			}
+			h := append(hits[p.cat], n)
+			if f.Window > 0 {
+				for len(h) > 0 && h[0] <= n-f.Window {
+					h = h[1:]
+				}
+			}
+			hits[p.cat] = h
+			if len(h) >= c.Threshold {
+				return counts, c.Name, nil
+			}
+		}
+	}
+}
+
+// maxPending is the number of bytes of text a masker holds back while
+// waiting to see whether a phrase is complete.
+const maxPending = 64 << 10
+
+// A pendingToken is a token held back by mask.
+type pendingToken struct {
+	text string
+	word bool
+}
+
+// mask copies UTF-8 text from src to dst, masking the terms it contains.
+func (f *Filter) mask(dst io.Writer, src io.Reader) error {
+	t := newTokenizer(src)
+
+	var pending []pendingToken
+	words, size := 0, 0
+	flush := func(keepWords int) error {
+		for len(pending) > 0 && (words > keepWords || size > maxPending) {
+			if _, err := io.WriteString(dst, pending[0].text); err != nil {
+				return err
+			}
+			if pending[0].word {
+				words--
+			}
+			size -= len(pending[0].text)
+			pending = pending[1:]
+		}
+		return nil
+	}
+
+	var recent []string
+	for {
+		text, word, err := t.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		pending = append(pending, pendingToken{text, word})
+		size += len(text)
+		if word {
+			words++
+			recent = f.m.push(recent, text)
+			for _, p := range f.m.match(recent) {
+				// Mask the last len(p.words) words.
+				for i, n := len(pending)-1, len(p.words); i >= 0 && n > 0; i-- {
+					if pending[i].word {
+						pending[i].text = strings.Repeat("*", utf8.RuneCountInString(pending[i].text))
+						n--
+					}
+				}
+			}
+		}
+		if err := flush(f.m.maxLen - 1); err != nil {
+			return err
+		}
+	}
+	return flush(-1)
+}
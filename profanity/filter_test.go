@@ -0,0 +1,118 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package profanity
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/intra-sh/icap"
+	"github.com/intra-sh/icap/icaptest"
+	"golang.org/x/text/encoding/charmap"
+)
+
+func respmod(t *testing.T, h icap.Handler, contentType, body string) string {
+	t.Helper()
+	return encodedRespmod(t, h, contentType, "", body)
+}
+
+// encodedRespmod is like respmod, but the body is compressed with the
+// content-coding encoding.
+func encodedRespmod(t *testing.T, h icap.Handler, contentType, encoding, body string) string {
+	t.Helper()
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: " + contentType + "\r\n"
+	if encoding != "" {
+		body = icaptest.Encode(t, encoding, body)
+		httpHdr += "Content-Encoding: " + encoding + "\r\n"
+	}
+	httpHdr += "Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"\r\n"
+	return icaptest.RoundTrip(t, &icap.Server{Handler: h}, "RESPMOD icap://icap.example.net/filter ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: res-hdr=0, res-body="+strconv.Itoa(len(httpHdr))+"\r\n"+
+		"\r\n"+httpHdr+
+		strconv.FormatInt(int64(len(body)), 16)+"\r\n"+body+"\r\n0\r\n\r\n")
+}
+
+func TestMask(t *testing.T) {
+	f := &Filter{
+		Categories: []Category{{Name: "rude", Terms: []string{"darn", "Gosh Darn It"}}},
+		Mask:       true,
+	}
+	resp := respmod(t, f, "text/plain", "Darn! gosh darn it, darnation.")
+	if got, want := icaptest.Unchunk(t, resp), "****! **** **** **, darnation."; got != want {
+		t.Errorf("masked body = %q, want %q", got, want)
+	}
+
+	// A Latin-1 page keeps its encoding.
+	latin1, _ := charmap.ISO8859_1.NewEncoder().String("café darn über")
+	resp = respmod(t, f, "text/html; charset=iso-8859-1", latin1)
+	want, _ := charmap.ISO8859_1.NewEncoder().String("café **** über")
+	if got := icaptest.Unchunk(t, resp); got != want {
+		t.Errorf("Latin-1 body = %q, want %q", got, want)
+	}
+
+	resp = respmod(t, f, "image/png", "darn")
+	if got := icaptest.Unchunk(t, resp); got != "darn" {
+		t.Errorf("image body changed: %q", got)
+	}
+}
+
+func TestMaskCompressed(t *testing.T) {
+	f := &Filter{
+		Categories: []Category{{Name: "rude", Terms: []string{"darn"}}},
+		Mask:       true,
+	}
+	for _, coding := range []string{"br", "zstd"} {
+		resp := encodedRespmod(t, f, "text/plain", coding, "well, darn it")
+		if strings.Contains(resp, "Content-Encoding") {
+			t.Errorf("%s: Content-Encoding kept after decompression:\n%s", coding, resp)
+		}
+		if got, want := icaptest.Unchunk(t, resp), "well, **** it"; got != want {
+			t.Errorf("%s: body = %q, want %q", coding, got, want)
+		}
+	}
+}
+
+func TestThreshold(t *testing.T) {
+	f := &Filter{
+		Categories: []Category{
+			{Name: "rude", Terms: []string{"darn"}, Threshold: 2},
+			{Name: "mild", Terms: []string{"heck"}},
+		},
+		Window: 5,
+	}
+	resp := respmod(t, f, "text/html", "<p>darn one two three four five darn heck</p>")
+	if strings.Contains(resp, "403 Forbidden") {
+		t.Errorf("matches outside the window blocked the page:\n%s", resp)
+	}
+	resp = respmod(t, f, "text/html", "<p>darn one two darn</p>")
+	if !strings.Contains(resp, "403 Forbidden") || !strings.Contains(resp, "Blocked: rude") {
+		t.Errorf("page not blocked:\n%s", resp)
+	}
+
+	counts, blocked, err := f.scan("text/plain", strings.NewReader("heck, darn it heck"))
+	if err != nil || blocked != "" || counts["mild"] != 2 || counts["rude"] != 1 {
+		t.Errorf("scan = %v, %q, %v", counts, blocked, err)
+	}
+}
+
+func TestTokenizer(t *testing.T) {
+	tok := newTokenizer(strings.NewReader("Hi, \xffwörld42!"))
+	var got []string
+	for {
+		text, word, err := tok.next()
+		if err != nil {
+			break
+		}
+		got = append(got, text+":"+strconv.FormatBool(word))
+	}
+	want := "Hi:true|, \xff:false|wörld42:true|!:false"
+	if strings.Join(got, "|") != want {
+		t.Errorf("tokens = %q, want %q", strings.Join(got, "|"), want)
+	}
+}
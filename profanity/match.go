@@ -0,0 +1,125 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Word tokenizing and term matching.
+
+package profanity
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A phrase is a term split into lower-case words.
+type phrase struct {
+	words []string
+	cat   int // index in Filter.Categories
+}
+
+// A matcher finds the terms of a set of categories.
+type matcher struct {
+	byLast map[string][]phrase // phrases by their last word
+	maxLen int                 // words in the longest phrase
+}
+
+func compile(cats []Category) *matcher {
+	m := &matcher{byLast: make(map[string][]phrase), maxLen: 1}
+	for i, c := range cats {
+		for _, term := range c.Terms {
+			words := strings.FieldsFunc(strings.ToLower(term), func(r rune) bool { return !isWordRune(r) })
+			if len(words) == 0 {
+				continue
+			}
+			last := words[len(words)-1]
+			m.byLast[last] = append(m.byLast[last], phrase{words, i})
+			if len(words) > m.maxLen {
+				m.maxLen = len(words)
+			}
+		}
+	}
+	return m
+}
+
+// push adds word to the list of recent words, which holds the last
+// m.maxLen words in lower case.
+func (m *matcher) push(recent []string, word string) []string {
+	if len(recent) == m.maxLen {
+		copy(recent, recent[1:])
+		recent = recent[:len(recent)-1]
+	}
+	return append(recent, strings.ToLower(word))
+}
+
+// match returns the phrases that end with the last of the recent words.
+func (m *matcher) match(recent []string) []phrase {
+	var found []phrase
+	for _, p := range m.byLast[recent[len(recent)-1]] {
+		if len(p.words) > len(recent) {
+			continue
+		}
+		tail := recent[len(recent)-len(p.words):]
+		ok := true
+		for i, w := range p.words {
+			if tail[i] != w {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			found = append(found, p)
+		}
+	}
+	return found
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)
+}
+
+// maxToken is the length in bytes at which a token is split.
+const maxToken = 1024
+
+// A tokenizer splits text into alternating runs of word and non-word
+// characters. Bytes that aren't valid UTF-8 are passed through unchanged,
+// as non-word characters.
+type tokenizer struct {
+	br  *bufio.Reader
+	buf []byte
+}
+
+func newTokenizer(r io.Reader) *tokenizer {
+	return &tokenizer{br: bufio.NewReader(r)}
+}
+
+// next returns the next token, and whether it is a word.
+func (t *tokenizer) next() (text string, word bool, err error) {
+	t.buf = t.buf[:0]
+	for len(t.buf) < maxToken {
+		r, size, err := t.br.ReadRune()
+		if err != nil {
+			if err == io.EOF && len(t.buf) > 0 {
+				break
+			}
+			return "", false, err
+		}
+		isWord := r != utf8.RuneError && isWordRune(r)
+		if len(t.buf) == 0 {
+			word = isWord
+		} else if isWord != word {
+			t.br.UnreadRune()
+			break
+		}
+		if r == utf8.RuneError && size == 1 {
+			t.br.UnreadRune()
+			b, _ := t.br.ReadByte()
+			t.buf = append(t.buf, b)
+			continue
+		}
+		t.buf = utf8.AppendRune(t.buf, r)
+	}
+	return string(t.buf), word, nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Handling of range requests and partial content.
+
+package icap
+
+import (
+	"net/http"
+)
+
+// A RangePolicy tells ApplyRangePolicy how to treat range requests
+// and partial responses, which cannot be scanned as whole objects.
+type RangePolicy int
+
+const (
+	// RangePassThrough adapts partial content like any other message.
+	RangePassThrough RangePolicy = iota
+
+	// RangeStrip removes the Range and If-Range headers from requests,
+	// so that the origin server sends the full object.
+	// Partial responses are blocked.
+	RangeStrip
+
+	// RangeBlock blocks range requests and partial responses.
+	RangeBlock
+)
+
+// IsPartial reports whether the encapsulated message is a range request
+// (for REQMOD) or a partial content response (for RESPMOD).
+func (req *Request) IsPartial() bool {
+	switch req.Method {
+	case "REQMOD":
+		return req.Request != nil && req.Request.Header.Get("Range") != ""
+	case "RESPMOD":
+		return req.Response != nil &&
+			(req.Response.StatusCode == http.StatusPartialContent || req.Response.Header.Get("Content-Range") != "")
+	}
+	return false
+}
+
+// ApplyRangePolicy applies policy to req. If the policy blocks the message,
+// it writes a 403 Forbidden HTTP response and returns true; the handler
+// should then return without writing anything else.
+// With RangeStrip, the Range headers are removed from req.Request and
+// the handler must send the modified request.
+func ApplyRangePolicy(w ResponseWriter, req *Request, policy RangePolicy) bool {
+	if policy == RangePassThrough || !req.IsPartial() {
+		return false
+	}
+
+	if policy == RangeStrip && req.Method == "REQMOD" {
+		req.Request.Header.Del("Range")
+		req.Request.Header.Del("If-Range")
+		return false
+	}
+
+	const reason = "Partial content cannot be scanned."
+	req.Audit().SetVerdict(VerdictBlock, reason)
+	writeBlockPage(w, http.StatusForbidden, reason)
+	return true
+}
@@ -0,0 +1,117 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIsPartial(t *testing.T) {
+	request := func(header http.Header) *http.Request {
+		return &http.Request{Method: "GET", Header: header}
+	}
+	response := func(code int, header http.Header) *http.Response {
+		return &http.Response{StatusCode: code, Header: header}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		req    *http.Request
+		resp   *http.Response
+		want   bool
+	}{
+		{"range request", "REQMOD", request(http.Header{"Range": {"bytes=0-99"}}), nil, true},
+		{"full request", "REQMOD", request(http.Header{}), nil, false},
+		{"no request", "REQMOD", nil, nil, false},
+		{"206 with Content-Range", "RESPMOD", nil, response(206, http.Header{"Content-Range": {"bytes 0-99/1000"}}), true},
+		{"206 without Content-Range", "RESPMOD", nil, response(206, http.Header{}), true},
+		{"multipart/byteranges", "RESPMOD", nil, response(206, http.Header{"Content-Type": {"multipart/byteranges; boundary=x"}}), true},
+		{"200 with Content-Range", "RESPMOD", nil, response(200, http.Header{"Content-Range": {"bytes 0-99/100"}}), true},
+		{"full response", "RESPMOD", nil, response(200, http.Header{}), false},
+		{"Range on RESPMOD", "RESPMOD", request(http.Header{"Range": {"bytes=0-99"}}), response(200, http.Header{}), false},
+		{"no response", "RESPMOD", request(http.Header{"Range": {"bytes=0-99"}}), nil, false},
+		{"OPTIONS", "OPTIONS", nil, nil, false},
+	} {
+		req := &Request{Method: tc.method, Request: tc.req, Response: tc.resp}
+		if got := req.IsPartial(); got != tc.want {
+			t.Errorf("%s: IsPartial() = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestApplyRangePolicy(t *testing.T) {
+	reqmod := func(rng string) string {
+		httpHdr := "GET http://www.example.com/file HTTP/1.1\r\nHost: www.example.com\r\n"
+		if rng != "" {
+			httpHdr += "Range: " + rng + "\r\nIf-Range: \"v1\"\r\n"
+		}
+		httpHdr += "\r\n"
+		return "REQMOD icap://icap.example.net/range ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr
+	}
+	respmod := func(status string) string {
+		httpHdr := "GET http://www.example.com/file HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+		respHdr := "HTTP/1.1 " + status + "\r\nContent-Length: 0\r\n"
+		if strings.HasPrefix(status, "206") {
+			respHdr += "Content-Range: bytes 0-99/1000\r\n"
+		}
+		respHdr += "\r\n"
+		return "RESPMOD icap://icap.example.net/range ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Encapsulated: req-hdr=0, res-hdr=" + strconv.Itoa(len(httpHdr)) + ", null-body=" + strconv.Itoa(len(httpHdr)+len(respHdr)) + "\r\n" +
+			"\r\n" + httpHdr + respHdr
+	}
+
+	const blocked = "HTTP/1.1 403 Forbidden\r\n"
+	for _, tc := range []struct {
+		name    string
+		policy  RangePolicy
+		request string
+		want    string
+	}{
+		{"pass-through range request", RangePassThrough, reqmod("bytes=0-99"), "ICAP/1.0 204 "},
+		{"pass-through partial response", RangePassThrough, respmod("206 Partial Content"), "ICAP/1.0 204 "},
+		{"strip range request", RangeStrip, reqmod("bytes=0-99"), "ICAP/1.0 200 "},
+		{"strip partial response", RangeStrip, respmod("206 Partial Content"), blocked},
+		{"block range request", RangeBlock, reqmod("bytes=0-99"), blocked},
+		{"block partial response", RangeBlock, respmod("206 Partial Content"), blocked},
+		{"block full request", RangeBlock, reqmod(""), "ICAP/1.0 204 "},
+		{"block full response", RangeBlock, respmod("200 OK"), "ICAP/1.0 204 "},
+	} {
+		var applied bool
+		srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			if ApplyRangePolicy(w, req, tc.policy) {
+				applied = true
+				return
+			}
+			if tc.policy == RangeStrip && req.Method == "REQMOD" {
+				w.WriteHeader(StatusOK, req.Request, false)
+				return
+			}
+			Unmodified(w, req)
+		})}
+		resp := roundTrip(t, srv, tc.request)
+		if !strings.Contains(resp, tc.want) {
+			t.Errorf("%s: want %q in response:\n%s", tc.name, tc.want, resp)
+		}
+		if applied != (tc.want == blocked) {
+			t.Errorf("%s: ApplyRangePolicy returned %v", tc.name, applied)
+		}
+		if tc.policy == RangeStrip && strings.Contains(resp, "Range:") {
+			t.Errorf("%s: Range headers not removed:\n%s", tc.name, resp)
+		}
+		if tc.want == blocked && !strings.Contains(resp, "Partial content cannot be scanned.") {
+			t.Errorf("%s: block page has no reason:\n%s", tc.name, resp)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Bandwidth limiting for message bodies.
+
+package icap
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A rateLimiter is a token bucket that limits throughput in bytes per second.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64 // bucket size in bytes
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter that allows rate bytes per second,
+// with bursts of up to burst bytes. If burst is not positive, it is
+// set to one second's worth of data.
+func newRateLimiter(rate, burst int64) *rateLimiter {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &rateLimiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// maxChunk returns the largest number of bytes that should be
+// transferred at once.
+func (l *rateLimiter) maxChunk() int {
+	return int(l.burst)
+}
+
+// wait takes n bytes' worth of tokens from the bucket,
+// sleeping until they are available.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// A limitedReader reads from r no faster than its limiters allow.
+type limitedReader struct {
+	r        io.Reader
+	limiters []*rateLimiter
+}
+
+func (lr *limitedReader) Read(p []byte) (n int, err error) {
+	for _, l := range lr.limiters {
+		if max := l.maxChunk(); len(p) > max {
+			p = p[:max]
+		}
+	}
+	n, err = lr.r.Read(p)
+	for _, l := range lr.limiters {
+		l.wait(n)
+	}
+	return n, err
+}
+
+func (lr *limitedReader) Close() error {
+	if c, ok := lr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// A limitedWriter writes to w no faster than its limiters allow.
+type limitedWriter struct {
+	w        io.Writer
+	limiters []*rateLimiter
+}
+
+func (lw *limitedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		for _, l := range lw.limiters {
+			if max := l.maxChunk(); len(chunk) > max {
+				chunk = chunk[:max]
+			}
+		}
+		for _, l := range lw.limiters {
+			l.wait(len(chunk))
+		}
+		m, err := lw.w.Write(chunk)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// serverWriteLimiter returns the limiter for srv.WriteBytesPerSecond,
+// or nil if there is no limit.
+func (srv *Server) serverWriteLimiter() *rateLimiter {
+	if srv == nil || srv.WriteBytesPerSecond <= 0 {
+		return nil
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.writeLimit == nil {
+		srv.writeLimit = newRateLimiter(srv.WriteBytesPerSecond, srv.WriteBurst)
+	}
+	return srv.writeLimit
+}
+
+// LimitWriteRate returns a handler that runs h, writing the encapsulated
+// bodies of all its responses together at no more than bytesPerSecond,
+// with bursts of up to burst bytes (by default, one second's worth).
+// The limit applies in addition to the server's limits, so a service can
+// be given a smaller share of the uplink.
+func LimitWriteRate(h Handler, bytesPerSecond, burst int64) Handler {
+	l := newRateLimiter(bytesPerSecond, burst)
+	return HandlerFunc(func(w ResponseWriter, req *Request) {
+		if lw, ok := w.(interface{ addWriteLimiter(*rateLimiter) }); ok {
+			lw.addWriteLimiter(l)
+		}
+		h.ServeICAP(w, req)
+	})
+}
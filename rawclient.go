@@ -0,0 +1,111 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Sending ICAP requests with encapsulated messages in wire format.
+
+package icap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/textproto"
+	"net/url"
+	"time"
+)
+
+// A RawRequest is an ICAP request whose encapsulated HTTP headers are
+// given in wire format, for proxies that already have the bytes and don't
+// want to parse them into net/http types only for the client to format
+// them again.
+type RawRequest struct {
+	Method string // REQMOD, RESPMOD or OPTIONS
+	URL    *url.URL
+	Header textproto.MIMEHeader // the ICAP header; Host and Encapsulated are filled in
+
+	// The encapsulated HTTP request and response headers, each with its
+	// start line and ending with a blank line ("\r\n\r\n"), or nil.
+	RequestHeader  []byte
+	ResponseHeader []byte
+
+	// Body is the encapsulated body, or nil if there is none. If it is
+	// also an io.Closer, it is closed when the request has been sent.
+	Body io.Reader
+
+	// ContentLength is the length of Body, or -1 if it is unknown.
+	// A body of known length is sent as a single chunk (after any
+	// preview) instead of one chunk per read, and is cut off at that
+	// length. A length of zero sends no body.
+	ContentLength int64
+}
+
+// NewRawRequest returns a RawRequest for a client to send to the ICAP
+// service at urlStr. To send a preview, set the Preview header to the
+// number of body bytes to include in it.
+func NewRawRequest(method, urlStr string, reqHdr, respHdr []byte, body io.Reader, length int64) (*RawRequest, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "icap" || u.Host == "" {
+		return nil, &badStringError{"unsupported ICAP URL", urlStr}
+	}
+	return &RawRequest{
+		Method:         method,
+		URL:            u,
+		Header:         make(textproto.MIMEHeader),
+		RequestHeader:  reqHdr,
+		ResponseHeader: respHdr,
+		Body:           body,
+		ContentLength:  length,
+	}, nil
+}
+
+// A RawResponse is the response to a RawRequest, with the encapsulated
+// HTTP headers left in wire format.
+type RawResponse struct {
+	Status     string // e.g. "200 OK"
+	StatusCode int    // e.g. 200
+	Proto      string // e.g. "ICAP/1.0"
+	Header     textproto.MIMEHeader
+
+	// The encapsulated HTTP request and response headers, including the
+	// blank lines that end them, or nil.
+	RequestHeader  []byte
+	ResponseHeader []byte
+
+	// BodySection is the name of the Encapsulated section of the body:
+	// "req-body", "res-body" or "opt-body", or "" if there is no body.
+	BodySection string
+
+	// Body streams the encapsulated body from the connection, or is nil
+	// if there is none. Closing it closes the connection.
+	Body io.ReadCloser
+
+	received time.Time // when the response header was read
+}
+
+// DoRaw sends req and returns the server's response, like Do.
+func (c *Client) DoRaw(ctx context.Context, req *RawRequest) (*RawResponse, error) {
+	if req.URL == nil {
+		return nil, errors.New("icap: request has no URL")
+	}
+	for _, h := range [][]byte{req.RequestHeader, req.ResponseHeader} {
+		if h != nil && !bytes.HasSuffix(h, []byte("\r\n\r\n")) {
+			return nil, errors.New("icap: encapsulated header doesn't end with a blank line")
+		}
+	}
+	cc, err := c.open(ctx, req.URL)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := cc.roundTripRaw(req)
+	if err != nil {
+		err = contextError(ctx, err)
+		cc.finish(err)
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,285 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Replacing the handler of a running server.
+
+package icap
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Reloader is a Handler that serves requests with a handler made by
+// Build, and replaces it with a new one when Reload is called, for
+// example when the server's configuration file changes (see
+// ReloadOnSignal and HTTPHandler). The new handler is built and validated
+// while the old one goes on serving; if that fails, the old one is kept.
+// Once it has been replaced, the old handler finishes the transactions
+// it has started, and is then retired: the context passed to Build for
+// it is canceled, and if it implements io.Closer (as ServeMux and
+// Pipeline do), it is closed.
+type Reloader struct {
+	// Build makes a new handler. ctx is canceled when the handler is
+	// retired, so it can be used to run background tasks, such as
+	// feeds.Feed.Run, for as long as the handler is in use.
+	Build func(ctx context.Context) (Handler, error)
+
+	// Validate, if not nil, checks a new handler before it is put in
+	// service.
+	Validate func(Handler) error
+
+	// DrainTimeout limits the time a retired handler is given to finish
+	// its transactions before it is closed anyway. If zero, it is given
+	// a minute.
+	DrainTimeout time.Duration
+
+	mu       sync.Mutex // held while reloading
+	current  atomic.Pointer[handlerGeneration]
+	retiring sync.WaitGroup
+	stats    ReloadStats
+}
+
+// ReloadStats describes the reloads of a Reloader.
+type ReloadStats struct {
+	Generation int       // the number of handlers built successfully
+	LastReload time.Time // when the current handler was put in service
+	Failures   int       // the number of reloads that failed
+	LastError  string    // the error from the last reload that failed
+}
+
+// A handlerGeneration is a handler built by a Reloader, with a count of
+// the transactions it is serving.
+type handlerGeneration struct {
+	handler Handler
+	cancel  context.CancelFunc
+
+	mu      sync.Mutex
+	active  int
+	retired bool
+	drained chan struct{} // closed when retired with no transactions active
+}
+
+// acquire counts a new transaction, unless g has been retired.
+func (g *handlerGeneration) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.retired {
+		return false
+	}
+	g.active++
+	return true
+}
+
+func (g *handlerGeneration) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	if g.retired && g.active == 0 {
+		close(g.drained)
+	}
+}
+
+// retire waits up to timeout for g's transactions to finish, and then
+// cancels its context and closes its handler.
+func (g *handlerGeneration) retire(timeout time.Duration) {
+	g.mu.Lock()
+	g.retired = true
+	if g.active == 0 {
+		close(g.drained)
+	}
+	g.mu.Unlock()
+
+	t := time.NewTimer(timeout)
+	select {
+	case <-g.drained:
+	case <-t.C:
+		log.Printf("icap: retiring handler with transactions still active")
+	}
+	t.Stop()
+	g.cancel()
+	if err := closeHandler(g.handler, nil); err != nil {
+		log.Printf("icap: error closing retired handler: %v", err)
+	}
+}
+
+// ServeICAP serves req with the current handler, building the first one
+// if need be.
+func (r *Reloader) ServeICAP(w ResponseWriter, req *Request) {
+	for {
+		g := r.current.Load()
+		if g == nil {
+			if err := r.init(); err != nil {
+				log.Printf("icap: error building handler: %v", err)
+				w.WriteHeader(StatusInternalServerError, nil, false)
+				return
+			}
+			continue
+		}
+		if g.acquire() {
+			defer g.release()
+			g.handler.ServeICAP(w, req)
+			return
+		}
+		// g was replaced after it was loaded; use its successor.
+	}
+}
+
+// init builds the first handler, unless another goroutine has.
+func (r *Reloader) init() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current.Load() != nil {
+		return nil
+	}
+	return r.reload()
+}
+
+// Reload builds and validates a new handler, and replaces the current
+// one with it. The old handler is retired in the background.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.reload()
+}
+
+func (r *Reloader) reload() error {
+	if r.Build == nil {
+		return r.failed(errors.New("icap: Reloader has no Build function"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h, err := r.Build(ctx)
+	if err == nil && r.Validate != nil {
+		err = r.Validate(h)
+	}
+	if err != nil {
+		cancel()
+		if h != nil {
+			closeHandler(h, nil)
+		}
+		return r.failed(err)
+	}
+
+	g := &handlerGeneration{handler: h, cancel: cancel, drained: make(chan struct{})}
+	old := r.current.Swap(g)
+	r.stats.Generation++
+	r.stats.LastReload = time.Now()
+	if old != nil {
+		timeout := r.DrainTimeout
+		if timeout <= 0 {
+			timeout = time.Minute
+		}
+		r.retiring.Add(1)
+		go func() {
+			defer r.retiring.Done()
+			old.retire(timeout)
+		}()
+	}
+	return nil
+}
+
+// failed records a failed reload. r.mu must be held.
+func (r *Reloader) failed(err error) error {
+	r.stats.Failures++
+	r.stats.LastError = err.Error()
+	return err
+}
+
+// Stats returns statistics about the reloads.
+func (r *Reloader) Stats() ReloadStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Close retires the current handler, and waits for it and any others
+// being retired to finish their transactions and be closed. A request
+// served after Close builds a new handler.
+func (r *Reloader) Close() error {
+	r.mu.Lock()
+	old := r.current.Swap(nil)
+	r.mu.Unlock()
+	if old != nil {
+		timeout := r.DrainTimeout
+		if timeout <= 0 {
+			timeout = time.Minute
+		}
+		old.retire(timeout)
+	}
+	r.retiring.Wait()
+	return nil
+}
+
+// ReloadOnSignal calls Reload whenever the process receives one of sigs,
+// such as syscall.SIGHUP, logging any error, until stop is called.
+func (r *Reloader) ReloadOnSignal(sigs ...os.Signal) (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-c:
+				if err := r.Reload(); err != nil {
+					log.Printf("icap: reload failed: %v", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
+
+// HTTPHandler returns an HTTP handler for an admin listener: a POST
+// request calls Reload, and is answered with 500 Internal Server Error if
+// it fails; any request is answered with the ReloadStats as JSON.
+func (r *Reloader) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		status := http.StatusOK
+		if req.Method == http.MethodPost {
+			if err := r.Reload(); err != nil {
+				status = http.StatusInternalServerError
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(r.Stats())
+	})
+}
+
+// closeHandler closes v if it is an io.Closer that isn't in seen, and
+// adds it to seen.
+func closeHandler(v interface{}, seen map[interface{}]bool) error {
+	c, ok := v.(io.Closer)
+	if !ok {
+		return nil
+	}
+	if reflect.TypeOf(c).Comparable() {
+		if seen[c] {
+			return nil
+		}
+		if seen != nil {
+			seen[c] = true
+		}
+	}
+	return c.Close()
+}
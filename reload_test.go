@@ -0,0 +1,126 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A generationHandler is a handler built by a Reloader in a test.
+type generationHandler struct {
+	n       int
+	ctx     context.Context
+	block   chan struct{} // if not nil, transactions wait for it to close
+	started chan struct{}
+	closed  atomic.Bool
+}
+
+func (h *generationHandler) ServeICAP(w ResponseWriter, req *Request) {
+	if h.block != nil {
+		close(h.started)
+		<-h.block
+	}
+	w.Header().Set("X-Generation", strconv.Itoa(h.n))
+	w.WriteHeader(StatusNoContent, nil, false)
+}
+
+func (h *generationHandler) Close() error {
+	if h.ctx.Err() == nil {
+		return errors.New("closed before its context was canceled")
+	}
+	h.closed.Store(true)
+	return nil
+}
+
+func TestReloader(t *testing.T) {
+	var built []*generationHandler
+	invalid := false
+	r := &Reloader{
+		Build: func(ctx context.Context) (Handler, error) {
+			h := &generationHandler{n: len(built) + 1, ctx: ctx}
+			if h.n == 1 {
+				h.block = make(chan struct{})
+				h.started = make(chan struct{})
+			}
+			built = append(built, h)
+			return h, nil
+		},
+		Validate: func(Handler) error {
+			if invalid {
+				return errors.New("invalid configuration")
+			}
+			return nil
+		},
+	}
+	defer r.Close()
+	raw := "OPTIONS icap://icap.example.net/svc ICAP/1.0\r\nHost: icap.example.net\r\nEncapsulated: null-body=0\r\n\r\n"
+	generation := func(resp string) string {
+		if i := strings.Index(resp, "X-Generation: "); i >= 0 {
+			return strings.TrimSpace(resp[i+14 : i+15])
+		}
+		return resp
+	}
+
+	// A transaction on the first handler is still running when it is
+	// replaced.
+	first := make(chan string)
+	go func() { first <- roundTrip(t, &Server{Handler: r}, raw) }()
+	waitBuilt(t, r)
+	<-built[0].started
+
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if g := generation(roundTrip(t, &Server{Handler: r}, raw)); g != "2" {
+		t.Errorf("after reload, served by generation %s", g)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if built[0].closed.Load() {
+		t.Error("first handler closed while a transaction was active")
+	}
+	close(built[0].block)
+	if g := generation(<-first); g != "1" {
+		t.Errorf("transaction begun before reload served by generation %s", g)
+	}
+
+	invalid = true
+	rec := httptest.NewRecorder()
+	r.HTTPHandler().ServeHTTP(rec, httptest.NewRequest("POST", "/reload", nil))
+	if rec.Code != 500 || !strings.Contains(rec.Body.String(), "invalid configuration") {
+		t.Errorf("failed reload: %d %s", rec.Code, rec.Body)
+	}
+	if g := generation(roundTrip(t, &Server{Handler: r}, raw)); g != "2" {
+		t.Errorf("after failed reload, served by generation %s", g)
+	}
+
+	r.Close()
+	for i, h := range built[:2] {
+		if !h.closed.Load() {
+			t.Errorf("handler %d not closed", i+1)
+		}
+	}
+	if s := r.Stats(); s.Generation != 2 || s.Failures != 1 {
+		t.Errorf("Stats = %+v", s)
+	}
+}
+
+// waitBuilt waits for r to build its first handler.
+func waitBuilt(t *testing.T, r *Reloader) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.current.Load() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("no handler built")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Detection of replayed signed requests.
+
+package icap
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrReplayed is the error reported by a SignatureVerifier for a signed
+// request that is stale (its Date is too far from the server's clock),
+// or whose nonce has been seen before or is missing.
+var ErrReplayed = errors.New("icap: stale or replayed request")
+
+// A NonceStore remembers the nonces of signed requests, to detect
+// replays. Implementations shared among several servers (in a database,
+// for example) protect a whole cluster.
+type NonceStore interface {
+	// Add records nonce until expires, and reports whether it was new.
+	Add(nonce string, expires time.Time) (bool, error)
+}
+
+// ErrNonceStoreFull is returned by a MemoryNonceStore that can't record
+// another nonce. Requests are refused rather than risk accepting replays.
+var ErrNonceStoreFull = errors.New("icap: nonce store full")
+
+// A MemoryNonceStore is a NonceStore that keeps the nonces in memory.
+// The zero value is ready to use.
+type MemoryNonceStore struct {
+	// MaxEntries limits the number of nonces held. If zero, 1000000 are.
+	MaxEntries int
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+}
+
+// Add records nonce until expires, and reports whether it was new.
+func (s *MemoryNonceStore) Add(nonce string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if exp, ok := s.nonces[nonce]; ok && now.Before(exp) {
+		return false, nil
+	}
+	if s.nonces == nil {
+		s.nonces = make(map[string]time.Time)
+	}
+	max := s.MaxEntries
+	if max <= 0 {
+		max = 1000000
+	}
+	if len(s.nonces) >= max {
+		for n, exp := range s.nonces {
+			if !now.Before(exp) {
+				delete(s.nonces, n)
+			}
+		}
+		if len(s.nonces) >= max {
+			return false, ErrNonceStoreFull
+		}
+	}
+	s.nonces[nonce] = expires
+	return true, nil
+}
+
+// Len returns the number of nonces held, including any that have expired
+// but not yet been removed.
+func (s *MemoryNonceStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.nonces)
+}
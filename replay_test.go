@@ -0,0 +1,77 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayProtection(t *testing.T) {
+	key := []byte("a shared secret")
+	handler := &SignatureVerifier{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		Keys:   map[string][]byte{"client-1": key},
+		Nonces: &MemoryNonceStore{},
+	}
+
+	signed := func(header textproto.MIMEHeader) string {
+		sum := sha256.Sum256(nil)
+		(&RequestSigner{KeyID: "client-1", Key: key}).Sign("OPTIONS", "icap://icap.example.net/options", header, sum[:])
+		raw := "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Encapsulated: null-body=0\r\n"
+		for _, name := range []string{"Date", "X-ICAP-Nonce", "X-ICAP-Body-SHA256", "X-ICAP-Signature"} {
+			if v := header.Get(name); v != "" {
+				raw += name + ": " + v + "\r\n"
+			}
+		}
+		return raw + "\r\n"
+	}
+
+	raw := signed(make(textproto.MIMEHeader))
+	if resp := roundTrip(t, &Server{Handler: handler}, raw); !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Fatalf("first request: unexpected response:\n%s", resp)
+	}
+	if resp := roundTrip(t, &Server{Handler: handler}, raw); !strings.HasPrefix(resp, "ICAP/1.0 403 ") {
+		t.Errorf("replayed request: unexpected response:\n%s", resp)
+	}
+
+	stale := textproto.MIMEHeader{"Date": {time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)}}
+	if resp := roundTrip(t, &Server{Handler: handler}, signed(stale)); !strings.HasPrefix(resp, "ICAP/1.0 403 ") {
+		t.Errorf("stale request: unexpected response:\n%s", resp)
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	s := &MemoryNonceStore{MaxEntries: 2}
+	now := time.Now()
+	for _, tt := range []struct {
+		nonce   string
+		expires time.Time
+		fresh   bool
+		err     error
+	}{
+		{"a", now.Add(-time.Second), true, nil},
+		{"a", now.Add(time.Minute), true, nil}, // the first one expired
+		{"a", now.Add(time.Minute), false, nil},
+		{"b", now.Add(time.Minute), true, nil},
+		{"c", now.Add(time.Minute), false, ErrNonceStoreFull},
+	} {
+		fresh, err := s.Add(tt.nonce, tt.expires)
+		if fresh != tt.fresh || err != tt.err {
+			t.Errorf("Add(%q) = %v, %v; want %v, %v", tt.nonce, fresh, err, tt.fresh, tt.err)
+		}
+	}
+	if s.Len() != 2 {
+		t.Errorf("Len = %d, want 2", s.Len())
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Allowing and blocking files by the reputation of their hashes.
+
+package icap
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Reputation is what is known about a file.
+type Reputation int
+
+const (
+	ReputationUnknown Reputation = iota
+	ReputationGood               // known to be safe
+	ReputationBad                // known to be malicious
+)
+
+func (r Reputation) String() string {
+	switch r {
+	case ReputationUnknown:
+		return "unknown"
+	case ReputationGood:
+		return "good"
+	case ReputationBad:
+		return "bad"
+	}
+	return fmt.Sprintf("Reputation(%d)", int(r))
+}
+
+// A HashReputation looks up the reputation of a file by its hash.
+type HashReputation interface {
+	Lookup(h crypto.Hash, sum []byte) (Reputation, error)
+}
+
+// A HashSet is a HashReputation that holds lists of known-good and
+// known-bad hashes in memory. It is safe for concurrent use.
+type HashSet struct {
+	mu     sync.RWMutex
+	hashes map[string]Reputation
+}
+
+// Add records the reputation of the file with the given hash.
+func (s *HashSet) Add(sum []byte, r Reputation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hashes == nil {
+		s.hashes = make(map[string]Reputation)
+	}
+	s.hashes[string(sum)] = r
+}
+
+// Load adds the hashes read from rd, one per line in hexadecimal, with
+// reputation r. Blank lines and lines starting with # are ignored.
+func (s *HashSet) Load(rd io.Reader, r Reputation) error {
+	sc := bufio.NewScanner(rd)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		sum, err := hex.DecodeString(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		s.Add(sum, r)
+	}
+	return sc.Err()
+}
+
+// Len returns the number of hashes in the set.
+func (s *HashSet) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.hashes)
+}
+
+// Lookup returns the reputation recorded for sum. The hash function
+// doesn't matter, since the sums of different functions differ in length.
+func (s *HashSet) Lookup(h crypto.Hash, sum []byte) (Reputation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hashes[string(sum)], nil
+}
+
+// An HTTPReputation is a HashReputation that asks an HTTP service. It sends
+// a GET request to URL with the query parameters "hash" (the sum in
+// hexadecimal) and "algorithm" (such as "SHA-256"), and expects a JSON
+// response such as {"reputation": "bad"}. A 404 Not Found response means
+// the file is unknown.
+type HTTPReputation struct {
+	URL string
+
+	// Client sends the lookup requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Timeout limits the time taken by each lookup. Zero means no limit.
+	Timeout time.Duration
+}
+
+// Lookup asks the service for the reputation of sum.
+func (r *HTTPReputation) Lookup(h crypto.Hash, sum []byte) (Reputation, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return ReputationUnknown, err
+	}
+	q := u.Query()
+	q.Set("hash", hex.EncodeToString(sum))
+	q.Set("algorithm", h.String())
+	u.RawQuery = q.Encode()
+
+	ctx := context.Background()
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return ReputationUnknown, err
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return ReputationUnknown, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ReputationUnknown, nil
+	case resp.StatusCode/100 != 2:
+		return ReputationUnknown, fmt.Errorf("reputation lookup: unexpected status %s", resp.Status)
+	}
+	var v struct {
+		Reputation string `json:"reputation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return ReputationUnknown, fmt.Errorf("reputation lookup: malformed response: %v", err)
+	}
+	switch v.Reputation {
+	case "good":
+		return ReputationGood, nil
+	case "bad":
+		return ReputationBad, nil
+	case "unknown", "":
+		return ReputationUnknown, nil
+	}
+	return ReputationUnknown, fmt.Errorf("reputation lookup: unknown reputation %q", v.Reputation)
+}
+
+// A ReputationStage is a Stage that looks up the hash of the encapsulated
+// body in a HashReputation. Known-good files stop the pipeline, so that
+// they are sent on without running the expensive stages after it, such
+// as virus scanners; known-bad files are blocked; and unknown files go on
+// to the next stage.
+//
+// The hash is the one computed as the body streamed in (see
+// Server.BodyHashes) if it is available; otherwise the body is buffered
+// with Request.BufferedBody and hashed.
+type ReputationStage struct {
+	Reputation HashReputation
+
+	// Hash is the hash function to use. If zero, crypto.SHA256 is used.
+	Hash crypto.Hash
+
+	// BodyMemory is the number of bytes of each body kept in memory
+	// while it is hashed; larger bodies are spooled to disk.
+	// If zero, 1 MB is used.
+	BodyMemory int64
+
+	// Status and Reason make up the block page for known-bad files.
+	// If they are zero, 403 and "This file is known to be malicious."
+	// are used.
+	Status int
+	Reason string
+}
+
+// Process looks up the reputation of the body of req.
+func (s *ReputationStage) Process(req *Request) (StageResult, error) {
+	if !req.hasBody || req.bodyPtr() == nil {
+		return StageResult{Action: ActionContinue}, nil
+	}
+	h := s.Hash
+	if h == 0 {
+		h = crypto.SHA256
+	}
+	sum, err := s.sum(req, h)
+	if err != nil {
+		return StageResult{}, err
+	}
+
+	r, err := s.Reputation.Lookup(h, sum)
+	if err != nil {
+		return StageResult{}, err
+	}
+	req.Audit().AddScanResult("reputation", r.String())
+	switch r {
+	case ReputationGood:
+		return StageResult{Action: ActionNoModification}, nil
+	case ReputationBad:
+		reason := s.Reason
+		if reason == "" {
+			reason = "This file is known to be malicious."
+		}
+		return StageResult{Action: ActionBlock, Status: s.Status, Reason: reason}, nil
+	}
+	return StageResult{Action: ActionContinue}, nil
+}
+
+// sum returns the hash of the body of req, reading it if necessary.
+func (s *ReputationStage) sum(req *Request, h crypto.Hash) ([]byte, error) {
+	if sum, ok := req.BodyHash(h); ok {
+		return sum, nil
+	}
+	if !h.Available() {
+		return nil, fmt.Errorf("icap: hash function %v is not available", h)
+	}
+	if req.bufferedBody == nil {
+		// Hash the body as it is buffered, rather than reading it twice.
+		req.HashBody(h)
+	}
+	memLimit := s.BodyMemory
+	if memLimit <= 0 {
+		memLimit = 1 << 20
+	}
+	bb, err := req.BufferedBody(memLimit)
+	if err != nil {
+		return nil, err
+	}
+	if sum, ok := req.BodyHash(h); ok {
+		return sum, nil
+	}
+	hh := h.New()
+	if _, err := io.Copy(hh, io.NewSectionReader(bb, 0, bb.Size())); err != nil {
+		return nil, err
+	}
+	return hh.Sum(nil), nil
+}
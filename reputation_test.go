@@ -0,0 +1,91 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"crypto"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReputationStage(t *testing.T) {
+	good := sha256.Sum256([]byte("good file"))
+	bad := sha256.Sum256([]byte("evil file"))
+	set := new(HashSet)
+	err := set.Load(strings.NewReader("# known files\n"+hex.EncodeToString(good[:])+"\n\n"), ReputationGood)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.Add(bad[:], ReputationBad)
+	if set.Len() != 2 {
+		t.Errorf("Len = %d, want 2", set.Len())
+	}
+
+	request := func(body string) string {
+		httpHdr := "HTTP/1.1 200 OK\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n"
+		return "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr +
+			strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+	}
+
+	for _, hashes := range [][]crypto.Hash{nil, {crypto.MD5}, {crypto.SHA256}} {
+		scanned := 0
+		scanner := StageFunc(func(req *Request) (StageResult, error) {
+			scanned++
+			return StageResult{Action: ActionContinue}, nil
+		})
+		srv := &Server{
+			BodyHashes: hashes,
+			Handler:    &Pipeline{Stages: []Stage{&ReputationStage{Reputation: set}, scanner}},
+		}
+
+		resp := roundTrip(t, srv, request("good file"))
+		if !strings.HasPrefix(resp, "ICAP/1.0 204 ") || scanned != 0 {
+			t.Errorf("%v: known-good file should skip the scanner, got 204 = %v, scanned %d times", hashes, strings.HasPrefix(resp, "ICAP/1.0 204 "), scanned)
+		}
+		resp = roundTrip(t, srv, request("evil file"))
+		if !strings.Contains(resp, "HTTP/1.1 403 ") || scanned != 0 {
+			t.Errorf("%v: known-bad file should be blocked:\n%s", hashes, resp)
+		}
+		roundTrip(t, srv, request("other file"))
+		if scanned != 1 {
+			t.Errorf("%v: unknown file should be scanned", hashes)
+		}
+	}
+}
+
+func TestHTTPReputation(t *testing.T) {
+	bad := md5.Sum([]byte("evil file"))
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("algorithm") != "MD5" {
+			t.Errorf("algorithm = %q", r.URL.Query().Get("algorithm"))
+		}
+		switch r.URL.Query().Get("hash") {
+		case hex.EncodeToString(bad[:]):
+			w.Write([]byte(`{"reputation": "bad"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer api.Close()
+
+	r := &HTTPReputation{URL: api.URL + "/lookup"}
+	if rep, err := r.Lookup(crypto.MD5, bad[:]); rep != ReputationBad || err != nil {
+		t.Errorf("Lookup(bad) = %v, %v", rep, err)
+	}
+	other := md5.Sum([]byte("other file"))
+	if rep, err := r.Lookup(crypto.MD5, other[:]); rep != ReputationUnknown || err != nil {
+		t.Errorf("Lookup(other) = %v, %v", rep, err)
+	}
+}
@@ -10,13 +10,17 @@ package icap
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto"
 	"fmt"
 	"io"
 	"net/http"
 	"net/textproto"
 	"net/url"
-	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type badStringError struct {
@@ -35,16 +39,120 @@ type Request struct {
 	Header     textproto.MIMEHeader // The ICAP header
 	RemoteAddr string               // the address of the computer sending the request
 	Preview    []byte               // the body data for an ICAP preview
+	Tenant     *Tenant              // the tenant serving the request, if any
+
+	// ServicePath is the pattern of the ServeMux entry that the request
+	// was routed to, such as "/scan/", so that a handler mounted under
+	// several services can tell them apart. It is empty if the request
+	// wasn't routed by a ServeMux.
+	ServicePath string
+
+	// Diagnostics lists the deviations from RFC 3507 that were
+	// tolerated while parsing the request (see LenientDialect).
+	Diagnostics Diagnostics
+
+	// The size of the request as received, for logging and metrics.
+	// HeaderBytes counts the ICAP header and the encapsulated HTTP headers,
+	// and is set only for requests received by a Server. PreviewBytes
+	// counts the preview data, without the chunk framing; see BodyBytes
+	// for the rest of the body.
+	HeaderBytes  int64
+	PreviewBytes int64
+
+	// ParseDuration is the time taken to read and parse the headers and
+	// the preview, after the first byte of the request arrived.
+	ParseDuration time.Duration
 
 	// The HTTP messages.
 	Request  *http.Request
 	Response *http.Response
+
+	// OptBody is the body of an OPTIONS request (an opt-body section),
+	// or nil if there is none. Its format is given by the Opt-body-type
+	// header.
+	OptBody io.ReadCloser
+
+	// The encapsulated HTTP headers in the order and casing in which they
+	// were received. They are used when writing the messages back if
+	// Server.PreserveHeaderOrder is set.
+	RawRequestHeader  RawHeader
+	RawResponseHeader RawHeader
+
+	server       *Server                 // the server that received the request, if any
+	hasBody      bool                    // true if the Encapsulated header listed a body section
+	previewIEOF  bool                    // the preview ended with ieof
+	compression  *TransportCompression   // set if the client's offer of compression was accepted
+	bodyBytes    atomic.Int64            // body bytes read after the preview
+	bodyEnd      atomic.Int64            // when the body was read to its end, in Unix nanoseconds
+	bodyTooLarge atomic.Bool             // a body size limit was exceeded while reading the body
+	start        time.Time               // when the request started to arrive
+	audit        *AuditRecord            // nil unless the server has an Audit hook
+	maintenance  bool                    // the service is in maintenance mode
+	bufferedBody *BufferedBody           // set by BufferedBody
+	encodedBody  *BufferedBody           // bufferedBody before DecompressBody
+	handoff      *ObjectHandoff          // set by ObjectHandoff
+	verdictHdr   http.Header             // ICAP headers set by a handler run by HandlerVerdict
+	verdictOf    Verdict                 // the verdict that verdictHdr goes with
+	rawBody      io.Reader               // the body as read from the connection, whatever the handler does with it
+	continuer    *continueReader         // reads the rest of the body after an incomplete preview
+	ctx          context.Context         // see Context
+	cancelCtx    context.CancelCauseFunc // cancels ctx when the transaction is over
+
+	hashMu   sync.Mutex
+	bodySums map[crypto.Hash][]byte // set when a hashed body has been read
+
+	annotationMu sync.Mutex
+	annotations  map[string]interface{}
+
+	memMu   sync.Mutex
+	memUsed int64 // bytes reserved with Reserve
+
+	// Snapshots of the encapsulated messages as parsed, used to detect
+	// whether a handler is returning them unmodified.
+	reqSnapshot  *messageSnapshot
+	respSnapshot *messageSnapshot
 }
 
 // ReadRequest reads and parses a request from b.
 func ReadRequest(b *bufio.ReadWriter) (req *Request, err error) {
+	return readRequest(b, StrictDialect{})
+}
+
+// readRequest reads and parses a request from b using dialect d.
+func readRequest(b *bufio.ReadWriter, d Dialect) (req *Request, err error) {
+	return readRequestWith(b, d, requestOptions{})
+}
+
+// requestOptions are the settings a Server reads requests with.
+type requestOptions struct {
+	consumed  func() int64 // how many bytes of b have been parsed, if known
+	stats     *parserStats // records statistics on the request, if not nil
+	looseIEOF bool         // see CompatProfile.LooseIEOF
+	out       flushWriter  // for 100 Continue, if not b
+
+	// compression, if not nil, is accepted if the client offers it.
+	compression *TransportCompression
+
+	// maxHeaderBytes, if positive, limits the size of the ICAP header
+	// and the encapsulated headers; headerRead, if not nil, is called
+	// once they have been read.
+	maxHeaderBytes int
+	headerRead     func()
+}
+
+// readRequestWith is like readRequest, but with the settings in opts.
+func readRequestWith(b *bufio.ReadWriter, d Dialect, opts requestOptions) (req *Request, err error) {
+	consumed, stats := opts.consumed, opts.stats
+	var out flushWriter = b
+	if opts.out != nil {
+		out = opts.out
+	}
 	tp := textproto.NewReader(b.Reader)
 	req = new(Request)
+	var start int64
+	if consumed != nil {
+		start = consumed()
+	}
 
 	// Read first line.
 	var s string
@@ -56,11 +164,13 @@ func ReadRequest(b *bufio.ReadWriter) (req *Request, err error) {
 		return nil, err
 	}
 
-	f := strings.SplitN(s, " ", 3)
-	if len(f) < 3 {
-		return nil, &badStringError{"malformed ICAP request", s}
+	req.Method, req.RawURL, req.Proto, err = d.ParseRequestLine(s, &req.Diagnostics)
+	if err != nil {
+		return nil, err
+	}
+	if !isToken(req.Method) {
+		return nil, &badStringError{"invalid ICAP method", req.Method}
 	}
-	req.Method, req.RawURL, req.Proto = f[0], f[1], f[2]
 
 	req.URL, err = url.ParseRequestURI(req.RawURL)
 	if err != nil {
@@ -76,99 +186,78 @@ func ReadRequest(b *bufio.ReadWriter) (req *Request, err error) {
 	if s == "" {
 		return req, nil // No HTTP headers or body.
 	}
-	eList := strings.Split(s, ", ")
-	var initialOffset, reqHdrLen, respHdrLen int
-	var hasBody bool
-	var prevKey string
-	var prevValue int
-	for _, item := range eList {
-		eq := strings.Index(item, "=")
-		if eq == -1 {
-			return nil, &badStringError{"malformed Encapsulated: header", s}
-		}
-		key := item[:eq]
-		value, err := strconv.Atoi(item[eq+1:])
-		if err != nil {
-			return nil, &badStringError{"malformed Encapsulated: header", s}
-		}
-
-		// Calculate the length of the previous section.
-		switch prevKey {
-		case "":
-			initialOffset = value
-		case "req-hdr":
-			reqHdrLen = value - prevValue
-		case "res-hdr":
-			respHdrLen = value - prevValue
-		case "req-body", "opt-body", "res-body", "null-body":
-			return nil, fmt.Errorf("%s must be the last section", prevKey)
-		}
-
-		switch key {
-		case "req-hdr", "res-hdr", "null-body":
-		case "req-body", "res-body", "opt-body":
-			hasBody = true
-		default:
-			return nil, &badStringError{"invalid key for Encapsulated: header", key}
-		}
-
-		prevValue = value
-		prevKey = key
+	e, err := parseEncapsulated(d, s, &req.Diagnostics)
+	if err != nil {
+		return nil, err
 	}
-
-	// Read the HTTP headers.
-	var rawReqHdr, rawRespHdr []byte
-	if initialOffset > 0 {
-		junk := make([]byte, initialOffset)
-		_, err = io.ReadFull(b, junk)
-		if err != nil {
-			return nil, err
-		}
+	if max := opts.maxHeaderBytes; max > 0 && (e.initialOffset > max || e.reqHdrLen > max || e.respHdrLen > max ||
+		e.initialOffset+e.reqHdrLen+e.respHdrLen > max) {
+		return nil, errHeaderTooLarge
 	}
-	if reqHdrLen > 0 {
-		rawReqHdr = make([]byte, reqHdrLen)
-		_, err = io.ReadFull(b, rawReqHdr)
-		if err != nil {
-			return nil, err
-		}
+	rawReqHdr, rawRespHdr, err := e.readHeaders(b.Reader)
+	if err != nil {
+		return nil, err
 	}
-	if respHdrLen > 0 {
-		rawRespHdr = make([]byte, respHdrLen)
-		_, err = io.ReadFull(b, rawRespHdr)
-		if err != nil {
-			return nil, err
-		}
+	if consumed != nil && opts.maxHeaderBytes > 0 && consumed()-start > int64(opts.maxHeaderBytes) {
+		return nil, errHeaderTooLarge
+	}
+	if opts.headerRead != nil {
+		opts.headerRead()
+	}
+	if rawReqHdr != nil {
+		req.RawRequestHeader = parseRawHeader(rawReqHdr)
+	}
+	if rawRespHdr != nil {
+		req.RawResponseHeader = parseRawHeader(rawRespHdr)
+	}
+	if consumed != nil {
+		req.HeaderBytes = consumed() - start
+	}
+
+	if opts.compression.accepts(req.Header.Get(CompressionHeader)) {
+		req.compression = opts.compression
 	}
 
+	hasBody := e.body != ""
+	req.hasBody = hasBody
 	var bodyReader io.ReadCloser = emptyReader(0)
 	if hasBody {
 		if p := req.Header.Get("Preview"); p != "" {
-			moreBody := false
-
-			if previewSize, err := strconv.Atoi(p); err != nil && previewSize > 0 {
-				moreBody = true
-			}
-
-			req.Preview, err = io.ReadAll(newChunkedReader(b))
+			cr := newChunkedReader(b.Reader)
+			cr.stats = stats
+			cr.looseIEOF = opts.looseIEOF
+			req.Preview, err = io.ReadAll(cr)
 			if err != nil {
-				if strings.Contains(err.Error(), "ieof") {
-					// The data ended with "0; ieof", which the HTTP chunked reader doesn't understand.
-					moreBody = false
-					err = nil
-				} else {
-					return nil, err
-				}
+				return nil, err
+			}
+			req.PreviewBytes = int64(len(req.Preview))
+			stats.preview(cr.ieof)
+			req.previewIEOF = cr.ieof
+			if req.PreviewMismatch() {
+				stats.previewMismatch()
 			}
 			var r io.Reader = bytes.NewBuffer(req.Preview)
-			if moreBody {
-				r = io.MultiReader(r, &continueReader{buf: b})
+			if cr.ieof {
+				req.bodyEnd.Store(time.Now().UnixNano())
+			} else {
+				// The rest of the body follows once we send 100 Continue.
+				req.continuer = &continueReader{buf: b, out: out, stats: stats, compression: req.compression}
+				r = io.MultiReader(r, &bodyCounter{req.continuer, req})
 			}
+			req.rawBody = r
 			bodyReader = io.NopCloser(r)
 		} else {
-			bodyReader = io.NopCloser(newChunkedReader(b))
+			cr := newChunkedReader(b.Reader)
+			cr.stats = stats
+			req.rawBody = &bodyCounter{cr, req}
+			bodyReader = io.NopCloser(req.rawBody)
 		}
 	}
 
+	if e.body == "opt-body" && req.Method == "OPTIONS" {
+		req.OptBody = bodyReader
+	}
+
 	// Construct the http.Request.
 	if rawReqHdr != nil {
 		invalidURLEscapeFixed := false
@@ -199,6 +288,7 @@ func ReadRequest(b *bufio.ReadWriter) (req *Request, err error) {
 		} else {
 			req.Request.Body = emptyReader(0)
 		}
+		req.reqSnapshot = snapshotRequest(rawReqHdr, req.Request)
 	}
 
 	// Construct the http.Response.
@@ -212,11 +302,22 @@ func ReadRequest(b *bufio.ReadWriter) (req *Request, err error) {
 			return req, fmt.Errorf("error while parsing HTTP response: %v", err)
 		}
 
-		if req.Method == "RESPMOD" {
-			req.Response.Body = bodyReader
-		} else {
+		switch {
+		case req.Method != "RESPMOD":
 			req.Response.Body = emptyReader(0)
+		case !BodyAllowed(req.Response):
+			// The client should have sent null-body. Discard whatever
+			// it sent without asking for more than the preview.
+			if req.Preview == nil {
+				if _, err = io.Copy(io.Discard, bodyReader); err != nil {
+					return req, err
+				}
+			}
+			req.Response.Body = emptyReader(0)
+		default:
+			req.Response.Body = bodyReader
 		}
+		req.respSnapshot = snapshotResponse(rawRespHdr, req.Response)
 	}
 
 	// Fix the URL in the request and response if source supports it.
@@ -237,6 +338,140 @@ func ReadRequest(b *bufio.ReadWriter) (req *Request, err error) {
 	return
 }
 
+// An encapsulation describes the sections listed in an Encapsulated header.
+type encapsulation struct {
+	initialOffset int    // bytes before the first section
+	reqHdrLen     int    // length of the req-hdr section; -1 if it ends at a blank line
+	respHdrLen    int    // length of the res-hdr section; -1 if it ends at a blank line
+	body          string // "req-body", "res-body" or "opt-body"; "" for null-body
+}
+
+// readHeaders reads the encapsulated HTTP header sections from r.
+// A section that is not present is returned as nil.
+func (e encapsulation) readHeaders(r *bufio.Reader) (reqHdr, respHdr []byte, err error) {
+	if e.initialOffset > 0 {
+		if _, err = io.CopyN(io.Discard, r, int64(e.initialOffset)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if reqHdr, err = readSection(r, e.reqHdrLen); err != nil {
+		return nil, nil, err
+	}
+	if respHdr, err = readSection(r, e.respHdrLen); err != nil {
+		return nil, nil, err
+	}
+	return reqHdr, respHdr, nil
+}
+
+// readSection reads an encapsulated header section of length n from r.
+// If n is -1, the section extends through the first blank line.
+func readSection(r *bufio.Reader, n int) ([]byte, error) {
+	switch {
+	case n == 0:
+		return nil, nil
+	case n > 0:
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	var b []byte
+	for {
+		line, err := r.ReadSlice('\n')
+		b = append(b, line...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if len(line) <= 2 && strings.TrimRight(string(line), "\r\n") == "" {
+			return b, nil
+		}
+	}
+}
+
+// isToken reports whether s is a valid token (RFC 7230, section 3.2.6),
+// as required for the method name. Extension methods such as LOG are
+// accepted as long as they are tokens.
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Allows204 reports whether the client accepts a 204 No Modifications
+// response, either by listing 204 in its Allow header or by sending a preview,
+// or because the server's CompatProfile assumes it does. A preview allows
+// 204 only until the server asks for the rest of the body with 100
+// Continue (RFC 3507, section 4.6).
+func (req *Request) Allows204() bool {
+	if req.server.compat().Assume204 {
+		return true
+	}
+	if req.Header.Get("Preview") != "" && (req.continuer == nil || req.continuer.cr == nil) {
+		return true
+	}
+	for _, v := range strings.Split(req.Header.Get("Allow"), ",") {
+		if strings.TrimSpace(v) == "204" {
+			return true
+		}
+	}
+	return false
+}
+
+// Server returns the Server that received req, or nil if it wasn't
+// received by a Server, so that a handler can adapt to the server's
+// settings, such as its limits. The Server must not be modified.
+func (req *Request) Server() *Server {
+	return req.server
+}
+
+// DefaultISTag returns the ISTag that the response to req gets if its
+// handler doesn't set one: that of its Tenant, or else the one supplied
+// by the server's HeaderPolicy. It returns "" if there is none.
+func (req *Request) DefaultISTag() string {
+	if req.Tenant != nil && req.Tenant.ISTag != "" {
+		return req.Tenant.ISTag
+	}
+	return req.server.headerPolicy().istag(req)
+}
+
+// IsTunnel reports whether req is a REQMOD request for a CONNECT request
+// or a protocol upgrade (such as a WebSocket handshake), whose traffic
+// cannot be adapted.
+func (req *Request) IsTunnel() bool {
+	if req.Method != "REQMOD" || req.Request == nil {
+		return false
+	}
+	if req.Request.Method == http.MethodConnect {
+		return true
+	}
+	if req.Request.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range strings.Split(req.Request.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(v), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
 // An emptyReader is an io.ReadCloser that always returns os.EOF.
 type emptyReader byte
 
@@ -251,22 +486,68 @@ func (emptyReader) Close() error {
 // A continueReader sends a "100 Continue" message the first time Read
 // is called, creates a ChunkedReader, and reads from that.
 type continueReader struct {
-	buf *bufio.ReadWriter // the underlying connection
-	cr  io.Reader         // the ChunkedReader
+	buf   *bufio.ReadWriter // the underlying connection
+	out   flushWriter       // where to write 100 Continue
+	cr    io.Reader         // the ChunkedReader
+	stats *parserStats      // the server's statistics, if any
+
+	// compression, if not nil, is accepted in the 100 Continue, and
+	// the rest of the body is decompressed with it.
+	compression *TransportCompression
+}
+
+// A flushWriter is a buffered writer.
+type flushWriter interface {
+	io.Writer
+	Flush() error
 }
 
 func (c *continueReader) Read(p []byte) (n int, err error) {
 	if c.cr == nil {
-		_, err := c.buf.WriteString("ICAP/1.0 100 Continue\r\n\r\n")
+		msg := "ICAP/1.0 100 Continue\r\n\r\n"
+		if c.compression != nil {
+			msg = "ICAP/1.0 100 Continue\r\n" + CompressionHeader + ": " + c.compression.token() + "\r\n\r\n"
+		}
+		_, err := io.WriteString(c.out, msg)
 		if err != nil {
 			return 0, err
 		}
-		err = c.buf.Flush()
+		err = c.out.Flush()
 		if err != nil {
 			return 0, err
 		}
-		c.cr = newChunkedReader(c.buf)
+		c.stats.sentContinue()
+		cr := newChunkedReader(c.buf.Reader)
+		cr.stats = c.stats
+		c.cr = cr
+		if c.compression != nil {
+			c.cr = c.compression.newReader(cr)
+		}
 	}
 
 	return c.cr.Read(p)
 }
+
+// BodyBytes returns the number of bytes of the encapsulated body that
+// have been read from the client so far, not counting the preview or
+// the chunk framing. Once the body has been consumed, it is the size
+// of the rest of the body after the preview.
+func (req *Request) BodyBytes() int64 {
+	return req.bodyBytes.Load()
+}
+
+// A bodyCounter counts the bytes read from an encapsulated body, and
+// notes when it ends.
+type bodyCounter struct {
+	r   io.Reader
+	req *Request
+}
+
+func (c *bodyCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.req.bodyBytes.Add(int64(n))
+	if err == io.EOF {
+		c.req.bodyEnd.CompareAndSwap(0, time.Now().UnixNano())
+	}
+	return n, err
+}
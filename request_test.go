@@ -5,7 +5,12 @@
 package icap
 
 import (
+	"bufio"
 	"io"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -24,7 +29,6 @@ func TestRequestModification(t *testing.T) {
 		handleRequestModification)
 
 	expectedResp := "ICAP/1.0 200 OK\r\n" +
-		"Connection: close\r\n" +
 		"Date: Mon, 10 Jan 2000 09:55:21 GMT\r\n" +
 		"Encapsulated: req-hdr=0, req-body=163\r\n" +
 		"Server: ICAP-Test-Server/1.0\r\n" +
@@ -56,6 +60,277 @@ func handleRequestModification(w ResponseWriter, req *Request) {
 	req.Request.Header.Set("Via", "1.0 icap-server.net (ICAP Test Server)")
 
 	// Return the modified request
-	w.WriteHeader(200, req.Request, true)
+	w.WriteHeader(StatusOK, req.Request, true)
 	io.Copy(w, req.Request.Body)
 }
+
+func TestBypassTunnels(t *testing.T) {
+	httpHdr := "CONNECT www.example.com:443 HTTP/1.1\r\n" +
+		"Host: www.example.com:443\r\n" +
+		"\r\n"
+	request := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Allow: 204\r\n" +
+		"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr
+
+	tunnels := make(chan string, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			t.Error("handler called for bypassed tunnel")
+		}),
+		BypassTunnels: true,
+		OnTunnel: func(req *Request) {
+			tunnels <- req.Request.Host
+		},
+	}
+
+	resp := roundTrip(t, srv, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 No Modifications\r\n") {
+		t.Errorf("expected 204 for CONNECT request:\n%s", resp)
+	}
+	if host := <-tunnels; host != "www.example.com:443" {
+		t.Errorf("OnTunnel got host %q", host)
+	}
+}
+
+func TestAllows204AfterPreview(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	request := func(allow string) string {
+		return "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Preview: 4\r\n" + allow +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr +
+			"4\r\nsome\r\n0\r\n\r\n" +
+			"b\r\n body text.\r\n0\r\n\r\n"
+	}
+
+	for _, tc := range []struct {
+		name     string
+		allow    string
+		readBody bool
+		want     string
+	}{
+		{"preview only", "", false, "ICAP/1.0 204 "},
+		{"past the preview", "", true, "ICAP/1.0 100 Continue\r\n\r\nICAP/1.0 200 OK\r\n"},
+		{"past the preview with Allow: 204", "Allow: 204\r\n", true, "ICAP/1.0 100 Continue\r\n\r\nICAP/1.0 204 "},
+	} {
+		srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			if tc.readBody {
+				if _, err := req.BufferedBody(1 << 10); err != nil {
+					t.Error(err)
+				}
+			}
+			Unmodified(w, req)
+		})}
+		resp := roundTrip(t, srv, request(tc.allow))
+		if !strings.HasPrefix(resp, tc.want) {
+			t.Errorf("%s: want a response starting with %q:\n%s", tc.name, tc.want, resp)
+		}
+		if strings.Contains(tc.want, " 200 ") && !strings.HasSuffix(resp, "\r\nf\r\nsome body text.\r\n0\r\n\r\n") {
+			t.Errorf("%s: body not echoed:\n%q", tc.name, resp)
+		}
+	}
+}
+
+func TestExtensionMethod(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("/svc", func(w ResponseWriter, req *Request) {
+		w.Header().Set("X-Handler", "generic")
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	mux.HandleMethod("LOG", "/svc", HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("X-Handler", "log")
+		w.WriteHeader(StatusNoContent, nil, false)
+	}))
+	srv := &Server{Handler: mux}
+
+	resp := roundTrip(t, srv, "LOG icap://icap.example.net/svc ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: null-body=0\r\n\r\n")
+	if !strings.Contains(resp, "X-Handler: log\r\n") {
+		t.Errorf("LOG request not routed to its handler:\n%s", resp)
+	}
+
+	resp = roundTrip(t, srv, "OPTIONS icap://icap.example.net/svc ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n\r\n")
+	if !strings.Contains(resp, "X-Handler: generic\r\n") {
+		t.Errorf("OPTIONS request not routed to the generic handler:\n%s", resp)
+	}
+
+	resp = roundTrip(t, srv, "L@G icap://icap.example.net/svc ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n\r\n")
+	if resp != "" {
+		t.Errorf("request with invalid method was served:\n%s", resp)
+	}
+}
+
+func TestLenientDialect(t *testing.T) {
+	httpHdr := "GET /index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	request := "reqmod  icap://icap.example.net/reqmod\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: NULL-BODY=" + strconv.Itoa(len(httpHdr)) + ",req-hdr=0\r\n" +
+		"\r\n" + httpHdr
+
+	_, err := readRequest(bufio.NewReadWriter(bufio.NewReader(strings.NewReader(request)), nil), StrictDialect{})
+	if err == nil {
+		t.Error("strict dialect accepted a malformed request")
+	}
+
+	req, err := readRequest(bufio.NewReadWriter(bufio.NewReader(strings.NewReader(request)), nil), LenientDialect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != "REQMOD" || req.Proto != "ICAP/1.0" {
+		t.Errorf("request line parsed as %q %q", req.Method, req.Proto)
+	}
+	if req.Request == nil || req.Request.Host != "www.example.com" || req.hasBody {
+		t.Errorf("encapsulated request not parsed: %+v", req.Request)
+	}
+
+	var problems []string
+	for _, d := range req.Diagnostics {
+		problems = append(problems, d.Problem)
+	}
+	want := []string{
+		"missing protocol version",
+		"method not in upper case",
+		"irregular separators or spacing",
+		"section name not in lower case",
+		"sections out of order",
+	}
+	if !reflect.DeepEqual(problems, want) {
+		t.Errorf("diagnostics = %q, want %q", problems, want)
+	}
+
+	diagnosed := make(chan Diagnostics, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		Dialect: LenientDialect{},
+		Trace: &ServerTrace{
+			Diagnostics: func(req *Request) { diagnosed <- req.Diagnostics },
+		},
+	}
+	resp := roundTrip(t, srv, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Errorf("unexpected response:\n%s", resp)
+	}
+	if d := <-diagnosed; len(d) != len(want) {
+		t.Errorf("Diagnostics hook got %v", d)
+	}
+}
+
+func TestTrailingHeaderSection(t *testing.T) {
+	httpHdr := "GET /index.html HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	request := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: req-hdr=0\r\n" +
+		"\r\n" + httpHdr + "OPTIONS"
+	b := bufio.NewReader(strings.NewReader(request))
+	req, err := ReadRequest(bufio.NewReadWriter(b, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Request == nil || req.Request.Host != "www.example.com" {
+		t.Errorf("header without a following section not read: %+v", req.Request)
+	}
+	if rest, _ := io.ReadAll(b); string(rest) != "OPTIONS" {
+		t.Errorf("header section read too far; left %q", rest)
+	}
+}
+
+func TestHeaderIPs(t *testing.T) {
+	req := &Request{Header: textproto.MIMEHeader{
+		"X-Client-Ip": {"[2001:db8::1]"},
+		"X-Server-Ip": {"::ffff:192.0.2.7"},
+	}}
+	if ip, ok := req.ClientIP(); !ok || ip.String() != "2001:db8::1" {
+		t.Errorf("ClientIP() = %v, %v", ip, ok)
+	}
+	if ip, ok := req.ServerIP(); !ok || ip.String() != "192.0.2.7" {
+		t.Errorf("ServerIP() = %v, %v", ip, ok)
+	}
+}
+
+func TestAuthenticatedUser(t *testing.T) {
+	req := &Request{Header: textproto.MIMEHeader{
+		"X-Authenticated-User":   {"V2luTlQ6Ly9FWEFNUExFL2FsaWNl"}, // WinNT://EXAMPLE/alice
+		"X-Authenticated-Groups": {"TG9jYWw6Ly9zdGFmZiwgTG9jYWw6Ly9raWRz"},
+	}}
+	if u := req.AuthenticatedUser(); u != "EXAMPLE/alice" {
+		t.Errorf("AuthenticatedUser() = %q", u)
+	}
+	if g := req.AuthenticatedGroups(); !reflect.DeepEqual(g, []string{"staff", "kids"}) {
+		t.Errorf("AuthenticatedGroups() = %q", g)
+	}
+
+	req.Header.Set("X-Authenticated-User", "bob")
+	req.Header.Del("X-Authenticated-Groups")
+	if u := req.AuthenticatedUser(); u != "bob" {
+		t.Errorf("plain AuthenticatedUser() = %q", u)
+	}
+	if g := req.AuthenticatedGroups(); g != nil {
+		t.Errorf("AuthenticatedGroups() without header = %q", g)
+	}
+}
+
+func TestRequestSizes(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n"
+	header := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Preview: 4\r\n" +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr
+	request := header + "4\r\nsome\r\n0\r\n\r\n" + "8\r\n content\r\n0\r\n\r\n"
+
+	type sizes struct{ header, preview, body int64 }
+	got := make(chan sizes, 2)
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		io.Copy(io.Discard, req.Response.Body)
+		got <- sizes{req.HeaderBytes, req.PreviewBytes, req.BodyBytes()}
+		if req.ParseDuration <= 0 {
+			t.Errorf("ParseDuration = %v", req.ParseDuration)
+		}
+		w.WriteHeader(StatusNoContent, nil, false)
+	})}
+	roundTrip(t, srv, request+request)
+	for i := 0; i < 2; i++ {
+		if s := <-got; s != (sizes{int64(len(header)), 4, 8}) {
+			t.Errorf("request %d: sizes = %+v, want header %d, preview 4, body 8", i, s, len(header))
+		}
+	}
+}
+
+func TestServicePath(t *testing.T) {
+	type seen struct {
+		path, istag string
+		server      *Server
+	}
+	got := make(chan seen, 1)
+	record := HandlerFunc(func(w ResponseWriter, req *Request) {
+		got <- seen{req.ServicePath, req.DefaultISTag(), req.Server()}
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	mux := NewServeMux()
+	mux.Handle("/scan/", record)
+	mux.Handle("icap.example.net/log", record)
+
+	for _, tc := range []struct{ url, want string }{
+		{"icap://icap.example.net/scan/av", "/scan/"},
+		{"icap://icap.example.net/log", "icap.example.net/log"},
+	} {
+		srv := &Server{Handler: mux, HeaderPolicy: &HeaderPolicy{ISTag: StaticISTag("v1")}}
+		roundTrip(t, srv, "OPTIONS "+tc.url+" ICAP/1.0\r\nHost: icap.example.net\r\n\r\n")
+		s := <-got
+		if s.path != tc.want || s.istag != `"v1"` || s.server != srv {
+			t.Errorf("%s: ServicePath = %q, DefaultISTag = %q, Server = %p; want %q, %q, %p", tc.url, s.path, s.istag, s.server, tc.want, `"v1"`, srv)
+		}
+	}
+}
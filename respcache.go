@@ -0,0 +1,261 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Caching of adapted RESPMOD responses.
+
+package icap
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A ResponseCache is a Handler that remembers how Handler adapted each
+// HTTP response passed to it in a RESPMOD request, and answers later
+// requests for the same content without running Handler again.
+//
+// Responses are identified by their URL, their validator (the ETag
+// header, or else Last-Modified), and the service's current ISTag, so
+// changing the ISTag when the adaptation rules change makes every cached
+// result stale. Responses without a validator, with Cache-Control:
+// no-store, or with a body larger than MaxBodySize are not cached, nor
+// are ICAP responses other than 200 and 204.
+type ResponseCache struct {
+	Handler Handler
+
+	// ISTag supplies the current ISTag. If nil, the ISTag of the server's
+	// HeaderPolicy is used; if there is none, nothing is cached.
+	ISTag ISTagProvider
+
+	// MaxEntries limits the number of cached responses.
+	// If zero, 1000 is used.
+	MaxEntries int
+
+	// MaxBodySize is the largest adapted body that is cached.
+	// If zero, 1 MB is used.
+	MaxBodySize int64
+
+	// TTL, if positive, limits how long a response is cached.
+	TTL time.Duration
+
+	cache  atomic.Pointer[Cache[string, *cachedResponse]]
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// ResponseCacheStats describes the activity of a ResponseCache.
+type ResponseCacheStats struct {
+	Entries int
+	Hits    uint64
+	Misses  uint64
+}
+
+// A cachedResponse is a recorded ICAP response.
+type cachedResponse struct {
+	unmodified bool // the handler sent 204 No Modifications
+	header     http.Header
+	status     int
+	respHeader http.Header
+	hasBody    bool
+	body       []byte
+}
+
+// Stats returns statistics about the cache.
+func (c *ResponseCache) Stats() ResponseCacheStats {
+	return ResponseCacheStats{
+		Entries: c.lru().Len(),
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+	}
+}
+
+func (c *ResponseCache) lru() *Cache[string, *cachedResponse] {
+	if l := c.cache.Load(); l != nil {
+		return l
+	}
+	max := c.MaxEntries
+	if max <= 0 {
+		max = 1000
+	}
+	c.cache.CompareAndSwap(nil, NewCache[string, *cachedResponse](max, c.TTL))
+	return c.cache.Load()
+}
+
+// ServeICAP answers req from the cache if possible, and otherwise passes
+// it to c.Handler and caches the result.
+func (c *ResponseCache) ServeICAP(w ResponseWriter, req *Request) {
+	h := c.Handler
+	if h == nil {
+		h = NotFoundHandler()
+	}
+	key, tag := c.key(req)
+	if key == "" {
+		h.ServeICAP(w, req)
+		return
+	}
+
+	if cr, ok := c.lru().Get(key); ok {
+		c.hits.Add(1)
+		cr.replay(w, req)
+		return
+	}
+	c.misses.Add(1)
+
+	rec := &recordingWriter{ResponseWriter: w, max: c.maxBodySize()}
+	h.ServeICAP(rec, req)
+	if cr := rec.result(tag); cr != nil {
+		c.lru().Add(key, cr)
+	}
+}
+
+func (c *ResponseCache) maxBodySize() int64 {
+	if c.MaxBodySize <= 0 {
+		return 1 << 20
+	}
+	return c.MaxBodySize
+}
+
+// key returns the cache key for req and the current ISTag,
+// or "" if the response in req is not cacheable.
+func (c *ResponseCache) key(req *Request) (key, tag string) {
+	if req.Method != "RESPMOD" || req.Response == nil {
+		return "", ""
+	}
+	p := c.ISTag
+	if p == nil {
+		if hp := req.server.headerPolicy(); hp != nil {
+			p = hp.ISTag
+		}
+	}
+	if p == nil {
+		return "", ""
+	}
+	tag = strings.Trim(p.ISTag(req), `"`)
+
+	resp := req.Response
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	if validator == "" || resp.Request == nil || resp.Request.URL == nil {
+		return "", ""
+	}
+	for _, v := range resp.Header.Values("Cache-Control") {
+		if strings.Contains(strings.ToLower(v), "no-store") {
+			return "", ""
+		}
+	}
+	return strings.Join([]string{tag, validator, strconv.Itoa(resp.StatusCode), resp.Request.URL.String()}, "\x00"), tag
+}
+
+// replay sends a cached response.
+func (cr *cachedResponse) replay(w ResponseWriter, req *Request) {
+	for k, vv := range cr.header {
+		w.Header()[k] = append([]string(nil), vv...)
+	}
+	if cr.unmodified {
+		Unmodified(w, req)
+		return
+	}
+	hr := req.Request
+	if req.Response != nil {
+		hr = req.Response.Request
+	}
+	resp := &http.Response{
+		StatusCode: cr.status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     cr.respHeader.Clone(),
+		Request:    hr,
+	}
+	w.WriteHeader(StatusOK, resp, cr.hasBody)
+	if cr.hasBody {
+		w.Write(cr.body)
+	}
+}
+
+// A recordingWriter passes a response through to the client and records
+// it for a ResponseCache.
+type recordingWriter struct {
+	ResponseWriter
+	max       int64
+	code      int
+	header    http.Header
+	resp      *http.Response
+	hasBody   bool
+	body      bytes.Buffer
+	cacheable bool
+}
+
+func (w *recordingWriter) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	if w.code == 0 {
+		w.code = code
+		w.header = w.Header().Clone()
+		w.hasBody = hasBody
+		switch msg := httpMessage.(type) {
+		case *http.Response:
+			w.resp = &http.Response{StatusCode: msg.StatusCode, Header: msg.Header.Clone()}
+			w.cacheable = code == StatusOK
+		case nil:
+			w.cacheable = code == StatusNoContent
+		}
+	}
+	w.ResponseWriter.WriteHeader(code, httpMessage, hasBody)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.WriteHeader(StatusOK, nil, true)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil || int64(w.body.Len()+n) > w.max {
+		w.cacheable = false
+	} else if w.cacheable {
+		w.body.Write(p[:n])
+	}
+	return n, err
+}
+
+func (w *recordingWriter) WriteRaw(s string) {
+	w.cacheable = false
+	w.ResponseWriter.WriteRaw(s)
+}
+
+// SetBodyMode passes the body mode on to the underlying writer.
+func (w *recordingWriter) SetBodyMode(mode BodyMode) {
+	SetBodyMode(w.ResponseWriter, mode)
+}
+
+func (w *recordingWriter) addWriteLimiter(l *rateLimiter) {
+	if lw, ok := w.ResponseWriter.(interface{ addWriteLimiter(*rateLimiter) }); ok {
+		lw.addWriteLimiter(l)
+	}
+}
+
+// result returns the recorded response, or nil if it can't be cached.
+// A response whose ISTag doesn't match tag was generated under
+// different rules, and is not cached.
+func (w *recordingWriter) result(tag string) *cachedResponse {
+	if !w.cacheable {
+		return nil
+	}
+	if t := w.header.Get("ISTag"); t != "" && strings.Trim(t, `"`) != tag {
+		return nil
+	}
+	cr := &cachedResponse{header: w.header}
+	if w.code == StatusNoContent {
+		cr.unmodified = true
+		return cr
+	}
+	cr.status = w.resp.StatusCode
+	cr.respHeader = w.resp.Header
+	cr.hasBody = w.hasBody
+	cr.body = w.body.Bytes()
+	return cr
+}
@@ -0,0 +1,65 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResponseCache(t *testing.T) {
+	request := func(etag string) string {
+		httpHdr := "HTTP/1.1 200 OK\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"ETag: " + etag + "\r\n" +
+			"\r\n"
+		return "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"X-Icap-Request-Url: http://www.example.com/page.txt\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr +
+			"5\r\nhello\r\n0\r\n\r\n"
+	}
+
+	var calls atomic.Int32
+	upper := HandlerFunc(func(w ResponseWriter, req *Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(req.Response.Body)
+		req.Response.Header.Set("X-Adapted", "yes")
+		w.WriteHeader(StatusOK, req.Response, true)
+		w.Write([]byte(strings.ToUpper(string(body))))
+	})
+	tag := StaticISTag("rules-1")
+	cache := &ResponseCache{Handler: upper}
+	srv := &Server{Handler: cache, HeaderPolicy: &HeaderPolicy{ISTag: &tag}}
+
+	first := roundTrip(t, srv, request(`"v1"`))
+	second := roundTrip(t, srv, request(`"v1"`))
+	for _, resp := range []string{first, second} {
+		if !strings.Contains(resp, "X-Adapted: yes\r\n") || !strings.Contains(resp, "\r\n5\r\nHELLO\r\n") ||
+			!strings.Contains(resp, "Istag: \"rules-1\"\r\n") {
+			t.Errorf("unexpected response:\n%s", resp)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+
+	// A new version of the content, or new rules, need the handler again.
+	roundTrip(t, srv, request(`"v2"`))
+	tag = "rules-2"
+	roundTrip(t, srv, request(`"v1"`))
+	if n := calls.Load(); n != 3 {
+		t.Errorf("handler called %d times, want 3", n)
+	}
+
+	stats := cache.Stats()
+	if stats.Entries != 3 || stats.Hits != 1 || stats.Misses != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
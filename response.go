@@ -14,8 +14,10 @@ import (
 	"log"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,7 +29,7 @@ type ResponseWriter interface {
 	Header() http.Header
 
 	// Write writes the data to the connection as part of an ICAP reply.
-	// If WriteHeader has not yet been called, Write calls WriteHeader(http.StatusOK, nil)
+	// If WriteHeader has not yet been called, Write calls WriteHeader(StatusOK, nil)
 	// before writing the data.
 	Write([]byte) (int, error)
 
@@ -36,18 +38,188 @@ type ResponseWriter interface {
 
 	// WriteHeader sends an ICAP response header with status code.
 	// Then it sends an HTTP header if httpMessage is not nil.
-	// httpMessage may be an *http.Request or an *http.Response.
+	// httpMessage may be an *http.Request or an *http.Response; a REQMOD
+	// request may be answered with either (an *http.Response satisfies
+	// the request, as Respond does), but a RESPMOD request only with an
+	// *http.Response, and an OPTIONS request with neither.
 	// hasBody should be true if there will be calls to Write(), generating a message body.
+	// Pass false to send headers only. hasBody is ignored for ICAP responses
+	// and HTTP responses that cannot have a body (see BodyAllowed).
 	WriteHeader(code int, httpMessage interface{}, hasBody bool)
 }
 
+// ErrBodyNotAllowed is returned by ResponseWriter.Write calls
+// when the ICAP status or the encapsulated HTTP response does not permit a body.
+var ErrBodyNotAllowed = errors.New("icap: response status or request method does not permit a body")
+
+// ErrNoBody is returned by ResponseWriter.Write calls when WriteHeader
+// was called with hasBody false, so the response has a null-body.
+var ErrNoBody = errors.New("icap: Write called on a response sent without a body")
+
+// ErrHeaderWritten is reported when WriteHeader is called after the
+// response header has been written.
+var ErrHeaderWritten = errors.New("icap: WriteHeader called more than once")
+
+// BodyAllowed reports whether resp may carry a body:
+// 1xx, 204 and 304 responses, and responses to HEAD requests, may not.
+func BodyAllowed(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode >= 100 && resp.StatusCode < 200,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	case resp.Request != nil && resp.Request.Method == http.MethodHead:
+		return false
+	}
+	return true
+}
+
 type respWriter struct {
-	conn        *conn          // information on the connection
-	req         *Request       // the request that is being responded to
-	header      http.Header    // the ICAP header to write for the response
-	wroteHeader bool           // true if the headers have already been written
-	wroteRaw    bool           // true if raw data was written to the connection
-	cw          io.WriteCloser // the chunked writer used to write the body
+	conn        *conn             // information on the connection
+	out         *orderedWriter    // where to write the response
+	req         *Request          // the request that is being responded to
+	header      http.Header       // the ICAP header to write for the response
+	wroteHeader bool              // true if the headers have already been written
+	wroteRaw    bool              // true if raw data was written to the connection
+	noBody      bool              // true if the response may not have a body
+	bodyMode    BodyMode          // how to set the Content-Length of the HTTP message
+	modeSet     bool              // true if SetBodyMode has been called
+	deferred    *deferredHeader   // the header held back in BodyBuffered mode
+	buffered    *bytes.Buffer     // the body held back in BodyBuffered mode
+	memErr      *MemoryLimitError // set if the buffered body exceeded its budget
+	cw          io.WriteCloser    // the chunked writer used to write the body
+	limiters    []*rateLimiter    // limits on the rate of writing the body
+	err         error             // returned by Write after a misused WriteHeader
+	status      int               // the ICAP status code sent
+	closeConn   bool              // true if the connection is to be closed after the response
+
+	handlerTimer    *time.Timer // for Server.HandlerTimeout
+	handlerTimedOut atomic.Bool
+}
+
+// Unmodified replies that the encapsulated message should be used as is.
+// It sends 204 No Modifications if the client allows it; otherwise it
+// echoes the original message back in a 200 response.
+func Unmodified(w ResponseWriter, req *Request) {
+	req.Audit().defaultVerdict(VerdictAllow, "")
+	if req.Allows204() {
+		w.WriteHeader(StatusNoContent, nil, false)
+		return
+	}
+	writeMessage(w, req)
+}
+
+// Error replies to the request with the ICAP status code and no
+// encapsulated message, like http.Error. msg, if not empty, is sent in an
+// X-ICAP-Error header and, for error codes, recorded as the reason in the
+// audit record. Like other responses, the reply gets its ISTag from the
+// server's HeaderPolicy. The handler should not write to w afterwards.
+func Error(w ResponseWriter, code int, msg string) {
+	if msg != "" {
+		w.Header().Set("X-ICAP-Error", strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' {
+				return ' '
+			}
+			return r
+		}, msg))
+	}
+	if rw, ok := w.(*respWriter); ok && IsError(code) {
+		rw.req.Audit().defaultVerdict(VerdictError, msg)
+	}
+	w.WriteHeader(code, nil, false)
+}
+
+// writeMessage sends the encapsulated message of req, with any changes the
+// handler has made, in a 200 response.
+func writeMessage(w ResponseWriter, req *Request) {
+	if req.handOff(w) {
+		return
+	}
+	var msg interface{}
+	var body io.Reader
+	switch {
+	case req.Method == "REQMOD" && req.Request != nil:
+		msg, body = req.Request, req.Request.Body
+	case req.Method == "RESPMOD" && req.Response != nil:
+		msg, body = req.Response, req.Response.Body
+	}
+	w.WriteHeader(StatusOK, msg, msg != nil && req.hasBody)
+	if msg != nil && req.hasBody {
+		if _, err := io.Copy(w, body); err != nil {
+			log.Printf("icap: error copying body: %v", err)
+		}
+	}
+}
+
+// Respond replaces the encapsulated message of req with resp, and copies
+// resp's body, if any, to the response. For REQMOD, this is request
+// satisfaction (RFC 3507, section 3.1): the client sends resp to its user
+// instead of forwarding the request to the origin server. For RESPMOD,
+// resp replaces the origin server's response.
+//
+// If resp.Request is nil, it is set to the encapsulated HTTP request, so
+// that no body is sent in answer to HEAD. A response without a body that
+// could have one is given a Content-Length of 0. resp's body is closed.
+func Respond(w ResponseWriter, req *Request, resp *http.Response) {
+	if resp.Body != nil {
+		defer resp.Body.Close()
+	}
+	if resp.Request == nil {
+		resp.Request = req.Request
+		if req.Response != nil && req.Response.Request != nil {
+			resp.Request = req.Response.Request
+		}
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if req.Method == "REQMOD" {
+		req.Audit().defaultVerdict(VerdictBlock, "")
+	} else {
+		req.Audit().defaultVerdict(VerdictModify, "")
+	}
+
+	hasBody := bodyPresent(resp.Body) && BodyAllowed(resp)
+	if hasBody && resp.ContentLength == 0 {
+		// Unknown, rather than empty: keep any Content-Length header.
+		resp.ContentLength = -1
+	}
+	if !hasBody && BodyAllowed(resp) && resp.Header.Get("Content-Length") == "" {
+		resp.Header.Set("Content-Length", "0")
+	}
+	w.WriteHeader(StatusOK, resp, hasBody)
+	if hasBody {
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.Printf("icap: error copying body: %v", err)
+		}
+	}
+}
+
+// writeBlockPage replaces the encapsulated message with a plain-text
+// HTTP response with status code and body msg. If code doesn't allow a
+// body, msg is ignored.
+func writeBlockPage(w ResponseWriter, code int, msg string) {
+	resp := &http.Response{
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":   {"text/plain; charset=utf-8"},
+			"Content-Length": {strconv.Itoa(len(msg))},
+			"Cache-Control":  {"no-store"},
+		},
+	}
+	if !BodyAllowed(resp) {
+		// A stub response, such as 204 No Content.
+		resp.Header = http.Header{"Cache-Control": {"no-store"}}
+		w.WriteHeader(StatusOK, resp, false)
+		return
+	}
+	w.WriteHeader(StatusOK, resp, true)
+	if _, err := io.WriteString(w, msg); err != nil {
+		log.Printf("icap: error writing block page: %v", err)
+	}
 }
 
 func (w *respWriter) Header() http.Header {
@@ -56,90 +228,252 @@ func (w *respWriter) Header() http.Header {
 
 func (w *respWriter) Write(p []byte) (n int, err error) {
 	if !w.wroteHeader {
-		w.WriteHeader(http.StatusOK, nil, true)
+		w.WriteHeader(StatusOK, nil, true)
 	}
 
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.memErr != nil {
+		return 0, w.memErr
+	}
+	if w.buffered != nil {
+		if err := w.req.reserve(int64(len(p))); err != nil {
+			w.memErr = err
+			return 0, err
+		}
+		return w.buffered.Write(p)
+	}
 	if w.cw == nil {
-		return 0, errors.New("called Write() on an icap.ResponseWriter that should not have a body")
+		if w.noBody {
+			return 0, w.misuse(ErrBodyNotAllowed)
+		}
+		return 0, w.misuse(ErrNoBody)
 	}
 	return w.cw.Write(p)
 }
 
+// misuse reports a call that would corrupt the response, and returns err.
+// If the server's StrictWriter is set, it panics instead, so that the
+// faulty handler is found in testing.
+func (w *respWriter) misuse(err error) error {
+	if w.conn.server != nil && w.conn.server.StrictWriter {
+		panic(err)
+	}
+	return err
+}
+
 func (w *respWriter) WriteRaw(p string) {
-	bw := w.conn.buf.Writer
+	bw := w.out
 	if _, err := io.WriteString(bw, p); err != nil {
 		log.Printf("Error writing to buffer: %v", err)
 	}
 	w.wroteRaw = true
 }
 
+// A deferredHeader is a WriteHeader call held back until the body is complete.
+type deferredHeader struct {
+	code int
+	msg  interface{}
+}
+
+// SetBodyMode sets the BodyMode for the next WriteHeader call.
+func (w *respWriter) SetBodyMode(mode BodyMode) {
+	w.bodyMode = mode
+	w.modeSet = true
+}
+
 func (w *respWriter) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	w.stopHandlerTimer()
 	if w.wroteHeader {
-		log.Println("Called WriteHeader twice on the same connection")
+		log.Print(w.misuse(ErrHeaderWritten))
+		return
+	}
+
+	// Send a Server Error rather than a malformed response.
+	if code < 100 || code > 999 {
+		w.err = fmt.Errorf("icap: invalid status code %d", code)
+	}
+	switch httpMessage.(type) {
+	case nil:
+	case *http.Request:
+		if w.req.Method == "RESPMOD" || w.req.Method == "OPTIONS" {
+			w.err = fmt.Errorf("icap: WriteHeader called with an HTTP request in response to %s", w.req.Method)
+		}
+	case *http.Response:
+		if w.req.Method == "OPTIONS" {
+			w.err = errors.New("icap: WriteHeader called with an HTTP response in response to OPTIONS")
+		}
+	default:
+		w.err = fmt.Errorf("icap: WriteHeader called with unsupported message type %T", httpMessage)
+	}
+	if w.err != nil {
+		log.Print(w.misuse(w.err))
+		code, httpMessage, hasBody = StatusInternalServerError, nil, false
+	}
+
+	if code != StatusContinue {
+		w.status = code
+	}
+	if resp, ok := httpMessage.(*http.Response); (ok && !BodyAllowed(resp)) || code == StatusContinue || code == StatusNoContent {
+		w.noBody = true
+		hasBody = false
+	}
+
+	if !w.modeSet && w.conn.server != nil {
+		w.bodyMode = w.conn.server.BodyMode
+	}
+	if hasBody && httpMessage != nil && w.bodyMode == BodyBuffered {
+		w.wroteHeader = true
+		w.deferred = &deferredHeader{code, httpMessage}
+		w.buffered = new(bytes.Buffer)
 		return
 	}
 
+	w.writeHeader(code, httpMessage, hasBody)
+}
+
+// closesConn reports whether the connection is to be closed after a
+// response: when the server is refusing the transaction because of an
+// error (and has set closeConn), when it is shutting down and no other
+// request is waiting, when the client or the handler asked for it, or
+// when the rest of the request's body would be left unread (see
+// UnreadBodyPolicy). Otherwise it is kept open for the client's next
+// request.
+func (w *respWriter) closesConn(hasBody bool) bool {
+	srv := w.conn.server
+	if w.closeConn || srv.shuttingDown() && w.conn.buf.Reader.Buffered() == 0 {
+		return true
+	}
+	for _, h := range []textproto.MIMEHeader{w.req.Header, textproto.MIMEHeader(w.header)} {
+		for _, v := range splitList(h, "Connection") {
+			if strings.EqualFold(v, "close") {
+				return true
+			}
+		}
+	}
+
+	req := w.req
+	if srv == nil || hasBody || !req.hasBody || req.bodyEnd.Load() != 0 || req.rawBody == nil {
+		return false
+	}
+	if req.continuer != nil && req.continuer.cr == nil {
+		// The rest of the body won't be sent (see finishBody).
+		return false
+	}
+	if srv.UnreadBody == UnreadBodyClose {
+		return true
+	}
+	n := req.declaredSize()
+	return n >= 0 && n-int64(len(req.Preview))-req.BodyBytes() > srv.maxUnreadBody()
+}
+
+// writeHeader writes the ICAP response header and the encapsulated HTTP header.
+func (w *respWriter) writeHeader(code int, httpMessage interface{}, hasBody bool) {
 	// Make the HTTP header and the Encapsulated: header.
 	var header []byte
-	var encap string
+	var encap []Section
 	var err error
 
 	switch msg := httpMessage.(type) {
 	case *http.Request:
-		header, err = httpRequestHeader(msg)
+		keepLength := false
+		if hasBody {
+			keepLength = fixContentLength(msg.Header, msg.ContentLength, w.bodyMode)
+		}
+		if header = w.unmodifiedHeader(msg); header == nil {
+			header, err = httpRequestHeader(msg, w.headerOrder(msg), keepLength)
+		}
 		if err != nil {
 			break
 		}
 		if hasBody {
-			encap = fmt.Sprintf("req-hdr=0, req-body=%d", len(header))
+			encap = []Section{{"req-hdr", 0}, {"req-body", len(header)}}
 		} else {
-			encap = fmt.Sprintf("req-hdr=0, null-body=%d", len(header))
+			encap = []Section{{"req-hdr", 0}, {"null-body", len(header)}}
 		}
 
 	case *http.Response:
-		header, err = httpResponseHeader(msg)
+		if hasBody {
+			fixContentLength(msg.Header, msg.ContentLength, w.bodyMode)
+		}
+		if header = w.unmodifiedHeader(msg); header == nil {
+			header, err = httpResponseHeader(msg, w.headerOrder(msg))
+		}
 		if err != nil {
 			break
 		}
 		if hasBody {
-			encap = fmt.Sprintf("res-hdr=0, res-body=%d", len(header))
+			encap = []Section{{"res-hdr", 0}, {"res-body", len(header)}}
 		} else {
-			encap = fmt.Sprintf("res-hdr=0, null-body=%d", len(header))
+			encap = []Section{{"res-hdr", 0}, {"null-body", len(header)}}
 		}
 	}
 
-	if encap == "" {
+	if encap == nil {
 		if hasBody {
 			method := w.req.Method
 			if len(method) > 3 {
 				method = method[0:3]
 			}
 			method = strings.ToLower(method)
-			encap = fmt.Sprintf("%s-body=0", method)
+			encap = []Section{{method + "-body", 0}}
 		} else {
-			encap = "null-body=0"
+			encap = []Section{{"null-body", 0}}
 		}
 	}
 
-	w.header.Set("Encapsulated", encap)
-	if _, ok := w.header["Date"]; !ok {
-		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	d := w.conn.server.dialect()
+	value := d.FormatEncapsulated(encap)
+	if err == nil {
+		err = verifyEncapsulated(d, value, encap, header)
+	}
+	if err != nil {
+		// Send a Server Error rather than a message the client would
+		// misparse.
+		w.err = fmt.Errorf("icap: can't write encapsulated message: %v", err)
+		log.Print(w.misuse(w.err))
+		code, header, hasBody = StatusInternalServerError, nil, false
+		encap = []Section{{"null-body", 0}}
+		value = d.FormatEncapsulated(encap)
 	}
 
-	w.header.Set("Connection", "close")
+	if p := w.conn.server.headerPolicy(); p != nil {
+		p.apply(w.req, w.header)
+	}
+	if tag := w.header.Get("ISTag"); tag != "" && w.req.maintenance {
+		w.header.Set("ISTag", maintenanceTag(tag))
+	}
+	w.header.Set("Encapsulated", value)
+	// Every response carries an RFC 1123 Date unless the handler set one.
+	if w.header.Get("Date") == "" {
+		w.header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	if w.closesConn(hasBody) {
+		w.closeConn = true
+		w.header.Set("Connection", "close")
+	}
+	if hasBody && w.req.compression != nil {
+		w.header.Set(CompressionHeader, w.req.compression.token())
+	}
 	if w.req.Method == "REQMOD" && w.req.Header.Get("X-Original-Url") != "" {
 		w.header.Set("X-Original-Url", w.req.Header.Get("X-Original-Url"))
 	} else if w.req.Method == "RESPMOD" && w.req.Header.Get("X-Icap-Request-Url") != "" {
 		w.header.Set("X-Icap-Request-Url", w.req.Header.Get("X-Icap-Request-Url"))
 	}
 
-	bw := w.conn.buf.Writer
+	bw := w.out
 	status := StatusText(code)
 	if status == "" {
 		status = fmt.Sprintf("status code %d", code)
 	}
 	fmt.Fprintf(bw, "ICAP/1.0 %d %s\r\n", code, status)
-	if err := w.header.Write(bw); err != nil {
+	writeHeader := w.header.Write
+	if w.conn.server.compat().RFCHeaderCase {
+		writeHeader = func(bw io.Writer) error { return writeRFCHeader(bw, w.header) }
+	}
+	if err := writeHeader(bw); err != nil {
 		log.Printf("Error writing header: %v", err)
 	}
 	if _, err := io.WriteString(bw, "\r\n"); err != nil {
@@ -155,29 +489,153 @@ func (w *respWriter) WriteHeader(code int, httpMessage interface{}, hasBody bool
 	w.wroteHeader = true
 
 	if hasBody {
-		w.cw = httputil.NewChunkedWriter(w.conn.buf.Writer)
+		w.cw = httputil.NewChunkedWriter(w.bodyWriter())
+		if z := w.req.compression; z != nil {
+			w.cw = z.newWriter(w.cw)
+		}
+	}
+}
+
+// verifyEncapsulated checks that value, the Encapsulated header formatted
+// from sections, describes header, the serialized HTTP header block that
+// follows the ICAP header. An offset that is wrong by even one byte makes
+// the client split the message in the wrong place, so it is checked by
+// parsing value again rather than trusting the computation.
+func verifyEncapsulated(d Dialect, value string, sections []Section, header []byte) error {
+	parsed, err := d.ParseEncapsulated(value, nil)
+	if err != nil {
+		return fmt.Errorf("Encapsulated header %q doesn't parse: %v", value, err)
+	}
+	if len(parsed) != len(sections) {
+		return fmt.Errorf("Encapsulated header %q has %d sections, want %d", value, len(parsed), len(sections))
+	}
+	for i, s := range parsed {
+		if s != sections[i] {
+			return fmt.Errorf("Encapsulated header %q has %s=%d, want %s=%d", value, s.Name, s.Offset, sections[i].Name, sections[i].Offset)
+		}
+	}
+
+	last := parsed[len(parsed)-1]
+	if last.Offset != len(header) {
+		return fmt.Errorf("Encapsulated header %q puts the %s at %d, but the HTTP header is %d bytes", value, last.Name, last.Offset, len(header))
+	}
+	if len(header) > 0 {
+		if !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+			return errors.New("HTTP header doesn't end with a blank line")
+		}
+		if i := bytes.Index(header, []byte("\r\n\r\n")); i != len(header)-4 {
+			return fmt.Errorf("HTTP header contains a blank line at byte %d", i+2)
+		}
+	}
+	return nil
+}
+
+// bodyWriter returns the writer for the chunks of the body, which applies
+// any limits on the rate of writing.
+func (w *respWriter) bodyWriter() io.Writer {
+	limiters := append([]*rateLimiter(nil), w.limiters...)
+	if l := w.conn.server.serverWriteLimiter(); l != nil {
+		limiters = append(limiters, l)
+	}
+	if w.conn.writeLimit != nil {
+		limiters = append(limiters, w.conn.writeLimit)
 	}
+	if len(limiters) == 0 {
+		return w.out
+	}
+	return &limitedWriter{w: w.out, limiters: limiters}
+}
+
+// addWriteLimiter adds a limit on the rate of writing the body.
+// It is used by LimitWriteRate.
+func (w *respWriter) addWriteLimiter(l *rateLimiter) {
+	w.limiters = append(w.limiters, l)
+}
+
+// headerOrder returns the received header order to follow when writing msg,
+// or nil if msg should be written in net/http's canonical form.
+func (w *respWriter) headerOrder(msg interface{}) RawHeader {
+	if w.conn.server == nil || !w.conn.server.PreserveHeaderOrder {
+		return nil
+	}
+	switch msg := msg.(type) {
+	case *http.Request:
+		if msg == w.req.Request {
+			return w.req.RawRequestHeader
+		}
+	case *http.Response:
+		if msg == w.req.Response {
+			return w.req.RawResponseHeader
+		}
+	}
+	return nil
+}
+
+// unmodifiedHeader returns the header block of msg as it was received,
+// if passthrough is enabled and msg is an original message that the handler
+// has not changed. Otherwise it returns nil.
+func (w *respWriter) unmodifiedHeader(msg interface{}) []byte {
+	if w.conn.server == nil || !w.conn.server.PassthroughUnmodified {
+		return nil
+	}
+	switch msg := msg.(type) {
+	case *http.Request:
+		if msg == w.req.Request && w.req.reqSnapshot.unmodified(requestStart(msg), msg.Header) {
+			return w.req.reqSnapshot.raw
+		}
+	case *http.Response:
+		if msg == w.req.Response && w.req.respSnapshot.unmodified(responseStart(msg), msg.Header) {
+			return w.req.respSnapshot.raw
+		}
+	}
+	return nil
 }
 
 func (w *respWriter) finishRequest() {
 	if !w.wroteHeader {
-		w.WriteHeader(http.StatusOK, nil, false)
+		w.WriteHeader(StatusOK, nil, false)
+	}
+
+	if w.memErr != nil && w.deferred != nil {
+		w.abortMemory(w.memErr)
+	}
+
+	if d := w.deferred; d != nil {
+		body := w.buffered
+		w.deferred, w.buffered = nil, nil
+		switch msg := d.msg.(type) {
+		case *http.Request:
+			msg.ContentLength = int64(body.Len())
+		case *http.Response:
+			msg.ContentLength = int64(body.Len())
+		}
+		w.writeHeader(d.code, d.msg, true)
+		if _, err := w.cw.Write(body.Bytes()); err != nil {
+			log.Printf("Error writing body: %v", err)
+		}
 	}
 
 	if w.cw != nil && !w.wroteRaw {
 		w.cw.Close()
 		w.cw = nil
-		if _, err := io.WriteString(w.conn.buf, "\r\n"); err != nil {
+		if _, err := io.WriteString(w.out, "\r\n"); err != nil {
 			log.Printf("Error writing to buffer: %v", err)
 		}
 	}
 
-	w.conn.buf.Flush()
+	w.out.finish()
+	if w.conn.server != nil {
+		w.conn.server.stats.response(w.status)
+	}
+	w.recordClientTransaction()
+	w.finishAudit()
 }
 
 // httpRequestHeader returns the headers for an HTTP request
 // as a slice of bytes in a form suitable for including in an ICAP message.
-func httpRequestHeader(req *http.Request) (hdr []byte, err error) {
+// If order is not nil, the header fields follow its order and casing.
+// The Content-Length header is omitted unless keepLength is true.
+func httpRequestHeader(req *http.Request, order RawHeader, keepLength bool) (hdr []byte, err error) {
 	buf := new(bytes.Buffer)
 
 	if req.URL == nil {
@@ -195,10 +653,16 @@ func httpRequestHeader(req *http.Request) (hdr []byte, err error) {
 	uri := req.URL.String()
 
 	fmt.Fprintf(buf, "%s %s %s\r\n", valueOrDefault(req.Method, "GET"), uri, valueOrDefault(req.Proto, "HTTP/1.1"))
-	if err := req.Header.WriteSubset(buf, map[string]bool{
+	exclude := map[string]bool{
 		"Transfer-Encoding": true,
-		"Content-Length":    true,
-	}); err != nil {
+		"Content-Length":    !keepLength,
+	}
+	if order != nil {
+		err = order.write(buf, req.Header, exclude)
+	} else {
+		err = req.Header.WriteSubset(buf, exclude)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("failed to write header: %v", err)
 	}
 	if _, err := io.WriteString(buf, "\r\n"); err != nil {
@@ -210,11 +674,13 @@ func httpRequestHeader(req *http.Request) (hdr []byte, err error) {
 
 // httpResponseHeader returns the headers for an HTTP response
 // as a slice of bytes.
-func httpResponseHeader(resp *http.Response) (hdr []byte, err error) {
+// If order is not nil, the header fields follow its order and casing.
+func httpResponseHeader(resp *http.Response, order RawHeader) (hdr []byte, err error) {
 	buf := new(bytes.Buffer)
 
 	// Status line
-	text := resp.Status
+	// resp.Status may hold the full "200 OK" form that http.ReadResponse produces.
+	text := strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode)+" ")
 	if text == "" {
 		text = http.StatusText(resp.StatusCode)
 		if text == "" {
@@ -226,17 +692,20 @@ func httpResponseHeader(resp *http.Response) (hdr []byte, err error) {
 		proto = "HTTP/1.1"
 	}
 	fmt.Fprintf(buf, "%s %d %s\r\n", proto, resp.StatusCode, text)
+	exclude := map[string]bool{
+		"Transfer-Encoding": true,
+		"Content-Length":    false,
+	}
 	if _, xIcap206Exists := resp.Header["X-Icap-206"]; xIcap206Exists {
-		if err := resp.Header.Write(buf); err != nil {
-			return nil, fmt.Errorf("failed to write header: %v", err)
-		}
+		exclude = nil
+	}
+	if order != nil {
+		err = order.write(buf, resp.Header, exclude)
 	} else {
-		if err := resp.Header.WriteSubset(buf, map[string]bool{
-			"Transfer-Encoding": true,
-			"Content-Length":    false,
-		}); err != nil {
-			return nil, fmt.Errorf("failed to write subset header: %v", err)
-		}
+		err = resp.Header.WriteSubset(buf, exclude)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to write header: %v", err)
 	}
 	if _, err := io.WriteString(buf, "\r\n"); err != nil {
 		return nil, fmt.Errorf("failed to write string: %v", err)
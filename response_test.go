@@ -7,6 +7,8 @@ package icap
 import (
 	"bytes"
 	"io"
+	"net/http"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -28,7 +30,6 @@ func TestRequestModification1(t *testing.T) {
 		handleResponseModification1)
 	resp :=
 		"ICAP/1.0 200 OK\r\n" +
-			"Connection: close\r\n" +
 			"Date: Mon, 10 Jan 2000  09:55:21 GMT\r\n" +
 			"Encapsulated: req-hdr=0, req-body=231\r\n" +
 			"Istag: \"W3E4R7U9-L2E4-2\"\r\n" +
@@ -63,7 +64,7 @@ func handleResponseModification1(w ResponseWriter, req *Request) {
 	body, _ := io.ReadAll(req.Request.Body)
 	newBody := string(body) + "  ICAP powered!"
 
-	w.WriteHeader(200, req.Request, true)
+	w.WriteHeader(StatusOK, req.Request, true)
 	io.WriteString(w, newBody)
 }
 
@@ -111,7 +112,7 @@ func handleResponseModification2(w ResponseWriter, req *Request) {
 	_, err := req.Response.Body.Read(originalBody)
 	if err != nil {
 		// Handle error
-		w.WriteHeader(500, nil, false)
+		w.WriteHeader(StatusInternalServerError, nil, false)
 		return
 	}
 
@@ -129,6 +130,233 @@ func handleResponseModification2(w ResponseWriter, req *Request) {
 	}
 
 	// Return the modified response
-	w.WriteHeader(200, req.Response, true)
+	w.WriteHeader(StatusOK, req.Response, true)
 	w.Write(modifiedBody)
 }
+
+// A 304 must be re-emitted with null-body even if the handler asks for a body.
+func TestNotModifiedHasNoBody(t *testing.T) {
+	httpHdr := "HTTP/1.1 304 Not Modified\r\n" +
+		"Etag: \"abc\"\r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr +
+		"0\r\n\r\n"
+
+	var writeErr error
+	done := make(chan struct{})
+	handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+		defer close(done)
+		w.WriteHeader(StatusOK, req.Response, true)
+		_, writeErr = w.Write([]byte("bogus"))
+	})
+
+	resp := roundTrip(t, &Server{Handler: handler}, request)
+	<-done
+	if !strings.Contains(resp, "Encapsulated: res-hdr=0, null-body=") {
+		t.Errorf("expected null-body in response:\n%q", resp)
+	}
+	if !strings.HasSuffix(resp, "\r\n\r\nHTTP/1.1 304 Not Modified\r\nEtag: \"abc\"\r\n\r\n") {
+		t.Errorf("unexpected data after the HTTP header:\n%q", resp)
+	}
+	if writeErr != ErrBodyNotAllowed {
+		t.Errorf("Write returned %v, want ErrBodyNotAllowed", writeErr)
+	}
+}
+
+func TestError(t *testing.T) {
+	records := make(chan *AuditRecord, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			Error(w, StatusServiceUnavailable, "scanner\r\nunavailable")
+		}),
+		HeaderPolicy: &HeaderPolicy{ISTag: StaticISTag(`"v1"`)},
+		Audit:        func(r *AuditRecord) { records <- r },
+	}
+	resp := roundTrip(t, srv, "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: null-body=0\r\n\r\n")
+	for _, want := range []string{"ICAP/1.0 503 ", "Istag: \"v1\"\r\n", "X-Icap-Error: scanner  unavailable\r\n", "Encapsulated: null-body=0\r\n"} {
+		if !strings.Contains(resp, want) {
+			t.Errorf("response lacks %q:\n%s", want, resp)
+		}
+	}
+	if r := <-records; r.Verdict != VerdictError || r.Reason != "scanner\r\nunavailable" {
+		t.Errorf("audit record: verdict %q, reason %q", r.Verdict, r.Reason)
+	}
+}
+
+func TestBodyModes(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 5\r\n" +
+		"\r\n"
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr +
+		"5\r\nhello\r\n0\r\n\r\n"
+
+	handler := func(mode BodyMode) Handler {
+		return HandlerFunc(func(w ResponseWriter, req *Request) {
+			SetBodyMode(w, mode)
+			w.WriteHeader(StatusOK, req.Response, true)
+			io.Copy(w, req.Response.Body)
+			io.WriteString(w, ", world")
+		})
+	}
+
+	resp := roundTrip(t, &Server{Handler: handler(BodyBuffered)}, request)
+	if !strings.HasSuffix(resp, "HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\nc\r\nhello, world\r\n0\r\n\r\n") {
+		t.Errorf("buffered body should have an exact Content-Length:\n%q", resp)
+	}
+
+	resp = roundTrip(t, &Server{Handler: handler(BodyStream)}, request)
+	if strings.Contains(resp, "Content-Length") {
+		t.Errorf("streamed body should have no Content-Length:\n%q", resp)
+	}
+}
+
+func TestWriterMisuse(t *testing.T) {
+	request := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: null-body=0\r\n" +
+		"\r\n"
+
+	var writeErr, bodyErr error
+	resp := roundTrip(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusNoContent, nil, false)
+		w.WriteHeader(StatusOK, nil, true)
+		_, writeErr = io.WriteString(w, "junk")
+	})}, request)
+	if strings.Count(resp, "ICAP/1.0") != 1 || strings.Contains(resp, "junk") {
+		t.Errorf("misused writer produced a corrupt response:\n%q", resp)
+	}
+	if writeErr != ErrBodyNotAllowed {
+		t.Errorf("Write after 204: got %v, want ErrBodyNotAllowed", writeErr)
+	}
+
+	resp = roundTrip(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(42, "not a message", true)
+		_, bodyErr = io.WriteString(w, "junk")
+	})}, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 500 ") || strings.Contains(resp, "junk") {
+		t.Errorf("invalid WriteHeader should send a Server Error:\n%q", resp)
+	}
+	if bodyErr == nil {
+		t.Error("Write after an invalid WriteHeader succeeded")
+	}
+
+	var panicked interface{}
+	roundTrip(t, &Server{StrictWriter: true, Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		defer func() { panicked = recover() }()
+		w.WriteHeader(StatusOK, nil, false)
+		w.Write([]byte("junk"))
+	})}, request)
+	if panicked != ErrNoBody {
+		t.Errorf("StrictWriter: got panic %v, want ErrNoBody", panicked)
+	}
+}
+
+func TestRespond(t *testing.T) {
+	request := func(method string) string {
+		hdr := method + " http://www.example.com/private HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+		return "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(hdr)) + "\r\n" +
+			"\r\n" + hdr
+	}
+	srv := &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("ISTag", `"respond"`)
+		Respond(w, req, &http.Response{
+			StatusCode: http.StatusForbidden,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(strings.NewReader("forbidden")),
+		})
+	})}
+
+	resp := roundTrip(t, srv, request("GET"))
+	httpHdr := "HTTP/1.1 403 Forbidden\r\nContent-Type: text/plain\r\n\r\n"
+	if !strings.HasPrefix(resp, "ICAP/1.0 200 ") ||
+		!strings.Contains(resp, "Encapsulated: res-hdr=0, res-body="+strconv.Itoa(len(httpHdr))+"\r\n") ||
+		!strings.HasSuffix(resp, httpHdr+"9\r\nforbidden\r\n0\r\n\r\n") {
+		t.Errorf("request satisfaction:\n%s", resp)
+	}
+	if findings := Lint([]byte(resp)); len(findings) > 0 {
+		t.Errorf("response has problems: %v", findings)
+	}
+
+	// The answer to HEAD has no body.
+	resp = roundTrip(t, srv, request("HEAD"))
+	if !strings.Contains(resp, "Encapsulated: res-hdr=0, null-body=") || strings.Contains(resp, "forbidden") {
+		t.Errorf("request satisfaction for HEAD:\n%s", resp)
+	}
+
+	// An HTTP request can't be the answer to RESPMOD.
+	respHdr := "HTTP/1.1 200 OK\r\n\r\n"
+	resp = roundTrip(t, &Server{Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusOK, req.Request, false)
+	})}, "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: res-hdr=0, null-body="+strconv.Itoa(len(respHdr))+"\r\n"+
+		"\r\n"+respHdr)
+	if !strings.HasPrefix(resp, "ICAP/1.0 500 ") {
+		t.Errorf("HTTP request in a RESPMOD response should send a Server Error:\n%s", resp)
+	}
+
+	// An extension method may echo the HTTP request it carries.
+	mux := NewServeMux()
+	mux.HandleMethod("LOG", "/log", HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusOK, req.Request, false)
+	}))
+	reqHdr := "GET http://www.example.com/ HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	resp = roundTrip(t, &Server{Handler: mux}, "LOG icap://icap.example.net/log ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: req-hdr=0, null-body="+strconv.Itoa(len(reqHdr))+"\r\n"+
+		"\r\n"+reqHdr)
+	if !strings.HasPrefix(resp, "ICAP/1.0 200 ") || !strings.Contains(resp, "GET http://www.example.com/ HTTP/1.1\r\n") {
+		t.Errorf("HTTP request in answer to an extension method:\n%s", resp)
+	}
+}
+
+// skewedDialect formats Encapsulated offsets one byte too far.
+type skewedDialect struct{ StrictDialect }
+
+func (d skewedDialect) FormatEncapsulated(sections []Section) string {
+	skewed := make([]Section, len(sections))
+	for i, s := range sections {
+		skewed[i] = Section{s.Name, s.Offset + i}
+	}
+	return d.StrictDialect.FormatEncapsulated(skewed)
+}
+
+func TestVerifyEncapsulated(t *testing.T) {
+	request := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: req-hdr=0, null-body=41\r\n" +
+		"\r\n" +
+		"GET / HTTP/1.1\r\n" +
+		"Host: www.example.com\r\n" +
+		"\r\n"
+	var writeErr error
+	srv := &Server{Dialect: skewedDialect{}, Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+		req.Request.Header.Set("X-Adapted", "yes")
+		w.WriteHeader(StatusOK, req.Request, true)
+		_, writeErr = io.WriteString(w, "body")
+	})}
+	resp := roundTrip(t, srv, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 500 ") || strings.Contains(resp, "X-Adapted") {
+		t.Errorf("mismatched Encapsulated offsets should give a Server Error:\n%q", resp)
+	}
+	if writeErr == nil {
+		t.Error("Write succeeded after a mismatched Encapsulated header")
+	}
+
+	if err := verifyEncapsulated(StrictDialect{}, "req-hdr=0, req-body=4", []Section{{"req-hdr", 0}, {"req-body", 4}}, []byte("a\r\n\r\n")); err == nil {
+		t.Error("offset shorter than the header was not detected")
+	}
+	if err := verifyEncapsulated(StrictDialect{}, "req-hdr=0, req-body=7", []Section{{"req-hdr", 0}, {"req-body", 7}}, []byte("a\r\n\r\nb\r\n")); err == nil {
+		t.Error("header without a final blank line was not detected")
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package safesearch enforces SafeSearch on search engines and restricted
+// mode on YouTube.
+//
+// An Enforcer is a REQMOD handler. It adds the parameters that turn on
+// SafeSearch to the query strings of searches on Google, Bing, DuckDuckGo,
+// Yahoo and Yandex, and adds the YouTube-Restrict header to requests to
+// YouTube. Searches over HTTPS can only be changed if the ICAP client
+// decrypts them.
+//
+// The settings can differ from user to user: a Resolver chooses them for
+// each request, for example from the user and groups that the ICAP client
+// reports (see Policy).
+package safesearch
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/intra-sh/icap"
+)
+
+// A YouTubeMode is a level of YouTube restricted mode.
+type YouTubeMode int
+
+const (
+	YouTubeUnrestricted YouTubeMode = iota
+	YouTubeModerate
+	YouTubeStrict
+)
+
+// Settings choose what an Enforcer enforces.
+type Settings struct {
+	SafeSearch bool // enforce SafeSearch on search engines
+	YouTube    YouTubeMode
+}
+
+// A Resolver chooses the settings for a request.
+type Resolver interface {
+	Resolve(req *icap.Request) Settings
+}
+
+// An Enforcer is an icap.Handler, and an icap.Stage, that enforces
+// SafeSearch and YouTube restricted mode on REQMOD requests.
+type Enforcer struct {
+	// Resolver chooses the settings for each request. If nil, Default is
+	// used for every request.
+	Resolver Resolver
+	Default  Settings
+}
+
+// ServeICAP enforces the settings for req.
+func (e *Enforcer) ServeICAP(w icap.ResponseWriter, req *icap.Request) {
+	p := icap.Pipeline{Stages: []icap.Stage{e}}
+	p.ServeICAP(w, req)
+}
+
+// Process enforces the settings for req on its encapsulated HTTP request.
+func (e *Enforcer) Process(req *icap.Request) (icap.StageResult, error) {
+	hr := req.Request
+	if req.Method != "REQMOD" || hr == nil || hr.URL == nil {
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	}
+	s := e.Default
+	if e.Resolver != nil {
+		s = e.Resolver.Resolve(req)
+	}
+
+	host := hr.URL.Hostname()
+	if host == "" {
+		host = hr.Host
+		if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+			host = host[:i]
+		}
+	}
+	host = icap.CanonicalHost(host)
+
+	modified := false
+	if s.SafeSearch {
+		modified = enforceSearch(hr.URL, host)
+	}
+	if s.YouTube != YouTubeUnrestricted && isYouTube(host) {
+		v := "Moderate"
+		if s.YouTube == YouTubeStrict {
+			v = "Strict"
+		}
+		hr.Header.Set("YouTube-Restrict", v)
+		modified = true
+	}
+	if modified {
+		return icap.StageResult{Action: icap.ActionModify}, nil
+	}
+	return icap.StageResult{Action: icap.ActionContinue}, nil
+}
+
+// A searchEngine describes how to turn on SafeSearch for a search engine.
+type searchEngine struct {
+	match func(host string) bool
+	path  string // the path of searches, or "" for any path
+	param string
+	value string
+}
+
+var searchEngines = []searchEngine{
+	{domainWithTLD("google"), "/search", "safe", "active"},
+	{domainWithTLD("bing"), "/search", "adlt", "strict"},
+	{exactDomain("duckduckgo.com"), "", "kp", "1"},
+	{exactDomain("search.yahoo.com"), "/search", "vm", "r"},
+	{domainWithTLD("yandex"), "/search/", "family", "yes"},
+}
+
+// enforceSearch adds the SafeSearch parameter to u if it is a search on
+// one of searchEngines. It reports whether u was changed.
+func enforceSearch(u *url.URL, host string) bool {
+	for _, se := range searchEngines {
+		if !se.match(host) {
+			continue
+		}
+		if se.path != "" && u.Path != se.path && u.Path != strings.TrimSuffix(se.path, "/") {
+			return false
+		}
+		q := u.Query()
+		if q.Get(se.param) == se.value && len(q[se.param]) == 1 {
+			return false
+		}
+		q.Set(se.param, se.value)
+		u.RawQuery = q.Encode()
+		return true
+	}
+	return false
+}
+
+// domainWithTLD matches name under any top-level domain (or two-level
+// country domain, such as co.uk), with or without a www prefix.
+func domainWithTLD(name string) func(host string) bool {
+	return func(host string) bool {
+		host = strings.TrimPrefix(host, "www.")
+		rest, ok := strings.CutPrefix(host, name+".")
+		return ok && rest != "" && strings.Count(rest, ".") <= 1
+	}
+}
+
+// exactDomain matches domain, with or without a www prefix.
+func exactDomain(domain string) func(host string) bool {
+	return func(host string) bool {
+		return strings.TrimPrefix(host, "www.") == domain
+	}
+}
+
+// youTubeHosts are the hosts to which the YouTube-Restrict header applies.
+var youTubeHosts = map[string]bool{
+	"youtube.com":              true,
+	"www.youtube.com":          true,
+	"m.youtube.com":            true,
+	"music.youtube.com":        true,
+	"youtubei.googleapis.com":  true,
+	"youtube.googleapis.com":   true,
+	"youtube-nocookie.com":     true,
+	"www.youtube-nocookie.com": true,
+}
+
+func isYouTube(host string) bool {
+	return youTubeHosts[host]
+}
+
+// A Policy is a Resolver that chooses settings by the user and groups
+// that the ICAP client reports in the X-Authenticated-User and
+// X-Authenticated-Groups headers. The settings for the user take
+// precedence over those for the first of the user's groups that is listed,
+// which take precedence over Default.
+type Policy struct {
+	Users   map[string]Settings
+	Groups  map[string]Settings
+	Default Settings
+}
+
+// Resolve returns the settings for the user making req.
+func (p *Policy) Resolve(req *icap.Request) Settings {
+	if s, ok := p.Users[req.AuthenticatedUser()]; ok {
+		return s
+	}
+	for _, g := range req.AuthenticatedGroups() {
+		if s, ok := p.Groups[g]; ok {
+			return s
+		}
+	}
+	return p.Default
+}
@@ -0,0 +1,73 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package safesearch
+
+import (
+	"net/http"
+	"net/textproto"
+	"testing"
+
+	"github.com/intra-sh/icap"
+)
+
+func TestEnforcer(t *testing.T) {
+	e := &Enforcer{Default: Settings{SafeSearch: true, YouTube: YouTubeModerate}}
+	for _, tc := range []struct {
+		url, want string
+		youTube   string
+	}{
+		{"http://www.google.com/search?q=cats", "http://www.google.com/search?q=cats&safe=active", ""},
+		{"http://www.google.co.uk/search?q=cats&safe=off", "http://www.google.co.uk/search?q=cats&safe=active", ""},
+		{"http://www.google.com/maps?q=cats", "http://www.google.com/maps?q=cats", ""},
+		{"http://www.bing.com/search?q=cats", "http://www.bing.com/search?adlt=strict&q=cats", ""},
+		{"http://duckduckgo.com/?q=cats", "http://duckduckgo.com/?kp=1&q=cats", ""},
+		{"http://search.yahoo.com/search?p=cats", "http://search.yahoo.com/search?p=cats&vm=r", ""},
+		{"http://notgoogle.com/search?q=cats", "http://notgoogle.com/search?q=cats", ""},
+		{"http://www.youtube.com/watch?v=x", "http://www.youtube.com/watch?v=x", "Moderate"},
+	} {
+		hr, _ := http.NewRequest("GET", tc.url, nil)
+		req := &icap.Request{Method: "REQMOD", Request: hr, Header: textproto.MIMEHeader{}}
+		if _, err := e.Process(req); err != nil {
+			t.Fatal(err)
+		}
+		if got := hr.URL.String(); got != tc.want {
+			t.Errorf("%s: rewritten to %s, want %s", tc.url, got, tc.want)
+		}
+		if got := hr.Header.Get("YouTube-Restrict"); got != tc.youTube {
+			t.Errorf("%s: YouTube-Restrict = %q, want %q", tc.url, got, tc.youTube)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	p := &Policy{
+		Users:   map[string]Settings{"admin": {}},
+		Groups:  map[string]Settings{"kids": {SafeSearch: true, YouTube: YouTubeStrict}},
+		Default: Settings{SafeSearch: true},
+	}
+	e := &Enforcer{Resolver: p}
+	for _, tc := range []struct {
+		user, groups string
+		youTube      string
+	}{
+		{"admin", "kids", ""},
+		{"alice", "Local://kids", "Strict"},
+		{"", "", ""},
+	} {
+		hr, _ := http.NewRequest("GET", "http://www.youtube.com/results?search_query=x", nil)
+		h := textproto.MIMEHeader{}
+		if tc.user != "" {
+			h.Set("X-Authenticated-User", tc.user)
+		}
+		if tc.groups != "" {
+			h.Set("X-Authenticated-Groups", tc.groups)
+		}
+		req := &icap.Request{Method: "REQMOD", Request: hr, Header: h}
+		e.Process(req)
+		if got := hr.Header.Get("YouTube-Restrict"); got != tc.youTube {
+			t.Errorf("user %q, groups %q: YouTube-Restrict = %q, want %q", tc.user, tc.groups, got, tc.youTube)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Checking a server's services before it starts serving.
+
+package icap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// selfTestHost is the host in the URLs of the services that SelfTest
+// checks, other than tenants' services.
+const selfTestHost = "icap.selftest"
+
+// SelfTest checks each service of srv's handler with synthetic requests
+// sent by DryRun: an OPTIONS request, and a REQMOD or RESPMOD request for
+// each of those methods that the OPTIONS response lists. Each response
+// must be free of the problems that Lint finds, OPTIONS must get
+// 200 OK with a Methods header, and REQMOD and RESPMOD must get 200 OK or
+// 204 No Modifications.
+//
+// If the handler is a *ServeMux, its services are its patterns, including
+// method-specific ones and those of its tenants' muxes; otherwise the
+// handler is checked as the single service at "/". SelfTest is meant to
+// be run at startup, so that a misconfigured handler stops the process
+// before it serves clients. It returns an error listing every problem
+// found.
+func (srv *Server) SelfTest(ctx context.Context) error {
+	handler := srv.Handler
+	if handler == nil {
+		handler = DefaultServeMux
+	}
+	var errs []error
+	for _, u := range selfTestServices(handler, selfTestHost) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		errs = append(errs, srv.selfTestService(ctx, u)...)
+	}
+	return errors.Join(errs...)
+}
+
+// selfTestServices returns the URLs of the services of h, addressed to
+// host unless their pattern names another.
+func selfTestServices(h Handler, host string) []string {
+	mux, ok := h.(*ServeMux)
+	if !ok {
+		return []string{"icap://" + host + "/"}
+	}
+	patterns := make(map[string]bool)
+	for p, h := range mux.m {
+		if _, ok := h.(*redirectHandler); ok && mux.m[p+"/"] != nil {
+			// The redirect that Handle added for a subtree.
+			continue
+		}
+		patterns[p] = true
+	}
+	for method, m := range mux.methods {
+		if method != "OPTIONS" && method != "REQMOD" && method != "RESPMOD" {
+			continue
+		}
+		for p := range m {
+			patterns[p] = true
+		}
+	}
+
+	var urls []string
+	for p := range patterns {
+		if strings.HasPrefix(p, "/") {
+			urls = append(urls, "icap://"+host+p)
+		} else {
+			urls = append(urls, "icap://"+p)
+		}
+	}
+	sort.Strings(urls)
+	for tenantHost, t := range mux.tenants {
+		urls = append(urls, selfTestServices(t.Handler, tenantHost)...)
+	}
+	return urls
+}
+
+// selfTestService checks the service at u, and returns the problems found.
+func (srv *Server) selfTestService(ctx context.Context, u string) []error {
+	var errs []error
+	fail := func(method string, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("icap: self-test %s %s: %s", method, u, fmt.Sprintf(format, args...)))
+	}
+
+	req, err := NewRequest("OPTIONS", u, nil, nil)
+	if err != nil {
+		fail("OPTIONS", "%v", err)
+		return errs
+	}
+	resp, err := srv.selfTestRequest(ctx, req, StatusOK)
+	if err != nil {
+		fail("OPTIONS", "%v", err)
+		return errs
+	}
+	methods := splitList(resp.Header, "Methods")
+	if len(methods) == 0 {
+		fail("OPTIONS", "response has no Methods header")
+	}
+
+	for _, method := range methods {
+		var httpReq *http.Request
+		var httpResp *http.Response
+		switch strings.ToUpper(method) {
+		case "REQMOD":
+			httpReq = selfTestHTTPRequest("POST")
+		case "RESPMOD":
+			httpReq = selfTestHTTPRequest("GET")
+			httpResp = &http.Response{
+				Status:        "200 OK",
+				StatusCode:    http.StatusOK,
+				Proto:         "HTTP/1.1",
+				ProtoMajor:    1,
+				ProtoMinor:    1,
+				Header:        http.Header{"Content-Type": {"text/plain"}},
+				Body:          io.NopCloser(strings.NewReader("ICAP self-test response body\n")),
+				ContentLength: -1,
+				Request:       httpReq,
+			}
+		default:
+			continue
+		}
+		req, err := NewRequest(strings.ToUpper(method), u, httpReq, httpResp)
+		if err != nil {
+			fail(method, "%v", err)
+			continue
+		}
+		req.Header.Set("Allow", "204")
+		if _, err := srv.selfTestRequest(ctx, req, StatusOK, StatusNoContent); err != nil {
+			fail(req.Method, "%v", err)
+		}
+	}
+	return errs
+}
+
+// selfTestHTTPRequest returns an HTTP request to be encapsulated in a
+// synthetic ICAP request.
+func selfTestHTTPRequest(method string) *http.Request {
+	var body io.Reader
+	if method == "POST" {
+		body = strings.NewReader("ICAP self-test request body\n")
+	}
+	r, _ := http.NewRequest(method, "http://www.example.com/icap-self-test", body)
+	r.Header.Set("Content-Type", "text/plain")
+	r.ContentLength = -1
+	return r
+}
+
+// selfTestRequest sends req with DryRun, checks that the response has no
+// problems and one of the wanted status codes, and returns the parsed
+// response.
+func (srv *Server) selfTestRequest(ctx context.Context, req *Request, want ...int) (*Response, error) {
+	result, err := srv.DryRun(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if findings := Lint(result.Response); len(findings) > 0 {
+		problems := make([]string, len(findings))
+		for i, f := range findings {
+			problems[i] = f.String()
+		}
+		return nil, fmt.Errorf("invalid response: %s", strings.Join(problems, "; "))
+	}
+	resp, _, err := ParseResponse(result.Response, req)
+	if err != nil {
+		return nil, err
+	}
+	for _, code := range want {
+		if resp.StatusCode == code {
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
@@ -0,0 +1,75 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	service := func(methods string) HandlerFunc {
+		return func(w ResponseWriter, req *Request) {
+			w.Header().Set("ISTag", `"self-test"`)
+			switch req.Method {
+			case "OPTIONS":
+				w.Header().Set("Methods", methods)
+				w.WriteHeader(StatusOK, nil, false)
+			case "REQMOD":
+				w.WriteHeader(StatusOK, req.Request, false)
+			default:
+				w.WriteHeader(StatusNoContent, nil, false)
+			}
+		}
+	}
+
+	mux := NewServeMux()
+	mux.Handle("/reqmod", service("REQMOD"))
+	mux.Handle("/respmod/", service("RESPMOD"))
+	tenant := NewServeMux()
+	tenant.Handle("/both", service("REQMOD, RESPMOD"))
+	mux.HandleTenant("tenant.example.net", &Tenant{Handler: tenant})
+	srv := &Server{Handler: mux}
+	if err := srv.SelfTest(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A service without a Methods header, one that fails on RESPMOD,
+	// and one that sends no ISTag.
+	mux.Handle("/nomethods", HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("ISTag", `"self-test"`)
+		w.WriteHeader(StatusOK, nil, false)
+	}))
+	mux.Handle("/broken", HandlerFunc(func(w ResponseWriter, req *Request) {
+		if req.Method == "RESPMOD" {
+			w.Header().Set("ISTag", `"self-test"`)
+			w.WriteHeader(StatusInternalServerError, nil, false)
+			return
+		}
+		service("RESPMOD")(w, req)
+	}))
+	mux.Handle("/notag", HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("Methods", "REQMOD")
+		w.WriteHeader(StatusOK, nil, false)
+	}))
+	err := srv.SelfTest(context.Background())
+	if err == nil {
+		t.Fatal("misconfigured services passed")
+	}
+	msg := err.Error()
+	for _, want := range []string{
+		"OPTIONS icap://icap.selftest/nomethods: response has no Methods header",
+		"RESPMOD icap://icap.selftest/broken: unexpected status 500",
+		"OPTIONS icap://icap.selftest/notag: invalid response",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("error %q does not mention %q", msg, want)
+		}
+	}
+	if strings.Contains(msg, "/reqmod") || strings.Contains(msg, "tenant.example.net") {
+		t.Errorf("error mentions a working service: %q", msg)
+	}
+}
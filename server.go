@@ -9,12 +9,19 @@ package icap
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/netip"
 	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -41,18 +48,42 @@ func (f HandlerFunc) ServeICAP(w ResponseWriter, r *Request) {
 // A conn represents the server side of an ICAP connection.
 type conn struct {
 	remoteAddr string            // network address of remote side
+	server     *Server           // the Server on which the connection arrived
 	handler    Handler           // request handler
 	rwc        net.Conn          // i/o connection
 	buf        *bufio.ReadWriter // buffered rwc
+	bytesIn    *countingReader   // counts the bytes read from rwc
+
+	netConn    net.Conn     // rwc, kept after close for Shutdown
+	created    time.Time    // when the connection was accepted
+	state      atomic.Int32 // the connection's ConnState
+	writeLimit *rateLimiter // for ConnWriteBytesPerSecond
+	client     *clientEntry // statistics on the remote address, if tracked
+	responses  responseQueue
+	reader     *connReader        // applies BodyReadTimeout and MaxHeaderBytes
+	detached   bool               // not counted among the server's connections (see DryRun)
+	auditSink  func(*AuditRecord) // if not nil, receives audit records instead of the Audit hook
+	previewOf  *Request           // the last request, if its body after the preview wasn't asked for (see skipRemainder)
 }
 
 // Create new connection from rwc.
-func newConn(rwc net.Conn, handler Handler) (c *conn, err error) {
+func newConn(rwc net.Conn, srv *Server, handler Handler) (c *conn, err error) {
 	c = new(conn)
 	c.remoteAddr = rwc.RemoteAddr().String()
+	if ap, ok := addrPort(rwc.RemoteAddr()); ok {
+		c.remoteAddr = ap.String()
+	}
+	c.server = srv
 	c.handler = handler
 	c.rwc = rwc
-	br := bufio.NewReader(rwc)
+	c.netConn = rwc
+	c.created = time.Now()
+	if srv.ConnWriteBytesPerSecond > 0 {
+		c.writeLimit = newRateLimiter(srv.ConnWriteBytesPerSecond, srv.WriteBurst)
+	}
+	c.reader = newConnReader(rwc)
+	c.bytesIn = &countingReader{r: c.reader}
+	br := bufio.NewReader(c.bytesIn)
 	bw := bufio.NewWriter(rwc)
 	c.buf = bufio.NewReadWriter(br, bw)
 
@@ -60,9 +91,34 @@ func newConn(rwc net.Conn, handler Handler) (c *conn, err error) {
 }
 
 // Read next request from connection.
-func (c *conn) readRequest() (w *respWriter, err error) {
+func (c *conn) readRequest(out *orderedWriter) (w *respWriter, err error) {
 	var req *Request
-	if req, err = ReadRequest(c.buf); err != nil {
+	var head []byte
+	if t := c.server.trace(); t != nil && t.BadRequest != nil {
+		buffered, _ := c.buf.Reader.Peek(c.buf.Reader.Buffered())
+		head = append(head, buffered...)
+	}
+	start := time.Now()
+	c.limitHeader()
+	req, err = readRequestWith(c.buf, c.server.dialect(), requestOptions{
+		consumed:       c.consumed,
+		stats:          &c.server.stats,
+		looseIEOF:      c.server.compat().LooseIEOF,
+		compression:    c.server.Compression,
+		out:            out,
+		maxHeaderBytes: c.server.maxHeaderBytes(),
+		headerRead:     c.headerRead,
+	})
+	c.headerRead()
+	if rerr := c.reader.readError(); err != nil && rerr != nil {
+		err = rerr
+	}
+	c.server.stats.request(req, err)
+	if err != nil {
+		if err != io.EOF {
+			c.server.trace().badRequest(c.rwc, head, err)
+			c.client.transaction(true, 0, 0)
+		}
 		return nil, err
 	}
 
@@ -70,15 +126,45 @@ func (c *conn) readRequest() (w *respWriter, err error) {
 		req = new(Request)
 	} else {
 		req.RemoteAddr = c.remoteAddr
+		req.server = c.server
+		req.ParseDuration = time.Since(start)
+		req.start = start
+		req.ctx, req.cancelCtx = newRequestContext(req)
+		if c.server.Audit != nil || c.auditSink != nil {
+			req.audit = new(AuditRecord)
+		}
+		c.server.trace().diagnostics(req)
+		if len(c.server.BodyHashes) > 0 {
+			req.HashBody(c.server.BodyHashes...)
+		}
 	}
 
 	w = new(respWriter)
 	w.conn = c
+	w.out = out
 	w.req = req
 	w.header = make(http.Header)
 	return w, err
 }
 
+// consumed returns the number of bytes of the connection that have been
+// parsed: those read from it, less those still buffered.
+func (c *conn) consumed() int64 {
+	return c.bytesIn.n.Load() - int64(c.buf.Reader.Buffered())
+}
+
+// A countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
 // Close the connection.
 func (c *conn) close() {
 	if c.buf != nil {
@@ -87,7 +173,19 @@ func (c *conn) close() {
 	}
 	if c.rwc != nil {
 		c.rwc.Close()
+		c.setState(StateClosed)
 		c.rwc = nil
+		if c.server != nil && !c.detached {
+			c.server.connClosed(c)
+		}
+	}
+}
+
+// setState reports a change of the connection's state to the ConnState hook.
+func (c *conn) setState(state ConnState) {
+	c.state.Store(int32(state))
+	if c.server != nil && c.server.ConnState != nil && c.rwc != nil {
+		c.server.ConnState(c.rwc, state)
 	}
 }
 
@@ -98,41 +196,488 @@ func (c *conn) serve(debugLevel int) {
 		if err == nil {
 			return
 		}
+		if err == ErrAbortHandler {
+			c.close()
+			return
+		}
 
 		var buf bytes.Buffer
 		fmt.Fprintf(&buf, "icap: panic serving %v: %v\n", c.remoteAddr, err)
 		buf.Write(debug.Stack())
 		log.Print(buf.String())
+		c.close()
 	}()
-	for {
-		var w *respWriter
-		w, err := c.readRequest()
-		// In a case of parsing error there should be an option to handle a dummy request to not fail the whole service.
-		if w == nil {
-			c.rwc.Close()
-
+	if !c.handshake() {
+		c.close()
+		return
+	}
+	for first := true; ; first = false {
+		// Wait for the first byte of the next request before
+		// considering the connection active.
+		if !first {
+			c.reader.idle.Store(0)
+			if d := c.server.idleTimeout(); d != 0 {
+				c.rwc.SetReadDeadline(time.Now().Add(d))
+			} else {
+				c.rwc.SetReadDeadline(time.Time{})
+			}
+		}
+		if _, err := c.buf.Reader.Peek(1); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && !first {
+				c.server.trace().idleTimeout(c.rwc)
+			}
 			break
 		}
-		if err != nil {
-			log.Println("error while reading request:", err)
-			c.rwc.Close()
+		c.setState(StateActive)
+		if !c.serveTransaction() {
+			break
+		}
+		c.setState(StateIdle)
+		if c.server.shuttingDown() && c.buf.Reader.Buffered() == 0 {
+			// Requests that are already pipelined are handled
+			// according to DrainPolicy.
 			break
 		}
+	}
+
+	c.close()
+}
+
+// serveTransaction reads and serves a single request. It reports whether
+// the connection can be used for further transactions.
+func (c *conn) serveTransaction() bool {
+	if d := c.client.throttleDelay(); d > 0 {
+		time.Sleep(d)
+	}
+	c.setDeadlines()
+	defer c.watchTransaction()()
+	draining := c.server.shuttingDown()
+	if !c.skipRemainder() {
+		return false
+	}
+
+	out := c.responses.next(c.buf.Writer)
+	defer out.finish()
+
+	var w *respWriter
+	w, err := c.readRequest(out)
+	// In a case of parsing error there should be an option to handle a dummy request to not fail the whole service.
+	if w == nil {
+		c.rwc.Close()
+		return false
+	}
+	if err != nil {
+		log.Println("error while reading request:", err)
+		c.rwc.Close()
+		return false
+	}
+	c.setBodyDeadline(w.req.start)
+
+	if err := w.req.reserve(w.req.headerSize()); err != nil {
+		defer w.req.cleanup()
+		w.abortMemory(err)
+		w.finishRequest()
+		return false
+	}
+
+	if draining && c.server.DrainPolicy == DrainReject {
+		defer w.req.cleanup()
+		w.closeConn = true
+		w.WriteHeader(StatusServiceUnavailable, nil, false)
+		w.finishRequest()
+		return false
+	}
+
+	if c.server.PreviewMismatch == PreviewMismatchReject && w.req.PreviewMismatch() {
+		defer w.req.cleanup()
+		w.closeConn = true
+		Error(w, StatusBadRequest, fmt.Sprintf("preview of %d bytes, but Preview: %s", w.req.ReceivedPreview(), w.req.Header.Get("Preview")))
+		w.finishRequest()
+		return false
+	}
+
+	return c.serveRequest(w)
+}
+
+// setDeadlines sets the read and write deadlines for a transaction
+// that is about to begin.
+func (c *conn) setDeadlines() {
+	if c.server == nil {
+		return
+	}
+	c.reader.idle.Store(0)
+	c.rwc.SetReadDeadline(time.Now().Add(c.server.readHeaderTimeout()))
+	if d := c.server.WriteTimeout; d != 0 {
+		c.rwc.SetWriteDeadline(time.Now().Add(d))
+	}
+}
 
+// serveRequest runs the handler for a single transaction.
+// It reports whether the connection can be used for further transactions.
+func (c *conn) serveRequest(w *respWriter) bool {
+	defer w.req.cleanup()
+
+	if w.req.IsTunnel() && c.server.tunnel(w, w.req) {
+		w.finishRequest()
+		return !w.closeConn
+	}
+
+	run := func() {
+		w.startHandlerTimer()
 		c.handler.ServeICAP(w, w.req)
+		w.stopHandlerTimer()
+		if !w.wroteHeader && w.handlerTimedOut.Load() {
+			w.WriteHeader(StatusServiceUnavailable, nil, false)
+		}
+		if !w.wroteHeader && w.req.bodyTooLarge.Load() {
+			// The rest of the body is left unread.
+			w.closeConn = true
+			w.WriteHeader(StatusRequestEntityTooLarge, nil, false)
+		}
 		w.finishRequest()
 	}
+	p := c.server.workerPool()
+	if p == nil {
+		run()
+		return c.finishBody(w.req) && !w.closeConn
+	}
+	if p.do(run, c.server.OverflowPolicy) {
+		return c.finishBody(w.req) && !w.closeConn
+	}
+	if !w.wroteHeader {
+		// Rejected because of OverflowReject, or the handler panicked
+		// before responding. The request body may be left unread,
+		// so the connection can't be reused.
+		w.closeConn = true
+		w.WriteHeader(StatusServiceUnavailable, nil, false)
+		w.finishRequest()
+	}
+	return false
+}
 
-	c.close()
+// A ConnState represents the state of a client connection to a server.
+// It is used by the optional Server.ConnState hook.
+type ConnState int
+
+const (
+	// StateNew represents a new connection that is expected to
+	// send a request immediately.
+	StateNew ConnState = iota
+
+	// StateActive represents a connection that has read one or more
+	// bytes of a request. The ConnState hook for StateActive fires
+	// before the request is parsed and the handler runs.
+	StateActive
+
+	// StateIdle represents a connection that has finished handling
+	// a request and is waiting for the next one.
+	StateIdle
+
+	// StateClosed represents a closed connection.
+	// This is a terminal state.
+	StateClosed
+)
+
+var stateName = map[ConnState]string{
+	StateNew:    "new",
+	StateActive: "active",
+	StateIdle:   "idle",
+	StateClosed: "closed",
+}
+
+func (c ConnState) String() string {
+	return stateName[c]
 }
 
 // A Server defines parameters for running an ICAP server.
 type Server struct {
-	Addr         string  // TCP address to listen on, ":1344" if empty
-	Handler      Handler // handler to invoke
+	Addr    string  // TCP address to listen on, ":1344" if empty
+	Handler Handler // handler to invoke
+
+	// ReadTimeout and WriteTimeout limit the time spent reading and
+	// writing each transaction, from the first byte of its request.
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
-	DebugLevel   int
+
+	// IdleTimeout is how long to wait for the next request on a
+	// connection once a transaction is complete. It never interrupts
+	// a transaction in progress. If zero, ReadTimeout is used.
+	IdleTimeout time.Duration
+
+	// ReadHeaderTimeout limits the time spent reading the headers and
+	// preview of a request, from its first byte. Slow senders of headers
+	// are usually attacks, while slow uploads of bodies are legitimate,
+	// so it is best kept shorter than the time allowed for a body.
+	// If zero, ReadTimeout is used, or a minute if that is zero too.
+	ReadHeaderTimeout time.Duration
+
+	// TLSHandshakeTimeout limits the time a TLS client may take to
+	// complete its handshake, so that half-open clients don't hold
+	// connections open. If zero, the smaller of ReadHeaderTimeout (or
+	// its default) and WriteTimeout is used.
+	TLSHandshakeTimeout time.Duration
+
+	// MaxHeaderBytes limits the size of the ICAP header and the
+	// encapsulated HTTP headers of a request. A client that sends more
+	// is disconnected before any handler runs. If zero,
+	// DefaultMaxHeaderBytes is used.
+	MaxHeaderBytes int
+
+	// BodyReadTimeout limits the time to wait for more of an
+	// encapsulated body, so that a slow upload goes on as long as data
+	// keeps arriving. If zero, the whole body must be read within
+	// ReadTimeout of the start of the transaction (or without a limit,
+	// if that is zero).
+	BodyReadTimeout time.Duration
+
+	// HandlerTimeout limits the time a handler may take to begin its
+	// response. When it expires, the request's context is canceled with
+	// the cause ErrHandlerTimeout; if the handler then returns without
+	// responding, 503 Service Overloaded is sent. If zero, there is no
+	// limit.
+	HandlerTimeout time.Duration
+
+	// KeepAlive configures TCP keep-alive probes on accepted connections.
+	KeepAlive KeepAliveConfig
+
+	// MaxTransactionTime, if non-zero, is a hard limit on the duration of
+	// a transaction, regardless of progress. A watchdog closes the
+	// connections of transactions that take longer.
+	MaxTransactionTime time.Duration
+
+	// ListenConfig, if not nil, is used by ListenAndServe and
+	// ListenAndServeTLS to open the listener. Its Control function can set
+	// socket options (see ReusePort and BindToDevice), and its KeepAlive
+	// applies to accepted connections.
+	ListenConfig *net.ListenConfig
+
+	// IPMode selects the address families ListenAndServe and
+	// ListenAndServeTLS listen on when Addr doesn't specify one.
+	IPMode IPMode
+
+	// AllowClients, if not empty, lists the networks that clients may
+	// connect from; connections from other addresses are closed as soon
+	// as they are accepted. See ParsePrefixes.
+	AllowClients []netip.Prefix
+
+	// HeaderPolicy, if not nil, filters the ICAP headers of responses
+	// and adds ISTag and Service headers to them.
+	HeaderPolicy *HeaderPolicy
+
+	// Dialect parses requests and formats the Encapsulated headers of
+	// responses. If nil, StrictDialect is used; LenientDialect accepts
+	// requests from clients that deviate from RFC 3507.
+	Dialect Dialect
+
+	// Compat, if not nil, works around the quirks of particular clients,
+	// such as those built on c-icap (see CICAPCompat).
+	Compat *CompatProfile
+
+	// PreviewMismatch chooses what happens to requests whose preview
+	// doesn't match their Preview header.
+	PreviewMismatch PreviewMismatchPolicy
+
+	// DrainPolicy chooses how transactions that start on existing
+	// connections during Shutdown are handled.
+	DrainPolicy DrainPolicy
+
+	// MaxHandlerGoroutines, if positive, runs handlers on a pool of that
+	// many goroutines instead of on the goroutines of their connections.
+	// Up to HandlerQueueSize transactions wait for a free goroutine;
+	// OverflowPolicy chooses what happens to the rest.
+	// See also WorkerStats.
+	MaxHandlerGoroutines int
+	HandlerQueueSize     int
+	OverflowPolicy       OverflowPolicy
+
+	// MaxRequestMemory and MaxTotalMemory, if positive, limit the memory
+	// used to buffer each transaction and all transactions together:
+	// encapsulated headers, bodies buffered in memory, and reservations
+	// made with Request.Reserve. A transaction that exceeds a budget is
+	// answered with 413 or 500. See also MemoryInUse.
+	MaxRequestMemory int64
+	MaxTotalMemory   int64
+
+	// WriteBytesPerSecond and ConnWriteBytesPerSecond, if positive,
+	// limit the rate at which encapsulated bodies are written to all
+	// connections together and to each connection, allowing bursts of
+	// WriteBurst bytes (by default, one second's worth). Handlers can
+	// add a limit for a service with LimitWriteRate.
+	WriteBytesPerSecond     int64
+	ConnWriteBytesPerSecond int64
+	WriteBurst              int64
+
+	// MaxConns limits the number of client connections open at once;
+	// zero means no limit. ConnLimitPolicy chooses what happens to
+	// connections beyond the limit.
+	MaxConns        int
+	ConnLimitPolicy ConnLimitPolicy
+
+	// Trace, if not nil, receives notifications of server events.
+	Trace *ServerTrace
+
+	DebugLevel int
+
+	// StrictWriter makes a handler panic when it misuses its
+	// ResponseWriter, such as by calling WriteHeader twice or writing a
+	// body after sending a null-body, instead of the call being logged or
+	// returning an error. It is meant for tests.
+	StrictWriter bool
+
+	// PreserveHeaderOrder makes the server write encapsulated HTTP headers
+	// in the order and casing in which they were received, instead of
+	// net/http's canonical, sorted form. Headers added by the handler
+	// follow the original ones.
+	PreserveHeaderOrder bool
+
+	// PassthroughUnmodified makes the server write an encapsulated HTTP
+	// header exactly as it was received when the handler returns the
+	// original message without changing its start line or header fields.
+	PassthroughUnmodified bool
+
+	// BypassTunnels makes the server answer REQMOD requests for CONNECT
+	// requests and protocol upgrades (see Request.IsTunnel) without calling
+	// the handler, as if the handler had called Unmodified.
+	BypassTunnels bool
+
+	// OnTunnel, if not nil, is called for every request for which
+	// Request.IsTunnel is true, before it is bypassed or handled.
+	OnTunnel func(*Request)
+
+	// ConnState, if not nil, is called when a client connection
+	// changes state. See the ConnState type for details.
+	ConnState func(net.Conn, ConnState)
+
+	// Spool holds the temporary files for bodies buffered by
+	// Request.BufferedBody. If nil, DefaultSpool is used.
+	Spool *Spool
+
+	// UnreadBody chooses what happens to the rest of an encapsulated body
+	// that is still to come when the response has been sent, as when a
+	// handler answers 204 without reading the whole body, or a client
+	// sends the rest of the body after a preview without waiting for
+	// 100 Continue. MaxUnreadBody limits the bytes read after the
+	// response; if more follow, the connection is closed. If it is zero,
+	// 1 MiB is used.
+	UnreadBody    UnreadBodyPolicy
+	MaxUnreadBody int64
+
+	// UnreadBodySink, if not nil, is given the rest of each body that is
+	// read after the response, instead of its being discarded, to keep
+	// it for replay, in an ObjectStore for example. What it leaves
+	// unread is discarded; an error closes the connection.
+	UnreadBodySink func(req *Request, r io.Reader) error
+
+	// BodyMode is the default way of setting the Content-Length of
+	// encapsulated messages whose bodies handlers write. Handlers can
+	// override it for a response with SetBodyMode.
+	BodyMode BodyMode
+
+	// BodyHashes lists the hashes, such as crypto.SHA256, to compute of
+	// every encapsulated body as it is read. See Request.BodyHash.
+	BodyHashes []crypto.Hash
+
+	// Audit, if not nil, is called with the AuditRecord of each
+	// transaction once its response has been sent.
+	Audit func(*AuditRecord)
+
+	// AuditPolicy samples and redacts the audit records. AuditPolicies
+	// overrides it for the services whose paths match their patterns,
+	// which are like those of ServeMux.
+	AuditPolicy   *AuditPolicy
+	AuditPolicies map[string]*AuditPolicy
+
+	// ClientPolicy, if not nil, makes the server keep statistics on
+	// each client address and penalize clients that misbehave.
+	ClientPolicy *ClientPolicy
+
+	// Compression, if not nil, lets clients of this package that offer
+	// it compress encapsulated bodies on the wire (see
+	// TransportCompression).
+	Compression *TransportCompression
+
+	mu         sync.Mutex
+	slots      chan struct{} // semaphore for MaxConns
+	openConns  atomic.Int64
+	listeners  map[net.Listener]struct{}
+	conns      map[*conn]struct{}
+	spoolFiles map[*SpoolFile]struct{} // the files this server created in its Spool
+	inShutdown atomic.Bool
+	workers    *workerPool
+	memUsed    atomic.Int64 // bytes reserved by transactions
+	writeLimit *rateLimiter // for WriteBytesPerSecond
+	stats      parserStats
+	clients    *clientTracker
+}
+
+// A DrainPolicy tells a Server what to do with transactions that
+// start on existing connections while it is shutting down.
+type DrainPolicy int
+
+const (
+	// DrainFinish serves them normally, and then closes the connection.
+	DrainFinish DrainPolicy = iota
+
+	// DrainReject answers them with 503 Service Overloaded and closes
+	// the connection, so that clients fail over to another server quickly.
+	DrainReject
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe
+// after a call to Shutdown.
+var ErrServerClosed = errors.New("icap: Server closed")
+
+// ErrAbortHandler is a sentinel panic value to abort a handler. Like
+// http.ErrAbortHandler, it makes the server close the connection, cutting
+// off any response that has been started, without logging a stack trace.
+var ErrAbortHandler = errors.New("icap: abort Handler")
+
+// A ConnLimitPolicy tells a Server what to do with new connections
+// when Server.MaxConns connections are already open.
+type ConnLimitPolicy int
+
+const (
+	// ConnLimitWait stops accepting connections until one closes,
+	// leaving new ones waiting in the listen backlog.
+	ConnLimitWait ConnLimitPolicy = iota
+
+	// ConnLimitReject accepts new connections, answers them with
+	// 503 Service Overloaded and closes them.
+	ConnLimitReject
+)
+
+// tunnel reports a tunnel request to the OnTunnel hook and bypasses it
+// if configured to. It reports whether the request has been answered.
+func (srv *Server) tunnel(w ResponseWriter, req *Request) bool {
+	if srv.OnTunnel != nil {
+		srv.OnTunnel(req)
+	}
+	if !srv.BypassTunnels {
+		return false
+	}
+	Unmodified(w, req)
+	return true
+}
+
+func (srv *Server) idleTimeout() time.Duration {
+	if srv.IdleTimeout != 0 {
+		return srv.IdleTimeout
+	}
+	return srv.ReadTimeout
+}
+
+func (srv *Server) headerPolicy() *HeaderPolicy {
+	if srv == nil {
+		return nil
+	}
+	return srv.HeaderPolicy
+}
+
+func (srv *Server) trace() *ServerTrace {
+	if srv == nil {
+		return nil
+	}
+	return srv.Trace
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
@@ -143,7 +688,7 @@ func (srv *Server) ListenAndServe() error {
 	if addr == "" {
 		addr = ":1344"
 	}
-	l, err := net.Listen("tcp", addr)
+	l, err := srv.listen(addr)
 	if err != nil {
 		return err
 	}
@@ -161,11 +706,11 @@ func (srv *Server) ListenAndServeTLS(cert, key string) error {
 		addr = ":1344"
 	}
 	config := &tls.Config{Certificates: []tls.Certificate{cer}}
-	l, err := tls.Listen("tcp", addr, config)
+	l, err := srv.listen(addr)
 	if err != nil {
 		return err
 	}
-	return srv.Serve(l)
+	return srv.Serve(tls.NewListener(l, config))
 }
 
 // Serve accepts incoming connections on the Listener l, creating a
@@ -173,14 +718,29 @@ func (srv *Server) ListenAndServeTLS(cert, key string) error {
 // then call srv.Handler to reply to them.
 func (srv *Server) Serve(l net.Listener) error {
 	defer l.Close()
+	if !srv.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer srv.trackListener(l, false)
 	handler := srv.Handler
 	if handler == nil {
 		handler = DefaultServeMux
 	}
 
 	for {
+		if srv.MaxConns > 0 && srv.ConnLimitPolicy == ConnLimitWait {
+			// Leave further connections in the listen backlog
+			// until one of ours closes.
+			srv.connSlots() <- struct{}{}
+		}
 		rw, err := l.Accept()
 		if err != nil {
+			if srv.MaxConns > 0 && srv.ConnLimitPolicy == ConnLimitWait {
+				<-srv.connSlots()
+			}
+			if srv.shuttingDown() {
+				return ErrServerClosed
+			}
 			// Instead of using the deprecated ne.Temporary(), check for specific error types
 			// or just log and continue for non-critical errors
 			log.Printf("icap: Accept error: %v", err)
@@ -192,24 +752,235 @@ func (srv *Server) Serve(l net.Listener) error {
 			}
 			return err
 		}
-		if srv.ReadTimeout != 0 {
-			if err := rw.SetReadDeadline(time.Now().Add(srv.ReadTimeout)); err != nil {
+		if !srv.clientAllowed(rw.RemoteAddr()) {
+			if srv.MaxConns > 0 && srv.ConnLimitPolicy == ConnLimitWait {
+				<-srv.connSlots()
+			}
+			srv.trace().connRejected(rw)
+			rw.Close()
+			continue
+		}
+		client := srv.clientTracker().client(rw.RemoteAddr())
+		if !client.connOpened() {
+			if srv.MaxConns > 0 && srv.ConnLimitPolicy == ConnLimitWait {
+				<-srv.connSlots()
+			}
+			srv.trace().connRejected(rw)
+			go rejectConn(rw)
+			continue
+		}
+		srv.setKeepAlive(rw)
+		if d := srv.firstRequestTimeout(); d != 0 {
+			if err := rw.SetReadDeadline(time.Now().Add(d)); err != nil {
 				log.Printf("icap: SetReadDeadline error: %v", err)
 			}
 		}
-		if srv.WriteTimeout != 0 {
-			if err := rw.SetWriteDeadline(time.Now().Add(srv.WriteTimeout)); err != nil {
-				log.Printf("icap: SetWriteDeadline error: %v", err)
+		if srv.MaxConns > 0 && srv.ConnLimitPolicy == ConnLimitReject {
+			select {
+			case srv.connSlots() <- struct{}{}:
+			default:
+				client.connClosed()
+				srv.trace().connRejected(rw)
+				go rejectConn(rw)
+				continue
 			}
 		}
-		c, err := newConn(rw, handler)
+		c, err := newConn(rw, srv, handler)
 		if err != nil {
 			continue
 		}
+		c.client = client
+		srv.trackConn(c)
+		srv.trace().connCount(int(srv.openConns.Add(1)))
+		c.setState(StateNew)
 		go c.serve(srv.DebugLevel)
 	}
 }
 
+// connSlots returns the semaphore that limits the number of open
+// connections to MaxConns.
+func (srv *Server) connSlots() chan struct{} {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.slots == nil {
+		srv.slots = make(chan struct{}, srv.MaxConns)
+	}
+	return srv.slots
+}
+
+// connClosed releases the resources held for a connection that has closed.
+func (srv *Server) connClosed(c *conn) {
+	srv.mu.Lock()
+	delete(srv.conns, c)
+	srv.mu.Unlock()
+	c.client.connClosed()
+	if srv.MaxConns > 0 {
+		<-srv.connSlots()
+	}
+	srv.trace().connCount(int(srv.openConns.Add(-1)))
+}
+
+// trackListener adds l to or removes it from the listeners that Shutdown
+// closes. It reports false if l can't be added because of a Shutdown.
+func (srv *Server) trackListener(l net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !add {
+		delete(srv.listeners, l)
+		return true
+	}
+	if srv.shuttingDown() {
+		return false
+	}
+	if srv.listeners == nil {
+		srv.listeners = make(map[net.Listener]struct{})
+	}
+	srv.listeners[l] = struct{}{}
+	return true
+}
+
+func (srv *Server) trackConn(c *conn) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.conns == nil {
+		srv.conns = make(map[*conn]struct{})
+	}
+	srv.conns[c] = struct{}{}
+}
+
+func (srv *Server) shuttingDown() bool {
+	return srv != nil && srv.inShutdown.Load()
+}
+
+// Shutdown gracefully shuts down the server. It closes all listeners,
+// then closes each connection once its transaction in progress (if any)
+// is complete, and returns when all connections are closed or ctx is done,
+// in which case it returns the context's error. Once the connections are
+// closed, it removes the files it left in its Spool.
+// Once Shutdown has been called, Serve returns ErrServerClosed.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.inShutdown.Store(true)
+
+	srv.mu.Lock()
+	for l := range srv.listeners {
+		l.Close()
+	}
+	srv.mu.Unlock()
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if srv.closeIdleConns() {
+			return srv.removeSpoolFiles()
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and connections, including
+// those in a transaction, and removes the files the server created in
+// its Spool, including those of the transactions in progress.
+// For a graceful shutdown, use Shutdown.
+// Once Close has been called, Serve returns ErrServerClosed.
+func (srv *Server) Close() error {
+	srv.inShutdown.Store(true)
+
+	srv.mu.Lock()
+	for l := range srv.listeners {
+		l.Close()
+	}
+	for c := range srv.conns {
+		c.netConn.Close()
+	}
+	srv.mu.Unlock()
+	return srv.removeSpoolFiles()
+}
+
+// createSpoolFile creates a temporary file in the server's Spool, and
+// keeps track of it until it is closed. The Spool may be shared with
+// other servers, so the server removes only its own files when it shuts
+// down.
+func (srv *Server) createSpoolFile() (*SpoolFile, error) {
+	spool := srv.Spool
+	if spool == nil {
+		spool = DefaultSpool
+	}
+	f, err := spool.Create()
+	if err != nil {
+		return nil, err
+	}
+	f.onClose = func() {
+		srv.mu.Lock()
+		delete(srv.spoolFiles, f)
+		srv.mu.Unlock()
+	}
+	srv.mu.Lock()
+	if srv.spoolFiles == nil {
+		srv.spoolFiles = make(map[*SpoolFile]struct{})
+	}
+	srv.spoolFiles[f] = struct{}{}
+	srv.mu.Unlock()
+	return f, nil
+}
+
+// removeSpoolFiles closes and removes the files the server created in
+// its Spool.
+func (srv *Server) removeSpoolFiles() error {
+	srv.mu.Lock()
+	files := make([]*SpoolFile, 0, len(srv.spoolFiles))
+	for f := range srv.spoolFiles {
+		files = append(files, f)
+	}
+	srv.mu.Unlock()
+
+	var firstErr error
+	for _, f := range files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// closeIdleConns closes the connections that are not in a transaction,
+// and reports whether there are none left. A new connection counts as
+// idle if it has not started sending a request within 5 seconds.
+func (srv *Server) closeIdleConns() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for c := range srv.conns {
+		switch ConnState(c.state.Load()) {
+		case StateNew:
+			if time.Since(c.created) < 5*time.Second {
+				continue
+			}
+		case StateIdle:
+		default:
+			continue
+		}
+		c.netConn.Close()
+	}
+	return len(srv.conns) == 0
+}
+
+// OpenConns returns the number of client connections currently open.
+func (srv *Server) OpenConns() int {
+	return int(srv.openConns.Load())
+}
+
+// rejectConn answers a connection refused because of MaxConns or a
+// ClientPolicy with 503 Service Overloaded and closes it.
+func rejectConn(rw net.Conn) {
+	defer rw.Close()
+	rw.SetDeadline(time.Now().Add(time.Second)) // including any TLS handshake
+	fmt.Fprintf(rw, "ICAP/1.0 503 %s\r\nConnection: close\r\nDate: %s\r\nEncapsulated: null-body=0\r\n\r\n",
+		StatusText(StatusServiceUnavailable), time.Now().UTC().Format(http.TimeFormat))
+}
+
 // Serve accepts incoming ICAP connections on the listener l,
 // creating a new service thread for each.  The service threads
 // read requests and then call handler to reply to them.
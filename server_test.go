@@ -0,0 +1,624 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// roundTrip sends a raw ICAP request to srv over a loopback connection
+// and returns everything the server writes before closing it.
+func roundTrip(t *testing.T, srv *Server, request string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, request); err != nil {
+		t.Fatal(err)
+	}
+	c.(*net.TCPConn).CloseWrite()
+
+	resp, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(resp)
+}
+
+func TestConnState(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	closed := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		ConnState: func(c net.Conn, state ConnState) {
+			mu.Lock()
+			states = append(states, state)
+			mu.Unlock()
+			if state == StateClosed {
+				close(closed)
+			}
+		},
+	}
+
+	request := "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"\r\n"
+	roundTrip(t, srv, request+request)
+	<-closed
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []ConnState{StateNew, StateActive, StateIdle, StateActive, StateIdle, StateClosed}
+	if !reflect.DeepEqual(states, want) {
+		t.Errorf("states = %v, want %v", states, want)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	timedOut := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		IdleTimeout: 50 * time.Millisecond,
+		Trace: &ServerTrace{
+			IdleTimeout: func(net.Conn) { close(timedOut) },
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"\r\n")
+
+	// The connection stays open for the response, then is closed
+	// by the server once it has been idle for too long.
+	resp, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(resp), "ICAP/1.0 204 ") {
+		t.Errorf("unexpected response:\n%s", resp)
+	}
+	select {
+	case <-timedOut:
+	case <-time.After(time.Second):
+		t.Error("IdleTimeout hook not called")
+	}
+}
+
+func TestPersistentConnection(t *testing.T) {
+	var served int
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			served++
+			if req.Method == "RESPMOD" {
+				w.WriteHeader(StatusNotFound, nil, false)
+				return
+			}
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := textproto.NewReader(bufio.NewReader(c))
+	transaction := func(request string) (status string, header textproto.MIMEHeader) {
+		t.Helper()
+		if _, err := io.WriteString(c, request); err != nil {
+			t.Fatal(err)
+		}
+		status, err := r.ReadLine()
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err = r.ReadMIMEHeader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return status, header
+	}
+
+	// Each transaction waits for the response to the one before, on the
+	// same connection.
+	for i, request := range []string{
+		"OPTIONS icap://icap.example.net/options ICAP/1.0\r\nHost: icap.example.net\r\n\r\n",
+		"RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\nHost: icap.example.net\r\nEncapsulated: null-body=0\r\n\r\n",
+	} {
+		status, header := transaction(request)
+		if !strings.HasPrefix(status, "ICAP/1.0 ") || header.Get("Connection") != "" {
+			t.Fatalf("transaction %d: %s with Connection: %q", i+1, status, header.Get("Connection"))
+		}
+	}
+
+	// A client that asks for the connection to be closed gets its
+	// response, and then the connection is closed.
+	status, header := transaction("OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Connection: close\r\n" +
+		"\r\n")
+	if !strings.HasPrefix(status, "ICAP/1.0 204 ") || header.Get("Connection") != "close" {
+		t.Errorf("third transaction: %s with Connection: %q", status, header.Get("Connection"))
+	}
+	if _, err := r.ReadLine(); err != io.EOF {
+		t.Errorf("after Connection: close, read returned %v, want EOF", err)
+	}
+	if served != 3 {
+		t.Errorf("handler called %d times, want 3", served)
+	}
+}
+
+func TestMaxConnsReject(t *testing.T) {
+	rejected := make(chan struct{}, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		MaxConns:        1,
+		ConnLimitPolicy: ConnLimitReject,
+		Trace: &ServerTrace{
+			ConnRejected: func(net.Conn) { rejected <- struct{}{} },
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	// The first connection stays open without sending anything.
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	for srv.OpenConns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	resp, err := io.ReadAll(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(resp), "ICAP/1.0 503 ") {
+		t.Errorf("unexpected response to connection over the limit:\n%s", resp)
+	}
+	<-rejected
+	if n := srv.OpenConns(); n != 1 {
+		t.Errorf("OpenConns() = %d, want 1", n)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	inHandler := make(chan struct{})
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			close(inHandler)
+			<-release
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(l) }()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"\r\n")
+	<-inHandler
+	if !srv.Ready() {
+		t.Error("serving server not ready")
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Serve returned %v, want ErrServerClosed", err)
+	}
+	if srv.Ready() || !srv.Healthy() {
+		t.Errorf("during shutdown: Ready() = %v, Healthy() = %v", srv.Ready(), srv.Healthy())
+	}
+
+	// The transaction in progress completes before the connection closes.
+	close(release)
+	resp, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(resp), "ICAP/1.0 204 ") {
+		t.Errorf("unexpected response:\n%s", resp)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown: %v", err)
+	}
+}
+
+func TestShutdownRemovesSpool(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n\r\n"
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr +
+		"b\r\nbody text.\n\r\n0\r\n\r\n"
+
+	for _, graceful := range []bool{true, false} {
+		dir := t.TempDir()
+		spool := &Spool{Dir: dir}
+		// A file of another server that shares the spool.
+		other, err := spool.Create()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		inHandler := make(chan struct{})
+		release := make(chan struct{})
+		srv := &Server{Spool: spool, Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			if _, err := req.BufferedBody(0); err != nil {
+				t.Error(err)
+			}
+			close(inHandler)
+			<-release
+			w.WriteHeader(StatusNoContent, nil, false)
+		})}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(l)
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(c, request)
+		<-inHandler
+		if files, _ := spool.Usage(); files != 2 {
+			t.Fatalf("%d spool files in the transaction, want 2", files)
+		}
+
+		if graceful {
+			close(release)
+			err = srv.Shutdown(context.Background())
+		} else {
+			// The file of the transaction in progress goes too.
+			err = srv.Close()
+			close(release)
+		}
+		if err != nil {
+			t.Errorf("graceful=%v: %v", graceful, err)
+		}
+		c.Close()
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != filepath.Base(other.Name()) {
+			t.Errorf("graceful=%v: files left in the spool directory: %v, want only %s", graceful, entries, other.Name())
+		}
+		other.Close()
+	}
+}
+
+func TestDrainPolicy(t *testing.T) {
+	for _, policy := range []DrainPolicy{DrainFinish, DrainReject} {
+		inHandler := make(chan struct{}, 2)
+		release := make(chan struct{})
+		srv := &Server{
+			Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+				inHandler <- struct{}{}
+				<-release
+				w.WriteHeader(StatusNoContent, nil, false)
+			}),
+			DrainPolicy: policy,
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go srv.Serve(l)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"\r\n"
+		io.WriteString(c, request+request)
+		<-inHandler
+
+		shutdown := make(chan error, 1)
+		go func() { shutdown <- srv.Shutdown(context.Background()) }()
+		for !srv.shuttingDown() {
+			time.Sleep(time.Millisecond)
+		}
+		close(release)
+
+		resp, err := io.ReadAll(c)
+		c.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-shutdown
+		second := strings.Index(string(resp)[1:], "ICAP/1.0 ") + 1
+		if !strings.HasPrefix(string(resp), "ICAP/1.0 204 ") || second == 0 {
+			t.Errorf("policy %d: expected two responses, got:\n%s", policy, resp)
+			continue
+		}
+		want := "ICAP/1.0 204 "
+		if policy == DrainReject {
+			want = "ICAP/1.0 503 "
+		}
+		if !strings.HasPrefix(string(resp)[second:], want) {
+			t.Errorf("policy %d: second response should start with %q:\n%s", policy, want, resp)
+		}
+	}
+}
+
+func TestWorkerPoolOverflow(t *testing.T) {
+	inHandler := make(chan struct{}, 1)
+	release := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			inHandler <- struct{}{}
+			<-release
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		MaxHandlerGoroutines: 1,
+		OverflowPolicy:       OverflowReject,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	request := "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"\r\n"
+	first, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	io.WriteString(first, request)
+	<-inHandler
+	if srv.Healthy() {
+		t.Error("server with saturated workers reported healthy")
+	}
+
+	resp := roundTrip(t, srv, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 503 ") {
+		t.Errorf("expected 503 while all workers are busy:\n%s", resp)
+	}
+	close(release)
+	first.(*net.TCPConn).CloseWrite()
+	io.ReadAll(first)
+
+	stats := srv.WorkerStats()
+	if stats.Workers != 1 || stats.Rejected != 1 || stats.Completed != 1 || stats.Busy != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	lc := &net.ListenConfig{Control: ControlFuncs(ReusePort)}
+	l1, err := lc.Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err == ErrSockoptUnsupported {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+
+	srv := &Server{Addr: l1.Addr().String(), ListenConfig: lc}
+	l2, err := srv.listen(srv.Addr)
+	if err != nil {
+		t.Fatalf("second listener on the same port: %v", err)
+	}
+	l2.Close()
+}
+
+func TestMaxTransactionTime(t *testing.T) {
+	timedOut := make(chan struct{})
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			// The client never sends the body.
+			io.Copy(io.Discard, req.Request.Body)
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		MaxTransactionTime: 50 * time.Millisecond,
+		KeepAlive:          KeepAliveConfig{Enable: true, Idle: time.Minute, Interval: 10 * time.Second, Count: 3},
+		Trace: &ServerTrace{
+			TransactionTimeout: func(net.Conn) { close(timedOut) },
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	httpHdr := "POST / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	io.WriteString(c, "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: req-hdr=0, req-body="+strconv.Itoa(len(httpHdr))+"\r\n"+
+		"\r\n"+httpHdr)
+
+	select {
+	case <-timedOut:
+	case <-time.After(time.Second):
+		t.Fatal("stuck transaction was not aborted")
+	}
+	if _, err := io.ReadAll(c); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteRateLimit(t *testing.T) {
+	body := strings.Repeat("x", 20000)
+	handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+		resp := &http.Response{StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}}
+		w.WriteHeader(StatusOK, resp, true)
+		io.WriteString(w, body)
+	})
+	request := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: null-body=0\r\n\r\n"
+
+	for _, srv := range []*Server{
+		{Handler: handler, ConnWriteBytesPerSecond: 100000, WriteBurst: 1000},
+		{Handler: LimitWriteRate(handler, 100000, 1000)},
+	} {
+		start := time.Now()
+		resp := roundTrip(t, srv, request)
+		if !strings.Contains(resp, body) {
+			t.Errorf("body not written:\n%.200s", resp)
+		}
+		if d := time.Since(start); d < 150*time.Millisecond {
+			t.Errorf("20000 bytes at 100000 bytes/s written in %v", d)
+		}
+	}
+}
+
+func TestIPMode(t *testing.T) {
+	for _, tt := range []struct {
+		mode    IPMode
+		network string
+	}{
+		{IPv4Only, "tcp4"},
+		{IPv6Only, "tcp6"},
+	} {
+		srv := &Server{IPMode: tt.mode}
+		l, err := srv.listen(":0")
+		if err != nil {
+			t.Logf("%s: %v", tt.network, err)
+			continue
+		}
+		ip := l.Addr().(*net.TCPAddr).IP
+		l.Close()
+		if (ip.To4() != nil) != (tt.mode == IPv4Only) {
+			t.Errorf("%s listener bound to %v", tt.network, ip)
+		}
+	}
+}
+
+func TestAllowClients(t *testing.T) {
+	handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+		if ap, ok := req.RemoteAddrPort(); !ok || !ap.Addr().Is4() {
+			t.Errorf("RemoteAddrPort() of %q = %v, %v", req.RemoteAddr, ap, ok)
+		}
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	request := "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n\r\n"
+
+	allowed, err := ParsePrefixes("::ffff:127.0.0.1", "2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := roundTrip(t, &Server{Handler: handler, AllowClients: allowed}, request)
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Errorf("allowed client refused:\n%s", resp)
+	}
+
+	denied, err := ParsePrefixes("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := roundTrip(t, &Server{Handler: handler, AllowClients: denied}, request); resp != "" {
+		t.Errorf("client outside AllowClients served:\n%s", resp)
+	}
+
+	if _, err := ParsePrefixes("300.0.0.1"); err == nil {
+		t.Error("invalid address parsed")
+	}
+}
+
+func TestAbortHandler(t *testing.T) {
+	handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusOK, nil, true)
+		io.WriteString(w, "partial")
+		panic(ErrAbortHandler)
+	})
+	request := "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n\r\n" +
+		"OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n\r\n"
+
+	for _, workers := range []int{0, 2} {
+		resp := roundTrip(t, &Server{Handler: handler, MaxHandlerGoroutines: workers}, request)
+		if !strings.HasPrefix(resp, "ICAP/1.0 200 ") || !strings.HasSuffix(resp, "7\r\npartial\r\n") {
+			t.Errorf("with %d workers, response to aborted handler:\n%s", workers, resp)
+		}
+	}
+}
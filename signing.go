@@ -0,0 +1,227 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// HMAC signatures on ICAP requests.
+
+package icap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Requests are signed with HMAC-SHA256 over a canonical form made of the
+// ICAP method, the request URI, the Date header, the X-ICAP-Nonce header
+// and the SHA-256 hash of the encapsulated body, one per line:
+//
+//	ICAP-HMAC-SHA256
+//	RESPMOD
+//	icap://icap.example.net/respmod
+//	Mon, 02 Jan 2006 15:04:05 GMT
+//	<random nonce>
+//	<hex SHA-256 of the body>
+//
+// The hash is sent in the X-ICAP-Body-SHA256 header, and the signature in
+// the X-ICAP-Signature header as
+//
+//	keyId="<key ID>", signature="<base64 HMAC>"
+const signatureAlgorithm = "ICAP-HMAC-SHA256"
+
+// A RequestSigner signs the requests sent by a Client (see Client.Signer)
+// with a shared key, for servers that check them with a
+// SignatureVerifier. The body of each request is held in memory to
+// compute its hash before it is sent.
+type RequestSigner struct {
+	KeyID string
+	Key   []byte
+}
+
+// Sign adds the Date and X-ICAP-Nonce headers (if missing), and the
+// X-ICAP-Body-SHA256 and X-ICAP-Signature headers, to header, the ICAP
+// header of a request for method and uri whose encapsulated body has the
+// SHA-256 hash bodySum.
+func (s *RequestSigner) Sign(method, uri string, header textproto.MIMEHeader, bodySum []byte) {
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	if header.Get("X-ICAP-Nonce") == "" {
+		var nonce [16]byte
+		rand.Read(nonce[:])
+		header.Set("X-ICAP-Nonce", hex.EncodeToString(nonce[:]))
+	}
+	sum := hex.EncodeToString(bodySum)
+	header.Set("X-ICAP-Body-SHA256", sum)
+	mac := signature(s.Key, method, uri, header.Get("Date"), header.Get("X-ICAP-Nonce"), sum)
+	header.Set("X-ICAP-Signature", fmt.Sprintf(`keyId="%s", signature="%s"`,
+		s.KeyID, base64.StdEncoding.EncodeToString(mac)))
+}
+
+// signature computes the HMAC of a request in canonical form.
+func signature(key []byte, method, uri, date, nonce, bodySum string) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%s", signatureAlgorithm, method, uri, date, nonce, bodySum)
+	return mac.Sum(nil)
+}
+
+// signBody reads body into memory and signs req for it, returning a
+// reader of the body to send in its place.
+func (s *RequestSigner) signBody(req *RawRequest, body io.Reader) (io.Reader, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = io.ReadAll(body); err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	sum := sha256.Sum256(data)
+	header := make(textproto.MIMEHeader, len(req.Header)+3)
+	for k, v := range req.Header {
+		header[k] = v
+	}
+	s.Sign(req.Method, req.URL.String(), header, sum[:])
+	req.Header = header
+	return body, nil
+}
+
+// ErrBadSignature is the error reported by a SignatureVerifier for a
+// request whose signature is missing or doesn't match.
+var ErrBadSignature = errors.New("icap: missing or invalid request signature")
+
+// A SignatureVerifier is a Handler that passes on to Handler only the
+// requests signed with one of Keys by a RequestSigner, and answers the
+// rest with 403 Forbidden. It is meant for networks where clients can't
+// be authenticated with TLS certificates. Before Handler runs, the whole
+// body is read with BufferedBody to check its hash.
+type SignatureVerifier struct {
+	Handler Handler
+
+	// Keys maps key IDs to keys.
+	Keys map[string][]byte
+
+	// MaxSkew is how far the Date header of a request may be from the
+	// server's clock; older requests are refused as stale. If zero,
+	// 5 minutes is allowed.
+	MaxSkew time.Duration
+
+	// BodyMemory is the memory limit passed to BufferedBody.
+	// If zero, 1 MB is used.
+	BodyMemory int64
+
+	// Nonces, if not nil, records the X-ICAP-Nonce of each signed
+	// request, so that a request that is sent again, or that has no
+	// nonce, is refused as a replay (see ErrReplayed). Requests whose
+	// Date is more than MaxSkew old are refused anyway, so nonces need
+	// to be remembered only that long.
+	Nonces NonceStore
+}
+
+// ServeICAP checks the signature on req, and serves it with v.Handler if
+// it is valid.
+func (v *SignatureVerifier) ServeICAP(w ResponseWriter, req *Request) {
+	if err := v.Verify(req); err != nil {
+		req.Audit().SetVerdict(VerdictBlock, err.Error())
+		w.WriteHeader(StatusForbidden, nil, false)
+		return
+	}
+	v.Handler.ServeICAP(w, req)
+}
+
+// Verify checks the signature on req. The error is ErrBadSignature,
+// ErrReplayed, or one from the NonceStore or from reading the body.
+func (v *SignatureVerifier) Verify(req *Request) error {
+	keyID, sig, ok := parseSignatureHeader(req.Header.Get("X-ICAP-Signature"))
+	if !ok {
+		return ErrBadSignature
+	}
+	key, ok := v.Keys[keyID]
+	if !ok {
+		return ErrBadSignature
+	}
+
+	date := req.Header.Get("Date")
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return ErrBadSignature
+	}
+	skew := v.MaxSkew
+	if skew <= 0 {
+		skew = 5 * time.Minute
+	}
+	if d := time.Since(t); d > skew || d < -skew {
+		return ErrReplayed
+	}
+
+	nonce := req.Header.Get("X-ICAP-Nonce")
+	claimed := strings.ToLower(req.Header.Get("X-ICAP-Body-SHA256"))
+	if !hmac.Equal(sig, signature(key, req.Method, req.RawURL, date, nonce, claimed)) {
+		return ErrBadSignature
+	}
+	if v.Nonces != nil {
+		if nonce == "" {
+			return ErrReplayed
+		}
+		fresh, err := v.Nonces.Add(keyID+" "+nonce, t.Add(skew))
+		if err != nil {
+			return err
+		}
+		if !fresh {
+			return ErrReplayed
+		}
+	}
+
+	memLimit := v.BodyMemory
+	if memLimit <= 0 {
+		memLimit = 1 << 20
+	}
+	h := sha256.New()
+	if req.bodyPtr() != nil {
+		bb, err := req.BufferedBody(memLimit)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(h, io.NewSectionReader(bb, 0, bb.Size())); err != nil {
+			return err
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h.Sum(nil))), []byte(claimed)) != 1 {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// parseSignatureHeader parses the value of an X-ICAP-Signature header.
+func parseSignatureHeader(v string) (keyID string, sig []byte, ok bool) {
+	var encoded string
+	for _, param := range strings.Split(v, ",") {
+		name, value, found := strings.Cut(strings.TrimSpace(param), "=")
+		if !found {
+			return "", nil, false
+		}
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(name) {
+		case "keyid":
+			keyID = value
+		case "signature":
+			encoded = value
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || keyID == "" || len(sig) == 0 {
+		return "", nil, false
+	}
+	return keyID, sig, true
+}
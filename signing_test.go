@@ -0,0 +1,81 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestRequestSignature(t *testing.T) {
+	key := []byte("a shared secret")
+	srv := &Server{Handler: &SignatureVerifier{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			body, _ := io.ReadAll(req.Request.Body)
+			w.Header().Set("X-Body", string(body))
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		Keys: map[string][]byte{"client-1": key},
+	}}
+	u := startServer(t, srv, "/reqmod")
+
+	send := func(signer *RequestSigner, preview string) *Response {
+		t.Helper()
+		httpReq, _ := http.NewRequest("POST", "http://www.example.com/", strings.NewReader("hello, world"))
+		req, err := NewRequest("REQMOD", u, httpReq, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if preview != "" {
+			req.Header.Set("Preview", preview)
+		}
+		c := &Client{Signer: signer}
+		resp, err := c.Do(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for _, preview := range []string{"", "5"} {
+		resp := send(&RequestSigner{KeyID: "client-1", Key: key}, preview)
+		if resp.StatusCode != StatusNoContent || resp.Header.Get("X-Body") != "hello, world" {
+			t.Errorf("Preview %q: signed request got %d, body %q", preview, resp.StatusCode, resp.Header.Get("X-Body"))
+		}
+	}
+	for _, signer := range []*RequestSigner{
+		nil,
+		{KeyID: "client-1", Key: []byte("the wrong key")},
+		{KeyID: "client-2", Key: key},
+	} {
+		if resp := send(signer, ""); resp.StatusCode != StatusForbidden {
+			t.Errorf("signer %+v: status %d, want 403", signer, resp.StatusCode)
+		}
+	}
+
+	// A body that doesn't match the signed hash.
+	header := make(textproto.MIMEHeader)
+	sum := sha256.Sum256([]byte("hello, world"))
+	(&RequestSigner{KeyID: "client-1", Key: key}).Sign("REQMOD", "icap://icap.example.net/reqmod", header, sum[:])
+	httpHdr := "POST / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	raw := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Date: " + header.Get("Date") + "\r\n" +
+		"X-ICAP-Nonce: " + header.Get("X-ICAP-Nonce") + "\r\n" +
+		"X-ICAP-Body-SHA256: " + header.Get("X-ICAP-Body-SHA256") + "\r\n" +
+		"X-ICAP-Signature: " + header.Get("X-ICAP-Signature") + "\r\n" +
+		"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr +
+		"c\r\nhello, there\r\n0\r\n\r\n"
+	if resp := roundTrip(t, &Server{Handler: srv.Handler}, raw); !strings.HasPrefix(resp, "ICAP/1.0 403 ") {
+		t.Errorf("tampered body: unexpected response:\n%s", resp)
+	}
+}
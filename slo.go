@@ -0,0 +1,326 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Tracking services against service level objectives.
+
+package icap
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+)
+
+// An SLO is a Handler that tracks how well Handler meets a service level
+// objective: the proportion of requests to each service that succeed
+// (get a response other than 5xx) within LatencyTarget. It measures the
+// burn rate, the rate at which the service is using up its error budget
+// (a burn rate of 1 uses it up in exactly the window), and can fail open
+// when the burn rate shows that the adaptation backend is degraded.
+//
+// Services are told apart by Request.ServicePath, or by the path of the
+// request URL if the request wasn't routed by a ServeMux.
+type SLO struct {
+	Handler Handler
+
+	// Objective is the target proportion of good requests.
+	// If zero, 0.99 is used.
+	Objective float64
+
+	// LatencyTarget, if positive, counts requests that take longer as bad.
+	LatencyTarget time.Duration
+
+	// Window is the period over which rates and percentiles are
+	// measured. If zero, 5 minutes is used.
+	Window time.Duration
+
+	// FailOpenBurnRate, if positive, is the burn rate at which a service
+	// fails open: for FailOpenFor, its REQMOD and RESPMOD requests are
+	// answered with 204 No Modifications (or the unmodified message)
+	// without calling Handler. Then its measurements start again.
+	FailOpenBurnRate float64
+
+	// FailOpenFor is how long a service stays failed open.
+	// If zero, 30 seconds is used.
+	FailOpenFor time.Duration
+
+	// MinRequests is the number of requests in the window needed before
+	// a service can fail open. If zero, 20 is used.
+	MinRequests int
+
+	// OnFailOpen, if not nil, is called when a service starts or stops
+	// failing open.
+	OnFailOpen func(service string, failingOpen bool)
+
+	mu       sync.Mutex
+	services map[string]*sloService
+}
+
+// SLOStats describes how a service is doing against its objective over
+// the SLO's window.
+type SLOStats struct {
+	Service  string
+	Requests uint64
+	Bad      uint64 // requests that failed or were too slow
+
+	SuccessRate     float64 // the proportion of good requests; 1 if there were none
+	BurnRate        float64
+	BudgetRemaining float64 // the proportion of the error budget left; negative if overspent
+
+	// Latency percentiles, rounded up to a power of two milliseconds.
+	P50, P90, P99 time.Duration
+
+	FailingOpen bool
+}
+
+// sloSlices is the number of slices a window is divided into.
+const sloSlices = 10
+
+// sloLatencyBuckets is the number of latency histogram buckets: bucket i
+// counts requests that took up to 2^i ms, and the last one the rest.
+const sloLatencyBuckets = 18
+
+// An sloSlice holds the measurements of one slice of the window.
+type sloSlice struct {
+	start   time.Time
+	total   uint64
+	bad     uint64
+	latency [sloLatencyBuckets]uint64
+}
+
+type sloService struct {
+	slices    [sloSlices]sloSlice
+	openUntil time.Time // when failing open ends; zero if not failing open
+}
+
+func (s *SLO) objective() float64 {
+	if s.Objective <= 0 || s.Objective >= 1 {
+		return 0.99
+	}
+	return s.Objective
+}
+
+func (s *SLO) window() time.Duration {
+	if s.Window <= 0 {
+		return 5 * time.Minute
+	}
+	return s.Window
+}
+
+// service returns the measurements for name. s.mu must be held.
+func (s *SLO) service(name string) *sloService {
+	if s.services == nil {
+		s.services = make(map[string]*sloService)
+	}
+	svc := s.services[name]
+	if svc == nil {
+		svc = new(sloService)
+		s.services[name] = svc
+	}
+	return svc
+}
+
+// ServeICAP passes req to s.Handler, measuring the outcome, unless the
+// service is failing open.
+func (s *SLO) ServeICAP(w ResponseWriter, req *Request) {
+	h := s.Handler
+	if h == nil {
+		h = NotFoundHandler()
+	}
+	if req.Method != "REQMOD" && req.Method != "RESPMOD" {
+		h.ServeICAP(w, req)
+		return
+	}
+	name := req.ServicePath
+	if name == "" {
+		name = req.URL.Path
+	}
+
+	if s.failingOpen(name, time.Now()) {
+		req.Audit().SetVerdict(VerdictAllow, "failed open: service level objective missed")
+		Unmodified(w, req)
+		return
+	}
+
+	start := time.Now()
+	sw := &statusWriter{ResponseWriter: w}
+	h.ServeICAP(sw, req)
+	elapsed := time.Since(start)
+
+	bad := sw.code >= 500 || context.Cause(req.Context()) == ErrHandlerTimeout ||
+		s.LatencyTarget > 0 && elapsed > s.LatencyTarget
+	s.record(name, start, elapsed, bad)
+}
+
+// failingOpen reports whether the service name is failing open at now,
+// ending failing open if its time is up.
+func (s *SLO) failingOpen(name string, now time.Time) bool {
+	s.mu.Lock()
+	svc := s.service(name)
+	if svc.openUntil.IsZero() {
+		s.mu.Unlock()
+		return false
+	}
+	if now.Before(svc.openUntil) {
+		s.mu.Unlock()
+		return true
+	}
+	svc.openUntil = time.Time{}
+	svc.slices = [sloSlices]sloSlice{}
+	s.mu.Unlock()
+	if s.OnFailOpen != nil {
+		s.OnFailOpen(name, false)
+	}
+	return false
+}
+
+// record adds the outcome of a request to the service name, and starts
+// failing open if the burn rate calls for it.
+func (s *SLO) record(name string, start time.Time, elapsed time.Duration, bad bool) {
+	now := start.Add(elapsed)
+	s.mu.Lock()
+	svc := s.service(name)
+	slice := s.slice(svc, now)
+	slice.total++
+	if bad {
+		slice.bad++
+	}
+	slice.latency[latencyBucket(elapsed)]++
+
+	opened := false
+	if s.FailOpenBurnRate > 0 && svc.openUntil.IsZero() {
+		st := s.stats(name, svc, now)
+		minRequests := s.MinRequests
+		if minRequests <= 0 {
+			minRequests = 20
+		}
+		if st.Requests >= uint64(minRequests) && st.BurnRate >= s.FailOpenBurnRate {
+			d := s.FailOpenFor
+			if d <= 0 {
+				d = 30 * time.Second
+			}
+			svc.openUntil = now.Add(d)
+			opened = true
+		}
+	}
+	s.mu.Unlock()
+	if opened && s.OnFailOpen != nil {
+		s.OnFailOpen(name, true)
+	}
+}
+
+// slice returns the slice of svc's window that holds now, starting a new
+// one if necessary. s.mu must be held.
+func (s *SLO) slice(svc *sloService, now time.Time) *sloSlice {
+	d := s.window() / sloSlices
+	start := now.Truncate(d)
+	slice := &svc.slices[int(start.UnixNano()/int64(d))%sloSlices]
+	if !slice.start.Equal(start) {
+		*slice = sloSlice{start: start}
+	}
+	return slice
+}
+
+func latencyBucket(d time.Duration) int {
+	for i := 0; i < sloLatencyBuckets-1; i++ {
+		if d <= time.Duration(1<<i)*time.Millisecond {
+			return i
+		}
+	}
+	return sloLatencyBuckets - 1
+}
+
+// Stats returns the measurements of each service, sorted by name.
+func (s *SLO) Stats() []SLOStats {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]SLOStats, 0, len(s.services))
+	for name, svc := range s.services {
+		stats = append(stats, s.stats(name, svc, now))
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Service < stats[j].Service })
+	return stats
+}
+
+// stats computes the measurements of svc over the window ending at now.
+// s.mu must be held.
+func (s *SLO) stats(name string, svc *sloService, now time.Time) SLOStats {
+	st := SLOStats{Service: name, SuccessRate: 1, BudgetRemaining: 1}
+	st.FailingOpen = !svc.openUntil.IsZero() && now.Before(svc.openUntil)
+	cutoff := now.Add(-s.window())
+	var latency [sloLatencyBuckets]uint64
+	for i := range svc.slices {
+		slice := &svc.slices[i]
+		if slice.total == 0 || !slice.start.After(cutoff) {
+			continue
+		}
+		st.Requests += slice.total
+		st.Bad += slice.bad
+		for j, n := range slice.latency {
+			latency[j] += n
+		}
+	}
+	if st.Requests == 0 {
+		return st
+	}
+
+	errorRate := float64(st.Bad) / float64(st.Requests)
+	st.SuccessRate = 1 - errorRate
+	st.BurnRate = errorRate / (1 - s.objective())
+	st.BudgetRemaining = 1 - st.BurnRate
+
+	percentile := func(p float64) time.Duration {
+		want := uint64(p * float64(st.Requests))
+		var seen uint64
+		for i, n := range latency {
+			seen += n
+			if seen >= want && seen > 0 {
+				return time.Duration(1<<i) * time.Millisecond
+			}
+		}
+		return time.Duration(1<<(sloLatencyBuckets-1)) * time.Millisecond
+	}
+	st.P50, st.P90, st.P99 = percentile(0.5), percentile(0.9), percentile(0.99)
+	return st
+}
+
+// PublishExpvar publishes the SLO's Stats as the expvar variable name.
+// Like expvar.Publish, it panics if the name is already in use.
+func (s *SLO) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return s.Stats() }))
+}
+
+// A statusWriter records the ICAP status code of the response.
+type statusWriter struct {
+	ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code, httpMessage, hasBody)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// SetBodyMode passes the body mode on to the underlying writer.
+func (w *statusWriter) SetBodyMode(mode BodyMode) {
+	SetBodyMode(w.ResponseWriter, mode)
+}
+
+func (w *statusWriter) addWriteLimiter(l *rateLimiter) {
+	if lw, ok := w.ResponseWriter.(interface{ addWriteLimiter(*rateLimiter) }); ok {
+		lw.addWriteLimiter(l)
+	}
+}
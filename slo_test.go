@@ -0,0 +1,69 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSLO(t *testing.T) {
+	failing := true
+	calls := 0
+	var changes []bool
+	slo := &SLO{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			calls++
+			if failing {
+				w.WriteHeader(StatusInternalServerError, nil, false)
+				return
+			}
+			Unmodified(w, req)
+		}),
+		Objective:        0.75,
+		FailOpenBurnRate: 3,
+		FailOpenFor:      50 * time.Millisecond,
+		MinRequests:      4,
+		OnFailOpen:       func(service string, on bool) { changes = append(changes, on) },
+	}
+	mux := NewServeMux()
+	mux.Handle("/av", slo)
+
+	reqmod := func(n int) string {
+		httpHdr := "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+		return strings.Repeat("REQMOD icap://icap.example.net/av ICAP/1.0\r\n"+
+			"Host: icap.example.net\r\n"+
+			"Allow: 204\r\n"+
+			"Encapsulated: req-hdr=0, null-body="+strconv.Itoa(len(httpHdr))+"\r\n"+
+			"\r\n"+httpHdr, n)
+	}
+
+	// Four failures make a burn rate of 4, and the service fails open.
+	resp := roundTrip(t, &Server{Handler: mux}, reqmod(6))
+	if strings.Count(resp, "ICAP/1.0 500 ") != 4 || strings.Count(resp, "ICAP/1.0 204 ") != 2 || calls != 4 {
+		t.Errorf("handler called %d times; responses:\n%s", calls, resp)
+	}
+	stats := slo.Stats()
+	if len(stats) != 1 || stats[0].Service != "/av" || stats[0].Requests != 4 || stats[0].Bad != 4 ||
+		stats[0].BurnRate != 4 || !stats[0].FailingOpen {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	failing = false
+	resp = roundTrip(t, &Server{Handler: mux}, reqmod(2))
+	if strings.Count(resp, "ICAP/1.0 204 ") != 2 || calls != 6 {
+		t.Errorf("after failing open: handler called %d times; responses:\n%s", calls, resp)
+	}
+	stats = slo.Stats()
+	if stats[0].Requests != 2 || stats[0].Bad != 0 || stats[0].SuccessRate != 1 || stats[0].FailingOpen {
+		t.Errorf("stats after recovery = %+v", stats)
+	}
+	if len(changes) != 2 || !changes[0] || changes[1] {
+		t.Errorf("OnFailOpen calls: %v", changes)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Detecting domain fronting by comparing the TLS server name with the Host header.
+
+package icap
+
+import (
+	"log"
+	"net"
+	"net/http"
+)
+
+// DefaultSNIHeader is the ICAP header that SNICheck reads the TLS server
+// name from when its Header is empty. ICAP clients don't send the server
+// name by default; Squid can be told to, with
+//
+//	adaptation_meta X-SNI "%ssl::>sni"
+const DefaultSNIHeader = "X-SNI"
+
+// SNIMismatch reports whether the TLS server name that the ICAP client
+// passed in the ICAP header called header differs from the host that the
+// encapsulated HTTP request is addressed to, its Host header or the host
+// of its URL, and returns both. Hosts are compared in canonical form (see
+// CanonicalHost), without ports. A request without the header, or whose
+// HTTP request names no host, doesn't mismatch.
+func (req *Request) SNIMismatch(header string) (sni, host string, mismatch bool) {
+	sni = req.Header.Get(header)
+	hr := req.Request
+	if sni == "" || hr == nil {
+		return "", "", false
+	}
+	want := CanonicalHost(sni)
+	for _, h := range []string{httpHost(req), urlHost(hr)} {
+		if h != "" && hostOnly(h) != want {
+			return sni, h, true
+		}
+	}
+	return "", "", false
+}
+
+// httpHost returns the Host header of the encapsulated HTTP request, as
+// set by a handler or as received.
+func httpHost(req *Request) string {
+	hr := req.Request
+	if h := hr.Header.Get("Host"); h != "" {
+		return h
+	}
+	if h := req.RawRequestHeader.Get("Host"); h != "" {
+		return h
+	}
+	return hr.Host
+}
+
+// urlHost returns the host and port of the URL of hr, if it has one.
+func urlHost(hr *http.Request) string {
+	if hr.URL == nil {
+		return ""
+	}
+	return hr.URL.Host
+}
+
+// hostOnly returns the canonical form of the host in hostport.
+func hostOnly(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return CanonicalHost(host)
+}
+
+// An SNIAction is what an SNICheck does with a request whose TLS server
+// name and host disagree.
+type SNIAction int
+
+const (
+	// SNILog lets the request through unchanged.
+	SNILog SNIAction = iota
+
+	// SNIBlock blocks the request.
+	SNIBlock
+)
+
+// An SNICheck is a Stage that detects domain fronting: an HTTPS request
+// whose TLS server name, seen by the proxy and passed on in an ICAP
+// header, differs from the host in its Host header or URL (see
+// Request.SNIMismatch). A client can use it to reach a blocked site
+// through a content delivery network that also serves an allowed one,
+// past filters that look only at the server name. It checks the
+// encapsulated request of both REQMOD and RESPMOD requests. Every
+// mismatch is logged and recorded in the audit record; Action decides
+// whether the request is also blocked.
+type SNICheck struct {
+	Action SNIAction
+
+	// Header is the ICAP header that holds the TLS server name. If it is
+	// empty, DefaultSNIHeader is used.
+	Header string
+
+	// Allow reports whether a mismatch is expected, such as between hosts
+	// that share a certificate and may share a connection. If Allow is
+	// nil, every mismatch is acted on.
+	Allow func(sni, host string) bool
+
+	// Status and Reason make up the block page; if they are zero, 403
+	// and "The request's host doesn't match its TLS server name." are
+	// used.
+	Status int
+	Reason string
+
+	// Log is called for each mismatch that isn't allowed. If Log is nil,
+	// the mismatch is logged with the standard logger.
+	Log func(req *Request, sni, host string)
+}
+
+// Process checks the encapsulated HTTP request of req.
+func (c *SNICheck) Process(req *Request) (StageResult, error) {
+	header := c.Header
+	if header == "" {
+		header = DefaultSNIHeader
+	}
+	sni, host, mismatch := req.SNIMismatch(header)
+	if !mismatch || c.Allow != nil && c.Allow(sni, host) {
+		return StageResult{Action: ActionContinue}, nil
+	}
+	req.Audit().AddScanResult("sni-check", "Host "+host+" doesn't match TLS server name "+sni)
+	if c.Log != nil {
+		c.Log(req, sni, host)
+	} else {
+		log.Printf("icap: host %q of %s doesn't match TLS server name %q", host, req.RawURL, sni)
+	}
+
+	if c.Action == SNIBlock {
+		status, reason := c.Status, c.Reason
+		if status == 0 {
+			status = http.StatusForbidden
+		}
+		if reason == "" {
+			reason = "The request's host doesn't match its TLS server name."
+		}
+		return StageResult{Action: ActionBlock, Status: status, Reason: reason}, nil
+	}
+	return StageResult{Action: ActionContinue}, nil
+}
@@ -0,0 +1,59 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSNICheck(t *testing.T) {
+	request := func(method, sni, target, host string) string {
+		httpHdr := "GET " + target + " HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+		encap := "req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr))
+		if method == "RESPMOD" {
+			respHdr := "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+			encap = "req-hdr=0, res-hdr=" + strconv.Itoa(len(httpHdr)) + ", null-body=" + strconv.Itoa(len(httpHdr)+len(respHdr))
+			httpHdr += respHdr
+		}
+		var sniHdr string
+		if sni != "" {
+			sniHdr = "X-SNI: " + sni + "\r\n"
+		}
+		return method + " icap://icap.example.net/check ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" + sniHdr +
+			"Encapsulated: " + encap + "\r\n" +
+			"\r\n" + httpHdr
+	}
+
+	for _, tc := range []struct {
+		method, sni, target, host string
+		action                    SNIAction
+		want                      string
+		mismatch                  bool
+	}{
+		{"REQMOD", "", "https://hidden.example/", "hidden.example", SNIBlock, "ICAP/1.0 204 ", false},
+		{"REQMOD", "WWW.Example.com.", "https://www.example.com:443/", "www.example.com", SNIBlock, "ICAP/1.0 204 ", false},
+		{"REQMOD", "front.example", "/", "hidden.example", SNILog, "ICAP/1.0 204 ", true},
+		{"REQMOD", "front.example", "/", "hidden.example", SNIBlock, "HTTP/1.1 403 Forbidden\r\n", true},
+		{"REQMOD", "front.example", "https://hidden.example/", "front.example", SNIBlock, "HTTP/1.1 403 Forbidden\r\n", true},
+		{"RESPMOD", "front.example", "/", "hidden.example", SNIBlock, "HTTP/1.1 403 Forbidden\r\n", true},
+		{"REQMOD", "front.example", "/", "cdn.front.example", SNIBlock, "ICAP/1.0 204 ", false},
+	} {
+		var logged bool
+		check := &SNICheck{
+			Action: tc.action,
+			Allow:  func(sni, host string) bool { return strings.HasSuffix(host, "."+sni) },
+			Log:    func(req *Request, sni, host string) { logged = true },
+		}
+		srv := &Server{Handler: &Pipeline{Stages: []Stage{check}}}
+		resp := roundTrip(t, srv, request(tc.method, tc.sni, tc.target, tc.host))
+		if !strings.Contains(resp, tc.want) || logged != tc.mismatch {
+			t.Errorf("%s %s with SNI %q and Host %s, action %d: logged = %v, response:\n%s", tc.method, tc.target, tc.sni, tc.host, tc.action, logged, resp)
+		}
+	}
+}
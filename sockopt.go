@@ -0,0 +1,44 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Control of the options of listening sockets.
+
+package icap
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// ErrSockoptUnsupported is returned by socket control functions
+// that are not available on the current platform.
+var ErrSockoptUnsupported = errors.New("icap: socket option not supported on this platform")
+
+// A ControlFunc sets options on a socket before it is bound, for use as
+// net.ListenConfig.Control.
+type ControlFunc func(network, address string, c syscall.RawConn) error
+
+// ControlFuncs returns a ControlFunc that calls each of fns in turn,
+// stopping at the first error.
+func ControlFuncs(fns ...ControlFunc) ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		for _, fn := range fns {
+			if err := fn(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// listen opens the listener for ListenAndServe and ListenAndServeTLS.
+func (srv *Server) listen(addr string) (net.Listener, error) {
+	lc := srv.ListenConfig
+	if lc == nil {
+		lc = new(net.ListenConfig)
+	}
+	return lc.Listen(context.Background(), srv.IPMode.network(), addr)
+}
@@ -0,0 +1,23 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import "syscall"
+
+// BindToDevice returns a ControlFunc that binds sockets to the network
+// interface with the given name (SO_BINDTODEVICE), so that the server
+// accepts connections only through that interface.
+func BindToDevice(name string) ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.BindToDevice(int(fd), name)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package icap
+
+import "syscall"
+
+// BindToDevice returns a ControlFunc that binds sockets to a network
+// interface. It is only supported on Linux; elsewhere the ControlFunc
+// returns ErrSockoptUnsupported.
+func BindToDevice(name string) ControlFunc {
+	return func(network, address string, c syscall.RawConn) error {
+		return ErrSockoptUnsupported
+	}
+}
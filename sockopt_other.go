@@ -0,0 +1,15 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package icap
+
+import "syscall"
+
+// ReusePort is a ControlFunc that sets SO_REUSEPORT. It is not supported
+// on this platform, and always returns ErrSockoptUnsupported.
+func ReusePort(network, address string, c syscall.RawConn) error {
+	return ErrSockoptUnsupported
+}
@@ -0,0 +1,11 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !(386 || amd64 || arm))
+
+package icap
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
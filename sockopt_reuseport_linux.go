@@ -0,0 +1,11 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux && (386 || amd64 || arm)
+
+package icap
+
+// soReusePort is SO_REUSEPORT, which package syscall doesn't define
+// for these architectures.
+const soReusePort = 0xf
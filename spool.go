@@ -0,0 +1,164 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Temporary files for large message bodies.
+
+package icap
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// ErrSpoolFull is returned when writing to a SpoolFile would exceed
+// the size limits of its Spool.
+var ErrSpoolFull = errors.New("icap: spool size limit exceeded")
+
+// A Spool manages the temporary files used to hold message bodies that are
+// too large to keep in memory, bounding the disk space they use.
+// The zero value is usable and places files in os.TempDir without limits.
+type Spool struct {
+	Dir          string // directory for the files; os.TempDir() if empty
+	MaxFileSize  int64  // maximum size of a single file; 0 means no limit
+	MaxTotalSize int64  // maximum combined size of all files; 0 means no limit
+
+	mu    sync.Mutex
+	files map[*SpoolFile]struct{}
+	total int64
+}
+
+// DefaultSpool is the Spool used by servers that don't set Server.Spool.
+var DefaultSpool = &Spool{}
+
+// Create creates a new, empty spool file. Its contents are readable
+// only by the current user, and it is removed when it is closed.
+func (s *Spool) Create() (*SpoolFile, error) {
+	dir := s.Dir
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.CreateTemp(dir, "icap-spool-*")
+	if err != nil {
+		return nil, err
+	}
+
+	sf := &SpoolFile{f: f, spool: s}
+	s.mu.Lock()
+	if s.files == nil {
+		s.files = make(map[*SpoolFile]struct{})
+	}
+	s.files[sf] = struct{}{}
+	s.mu.Unlock()
+	return sf, nil
+}
+
+// Usage returns the number of open spool files and their combined size.
+func (s *Spool) Usage() (files int, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files), s.total
+}
+
+// RemoveAll closes and removes all open spool files.
+// It is meant to be called when shutting down.
+func (s *Spool) RemoveAll() error {
+	s.mu.Lock()
+	files := make([]*SpoolFile, 0, len(s.files))
+	for f := range s.files {
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for _, f := range files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// reserve accounts for n more bytes in f, if the limits allow it.
+func (s *Spool) reserve(f *SpoolFile, n int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxFileSize > 0 && f.size+n > s.MaxFileSize {
+		return false
+	}
+	if s.MaxTotalSize > 0 && s.total+n > s.MaxTotalSize {
+		return false
+	}
+	f.size += n
+	s.total += n
+	return true
+}
+
+// release gives back n bytes reserved for f that were never written.
+func (s *Spool) release(f *SpoolFile, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f.size -= n
+	s.total -= n
+}
+
+// A SpoolFile is a temporary file created by a Spool.
+type SpoolFile struct {
+	f       *os.File
+	spool   *Spool
+	size    int64
+	onClose func() // if not nil, called when the file is closed
+}
+
+// Write appends p to the file. It returns ErrSpoolFull, without writing
+// anything, if that would exceed the spool's limits.
+func (f *SpoolFile) Write(p []byte) (n int, err error) {
+	if !f.spool.reserve(f, int64(len(p))) {
+		return 0, ErrSpoolFull
+	}
+	n, err = f.f.Write(p)
+	if n < len(p) {
+		f.spool.release(f, int64(len(p)-n))
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt.
+func (f *SpoolFile) ReadAt(p []byte, off int64) (n int, err error) {
+	return f.f.ReadAt(p, off)
+}
+
+// Name returns the path of the file.
+func (f *SpoolFile) Name() string {
+	return f.f.Name()
+}
+
+// Size returns the number of bytes written to the file.
+func (f *SpoolFile) Size() int64 {
+	f.spool.mu.Lock()
+	defer f.spool.mu.Unlock()
+	return f.size
+}
+
+// Close closes and removes the file, releasing its space in the spool.
+// Closing a file more than once has no effect.
+func (f *SpoolFile) Close() error {
+	s := f.spool
+	s.mu.Lock()
+	if _, ok := s.files[f]; !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.files, f)
+	s.total -= f.size
+	s.mu.Unlock()
+
+	if f.onClose != nil {
+		f.onClose()
+	}
+	f.f.Close()
+	return os.Remove(f.f.Name())
+}
@@ -0,0 +1,31 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import "testing"
+
+func TestSpoolFailedWrite(t *testing.T) {
+	spool := &Spool{Dir: t.TempDir(), MaxTotalSize: 10}
+	f, err := spool.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("four")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write that fails gives back the space it reserved.
+	f.f.Close()
+	if n, err := f.Write([]byte("more")); n != 0 || err == nil {
+		t.Errorf("Write to a closed file = %d, %v", n, err)
+	}
+	if size := f.Size(); size != 4 {
+		t.Errorf("Size() = %d after a failed write, want 4", size)
+	}
+	if _, total := spool.Usage(); total != 4 {
+		t.Errorf("spool total = %d after a failed write, want 4", total)
+	}
+}
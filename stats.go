@@ -0,0 +1,236 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Statistics on the requests a server parses, for diagnosing
+// interoperability problems.
+
+package icap
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ParserStats is a snapshot of the statistics that a Server keeps on the
+// requests it has parsed and the responses it has sent.
+type ParserStats struct {
+	Requests int64 // requests whose parsing started
+
+	// ParseErrors counts the requests that couldn't be parsed, by the
+	// kind of error, such as "malformed Encapsulated: header" or "eof".
+	ParseErrors map[string]int64
+
+	// HeaderLimits counts the requests that were cut off for taking
+	// longer than ReadHeaderTimeout to send their headers and preview, or
+	// for headers larger than MaxHeaderBytes. They are also counted in
+	// ParseErrors, as "timeout" and "header too large".
+	HeaderLimits int64
+
+	// LenientFixups counts the deviations from RFC 3507 that were
+	// tolerated (see LenientDialect), by problem.
+	LenientFixups map[string]int64
+
+	Previews         int64 // requests with a preview
+	CompletePreviews int64 // previews that held the whole body (ieof)
+	Continues        int64 // 100 Continue responses sent after previews
+
+	// PreviewMismatches counts the previews whose size didn't match
+	// their Preview header (see Request.PreviewMismatch).
+	PreviewMismatches int64
+
+	Responses     int64   // final responses sent
+	NoContent     int64   // 204 No Content responses
+	NoContentRate float64 // NoContent / Responses
+
+	// ChunkSizes is a histogram of the sizes of the body chunks received,
+	// with buckets such as "<=1024" and ">65536".
+	ChunkSizes map[string]int64
+}
+
+// chunkBuckets are the upper bounds of the buckets of ChunkSizes.
+var chunkBuckets = []uint64{64, 1024, 16 << 10, 64 << 10}
+
+// parserStats collects ParserStats.
+type parserStats struct {
+	requests, previews, completePreviews, continues atomic.Int64
+	previewMismatches                               atomic.Int64
+	responses, noContent                            atomic.Int64
+	headerLimits                                    atomic.Int64
+	chunks                                          [5]atomic.Int64 // len(chunkBuckets)+1
+
+	mu     sync.Mutex
+	errors map[string]int64
+	fixups map[string]int64
+}
+
+// request records the outcome of parsing a request.
+func (s *parserStats) request(req *Request, err error) {
+	if s == nil {
+		return
+	}
+	s.requests.Add(1)
+	if err == nil && (req == nil || len(req.Diagnostics) == 0) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if s.errors == nil {
+			s.errors = make(map[string]int64)
+		}
+		kind := parseErrorKind(err)
+		s.errors[kind]++
+		if kind == "timeout" || kind == "header too large" {
+			s.headerLimits.Add(1)
+		}
+	}
+	if req != nil && len(req.Diagnostics) > 0 {
+		if s.fixups == nil {
+			s.fixups = make(map[string]int64)
+		}
+		for _, d := range req.Diagnostics {
+			s.fixups[d.Problem]++
+		}
+	}
+}
+
+func (s *parserStats) preview(complete bool) {
+	if s == nil {
+		return
+	}
+	s.previews.Add(1)
+	if complete {
+		s.completePreviews.Add(1)
+	}
+}
+
+func (s *parserStats) previewMismatch() {
+	if s != nil {
+		s.previewMismatches.Add(1)
+	}
+}
+
+func (s *parserStats) sentContinue() {
+	if s != nil {
+		s.continues.Add(1)
+	}
+}
+
+func (s *parserStats) chunk(size uint64) {
+	if s == nil {
+		return
+	}
+	i := 0
+	for i < len(chunkBuckets) && size > chunkBuckets[i] {
+		i++
+	}
+	s.chunks[i].Add(1)
+}
+
+func (s *parserStats) response(code int) {
+	if s == nil || code == 0 {
+		return
+	}
+	s.responses.Add(1)
+	if code == StatusNoContent {
+		s.noContent.Add(1)
+	}
+}
+
+func (s *parserStats) snapshot() ParserStats {
+	st := ParserStats{
+		Requests:          s.requests.Load(),
+		Previews:          s.previews.Load(),
+		CompletePreviews:  s.completePreviews.Load(),
+		Continues:         s.continues.Load(),
+		PreviewMismatches: s.previewMismatches.Load(),
+		HeaderLimits:      s.headerLimits.Load(),
+		Responses:         s.responses.Load(),
+		NoContent:         s.noContent.Load(),
+		ParseErrors:       make(map[string]int64),
+		LenientFixups:     make(map[string]int64),
+		ChunkSizes:        make(map[string]int64),
+	}
+	if st.Responses > 0 {
+		st.NoContentRate = float64(st.NoContent) / float64(st.Responses)
+	}
+	for i := range s.chunks {
+		name := ">" + strconv.FormatUint(chunkBuckets[len(chunkBuckets)-1], 10)
+		if i < len(chunkBuckets) {
+			name = "<=" + strconv.FormatUint(chunkBuckets[i], 10)
+		}
+		st.ChunkSizes[name] = s.chunks[i].Load()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.errors {
+		st.ParseErrors[k] = v
+	}
+	for k, v := range s.fixups {
+		st.LenientFixups[k] = v
+	}
+	return st
+}
+
+// parseErrorKind classifies an error from parsing a request.
+func parseErrorKind(err error) string {
+	var bse *badStringError
+	var ne net.Error
+	var ue *url.Error
+	var pe textproto.ProtocolError
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		return "eof"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.As(err, &bse):
+		return bse.what
+	case errors.As(err, &ue):
+		return "invalid URL"
+	case errors.As(err, &pe):
+		return "malformed header"
+	case errors.Is(err, errHeaderTooLarge):
+		return "header too large"
+	case errors.Is(err, errLineTooLong):
+		return "line too long"
+	case strings.HasPrefix(err.Error(), "error while parsing HTTP request"):
+		return "malformed HTTP request"
+	case strings.HasPrefix(err.Error(), "error while parsing HTTP response"):
+		return "malformed HTTP response"
+	}
+	return "other"
+}
+
+// ParserStats returns the statistics the server has collected on the
+// requests it has parsed.
+func (srv *Server) ParserStats() ParserStats {
+	return srv.stats.snapshot()
+}
+
+// PublishExpvar publishes the server's ParserStats as the expvar
+// variable name, which is served as JSON at /debug/vars by
+// http.DefaultServeMux. Like expvar.Publish, it panics if the name is
+// already in use.
+func (srv *Server) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return srv.ParserStats() }))
+}
+
+// serveStats writes the server's ParserStats as JSON.
+func (srv *Server) serveStats(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(srv.ParserStats())
+}
@@ -0,0 +1,88 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"encoding/json"
+	"expvar"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParserStats(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 11\r\n" +
+		"\r\n"
+	request := func(method, body string) string {
+		return method + " icap://icap.example.net/respmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Preview: 5\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr + body
+	}
+
+	srv := &Server{
+		Dialect: LenientDialect{},
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			io.Copy(io.Discard, req.Response.Body)
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+	}
+
+	// A complete preview, with a method in lower case.
+	resp := roundTrip(t, srv, request("respmod", "5\r\nhello\r\n0; ieof\r\n\r\n"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 204") {
+		t.Fatalf("complete preview:\n%s", resp)
+	}
+
+	// A preview followed by the rest of the body after 100 Continue.
+	resp = roundTrip(t, srv, request("RESPMOD", "5\r\nhello\r\n0\r\n\r\n6\r\n world\r\n0\r\n\r\n"))
+	if !strings.Contains(resp, "ICAP/1.0 204") {
+		t.Fatalf("continued preview:\n%s", resp)
+	}
+
+	// A malformed Encapsulated header.
+	roundTrip(t, srv, "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: res-hdr\r\n"+
+		"\r\n")
+
+	st := srv.ParserStats()
+	if st.Requests != 3 || st.Previews != 2 || st.CompletePreviews != 1 || st.Continues != 1 {
+		t.Errorf("request counts: %+v", st)
+	}
+	if st.ParseErrors["malformed Encapsulated: header"] != 1 {
+		t.Errorf("ParseErrors = %v", st.ParseErrors)
+	}
+	if st.LenientFixups["method not in upper case"] != 1 {
+		t.Errorf("LenientFixups = %v", st.LenientFixups)
+	}
+	if st.Responses != 2 || st.NoContent != 2 || st.NoContentRate != 1 {
+		t.Errorf("response counts: %+v", st)
+	}
+	if st.ChunkSizes["<=64"] != 3 || st.ChunkSizes[">65536"] != 0 {
+		t.Errorf("ChunkSizes = %v", st.ChunkSizes)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.HealthHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/icap/stats", nil))
+	var served ParserStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatalf("decoding /stats: %v\n%s", err, rec.Body)
+	}
+	if served.Requests != 3 || served.ParseErrors["malformed Encapsulated: header"] != 1 {
+		t.Errorf("/stats served %+v", served)
+	}
+
+	srv.PublishExpvar("icap_test_parser")
+	v := expvar.Get("icap_test_parser")
+	if v == nil || !strings.Contains(v.String(), `"Continues":1`) {
+		t.Errorf("expvar = %v", v)
+	}
+}
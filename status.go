@@ -10,18 +10,44 @@ import (
 	"net/http"
 )
 
+// ICAP status codes (RFC 3507, section 4.3.3). They are untyped constants,
+// like those of net/http, so they can be passed to WriteHeader and compared
+// with Response.StatusCode directly.
+const (
+	StatusContinue = 100
+
+	StatusOK             = 200
+	StatusNoContent      = 204 // No Modifications
+	StatusPartialContent = 206
+
+	StatusMovedPermanently = 301
+
+	StatusBadRequest            = 400
+	StatusForbidden             = 403
+	StatusNotFound              = 404 // ICAP Service Not Found
+	StatusMethodNotAllowed      = 405
+	StatusRequestTimeout        = 408
+	StatusRequestEntityTooLarge = 413
+
+	StatusInternalServerError = 500 // Server Error
+	StatusNotImplemented      = 501
+	StatusBadGateway          = 502
+	StatusServiceUnavailable  = 503 // Service Overloaded
+	StatusVersionNotSupported = 505
+)
+
 var statusText = map[int]string{
-	100: "Continue",
-	204: "No Modifications",
-	400: "Bad Request",
-	404: "ICAP Service Not Found",
-	405: "Method Not Allowed",
-	408: "Request Timeout",
-	500: "Server Error",
-	501: "Method Not Implemented",
-	502: "Bad Gateway",
-	503: "Service Overloaded",
-	505: "ICAP Version Not Supported",
+	StatusContinue:            "Continue",
+	StatusNoContent:           "No Modifications",
+	StatusBadRequest:          "Bad Request",
+	StatusNotFound:            "ICAP Service Not Found",
+	StatusMethodNotAllowed:    "Method Not Allowed",
+	StatusRequestTimeout:      "Request Timeout",
+	StatusInternalServerError: "Server Error",
+	StatusNotImplemented:      "Method Not Implemented",
+	StatusBadGateway:          "Bad Gateway",
+	StatusServiceUnavailable:  "Service Overloaded",
+	StatusVersionNotSupported: "ICAP Version Not Supported",
 }
 
 // StatusText returns a text for the ICAP status code. It returns the empty string if the code is unknown.
@@ -32,3 +58,14 @@ func StatusText(code int) string {
 	}
 	return http.StatusText(code)
 }
+
+// IsSuccess reports whether code is a successful final status (2xx),
+// including 204 No Modifications.
+func IsSuccess(code int) bool {
+	return code >= 200 && code < 300
+}
+
+// IsError reports whether code reports a client or server error (4xx or 5xx).
+func IsError(code int) bool {
+	return code >= 400 && code < 600
+}
@@ -19,3 +19,21 @@ func TestStatusCodes(t *testing.T) {
 	checkString("Message", StatusText(401), "Unauthorized", t)
 	checkString("Status-not-found message", StatusText(12345), "", t)
 }
+
+func TestStatusClasses(t *testing.T) {
+	for _, c := range []struct {
+		code             int
+		success, isError bool
+	}{
+		{StatusContinue, false, false},
+		{StatusOK, true, false},
+		{StatusNoContent, true, false},
+		{StatusMovedPermanently, false, false},
+		{StatusBadRequest, false, true},
+		{StatusServiceUnavailable, false, true},
+	} {
+		if IsSuccess(c.code) != c.success || IsError(c.code) != c.isError {
+			t.Errorf("%d: IsSuccess = %v, IsError = %v", c.code, IsSuccess(c.code), IsError(c.code))
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Virtual hosting of isolated tenants.
+
+package icap
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrBodyTooLarge is returned when reading an encapsulated body
+// that exceeds a configured size limit.
+var ErrBodyTooLarge = errors.New("icap: message body too large")
+
+// A Tenant is an isolated tree of ICAP services, selected by the host name
+// that clients use to reach the server. Register tenants with
+// ServeMux.HandleTenant.
+type Tenant struct {
+	Name    string  // name used in logs and metrics
+	Handler Handler // handler for the tenant's services, usually a *ServeMux
+	ISTag   string  // ISTag sent in responses whose handler doesn't set one
+
+	// Quotas; zero means no limit.
+	MaxActive      int   // concurrent transactions; more get 503 Service Overloaded
+	MaxBodySize    int64 // bytes per encapsulated body; larger ones get 413 unless the handler has responded
+	BytesPerSecond int64 // combined rate at which the tenant's bodies are read
+
+	requests atomic.Int64
+	active   atomic.Int64
+	rejected atomic.Int64
+	tooLarge atomic.Int64
+
+	limiterOnce sync.Once
+	limiter     *rateLimiter
+}
+
+// TenantStats holds a snapshot of a tenant's counters.
+type TenantStats struct {
+	Requests int64 // transactions handled since the server started
+	Active   int64 // transactions in progress
+	Rejected int64 // transactions refused because MaxActive was reached
+	TooLarge int64 // transactions refused because of MaxBodySize
+}
+
+// Stats returns a snapshot of the tenant's counters.
+func (t *Tenant) Stats() TenantStats {
+	return TenantStats{
+		Requests: t.requests.Load(),
+		Active:   t.active.Load(),
+		Rejected: t.rejected.Load(),
+		TooLarge: t.tooLarge.Load(),
+	}
+}
+
+// ServeICAP serves req with the tenant's handler, enforcing its quotas.
+func (t *Tenant) ServeICAP(w ResponseWriter, req *Request) {
+	t.requests.Add(1)
+	active := t.active.Add(1)
+	defer t.active.Add(-1)
+
+	req.Tenant = t
+	if t.ISTag != "" && w.Header().Get("ISTag") == "" {
+		w.Header().Set("ISTag", t.ISTag)
+	}
+
+	if t.MaxActive > 0 && active > int64(t.MaxActive) {
+		t.rejected.Add(1)
+		w.WriteHeader(StatusServiceUnavailable, nil, false)
+		return
+	}
+
+	if body := req.bodyPtr(); body != nil {
+		if t.MaxBodySize > 0 {
+			if n, err := strconv.ParseInt(req.bodyHeader().Get("Content-Length"), 10, 64); err == nil && n > t.MaxBodySize {
+				t.tooLarge.Add(1)
+				w.WriteHeader(StatusRequestEntityTooLarge, nil, false)
+				return
+			}
+			*body = &maxBodyReader{r: *body, remaining: t.MaxBodySize, req: req}
+		}
+		if t.BytesPerSecond > 0 {
+			t.limiterOnce.Do(func() {
+				t.limiter = newRateLimiter(t.BytesPerSecond, 0)
+			})
+			*body = &limitedReader{r: *body, limiters: []*rateLimiter{t.limiter}}
+		}
+	}
+
+	h := t.Handler
+	if h == nil {
+		h = NotFoundHandler()
+	}
+	h.ServeICAP(w, req)
+	if req.bodyTooLarge.Load() {
+		// A body without Content-Length, found to be too large as it
+		// was read. The server sends 413 if the handler didn't respond.
+		t.tooLarge.Add(1)
+	}
+}
+
+// requestHost returns the host name the client used to reach the server:
+// the ICAP Host header, or else the authority of the request URI,
+// lowercased and without a port.
+func requestHost(req *Request) string {
+	host := req.Header.Get("Host")
+	if host == "" && req.URL != nil {
+		host = req.URL.Host
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// A maxBodyReader returns ErrBodyTooLarge once more than remaining bytes
+// have been read from r, and marks req as having too large a body.
+type maxBodyReader struct {
+	r         io.ReadCloser
+	remaining int64
+	req       *Request
+}
+
+func (mr *maxBodyReader) Read(p []byte) (n int, err error) {
+	if mr.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	if int64(len(p)) > mr.remaining+1 {
+		p = p[:mr.remaining+1]
+	}
+	n, err = mr.r.Read(p)
+	mr.remaining -= int64(n)
+	if mr.remaining < 0 {
+		n += int(mr.remaining)
+		mr.req.bodyTooLarge.Store(true)
+		return n, ErrBodyTooLarge
+	}
+	return n, err
+}
+
+func (mr *maxBodyReader) Close() error {
+	return mr.r.Close()
+}
@@ -0,0 +1,143 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTenantRouting(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n" +
+		"Content-Length: 11\r\n" +
+		"\r\n"
+	request := func(host string) string {
+		return "RESPMOD icap://" + host + "/respmod ICAP/1.0\r\n" +
+			"Host: " + host + ":1344\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr +
+			"b\r\nhello world\r\n0\r\n\r\n"
+	}
+
+	small := NewServeMux()
+	small.HandleFunc("/respmod", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	tenant := &Tenant{Name: "small", Handler: small, ISTag: `"small-1"`, MaxBodySize: 5}
+
+	mux := NewServeMux()
+	mux.HandleTenant("small.example.net", tenant)
+	mux.HandleFunc("/respmod", func(w ResponseWriter, req *Request) {
+		w.Header().Set("ISTag", `"default"`)
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	srv := &Server{Handler: mux}
+
+	resp := roundTrip(t, srv, request("other.example.net"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 204") || !strings.Contains(resp, `Istag: "default"`) {
+		t.Errorf("request for other host not served by default tree:\n%s", resp)
+	}
+
+	resp = roundTrip(t, srv, request("SMALL.example.net"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 413") || !strings.Contains(resp, `Istag: "small-1"`) {
+		t.Errorf("oversized body not refused by tenant:\n%s", resp)
+	}
+	if stats := tenant.Stats(); stats.Requests != 1 || stats.TooLarge != 1 || stats.Active != 0 {
+		t.Errorf("tenant stats: %+v", stats)
+	}
+}
+
+func TestTenantChunkedBody(t *testing.T) {
+	httpHdr := "HTTP/1.1 200 OK\r\n\r\n"
+	request := func(path, body string) string {
+		return "RESPMOD icap://small.example.net" + path + " ICAP/1.0\r\n" +
+			"Host: small.example.net\r\n" +
+			"Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr +
+			strconv.FormatInt(int64(len(body)), 16) + "\r\n" + body + "\r\n0\r\n\r\n"
+	}
+
+	mux := NewServeMux()
+	mux.HandleFunc("/read", func(w ResponseWriter, req *Request) {
+		if _, err := io.ReadAll(req.Response.Body); err != nil {
+			// Leave the response to the server.
+			return
+		}
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	mux.HandleFunc("/respond", func(w ResponseWriter, req *Request) {
+		if _, err := io.ReadAll(req.Response.Body); err != nil {
+			Error(w, StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	tenant := &Tenant{Handler: mux, MaxBodySize: 5}
+	srv := &Server{Handler: tenant}
+
+	for _, tc := range []struct {
+		path, body string
+		want       string
+		tooLarge   int64
+	}{
+		{"/read", "small", "ICAP/1.0 204 ", 0},
+		{"/read", "hello world", "ICAP/1.0 413 ", 1},
+		{"/respond", "hello world", "ICAP/1.0 500 ", 2},
+	} {
+		resp := roundTrip(t, srv, request(tc.path, tc.body))
+		if !strings.HasPrefix(resp, tc.want) {
+			t.Errorf("%s with %q: want %q:\n%s", tc.path, tc.body, tc.want, resp)
+		}
+		if n := tenant.Stats().TooLarge; n != tc.tooLarge {
+			t.Errorf("%s with %q: TooLarge = %d, want %d", tc.path, tc.body, n, tc.tooLarge)
+		}
+	}
+}
+
+func TestTenantHost(t *testing.T) {
+	tree := func(name string) *ServeMux {
+		mux := NewServeMux()
+		mux.HandleFunc("/options", func(w ResponseWriter, req *Request) {
+			w.Header().Set("X-Tree", name)
+			w.WriteHeader(StatusOK, nil, false)
+		})
+		return mux
+	}
+	mux := tree("default")
+	mux.HandleFunc("/default-only", func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusOK, nil, false)
+	})
+	mux.HandleTenant("A.example.net", &Tenant{Handler: tree("a")})
+	mux.HandleTenant("b.example.net", &Tenant{Handler: tree("b")})
+	srv := &Server{Handler: mux}
+
+	for _, tc := range []struct {
+		uri, host string
+		want      string
+	}{
+		{"icap://a.example.net/options", "a.example.net", "X-Tree: a\r\n"},
+		{"icap://a.example.net/options", "a.example.net:1344", "X-Tree: a\r\n"},
+		{"icap://a.example.net/options", "A.EXAMPLE.NET", "X-Tree: a\r\n"},
+		{"icap://a.example.net/options", "a.example.net.:1344", "X-Tree: a\r\n"},
+		{"icap://B.Example.Net:1344/options", "", "X-Tree: b\r\n"},
+		{"icap://a.example.net/options", "b.example.net", "X-Tree: b\r\n"},
+		{"icap://c.example.net/options", "c.example.net", "X-Tree: default\r\n"},
+		{"icap://10.0.0.1:1344/options", "10.0.0.1:1344", "X-Tree: default\r\n"},
+		{"icap://a.example.net/default-only", "a.example.net", "ICAP/1.0 404 "},
+		{"icap://c.example.net/default-only", "c.example.net", "ICAP/1.0 200 "},
+		{"icap://c.example.net/missing", "c.example.net", "ICAP/1.0 404 "},
+	} {
+		request := "OPTIONS " + tc.uri + " ICAP/1.0\r\n"
+		if tc.host != "" {
+			request += "Host: " + tc.host + "\r\n"
+		}
+		resp := roundTrip(t, srv, request+"\r\n")
+		if !strings.Contains(resp, tc.want) {
+			t.Errorf("%s with Host %q: want %q in response:\n%s", tc.uri, tc.host, tc.want, resp)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Limits on reading requests and running handlers: timeouts for headers,
+// bodies and handlers, and the size of headers.
+
+package icap
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxHeaderBytes is the size of the headers of a request that a
+// Server accepts if its MaxHeaderBytes is zero.
+const DefaultMaxHeaderBytes = 1 << 20
+
+// errHeaderTooLarge is the error from reading a request whose headers
+// are larger than the server's MaxHeaderBytes.
+var errHeaderTooLarge = errors.New("request header too large")
+
+// ErrHandlerTimeout is the cause of the cancellation of a request's
+// context when its handler has not begun its response within the
+// server's HandlerTimeout (see context.Cause).
+var ErrHandlerTimeout = errors.New("icap: handler timeout")
+
+// readHeaderTimeout returns the time allowed for reading the headers and
+// preview of a request.
+func (srv *Server) readHeaderTimeout() time.Duration {
+	switch {
+	case srv.ReadHeaderTimeout > 0:
+		return srv.ReadHeaderTimeout
+	case srv.ReadTimeout > 0:
+		return srv.ReadTimeout
+	}
+	return time.Minute
+}
+
+// firstRequestTimeout returns the time allowed for the first request to
+// begin on a new connection.
+func (srv *Server) firstRequestTimeout() time.Duration {
+	if srv.ReadTimeout > 0 {
+		return srv.ReadTimeout
+	}
+	return srv.readHeaderTimeout()
+}
+
+// tlsHandshakeTimeout returns the time allowed for a TLS handshake.
+func (srv *Server) tlsHandshakeTimeout() time.Duration {
+	if srv.TLSHandshakeTimeout > 0 {
+		return srv.TLSHandshakeTimeout
+	}
+	d := srv.readHeaderTimeout()
+	if srv.WriteTimeout > 0 && srv.WriteTimeout < d {
+		d = srv.WriteTimeout
+	}
+	return d
+}
+
+// handshake completes the TLS handshake of c, if it is a TLS connection,
+// within the server's TLSHandshakeTimeout. It reports whether the
+// connection can be served.
+func (c *conn) handshake() bool {
+	tc, ok := c.rwc.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	c.rwc.SetDeadline(time.Now().Add(c.server.tlsHandshakeTimeout()))
+	if err := tc.Handshake(); err != nil {
+		log.Printf("icap: TLS handshake error from %s: %v", c.remoteAddr, err)
+		c.server.trace().tlsHandshakeError(c.rwc, err)
+		return false
+	}
+	c.rwc.SetWriteDeadline(time.Time{})
+	if d := c.server.firstRequestTimeout(); d != 0 {
+		c.rwc.SetReadDeadline(time.Now().Add(d))
+	}
+	return true
+}
+
+func (srv *Server) maxHeaderBytes() int {
+	if srv.MaxHeaderBytes > 0 {
+		return srv.MaxHeaderBytes
+	}
+	return DefaultMaxHeaderBytes
+}
+
+// setBodyDeadline sets the read deadline for the body of a transaction
+// that began at start, once its headers have been read.
+func (c *conn) setBodyDeadline(start time.Time) {
+	if start.IsZero() {
+		start = time.Now()
+	}
+	switch {
+	case c.server.BodyReadTimeout > 0:
+		c.reader.idle.Store(int64(c.server.BodyReadTimeout))
+		c.rwc.SetReadDeadline(time.Now().Add(c.server.BodyReadTimeout))
+	case c.server.ReadTimeout > 0:
+		c.rwc.SetReadDeadline(start.Add(c.server.ReadTimeout))
+	default:
+		c.rwc.SetReadDeadline(time.Time{})
+	}
+}
+
+// A connReader reads from a connection. While idle is set, it extends
+// the read deadline before each read, so that reading fails only after
+// the connection has been idle that long. While budget is not negative,
+// it allows only that many more bytes to be read.
+type connReader struct {
+	conn   net.Conn
+	idle   atomic.Int64 // nanoseconds, or 0 if the deadline isn't extended
+	budget atomic.Int64 // bytes, or -1 for no limit
+	err    atomic.Pointer[error]
+}
+
+func newConnReader(conn net.Conn) *connReader {
+	r := &connReader{conn: conn}
+	r.budget.Store(-1)
+	return r
+}
+
+func (r *connReader) Read(p []byte) (int, error) {
+	if d := r.idle.Load(); d > 0 {
+		r.conn.SetReadDeadline(time.Now().Add(time.Duration(d)))
+	}
+	b := r.budget.Load()
+	if b == 0 {
+		r.err.Store(&errHeaderTooLarge)
+		return 0, errHeaderTooLarge
+	}
+	if b > 0 && int64(len(p)) > b {
+		p = p[:b]
+	}
+	n, err := r.conn.Read(p)
+	if b > 0 {
+		r.budget.Add(-int64(n))
+	}
+	if err != nil && err != io.EOF {
+		r.err.Store(&err)
+	}
+	return n, err
+}
+
+// readError returns the last error from reading the connection other
+// than io.EOF, if any. A bufio.Reader doesn't always pass on such an
+// error; if a line was partly read, it returns the line without it.
+func (r *connReader) readError() error {
+	if err := r.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// limitHeader limits the reads from the connection while the headers of a
+// request are read. The buffered reader may read up to its size past the
+// end of the headers, so that much is allowed in addition.
+func (c *conn) limitHeader() {
+	c.reader.budget.Store(int64(c.server.maxHeaderBytes() + c.buf.Reader.Size()))
+}
+
+// headerRead lifts the limit set by limitHeader.
+func (c *conn) headerRead() {
+	c.reader.budget.Store(-1)
+}
+
+// startHandlerTimer starts timing the handler for the transaction of w,
+// if the server has a HandlerTimeout. The timer is stopped when the
+// handler begins its response.
+func (w *respWriter) startHandlerTimer() {
+	d := w.conn.server.HandlerTimeout
+	if d <= 0 || w.req.cancelCtx == nil {
+		return
+	}
+	cancel := w.req.cancelCtx
+	w.handlerTimer = time.AfterFunc(d, func() {
+		w.handlerTimedOut.Store(true)
+		cancel(ErrHandlerTimeout)
+	})
+}
+
+// stopHandlerTimer stops the timer started by startHandlerTimer.
+func (w *respWriter) stopHandlerTimer() {
+	if w.handlerTimer != nil {
+		w.handlerTimer.Stop()
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadTimeouts(t *testing.T) {
+	var body string
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			b, _ := io.ReadAll(req.Request.Body)
+			body = string(b)
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		ReadHeaderTimeout: 50 * time.Millisecond,
+		BodyReadTimeout:   300 * time.Millisecond,
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(l)
+
+	// send writes the parts of a request with a pause between them, and
+	// returns the response.
+	send := func(pause time.Duration, parts ...string) string {
+		t.Helper()
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		for i, p := range parts {
+			if i > 0 {
+				time.Sleep(pause)
+			}
+			if _, err := io.WriteString(c, p); err != nil {
+				break
+			}
+		}
+		c.(*net.TCPConn).CloseWrite()
+		resp, _ := io.ReadAll(c)
+		return string(resp)
+	}
+
+	httpHdr := "POST / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"
+	head := "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+		"Host: icap.example.net\r\n" +
+		"Encapsulated: req-hdr=0, req-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+		"\r\n" + httpHdr
+
+	// A slow upload goes on as long as data keeps arriving.
+	chunks := []string{head}
+	for i := 0; i < 5; i++ {
+		chunks = append(chunks, "1\r\nx\r\n")
+	}
+	chunks = append(chunks, "0\r\n\r\n")
+	if resp := send(100*time.Millisecond, chunks...); !strings.HasPrefix(resp, "ICAP/1.0 204 ") || body != "xxxxx" {
+		t.Errorf("slow upload: body %q, response:\n%s", body, resp)
+	}
+
+	// A client that stops partway through the headers is cut off.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	io.WriteString(c, head[:20])
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if resp, err := io.ReadAll(c); err != nil || len(resp) > 0 {
+		t.Errorf("slow headers: connection not closed: %q, %v", resp, err)
+	}
+	if n := srv.ParserStats().HeaderLimits; n != 1 {
+		t.Errorf("HeaderLimits = %d, want 1", n)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	var cause error
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			<-req.Context().Done()
+			cause = context.Cause(req.Context())
+		}),
+		HandlerTimeout: 20 * time.Millisecond,
+	}
+	resp := roundTrip(t, srv, "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: null-body=0\r\n\r\n")
+	if !strings.HasPrefix(resp, "ICAP/1.0 503 ") {
+		t.Errorf("unexpected response:\n%s", resp)
+	}
+	if cause != ErrHandlerTimeout {
+		t.Errorf("context canceled with %v", cause)
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+	options := func(extra string) string {
+		return "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" + extra +
+			"Encapsulated: null-body=0\r\n\r\n"
+	}
+	for _, tt := range []struct {
+		name    string
+		request string
+		ok      bool
+	}{
+		{"small", options("X-Pad: " + strings.Repeat("x", 500) + "\r\n"), true},
+		{"large", options(strings.Repeat("X-Pad: "+strings.Repeat("x", 500)+"\r\n", 10)), false},
+		{"huge section", "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Encapsulated: res-hdr=0, res-body=1000000000\r\n\r\n" +
+			"HTTP/1.1 200 OK\r\n\r\n", false},
+	} {
+		srv := &Server{Handler: handler, MaxHeaderBytes: 1024}
+		resp := roundTrip(t, srv, tt.request)
+		if ok := strings.HasPrefix(resp, "ICAP/1.0 204 "); ok != tt.ok {
+			t.Errorf("%s: unexpected response:\n%s", tt.name, resp)
+		}
+		stats := srv.ParserStats()
+		if limited := stats.HeaderLimits == 1 && stats.ParseErrors["header too large"] == 1; limited == tt.ok {
+			t.Errorf("%s: stats = %+v", tt.name, stats)
+		}
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	ts := httptest.NewUnstartedServer(nil)
+	ts.StartTLS()
+	config := ts.TLS.Clone()
+	ts.Close()
+
+	handshakeErrors := make(chan error, 1)
+	srv := &Server{
+		Handler: HandlerFunc(func(w ResponseWriter, req *Request) {
+			w.WriteHeader(StatusNoContent, nil, false)
+		}),
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+		Trace: &ServerTrace{
+			TLSHandshakeError: func(c net.Conn, err error) { handshakeErrors <- err },
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go srv.Serve(tls.NewListener(l, config))
+
+	// A client that never starts its handshake is disconnected.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c); err != nil {
+		t.Errorf("half-open client not disconnected: %v", err)
+	}
+	if err := <-handshakeErrors; err == nil {
+		t.Error("TLSHandshakeError called with nil error")
+	}
+
+	// One that completes it is served.
+	tc, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	io.WriteString(tc, "OPTIONS icap://icap.example.net/options ICAP/1.0\r\n"+
+		"Host: icap.example.net\r\n"+
+		"Encapsulated: null-body=0\r\n\r\n")
+	line, err := bufio.NewReader(tc).ReadString('\n')
+	if !strings.HasPrefix(line, "ICAP/1.0 204 ") {
+		t.Errorf("TLS client got %q, %v", line, err)
+	}
+}
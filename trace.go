@@ -0,0 +1,110 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Hooks for observing server events.
+
+package icap
+
+import (
+	"net"
+)
+
+// A ServerTrace is a set of hooks called when events occur in a Server.
+// Any of the fields may be nil. The hooks may be called concurrently
+// from different connections.
+type ServerTrace struct {
+	// IdleTimeout is called when a connection is closed because no
+	// request arrived within the server's IdleTimeout.
+	IdleTimeout func(net.Conn)
+
+	// ConnCount is called with the number of open connections
+	// whenever a connection opens or closes.
+	ConnCount func(open int)
+
+	// ConnRejected is called when a connection is refused
+	// because Server.MaxConns connections are open, or because its
+	// address is not in Server.AllowClients.
+	ConnRejected func(net.Conn)
+
+	// TransactionTimeout is called when a connection is closed because
+	// its transaction took longer than Server.MaxTransactionTime.
+	TransactionTimeout func(net.Conn)
+
+	// MemoryLimit is called when a transaction is refused memory
+	// because of Server.MaxRequestMemory or Server.MaxTotalMemory.
+	MemoryLimit func(*Request, *MemoryLimitError)
+
+	// Diagnostics is called with each request whose Diagnostics are not
+	// empty, before it is handled, so that misbehaving clients can be
+	// logged and fixed.
+	Diagnostics func(*Request)
+
+	// BadRequest is called when a request can't be parsed, before its
+	// connection is closed, with the parse error and the bytes of the
+	// request that had arrived when parsing began, which Dump can render.
+	BadRequest func(c net.Conn, head []byte, err error)
+
+	// TLSHandshakeError is called when a TLS client fails to complete
+	// its handshake, or doesn't complete it within the server's
+	// TLSHandshakeTimeout, before its connection is closed.
+	TLSHandshakeError func(c net.Conn, err error)
+
+	// ClientPenalized is called when a client is penalized under the
+	// server's ClientPolicy, with its statistics at the time.
+	ClientPenalized func(ClientStats)
+}
+
+func (t *ServerTrace) idleTimeout(c net.Conn) {
+	if t != nil && t.IdleTimeout != nil {
+		t.IdleTimeout(c)
+	}
+}
+
+func (t *ServerTrace) connCount(open int) {
+	if t != nil && t.ConnCount != nil {
+		t.ConnCount(open)
+	}
+}
+
+func (t *ServerTrace) connRejected(c net.Conn) {
+	if t != nil && t.ConnRejected != nil {
+		t.ConnRejected(c)
+	}
+}
+
+func (t *ServerTrace) transactionTimeout(c net.Conn) {
+	if t != nil && t.TransactionTimeout != nil {
+		t.TransactionTimeout(c)
+	}
+}
+
+func (t *ServerTrace) memoryLimit(req *Request, err *MemoryLimitError) {
+	if t != nil && t.MemoryLimit != nil {
+		t.MemoryLimit(req, err)
+	}
+}
+
+func (t *ServerTrace) badRequest(c net.Conn, head []byte, err error) {
+	if t != nil && t.BadRequest != nil {
+		t.BadRequest(c, head, err)
+	}
+}
+
+func (t *ServerTrace) tlsHandshakeError(c net.Conn, err error) {
+	if t != nil && t.TLSHandshakeError != nil {
+		t.TLSHandshakeError(c, err)
+	}
+}
+
+func (t *ServerTrace) clientPenalized(s ClientStats) {
+	if t != nil && t.ClientPenalized != nil {
+		t.ClientPenalized(s)
+	}
+}
+
+func (t *ServerTrace) diagnostics(req *Request) {
+	if t != nil && t.Diagnostics != nil && len(req.Diagnostics) > 0 {
+		t.Diagnostics(req)
+	}
+}
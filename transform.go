@@ -0,0 +1,179 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Rewriting encapsulated bodies as they stream through.
+
+package icap
+
+import (
+	"io"
+	"mime"
+	"strings"
+	"sync"
+)
+
+// A Transformer rewrites a body: it reads the original from src and
+// writes the new version to dst. Transformers should work on the body as
+// it arrives rather than reading it all first, so that large bodies are
+// not held in memory.
+type Transformer interface {
+	Transform(dst io.Writer, src io.Reader) error
+}
+
+// The TransformerFunc type is an adapter to allow the use of ordinary
+// functions as transformers.
+type TransformerFunc func(dst io.Writer, src io.Reader) error
+
+// Transform calls f(dst, src).
+func (f TransformerFunc) Transform(dst io.Writer, src io.Reader) error {
+	return f(dst, src)
+}
+
+// TransformBody replaces the body of the encapsulated message (the HTTP
+// request for REQMOD, the HTTP response for RESPMOD) with the output of t,
+// which runs as the new body is read. Since the length of the output isn't
+// known, the Content-Length header is removed. TransformBody reports
+// false if the message has no body.
+func (req *Request) TransformBody(t Transformer) bool {
+	body := req.bodyPtr()
+	if body == nil || *body == nil || !req.hasBody {
+		return false
+	}
+	*body = &transformReader{t: t, src: *body}
+	switch {
+	case req.Method == "REQMOD":
+		req.Request.ContentLength = -1
+	case req.Method == "RESPMOD":
+		req.Response.ContentLength = -1
+	}
+	req.bodyHeader().Del("Content-Length")
+	return true
+}
+
+// A transformReader is the output of a Transformer. The transformer is
+// started on the first Read, so that it doesn't run if the body is never
+// sent.
+type transformReader struct {
+	t    Transformer
+	src  io.ReadCloser
+	once sync.Once
+	pr   *io.PipeReader
+}
+
+func (r *transformReader) start() {
+	pr, pw := io.Pipe()
+	r.pr = pr
+	go func() {
+		pw.CloseWithError(r.t.Transform(pw, r.src))
+	}()
+}
+
+func (r *transformReader) Read(p []byte) (int, error) {
+	r.once.Do(r.start)
+	return r.pr.Read(p)
+}
+
+// Close stops the transformer, if it is running, and closes the
+// original body.
+func (r *transformReader) Close() error {
+	r.once.Do(func() {})
+	if r.pr != nil {
+		r.pr.Close()
+	}
+	return r.src.Close()
+}
+
+// A TransformStage is a Stage that applies Transformer to the bodies of
+// messages whose Content-Type is one of Types. Compressed bodies are
+// decompressed first (see DecompressBody), and left alone if their coding
+// has no registered Codec.
+type TransformStage struct {
+	Transformer Transformer
+
+	// Types lists the media types to transform, such as "text/html".
+	// An entry such as "text/*" matches all subtypes. If Types is empty,
+	// every body is transformed.
+	Types []string
+}
+
+// Process applies the transformer to the body of req, if it matches.
+func (s *TransformStage) Process(req *Request) (StageResult, error) {
+	h := req.bodyHeader()
+	if !CanDecompress(h) || !MatchMediaType(h.Get("Content-Type"), s.Types) {
+		return StageResult{Action: ActionContinue}, nil
+	}
+	if _, err := req.DecompressBody(); err != nil {
+		return StageResult{}, err
+	}
+	if !req.TransformBody(s.Transformer) {
+		return StageResult{Action: ActionContinue}, nil
+	}
+	return StageResult{Action: ActionModify}, nil
+}
+
+// MatchMediaType reports whether the media type of contentType is one of
+// types, where an entry such as "text/*" matches all subtypes. An empty
+// list matches everything.
+func MatchMediaType(contentType string, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == mt || strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// A TailTransformer is a Transformer that lets Modify rewrite the end of
+// a body, such as to add a footer before a closing </body> tag or to
+// strip a tracker appended to a script. It passes the body through as it
+// arrives, except for its last Size bytes, which it holds back; at the
+// end of the body, it writes Modify(tail) in their place. tail is shorter
+// than Size only if the whole body is.
+type TailTransformer struct {
+	// Size is the number of bytes held back. If zero, 4096 is used.
+	Size int
+
+	Modify func(tail []byte) []byte
+}
+
+// Transform copies src to dst, passing the last t.Size bytes through
+// t.Modify.
+func (t *TailTransformer) Transform(dst io.Writer, src io.Reader) error {
+	size := t.Size
+	if size <= 0 {
+		size = 4096
+	}
+	buf := make([]byte, size+32*1024)
+	n := 0
+	for {
+		m, err := src.Read(buf[n:])
+		n += m
+		if n > size {
+			if _, err := dst.Write(buf[:n-size]); err != nil {
+				return err
+			}
+			n = copy(buf, buf[n-size:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	tail := buf[:n]
+	if t.Modify != nil {
+		tail = t.Modify(tail)
+	}
+	_, err := dst.Write(tail)
+	return err
+}
@@ -0,0 +1,132 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The rest of an encapsulated body that arrives after the response.
+
+package icap
+
+import (
+	"io"
+	"log"
+)
+
+// An UnreadBodyPolicy tells a Server what to do with the rest of an
+// encapsulated body that is still to come when the response has been
+// sent. A handler may answer 204 No Modifications after reading part of
+// the body, or after a preview; a client that doesn't wait for
+// 100 Continue may already be sending the rest of the body by then,
+// although RFC 3507 says it must not. Left unread, the rest of the body
+// would be taken for the next request, and closing the connection with
+// it unread can make the client's operating system discard the response
+// before the client has read it.
+type UnreadBodyPolicy int
+
+const (
+	// UnreadBodyDrain reads the rest of the body, up to the server's
+	// MaxUnreadBody, and gives it to the server's UnreadBodySink or
+	// discards it, so that the connection can be used for the next
+	// request. After a preview whose rest wasn't asked for, the next
+	// data is taken for the rest of the body if it starts with a chunk
+	// size rather than a request line.
+	UnreadBodyDrain UnreadBodyPolicy = iota
+
+	// UnreadBodyClose closes the connection instead, once the response
+	// has been sent.
+	UnreadBodyClose
+)
+
+// defaultMaxUnreadBody is used when Server.MaxUnreadBody is zero.
+const defaultMaxUnreadBody = 1 << 20
+
+// maxUnreadBody returns the limit on the rest of a body that is drained.
+func (srv *Server) maxUnreadBody() int64 {
+	if srv.MaxUnreadBody <= 0 {
+		return defaultMaxUnreadBody
+	}
+	return srv.MaxUnreadBody
+}
+
+// finishBody deals with the rest of req's body, once the response has
+// been sent, according to the server's UnreadBody policy. It reports
+// whether the connection can be used for further transactions.
+func (c *conn) finishBody(req *Request) bool {
+	if !req.hasBody || req.bodyEnd.Load() != 0 || req.rawBody == nil {
+		return true
+	}
+	if req.continuer != nil && req.continuer.cr == nil {
+		// The rest of the body was never asked for, so a client that
+		// follows RFC 3507 won't send it; skipRemainder checks whether
+		// this one does.
+		c.previewOf = req
+		return true
+	}
+	if c.server.UnreadBody == UnreadBodyClose {
+		return false
+	}
+	return c.absorb(req, req.rawBody)
+}
+
+// skipRemainder reads the rest of the last request's body after its
+// preview, if the client is sending it although it wasn't asked for.
+// It reports whether the connection can be used for the next request.
+func (c *conn) skipRemainder() bool {
+	req := c.previewOf
+	if req == nil {
+		return true
+	}
+	c.previewOf = nil
+	if !c.chunkFollows() {
+		return true
+	}
+	if c.server.UnreadBody == UnreadBodyClose {
+		return false
+	}
+	cr := newChunkedReader(c.buf.Reader)
+	cr.stats = &c.server.stats
+	if !c.absorb(req, cr) {
+		return false
+	}
+	// Wait for the next request, as serve does.
+	_, err := c.buf.Reader.Peek(1)
+	return err == nil
+}
+
+// chunkFollows reports whether the next line from the client is a chunk
+// size, rather than a request line: a chunk size is a hexadecimal number
+// followed by the end of the line or a chunk extension, while a method
+// is followed by a space.
+func (c *conn) chunkFollows() bool {
+	for i := 0; ; i++ {
+		buf, err := c.buf.Reader.Peek(i + 1)
+		if err != nil {
+			return false
+		}
+		switch b := buf[i]; {
+		case '0' <= b && b <= '9', 'a' <= b && b <= 'f', 'A' <= b && b <= 'F':
+		case b == '\r' || b == '\n' || b == ';':
+			return i > 0
+		default:
+			return false
+		}
+	}
+}
+
+// absorb reads r, the rest of req's body, to its end, giving it to the
+// server's UnreadBodySink or discarding it. It reports whether the body
+// ended within MaxUnreadBody bytes.
+func (c *conn) absorb(req *Request, r io.Reader) bool {
+	lr := io.LimitReader(r, c.server.maxUnreadBody())
+	if sink := c.server.UnreadBodySink; sink != nil {
+		if err := sink(req, lr); err != nil {
+			log.Printf("icap: error keeping the rest of the body of %s %s: %v", req.Method, req.RawURL, err)
+			return false
+		}
+	}
+	if _, err := io.Copy(io.Discard, lr); err != nil {
+		return false
+	}
+	// The body must have ended within the limit.
+	n, err := r.Read(make([]byte, 1))
+	return n == 0 && err == io.EOF
+}
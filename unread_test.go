@@ -0,0 +1,112 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUnreadBody(t *testing.T) {
+	respHdr := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\n\r\n"
+	request := func(preview string, chunks string) string {
+		h := "RESPMOD icap://icap.example.net/respmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n"
+		if preview != "" {
+			h += "Preview: " + preview + "\r\n"
+		}
+		return h + "Encapsulated: res-hdr=0, res-body=" + strconv.Itoa(len(respHdr)) + "\r\n\r\n" +
+			respHdr + chunks
+	}
+	options := "OPTIONS icap://icap.example.net/respmod ICAP/1.0\r\nHost: icap.example.net\r\n\r\n"
+
+	// The handler decides from the preview, or from the first bytes of
+	// the body, without reading the rest.
+	handler := HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("ISTag", `"unread"`)
+		if req.Method == "OPTIONS" {
+			w.Header().Set("Methods", "RESPMOD")
+			w.WriteHeader(StatusOK, nil, false)
+			return
+		}
+		if len(req.Preview) == 0 {
+			io.ReadFull(req.Response.Body, make([]byte, 4))
+		}
+		w.WriteHeader(StatusNoContent, nil, false)
+	})
+
+	for _, tc := range []struct {
+		name      string
+		policy    UnreadBodyPolicy
+		max       int64
+		raw       string
+		responses int
+		kept      string
+	}{
+		{
+			// A client that sends the rest of the body after the
+			// preview without waiting for 100 Continue.
+			name:      "eager client",
+			raw:       request("4", "4\r\nhell\r\n0\r\n\r\n") + "8\r\no, world\r\n0\r\n\r\n" + options,
+			responses: 2,
+			kept:      "o, world",
+		},
+		{
+			name:      "well-behaved client",
+			raw:       request("4", "4\r\nhell\r\n0\r\n\r\n") + options,
+			responses: 2,
+		},
+		{
+			// A 204 before the whole body has been read.
+			name:      "early response",
+			raw:       request("", "c\r\nhello, world\r\n0\r\n\r\n") + options,
+			responses: 2,
+			kept:      "o, world",
+		},
+		{
+			name:      "close",
+			policy:    UnreadBodyClose,
+			raw:       request("4", "4\r\nhell\r\n0\r\n\r\n") + "8\r\no, world\r\n0\r\n\r\n" + options,
+			responses: 1,
+		},
+		{
+			name:      "too much",
+			max:       4,
+			raw:       request("", "c\r\nhello, world\r\n0\r\n\r\n") + options,
+			responses: 1,
+			kept:      "o, w",
+		},
+	} {
+		var mu sync.Mutex
+		var kept strings.Builder
+		srv := &Server{
+			Handler:       handler,
+			UnreadBody:    tc.policy,
+			MaxUnreadBody: tc.max,
+			UnreadBodySink: func(req *Request, r io.Reader) error {
+				mu.Lock()
+				defer mu.Unlock()
+				_, err := io.Copy(&kept, r)
+				return err
+			},
+		}
+		resp := roundTrip(t, srv, tc.raw)
+		if n := strings.Count(resp, "ICAP/1.0 "); n != tc.responses || !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+			t.Errorf("%s: got %d responses, want %d:\n%s", tc.name, n, tc.responses, resp)
+		}
+		if tc.responses == 2 && !strings.Contains(resp, "Methods: RESPMOD") {
+			t.Errorf("%s: second request not answered:\n%s", tc.name, resp)
+		}
+		mu.Lock()
+		if kept.String() != tc.kept {
+			t.Errorf("%s: sink got %q, want %q", tc.name, kept.String(), tc.kept)
+		}
+		mu.Unlock()
+	}
+}
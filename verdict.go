@@ -0,0 +1,301 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Handlers that return a verdict instead of writing the response.
+
+package icap
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+// A Verdict is the outcome of a VerdictFunc: NoModification,
+// ModifiedRequest, ModifiedResponse, Satisfy or Block.
+type Verdict interface {
+	respond(w ResponseWriter, req *Request)
+}
+
+// NoModification passes the encapsulated message on unchanged, with
+// 204 No Modifications if the client allows it.
+type NoModification struct{}
+
+// ModifiedRequest sends a modified HTTP request in answer to REQMOD.
+type ModifiedRequest struct {
+	// Request is the request to send, with its body. If nil, the
+	// encapsulated request is sent, with any changes made to it in
+	// place.
+	Request *http.Request
+}
+
+// ModifiedResponse sends a modified HTTP response in answer to RESPMOD.
+type ModifiedResponse struct {
+	// Response is the response to send, with its body. If nil, the
+	// encapsulated response is sent, with any changes made to it in
+	// place.
+	Response *http.Response
+}
+
+// Satisfy answers REQMOD with an HTTP response, which the client sends
+// to its user instead of forwarding the request (see Respond).
+type Satisfy struct {
+	Response *http.Response
+}
+
+// Block replaces the encapsulated message with a plain-text block page.
+type Block struct {
+	Status int    // HTTP status code of the block page; 403 if zero
+	Reason string // body of the block page, recorded in the audit record
+}
+
+func (NoModification) respond(w ResponseWriter, req *Request) {
+	Unmodified(w, req)
+}
+
+func (v ModifiedRequest) respond(w ResponseWriter, req *Request) {
+	msg := v.Request
+	if msg == nil {
+		msg = req.Request
+	}
+	if msg == nil {
+		Error(w, StatusInternalServerError, "no HTTP request to send")
+		return
+	}
+	req.Audit().defaultVerdict(VerdictModify, "")
+	writeModified(w, msg, msg.Body, msg == req.Request && !req.hasBody)
+}
+
+func (v ModifiedResponse) respond(w ResponseWriter, req *Request) {
+	msg := v.Response
+	if msg == nil {
+		msg = req.Response
+	}
+	if msg == nil {
+		Error(w, StatusInternalServerError, "no HTTP response to send")
+		return
+	}
+	req.Audit().defaultVerdict(VerdictModify, "")
+	writeModified(w, msg, msg.Body, msg == req.Response && !req.hasBody)
+}
+
+func (v Satisfy) respond(w ResponseWriter, req *Request) {
+	Respond(w, req, v.Response)
+}
+
+func (v Block) respond(w ResponseWriter, req *Request) {
+	status := v.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	req.Audit().SetVerdict(VerdictBlock, v.Reason)
+	writeBlockPage(w, status, v.Reason)
+}
+
+// writeModified sends msg, an *http.Request or *http.Response, in a 200
+// response, with body unless noBody is set or there is none.
+func writeModified(w ResponseWriter, msg interface{}, body io.ReadCloser, noBody bool) {
+	hasBody := !noBody && bodyPresent(body)
+	w.WriteHeader(StatusOK, msg, hasBody)
+	if hasBody {
+		if _, err := io.Copy(w, body); err != nil {
+			log.Printf("icap: error copying body: %v", err)
+		}
+	}
+	if body != nil {
+		body.Close()
+	}
+}
+
+// bodyPresent reports whether body may have content.
+func bodyPresent(body io.ReadCloser) bool {
+	switch body.(type) {
+	case nil, emptyReader:
+		return false
+	}
+	return body != http.NoBody
+}
+
+// The VerdictFunc type is an adapter to allow the use of ordinary
+// functions that decide what to do with a message as handlers. The
+// function is called for REQMOD and RESPMOD requests with the request's
+// context, and the verdict it returns is sent in the form RFC 3507
+// requires; a nil verdict means NoModification. If it returns an error,
+// the client gets 500 Server Error. OPTIONS requests are answered with
+// both methods and 204 support, and other methods with 405 Method Not
+// Allowed.
+type VerdictFunc func(ctx context.Context, req *Request) (Verdict, error)
+
+// ServeICAP calls f(req.Context(), req) and sends its verdict.
+func (f VerdictFunc) ServeICAP(w ResponseWriter, req *Request) {
+	switch req.Method {
+	case "OPTIONS":
+		h := w.Header()
+		if h.Get("Methods") == "" {
+			h.Set("Methods", "REQMOD, RESPMOD")
+		}
+		h.Set("Allow", "204")
+		w.WriteHeader(StatusOK, nil, false)
+		return
+	case "REQMOD", "RESPMOD":
+	default:
+		w.WriteHeader(StatusMethodNotAllowed, nil, false)
+		return
+	}
+
+	v, err := f(req.Context(), req)
+	if err != nil {
+		log.Printf("icap: verdict for %s %s failed: %v", req.Method, req.RawURL, err)
+		req.Audit().SetVerdict(VerdictError, err.Error())
+		var memErr *MemoryLimitError
+		if errors.As(err, &memErr) {
+			if rw, ok := w.(*respWriter); ok {
+				rw.abortMemory(memErr)
+				return
+			}
+			w.WriteHeader(memErr.Status(), nil, false)
+			return
+		}
+		w.WriteHeader(StatusInternalServerError, nil, false)
+		return
+	}
+	if v == nil {
+		v = NoModification{}
+	}
+	if v == req.verdictOf {
+		for k, vv := range req.verdictHdr {
+			if _, ok := w.Header()[k]; !ok {
+				w.Header()[k] = vv
+			}
+		}
+	}
+	v.respond(w, req)
+}
+
+// HandlerVerdict adapts a classic Handler to return a verdict, so that it
+// can be used where a VerdictFunc is expected, such as by middleware for
+// verdict functions. (A VerdictFunc is itself a Handler, so the other
+// direction needs no adapter.) h writes its response to a recorder, which
+// is turned into the matching Verdict: 204 into NoModification, an HTTP
+// request into ModifiedRequest, and an HTTP response into Satisfy for
+// REQMOD or ModifiedResponse for RESPMOD, each with the body h wrote. The
+// ICAP headers h set, such as X-Infection-Found, are sent with the
+// response when the verdict reaches a VerdictFunc's ServeICAP, unless
+// middleware has replaced the verdict with another one. Other status
+// codes are sent as they are, and WriteRaw is not supported. The body h
+// writes counts against the transaction's memory budget (see
+// Server.MaxRequestMemory); if it goes over, the error returned is a
+// *MemoryLimitError, and ServeICAP answers with its Status.
+func HandlerVerdict(h Handler) VerdictFunc {
+	return func(ctx context.Context, req *Request) (Verdict, error) {
+		rec := &verdictRecorder{req: req, header: make(http.Header)}
+		h.ServeICAP(rec, req)
+		if rec.err != nil {
+			return nil, rec.err
+		}
+		v, err := rec.verdict(req)
+		if err != nil {
+			return nil, err
+		}
+		req.verdictHdr, req.verdictOf = nil, v
+		if len(rec.header) > 0 {
+			req.verdictHdr = rec.header
+		}
+		return v, nil
+	}
+}
+
+// A verdictRecorder is the ResponseWriter of a handler run by
+// HandlerVerdict.
+type verdictRecorder struct {
+	req         *Request
+	header      http.Header
+	wroteHeader bool
+	code        int
+	msg         interface{}
+	hasBody     bool
+	body        bytes.Buffer
+	err         error
+}
+
+func (w *verdictRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *verdictRecorder) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(StatusOK, nil, true)
+	}
+	if !w.hasBody {
+		return 0, ErrNoBody
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+	if err := w.req.reserve(int64(len(p))); err != nil {
+		w.err = err
+		return 0, err
+	}
+	return w.body.Write(p)
+}
+
+func (w *verdictRecorder) WriteRaw(string) {
+	if w.err == nil {
+		w.err = errors.New("icap: WriteRaw called by a handler run by HandlerVerdict")
+	}
+}
+
+func (w *verdictRecorder) WriteHeader(code int, httpMessage interface{}, hasBody bool) {
+	if w.wroteHeader {
+		log.Print(ErrHeaderWritten)
+		return
+	}
+	w.wroteHeader = true
+	w.code, w.msg, w.hasBody = code, httpMessage, hasBody
+}
+
+// verdict returns the verdict that matches the recorded response to req.
+func (w *verdictRecorder) verdict(req *Request) (Verdict, error) {
+	if !w.wroteHeader {
+		w.code = StatusOK
+	}
+	var body io.ReadCloser = http.NoBody
+	if w.hasBody {
+		body = io.NopCloser(bytes.NewReader(w.body.Bytes()))
+	}
+	switch msg := w.msg.(type) {
+	case nil:
+		if w.code == StatusNoContent {
+			return NoModification{}, nil
+		}
+		return statusVerdict(w.code), nil
+	case *http.Request:
+		if w.code == StatusOK {
+			msg.Body, msg.ContentLength = body, int64(w.body.Len())
+			return ModifiedRequest{Request: msg}, nil
+		}
+	case *http.Response:
+		if w.code == StatusOK {
+			msg.Body, msg.ContentLength = body, int64(w.body.Len())
+			if req.Method == "REQMOD" {
+				return Satisfy{Response: msg}, nil
+			}
+			return ModifiedResponse{Response: msg}, nil
+		}
+	}
+	return nil, fmt.Errorf("icap: handler sent status %d with a %T", w.code, w.msg)
+}
+
+// A statusVerdict sends an ICAP status with no encapsulated message. It
+// is the verdict of a handler run by HandlerVerdict that replied with
+// anything other than 204 or a message.
+type statusVerdict int
+
+func (v statusVerdict) respond(w ResponseWriter, req *Request) {
+	w.WriteHeader(int(v), nil, false)
+}
@@ -0,0 +1,213 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package icap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestVerdictFunc(t *testing.T) {
+	srv := &Server{Handler: VerdictFunc(func(ctx context.Context, req *Request) (Verdict, error) {
+		if ctx == nil {
+			return nil, errors.New("no context")
+		}
+		switch req.URL.Path {
+		case "/none":
+			return nil, nil
+		case "/modify":
+			req.Request.Header.Set("X-Scanned", "1")
+			return ModifiedRequest{}, nil
+		case "/replace":
+			r, _ := http.NewRequest("POST", "http://www.example.com/upload", strings.NewReader("replaced"))
+			return ModifiedRequest{Request: r}, nil
+		case "/satisfy":
+			return Satisfy{Response: &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader("cached copy")),
+			}}, nil
+		case "/block":
+			return Block{Reason: "not allowed"}, nil
+		case "/wrong":
+			// A RESPMOD verdict in answer to REQMOD can't be sent.
+			return ModifiedResponse{}, nil
+		}
+		return nil, errors.New("no such test")
+	})}
+	srv.HeaderPolicy = &HeaderPolicy{ISTag: StaticISTag("verdict")}
+
+	for _, tc := range []struct {
+		path    string
+		status  int
+		verdict string
+		want    []string
+	}{
+		{"/none", StatusNoContent, VerdictAllow, []string{"Encapsulated: null-body=0"}},
+		{"/modify", StatusOK, VerdictModify, []string{"X-Scanned: 1", "req-body=", "hello"}},
+		{"/replace", StatusOK, VerdictModify, []string{"POST http://www.example.com/upload", "replaced"}},
+		{"/satisfy", StatusOK, VerdictBlock, []string{"res-hdr=0, res-body=", "HTTP/1.1 200 OK", "cached copy"}},
+		{"/block", StatusOK, VerdictBlock, []string{"HTTP/1.1 403 Forbidden", "not allowed"}},
+		{"/wrong", StatusInternalServerError, VerdictError, []string{"no HTTP response to send"}},
+		{"/missing", StatusInternalServerError, VerdictError, nil},
+	} {
+		httpReq, _ := http.NewRequest("POST", "http://www.example.com/form", strings.NewReader("hello"))
+		req, _ := NewRequest("REQMOD", "icap://icap.example.net"+tc.path, httpReq, nil)
+		req.Header.Set("Allow", "204")
+		result, err := srv.DryRun(context.Background(), req)
+		if err != nil {
+			t.Errorf("%s: %v", tc.path, err)
+			continue
+		}
+		resp := string(result.Response)
+		if !strings.HasPrefix(resp, "ICAP/1.0 "+strconv.Itoa(tc.status)+" ") {
+			t.Errorf("%s: got response\n%s", tc.path, resp)
+		}
+		for _, w := range tc.want {
+			if !strings.Contains(resp, w) {
+				t.Errorf("%s: response doesn't contain %q:\n%s", tc.path, w, resp)
+			}
+		}
+		if findings := Lint(result.Response); len(findings) > 0 {
+			t.Errorf("%s: response has problems: %v", tc.path, findings)
+		}
+		if result.Audit.Verdict != tc.verdict {
+			t.Errorf("%s: verdict %q, want %q", tc.path, result.Audit.Verdict, tc.verdict)
+		}
+	}
+}
+
+func TestHandlerVerdict(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("/scan", func(w ResponseWriter, req *Request) {
+		w.Header().Set("ISTag", `"classic"`)
+		if req.Request.URL.Path == "/eicar" {
+			w.Header().Set("X-Infection-Found", "Type=0; Resolution=2; Threat=EICAR;")
+			writeBlockPage(w, http.StatusForbidden, "infected")
+			return
+		}
+		if req.Request.URL.Path == "/clean" {
+			Unmodified(w, req)
+			return
+		}
+		req.Request.Header.Set("X-Scanned", "1")
+		w.WriteHeader(StatusOK, req.Request, true)
+		io.Copy(w, req.Request.Body)
+	})
+
+	// Middleware for verdict functions, around a classic handler.
+	var verdicts []string
+	record := func(next VerdictFunc) VerdictFunc {
+		return func(ctx context.Context, req *Request) (Verdict, error) {
+			v, err := next(ctx, req)
+			verdicts = append(verdicts, strings.TrimPrefix(fmt.Sprintf("%T", v), "icap."))
+			return v, err
+		}
+	}
+	srv := &Server{Handler: record(HandlerVerdict(mux))}
+
+	for _, tc := range []struct {
+		path string
+		want []string
+	}{
+		{"/eicar", []string{"ICAP/1.0 200 ", "X-Infection-Found: Type=0", `Istag: "classic"`, "res-hdr=0", "infected"}},
+		{"/clean", []string{"ICAP/1.0 204 ", `Istag: "classic"`}},
+		{"/upload", []string{"ICAP/1.0 200 ", "X-Scanned: 1", "hello"}},
+	} {
+		httpReq, _ := http.NewRequest("POST", "http://www.example.com"+tc.path, strings.NewReader("hello"))
+		req, _ := NewRequest("REQMOD", "icap://icap.example.net/scan", httpReq, nil)
+		req.Header.Set("Allow", "204")
+		result, err := srv.DryRun(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := string(result.Response)
+		for _, w := range tc.want {
+			if !strings.Contains(resp, w) {
+				t.Errorf("%s: response doesn't contain %q:\n%s", tc.path, w, resp)
+			}
+		}
+		if findings := Lint(result.Response); len(findings) > 0 {
+			t.Errorf("%s: response has problems: %v", tc.path, findings)
+		}
+	}
+	if got := strings.Join(verdicts, " "); got != "Satisfy NoModification ModifiedRequest" {
+		t.Errorf("verdicts = %s", got)
+	}
+
+	// A status without a message is passed on as it is.
+	httpReq, _ := http.NewRequest("GET", "http://www.example.com/", nil)
+	req, _ := NewRequest("REQMOD", "icap://icap.example.net/missing", httpReq, nil)
+	result, err := srv.DryRun(context.Background(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(result.Response), "ICAP/1.0 404 ") {
+		t.Errorf("response from unknown service:\n%s", result.Response)
+	}
+}
+
+func TestHandlerVerdictReplaced(t *testing.T) {
+	scan := HandlerFunc(func(w ResponseWriter, req *Request) {
+		w.Header().Set("X-Infection-Found", "Type=0; Resolution=2; Threat=EICAR;")
+		req.Request.Header.Set("X-Scanned", "1")
+		w.WriteHeader(StatusOK, req.Request, true)
+		io.Copy(w, req.Request.Body)
+	})
+	// Middleware that blocks whatever the handler decided.
+	block := func(next VerdictFunc) VerdictFunc {
+		return func(ctx context.Context, req *Request) (Verdict, error) {
+			if _, err := next(ctx, req); err != nil {
+				return nil, err
+			}
+			return Block{Reason: "policy"}, nil
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		handler Handler
+		limit   int64
+		want    string
+		notWant string
+	}{
+		{"kept", HandlerVerdict(scan), 0, "X-Infection-Found: ", ""},
+		{"replaced", block(HandlerVerdict(scan)), 0, "HTTP/1.1 403 Forbidden", "X-Infection-Found"},
+		{"over budget", HandlerVerdict(scan), 1000, "ICAP/1.0 413 ", "X-Infection-Found"},
+	} {
+		exceeded := 0
+		srv := &Server{
+			Handler:          tc.handler,
+			MaxRequestMemory: tc.limit,
+			Trace: &ServerTrace{
+				MemoryLimit: func(*Request, *MemoryLimitError) { exceeded++ },
+			},
+		}
+		httpReq, _ := http.NewRequest("POST", "http://www.example.com/upload", strings.NewReader(strings.Repeat("x", 2000)))
+		req, _ := NewRequest("REQMOD", "icap://icap.example.net/scan", httpReq, nil)
+		result, err := srv.DryRun(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := string(result.Response)
+		if !strings.Contains(resp, tc.want) {
+			t.Errorf("%s: response doesn't contain %q:\n%s", tc.name, tc.want, resp)
+		}
+		if tc.notWant != "" && strings.Contains(resp, tc.notWant) {
+			t.Errorf("%s: response contains %q:\n%s", tc.name, tc.notWant, resp)
+		}
+		if (tc.limit > 0) != (exceeded > 0) {
+			t.Errorf("%s: memory limit reached %d times", tc.name, exceeded)
+		}
+		if n := srv.MemoryInUse(); n != 0 {
+			t.Errorf("%s: MemoryInUse() = %d after the transaction", tc.name, n)
+		}
+	}
+}
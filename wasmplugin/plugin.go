@@ -0,0 +1,363 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wasmplugin runs adaptation rules compiled to WebAssembly.
+//
+// A Plugin loads a .wasm module and runs it for each REQMOD and RESPMOD
+// request. The module can be replaced while the server is running, with
+// Load or Watch; transactions in progress finish with the old module.
+// Each transaction gets a fresh instance of the module, so no state is
+// shared between transactions.
+//
+// # ABI
+//
+// The module must export its memory and a function
+//
+//	on_request() -> i32
+//
+// which returns 0 to pass the message on unchanged, 1 to pass it on with
+// the changes made through set_header and remove_header, or 2 to block it
+// (with the status and reason given to set_block, or 403 by default).
+//
+// The host provides these functions in the "icap" import module.
+// Strings are passed as a pointer and length in the module's memory.
+// The header kind is 0 for the ICAP header, 1 for the encapsulated HTTP
+// request, and 2 for the encapsulated HTTP response.
+//
+//	get_method(buf, buf_len) -> i32
+//	get_url(buf, buf_len) -> i32
+//	get_header(kind, name, name_len, buf, buf_len) -> i32
+//	set_header(kind, name, name_len, value, value_len) -> i32
+//	remove_header(kind, name, name_len) -> i32
+//	read_body(buf, buf_len) -> i32
+//	set_block(status, reason, reason_len)
+//
+// The get functions copy up to buf_len bytes into buf and return the full
+// length of the value, so that a longer value can be fetched again with a
+// larger buffer; get_header returns -1 if the header is absent. read_body
+// returns the number of bytes read from the body of the message being
+// adapted, and 0 at the end of the body. set_header and remove_header
+// return -1 if there is no such message. All functions return -1 if a
+// pointer is out of range.
+package wasmplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/intra-sh/icap"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Results of on_request.
+const (
+	resultAllow  = 0
+	resultModify = 1
+	resultBlock  = 2
+)
+
+// Header kinds.
+const (
+	kindICAP     = 0
+	kindRequest  = 1
+	kindResponse = 2
+)
+
+// A Plugin runs a WebAssembly module as an adaptation stage.
+// It is an icap.Stage and an icap.Handler.
+type Plugin struct {
+	// Timeout limits the time each call to the module may take.
+	// Zero means no limit.
+	Timeout time.Duration
+
+	// BodyMemory is the number of bytes of a body kept in memory when
+	// the module reads it; larger bodies are spooled to disk.
+	// If zero, 1 MB is used.
+	BodyMemory int64
+
+	// FailOpen makes ServeICAP pass messages on unmodified when the
+	// module fails, instead of sending an ICAP 500 Server Error.
+	FailOpen bool
+
+	runtime wazero.Runtime
+	mu      sync.RWMutex // held for reading while the module is instantiated
+	module  wazero.CompiledModule
+}
+
+// New returns a Plugin with no module loaded. Call Load or LoadFile
+// before using it.
+func New(ctx context.Context) (*Plugin, error) {
+	p := &Plugin{
+		runtime: wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true)),
+	}
+	_, err := p.runtime.NewHostModuleBuilder("icap").
+		NewFunctionBuilder().WithFunc(getMethod).Export("get_method").
+		NewFunctionBuilder().WithFunc(getURL).Export("get_url").
+		NewFunctionBuilder().WithFunc(getHeader).Export("get_header").
+		NewFunctionBuilder().WithFunc(setHeader).Export("set_header").
+		NewFunctionBuilder().WithFunc(removeHeader).Export("remove_header").
+		NewFunctionBuilder().WithFunc(readBody).Export("read_body").
+		NewFunctionBuilder().WithFunc(setBlock).Export("set_block").
+		Instantiate(ctx)
+	if err != nil {
+		p.runtime.Close(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+// Load compiles wasm and makes it the module used for new transactions.
+func (p *Plugin) Load(ctx context.Context, wasm []byte) error {
+	m, err := p.runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		return err
+	}
+	if f, ok := m.ExportedFunctions()["on_request"]; !ok || len(f.ParamTypes()) != 0 ||
+		len(f.ResultTypes()) != 1 || f.ResultTypes()[0] != api.ValueTypeI32 {
+		m.Close(ctx)
+		return errors.New("wasmplugin: module does not export on_request() -> i32")
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.module != nil {
+		// Instances of the old module that are running are not affected.
+		p.module.Close(ctx)
+	}
+	p.module = m
+	return nil
+}
+
+// LoadFile loads the module in the named file.
+func (p *Plugin) LoadFile(ctx context.Context, name string) error {
+	wasm, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	return p.Load(ctx, wasm)
+}
+
+// Watch loads the named file, then checks it every interval and loads it
+// again when its modification time changes, until ctx is done.
+// Errors reloading the file are logged, and the previous module stays
+// in use.
+func (p *Plugin) Watch(ctx context.Context, name string, interval time.Duration) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if err := p.LoadFile(ctx, name); err != nil {
+		return err
+	}
+	go func() {
+		loaded := fi.ModTime()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+			fi, err := os.Stat(name)
+			if err != nil || fi.ModTime().Equal(loaded) {
+				continue
+			}
+			loaded = fi.ModTime()
+			if err := p.LoadFile(ctx, name); err != nil {
+				log.Printf("wasmplugin: reloading %s: %v", name, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close releases the runtime and the loaded module.
+func (p *Plugin) Close(ctx context.Context) error {
+	return p.runtime.Close(ctx)
+}
+
+// ServeICAP runs the module for req and responds according to its result.
+func (p *Plugin) ServeICAP(w icap.ResponseWriter, req *icap.Request) {
+	pl := icap.Pipeline{Stages: []icap.Stage{p}, FailOpen: p.FailOpen}
+	pl.ServeICAP(w, req)
+}
+
+// Process runs the module for req.
+func (p *Plugin) Process(req *icap.Request) (icap.StageResult, error) {
+	ctx := context.Background()
+	if p.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.Timeout)
+		defer cancel()
+	}
+	tx := &transaction{req: req, bodyMemory: p.BodyMemory}
+	ctx = context.WithValue(ctx, transactionKey{}, tx)
+
+	p.mu.RLock()
+	if p.module == nil {
+		p.mu.RUnlock()
+		return icap.StageResult{}, errors.New("wasmplugin: no module loaded")
+	}
+	mod, err := p.runtime.InstantiateModule(ctx, p.module, wazero.NewModuleConfig().WithName(""))
+	p.mu.RUnlock()
+	if err != nil {
+		return icap.StageResult{}, err
+	}
+	defer mod.Close(ctx)
+
+	results, err := mod.ExportedFunction("on_request").Call(ctx)
+	if err != nil {
+		return icap.StageResult{}, fmt.Errorf("wasmplugin: on_request: %v", err)
+	}
+	switch results[0] {
+	case resultAllow:
+		return icap.StageResult{Action: icap.ActionContinue}, nil
+	case resultModify:
+		return icap.StageResult{Action: icap.ActionModify}, nil
+	case resultBlock:
+		return icap.StageResult{Action: icap.ActionBlock, Status: tx.blockStatus, Reason: tx.blockReason}, nil
+	}
+	return icap.StageResult{}, fmt.Errorf("wasmplugin: on_request returned %d", int32(results[0]))
+}
+
+// A transaction holds the state of one call to on_request.
+type transaction struct {
+	req         *icap.Request
+	bodyMemory  int64
+	body        io.Reader
+	blockStatus int
+	blockReason string
+}
+
+type transactionKey struct{}
+
+func txFrom(ctx context.Context) *transaction {
+	return ctx.Value(transactionKey{}).(*transaction)
+}
+
+// header returns the header of the given kind, or nil.
+func (tx *transaction) header(kind int32) http.Header {
+	switch kind {
+	case kindICAP:
+		return http.Header(tx.req.Header)
+	case kindRequest:
+		if tx.req.Request != nil {
+			return tx.req.Request.Header
+		}
+	case kindResponse:
+		if tx.req.Response != nil {
+			return tx.req.Response.Header
+		}
+	}
+	return nil
+}
+
+// readString reads a string from the module's memory.
+func readString(m api.Module, ptr, n uint32) (string, bool) {
+	b, ok := m.Memory().Read(ptr, n)
+	return string(b), ok
+}
+
+// writeValue copies as much of s as fits into the buffer at ptr and
+// returns the length of s.
+func writeValue(m api.Module, ptr, n uint32, s string) int32 {
+	if uint32(len(s)) < n {
+		n = uint32(len(s))
+	}
+	if !m.Memory().Write(ptr, []byte(s[:n])) {
+		return -1
+	}
+	return int32(len(s))
+}
+
+func getMethod(ctx context.Context, m api.Module, buf, bufLen uint32) int32 {
+	return writeValue(m, buf, bufLen, txFrom(ctx).req.Method)
+}
+
+func getURL(ctx context.Context, m api.Module, buf, bufLen uint32) int32 {
+	req := txFrom(ctx).req
+	var u string
+	switch {
+	case req.Request != nil:
+		u = req.Request.URL.String()
+	case req.Response != nil && req.Response.Request != nil:
+		u = req.Response.Request.URL.String()
+	}
+	return writeValue(m, buf, bufLen, u)
+}
+
+func getHeader(ctx context.Context, m api.Module, kind int32, name, nameLen, buf, bufLen uint32) int32 {
+	key, ok := readString(m, name, nameLen)
+	if !ok {
+		return -1
+	}
+	h := txFrom(ctx).header(kind)
+	if h == nil || len(h.Values(key)) == 0 {
+		return -1
+	}
+	return writeValue(m, buf, bufLen, h.Get(key))
+}
+
+func setHeader(ctx context.Context, m api.Module, kind int32, name, nameLen, value, valueLen uint32) int32 {
+	key, ok := readString(m, name, nameLen)
+	val, ok2 := readString(m, value, valueLen)
+	h := txFrom(ctx).header(kind)
+	if !ok || !ok2 || h == nil || kind == kindICAP {
+		return -1
+	}
+	h.Set(key, val)
+	return 0
+}
+
+func removeHeader(ctx context.Context, m api.Module, kind int32, name, nameLen uint32) int32 {
+	key, ok := readString(m, name, nameLen)
+	h := txFrom(ctx).header(kind)
+	if !ok || h == nil || kind == kindICAP {
+		return -1
+	}
+	h.Del(key)
+	return 0
+}
+
+func readBody(ctx context.Context, m api.Module, buf, bufLen uint32) int32 {
+	tx := txFrom(ctx)
+	if tx.body == nil {
+		memLimit := tx.bodyMemory
+		if memLimit <= 0 {
+			memLimit = 1 << 20
+		}
+		bb, err := tx.req.BufferedBody(memLimit)
+		if err != nil {
+			return -1
+		}
+		tx.body = io.NewSectionReader(bb, 0, bb.Size())
+	}
+	if uint64(buf)+uint64(bufLen) > uint64(m.Memory().Size()) {
+		return -1
+	}
+	p := make([]byte, bufLen)
+	n, err := io.ReadFull(tx.body, p)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return -1
+	}
+	if !m.Memory().Write(buf, p[:n]) {
+		return -1
+	}
+	return int32(n)
+}
+
+func setBlock(ctx context.Context, m api.Module, status int32, reason, reasonLen uint32) {
+	tx := txFrom(ctx)
+	tx.blockStatus = int(status)
+	tx.blockReason, _ = readString(m, reason, reasonLen)
+}
@@ -0,0 +1,167 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wasmplugin
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/intra-sh/icap"
+	"github.com/intra-sh/icap/icaptest"
+)
+
+// Helpers for assembling WebAssembly modules by hand.
+
+func uleb(n uint32) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func i32(n int32) []byte {
+	b := []byte{0x41}
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func name(s string) []byte {
+	return append(uleb(uint32(len(s))), s...)
+}
+
+func vec(items ...[]byte) []byte {
+	b := uleb(uint32(len(items)))
+	for _, item := range items {
+		b = append(b, item...)
+	}
+	return b
+}
+
+func section(id byte, content []byte) []byte {
+	return append(append([]byte{id}, uleb(uint32(len(content)))...), content...)
+}
+
+func cat(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+const (
+	i32Type = 0x7f
+	call    = 0x10
+	drop    = 0x1a
+	end     = 0x0b
+)
+
+// blockerModule blocks requests with an X-Block header, with status 451,
+// and adds X-Checked: yes to the others.
+func blockerModule() []byte {
+	text := map[int32]string{0: "X-Block", 16: "forbidden", 32: "X-Checked", 48: "yes"}
+	var data [][]byte
+	for off, s := range text {
+		data = append(data, cat([]byte{0}, i32(off), []byte{end}, name(s)))
+	}
+	body := cat(
+		[]byte{0},                                                 // no locals
+		i32(1), i32(0), i32(7), i32(100), i32(0), []byte{call, 0}, // get_header(1, "X-Block", buf, 0)
+		i32(0), []byte{0x4e}, // i32.ge_s
+		[]byte{0x04, i32Type}, // if (result i32)
+		i32(451), i32(16), i32(9), []byte{call, 2}, i32(2),
+		[]byte{0x05}, // else
+		i32(1), i32(32), i32(9), i32(48), i32(3), []byte{call, 1, drop}, i32(1),
+		[]byte{end, end},
+	)
+	return cat(
+		[]byte{0, 'a', 's', 'm', 1, 0, 0, 0},
+		section(1, vec(
+			[]byte{0x60, 0, 1, i32Type},
+			[]byte{0x60, 5, i32Type, i32Type, i32Type, i32Type, i32Type, 1, i32Type},
+			[]byte{0x60, 3, i32Type, i32Type, i32Type, 0},
+		)),
+		section(2, vec(
+			cat(name("icap"), name("get_header"), []byte{0, 1}),
+			cat(name("icap"), name("set_header"), []byte{0, 1}),
+			cat(name("icap"), name("set_block"), []byte{0, 2}),
+		)),
+		section(3, vec([]byte{0})),
+		section(5, vec([]byte{0, 1})),
+		section(7, vec(
+			cat(name("memory"), []byte{2, 0}),
+			cat(name("on_request"), []byte{0, 3}),
+		)),
+		section(10, vec(cat(uleb(uint32(len(body))), body))),
+		section(11, vec(data...)),
+	)
+}
+
+// allowModule passes every request on unchanged.
+func allowModule() []byte {
+	body := cat([]byte{0}, i32(0), []byte{end})
+	return cat(
+		[]byte{0, 'a', 's', 'm', 1, 0, 0, 0},
+		section(1, vec([]byte{0x60, 0, 1, i32Type})),
+		section(3, vec([]byte{0})),
+		section(7, vec(cat(name("on_request"), []byte{0, 0}))),
+		section(10, vec(cat(uleb(uint32(len(body))), body))),
+	)
+}
+
+func TestPlugin(t *testing.T) {
+	ctx := context.Background()
+	p, err := New(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close(ctx)
+	if err := p.Load(ctx, blockerModule()); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(header string) string {
+		httpHdr := "GET / HTTP/1.1\r\nHost: www.example.com\r\n" + header + "\r\n"
+		return "REQMOD icap://icap.example.net/reqmod ICAP/1.0\r\n" +
+			"Host: icap.example.net\r\n" +
+			"Allow: 204\r\n" +
+			"Encapsulated: req-hdr=0, null-body=" + strconv.Itoa(len(httpHdr)) + "\r\n" +
+			"\r\n" + httpHdr
+	}
+
+	resp := icaptest.RoundTrip(t, &icap.Server{Handler: p}, request(""))
+	if !strings.HasPrefix(resp, "ICAP/1.0 200 ") || !strings.Contains(resp, "X-Checked: yes\r\n") {
+		t.Errorf("expected the modified request:\n%s", resp)
+	}
+	resp = icaptest.RoundTrip(t, &icap.Server{Handler: p}, request("X-Block: 1\r\n"))
+	if !strings.Contains(resp, "HTTP/1.1 451 ") || !strings.Contains(resp, "forbidden") {
+		t.Errorf("expected a block page:\n%s", resp)
+	}
+
+	if err := p.Load(ctx, allowModule()); err != nil {
+		t.Fatal(err)
+	}
+	resp = icaptest.RoundTrip(t, &icap.Server{Handler: p}, request("X-Block: 1\r\n"))
+	if !strings.HasPrefix(resp, "ICAP/1.0 204 ") {
+		t.Errorf("expected 204 after reloading:\n%s", resp)
+	}
+
+	if err := p.Load(ctx, []byte("not wasm")); err == nil {
+		t.Error("invalid module loaded")
+	}
+}
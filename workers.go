@@ -0,0 +1,164 @@
+// Copyright 2011 Andy Balholm. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// A bounded pool of goroutines for running handlers.
+
+package icap
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// An OverflowPolicy tells a Server what to do with a transaction when
+// all handler goroutines are busy and the handler queue is full.
+type OverflowPolicy int
+
+const (
+	// OverflowWait makes the transaction wait for room in the queue.
+	OverflowWait OverflowPolicy = iota
+
+	// OverflowReject answers the transaction with 503 Service Overloaded
+	// and closes its connection.
+	OverflowReject
+)
+
+// WorkerStats describes the activity of a Server's handler goroutines.
+type WorkerStats struct {
+	Workers   int           // the number of handler goroutines
+	Busy      int           // goroutines running a handler
+	Queued    int           // transactions waiting for a goroutine
+	Completed uint64        // transactions handled
+	Rejected  uint64        // transactions refused by OverflowReject
+	QueueWait time.Duration // total time transactions spent queued
+}
+
+// A workerPool runs handlers on a fixed number of goroutines.
+type workerPool struct {
+	size      int
+	slots     chan struct{} // one per transaction running or queued
+	jobs      chan *job
+	busy      atomic.Int64
+	queued    atomic.Int64
+	completed atomic.Uint64
+	rejected  atomic.Uint64
+	waitNanos atomic.Int64
+}
+
+type job struct {
+	run      func()
+	queuedAt time.Time
+	done     chan struct{}
+	panicked bool
+	aborted  bool // panicked with ErrAbortHandler
+}
+
+func newWorkerPool(size, queue int) *workerPool {
+	p := &workerPool{
+		size:  size,
+		slots: make(chan struct{}, size+queue),
+		jobs:  make(chan *job, size+queue),
+	}
+	for i := 0; i < size; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for j := range p.jobs {
+		p.queued.Add(-1)
+		p.waitNanos.Add(int64(time.Since(j.queuedAt)))
+		p.busy.Add(1)
+		p.runJob(j)
+		p.busy.Add(-1)
+		p.completed.Add(1)
+		<-p.slots
+		close(j.done)
+	}
+}
+
+func (p *workerPool) runJob(j *job) {
+	defer func() {
+		if err := recover(); err != nil {
+			if err == ErrAbortHandler {
+				j.aborted = true
+				return
+			}
+			var buf bytes.Buffer
+			fmt.Fprintf(&buf, "icap: panic in handler: %v\n", err)
+			buf.Write(debug.Stack())
+			log.Print(buf.String())
+			j.panicked = true
+		}
+	}()
+	j.run()
+}
+
+// do runs fn on one of the pool's goroutines and waits for it to finish.
+// It reports false if fn was not run because of OverflowReject, or if it
+// panicked. If fn panicked with ErrAbortHandler, so does do.
+func (p *workerPool) do(fn func(), policy OverflowPolicy) bool {
+	j := &job{run: fn, queuedAt: time.Now(), done: make(chan struct{})}
+	if policy == OverflowReject {
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			p.rejected.Add(1)
+			return false
+		}
+	} else {
+		p.slots <- struct{}{}
+	}
+	p.queued.Add(1)
+	p.jobs <- j
+	<-j.done
+	if j.aborted {
+		panic(ErrAbortHandler)
+	}
+	return !j.panicked
+}
+
+// full reports whether a new transaction would have to wait or be rejected.
+func (p *workerPool) full() bool {
+	return len(p.slots) >= cap(p.slots)
+}
+
+func (p *workerPool) stats() WorkerStats {
+	return WorkerStats{
+		Workers:   p.size,
+		Busy:      int(p.busy.Load()),
+		Queued:    int(p.queued.Load()),
+		Completed: p.completed.Load(),
+		Rejected:  p.rejected.Load(),
+		QueueWait: time.Duration(p.waitNanos.Load()),
+	}
+}
+
+// workerPool returns the server's pool of handler goroutines,
+// or nil if handlers run on their connections' goroutines.
+func (srv *Server) workerPool() *workerPool {
+	if srv == nil || srv.MaxHandlerGoroutines <= 0 {
+		return nil
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.workers == nil {
+		srv.workers = newWorkerPool(srv.MaxHandlerGoroutines, srv.HandlerQueueSize)
+	}
+	return srv.workers
+}
+
+// WorkerStats returns statistics about the server's handler goroutines.
+// It returns the zero value unless MaxHandlerGoroutines is set.
+func (srv *Server) WorkerStats() WorkerStats {
+	if p := srv.workerPool(); p != nil {
+		return p.stats()
+	}
+	return WorkerStats{}
+}